@@ -0,0 +1,118 @@
+// Package api holds the JSON bodies of the jobs API that both the server
+// (cmd/api) and the Go client (package client) use.
+package api
+
+import (
+	"time"
+
+	"video2mp3/internal/jobs"
+)
+
+// Options are a job's output options; see jobs.Options.
+type Options = jobs.Options
+
+// Job statuses.
+const (
+	StatusQueued      = jobs.StatusQueued
+	StatusDownloading = jobs.StatusDownloading
+	StatusTranscoding = jobs.StatusTranscoding
+	StatusReady       = jobs.StatusReady
+	StatusFailed      = jobs.StatusFailed
+	StatusExpired     = jobs.StatusExpired
+	StatusDead        = jobs.StatusDead
+)
+
+// IsTerminal reports whether a job in status will not change without a retry.
+func IsTerminal(status string) bool {
+	return jobs.IsTerminal(status)
+}
+
+type CreateJobRequest struct {
+	URL         string `json:"url"`
+	ClientJobID string `json:"client_job_id,omitempty"`
+	// Text is the share message the link was pasted from, kept as a title
+	// fallback; url may be left empty to take the link from it.
+	Text string `json:"text,omitempty"`
+	// FreshParse bypasses the worker's parser result cache.
+	FreshParse bool `json:"fresh_parse,omitempty"`
+	// StrictURL rejects a url that is not exactly one http or https link
+	// instead of extracting the link from it.
+	StrictURL bool `json:"strict_url,omitempty"`
+	// ObjectKey creates the job from media uploaded through
+	// /uploads/presign instead of a link; Filename becomes its title.
+	ObjectKey string `json:"object_key,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+	jobs.Options
+}
+
+type CreateJobResponse struct {
+	JobID  string `json:"job_id"`
+	Status string `json:"status"`
+}
+
+type ListJobsResponse struct {
+	Jobs []Job `json:"jobs"`
+}
+
+// Job is a job as returned by GET /jobs/{id}, the job lists and the live
+// update streams.
+type Job struct {
+	JobID       string        `json:"job_id"`
+	ClientJobID *string       `json:"client_job_id,omitempty"`
+	SourceURL   string        `json:"source_url"`
+	Title       *string       `json:"title,omitempty"`
+	VideoID     *string       `json:"video_id,omitempty"`
+	Platform    string        `json:"platform"`
+	Status      string        `json:"status"`
+	Options     *jobs.Options `json:"options,omitempty"`
+	Error       *string       `json:"error,omitempty"`
+	MP3URL      *string       `json:"mp3_url,omitempty"`
+	CoverURL    *string       `json:"cover_url,omitempty"`
+	CreatedAt   string        `json:"created_at"`
+	UpdatedAt   string        `json:"updated_at"`
+	CompletedAt *string       `json:"completed_at,omitempty"`
+	// FileSizeBytes and DurationSeconds describe the output once it is ready.
+	FileSizeBytes   *int64   `json:"file_size_bytes,omitempty"`
+	DurationSeconds *float64 `json:"duration_seconds,omitempty"`
+	ChecksumSHA256  *string  `json:"checksum_sha256,omitempty"`
+	Attempts        int      `json:"attempts"`
+	// NextRetryAt is set while a failed job is waiting for an automatic retry.
+	NextRetryAt *string `json:"next_retry_at,omitempty"`
+	// Download progress of the source, total only when known.
+	ProgressBytes      *int64 `json:"progress_bytes,omitempty"`
+	ProgressTotalBytes *int64 `json:"progress_total_bytes,omitempty"`
+	// ETASeconds estimates the seconds left while downloading or
+	// transcoding; null when there is nothing to estimate from.
+	ETASeconds *int64 `json:"eta_seconds"`
+	// ErrorCategory tells whether retrying can help: unsupported,
+	// unavailable and geo_blocked jobs will fail again, rate_limited and
+	// transient ones may not. Unset when the error is not classified.
+	ErrorCategory *string `json:"error_category,omitempty"`
+	// QueuePosition is the approximate 1-based position of a queued job,
+	// reported on single-job reads and the SSE snapshot only.
+	QueuePosition *int `json:"queue_position,omitempty"`
+	// DetectedPlatform is the platform detected from the link, set only
+	// when the parser reported a different one (now in platform).
+	DetectedPlatform *string `json:"detected_platform,omitempty"`
+	// PlatformName is Platform's display name and PlatformIcon a stable slug
+	// for picking its icon ("unknown" for unrecognized platforms).
+	PlatformName string `json:"platform_name"`
+	PlatformIcon string `json:"platform_icon"`
+}
+
+// DownloadURLResponse is returned by GET /jobs/{id}/url.
+type DownloadURLResponse struct {
+	URL string `json:"url"`
+	// ExpiresAt is when URL stops working; unset for outputs stored
+	// outside the bucket, which are not signed.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type RateLimitResponse struct {
+	Error      string `json:"error"`
+	RetryAfter int    `json:"retry_after"`
+}
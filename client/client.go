@@ -0,0 +1,352 @@
+// Package client is a Go client for the jobs API served by cmd/api.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"video2mp3/api"
+)
+
+// DefaultMaxRetries is how many times a request answered with 429 is sent
+// again before its error is returned.
+const DefaultMaxRetries = 3
+
+// maxRetryWait caps how long one Retry-After is honoured.
+const maxRetryWait = time.Minute
+
+// reconnectDelay is the pause before StreamEvents reconnects to a stream the
+// server closed before the job finished.
+const reconnectDelay = time.Second
+
+// Client calls the API at a base URL, authenticating with an API token when
+// one is set. It is safe for concurrent use.
+type Client struct {
+	baseURL string
+	token   string
+
+	// HTTPClient sends the requests; http.DefaultClient when nil.
+	HTTPClient *http.Client
+	// MaxRetries is how many times a 429 response is retried after its
+	// Retry-After; 0 disables retries.
+	MaxRetries int
+}
+
+// New returns a client for the API at baseURL (e.g. "http://localhost:8080").
+// token is sent as a bearer token; leave it empty when API_TOKEN is unset.
+func New(baseURL, token string) (*Client, error) {
+	u, err := url.Parse(strings.TrimSpace(baseURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid base URL %q", baseURL)
+	}
+	return &Client{
+		baseURL:    strings.TrimRight(u.String(), "/"),
+		token:      token,
+		MaxRetries: DefaultMaxRetries,
+	}, nil
+}
+
+// Error is a non-2xx response from the API.
+type Error struct {
+	StatusCode int
+	Message    string
+	// RetryAfter is the server's Retry-After hint, zero when there was none.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("api: %d %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the API.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+// CreateJob submits a job. Set req.ClientJobID to make the submission safe to
+// repeat.
+func (c *Client) CreateJob(ctx context.Context, req api.CreateJobRequest) (api.CreateJobResponse, error) {
+	var out api.CreateJobResponse
+	err := c.doJSON(ctx, http.MethodPost, "/jobs", nil, req, &out)
+	return out, err
+}
+
+// GetJob returns the job, with signed URLs once it is ready.
+func (c *Client) GetJob(ctx context.Context, id string) (api.Job, error) {
+	var out api.Job
+	err := c.doJSON(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id), nil, nil, &out)
+	return out, err
+}
+
+// ListOptions filter and order ListJobs; zero values use the server's
+// defaults.
+type ListOptions struct {
+	Limit    int
+	Status   string
+	Platform string
+	OrderBy  string
+	// Order is "asc" or "desc".
+	Order string
+}
+
+func (o ListOptions) query() url.Values {
+	q := url.Values{}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	for k, v := range map[string]string{"status": o.Status, "platform": o.Platform, "order_by": o.OrderBy, "order": o.Order} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	return q
+}
+
+// ListJobs lists the caller's jobs.
+func (c *Client) ListJobs(ctx context.Context, opts ListOptions) ([]api.Job, error) {
+	var out api.ListJobsResponse
+	if err := c.doJSON(ctx, http.MethodGet, "/jobs", opts.query(), nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Jobs, nil
+}
+
+// Retry queues a failed or expired job again.
+func (c *Client) Retry(ctx context.Context, id string) (api.CreateJobResponse, error) {
+	var out api.CreateJobResponse
+	err := c.doJSON(ctx, http.MethodPost, "/jobs/"+url.PathEscape(id)+"/retry", nil, nil, &out)
+	return out, err
+}
+
+// Download opens the job's output, following the redirect to storage when
+// the server uses DOWNLOAD_MODE=redirect. The caller must close the body.
+func (c *Client) Download(ctx context.Context, id string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id)+"/download", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DownloadURLOptions pick the attachment name and lifetime of a signed
+// download URL; zero values use the server's defaults.
+type DownloadURLOptions struct {
+	Filename string
+	// TTL must be within the server's MP3_URL_MAX_TTL.
+	TTL time.Duration
+}
+
+// DownloadURL returns a signed URL of the job's output, for handing to a
+// browser or another service instead of proxying the file.
+func (c *Client) DownloadURL(ctx context.Context, id string, opts DownloadURLOptions) (api.DownloadURLResponse, error) {
+	q := url.Values{}
+	if opts.Filename != "" {
+		q.Set("filename", opts.Filename)
+	}
+	if opts.TTL > 0 {
+		q.Set("ttl", opts.TTL.String())
+	}
+	var out api.DownloadURLResponse
+	err := c.doJSON(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id)+"/url", q, nil, &out)
+	return out, err
+}
+
+// StreamEvents follows the job's Server-Sent Events and calls fn with every
+// update until the job finishes, fn returns an error or ctx ends. A stream
+// the server closes early (e.g. on shutdown) is resumed from the last event
+// seen.
+func (c *Client) StreamEvents(ctx context.Context, id string, fn func(api.Job) error) error {
+	lastID := ""
+	for {
+		done, err := c.streamOnce(ctx, id, &lastID, fn)
+		if err != nil || done {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// streamOnce reads one SSE connection and reports whether the job finished.
+func (c *Client) streamOnce(ctx context.Context, id string, lastID *string, fn func(api.Job) error) (bool, error) {
+	header := http.Header{"Accept": {"text/event-stream"}}
+	if *lastID != "" {
+		header.Set("Last-Event-ID", *lastID)
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id)+"/events", nil, nil, header)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	// The server answers 204 when the job already finished after lastID.
+	if resp.StatusCode == http.StatusNoContent {
+		return true, nil
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	var eventID, event string
+	var data strings.Builder
+	for sc.Scan() {
+		line := sc.Text()
+		if line != "" {
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "id":
+				eventID = value
+			case "event":
+				event = value
+			case "data":
+				if data.Len() > 0 {
+					data.WriteByte('\n')
+				}
+				data.WriteString(value)
+			}
+			continue
+		}
+		// A blank line dispatches the event. Updates come as default
+		// messages, the final one as "done" or "error".
+		if eventID != "" {
+			*lastID = eventID
+		}
+		if (event == "" || event == "done" || event == "error") && data.Len() > 0 {
+			var j api.Job
+			if err := json.Unmarshal([]byte(data.String()), &j); err != nil {
+				return false, fmt.Errorf("decode job event: %w", err)
+			}
+			if err := fn(j); err != nil {
+				return false, err
+			}
+			if api.IsTerminal(j.Status) {
+				return true, nil
+			}
+		}
+		eventID, event = "", ""
+		data.Reset()
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	// A closed or broken connection is resumed by the caller.
+	return false, nil
+}
+
+func (c *Client) doJSON(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	var body []byte
+	var header http.Header
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = b
+		header = http.Header{"Content-Type": {"application/json"}}
+	}
+	resp, err := c.do(ctx, method, path, query, body, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// do sends the request, retrying 429 responses after their Retry-After up
+// to MaxRetries times, and turns non-2xx responses into *Error.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	for attempt := 0; ; attempt++ {
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, target, r)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		apiErr := responseError(resp)
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= c.MaxRetries {
+			return nil, apiErr
+		}
+		wait := apiErr.RetryAfter
+		if wait <= 0 {
+			wait = time.Second << attempt
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(min(wait, maxRetryWait)):
+		}
+	}
+}
+
+// responseError reads and closes resp's body, taking the message from the
+// API's {"error": ...} body when there is one.
+func responseError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	e := &Error{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	var body api.ErrorResponse
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if json.Unmarshal(raw, &body) == nil && body.Error != "" {
+		e.Message = body.Error
+	} else {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
+
+// parseRetryAfter reads a Retry-After of delay seconds or an HTTP date; zero
+// when it is missing or invalid.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		return time.Duration(min(secs, int(maxRetryWait/time.Second))) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,268 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"video2mp3/api"
+)
+
+func newTestClient(t *testing.T, h http.HandlerFunc) *Client {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	c, err := New(srv.URL, "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRetriesTooManyRequests(t *testing.T) {
+	var calls atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":"slow down"}`)
+			return
+		}
+		fmt.Fprint(w, `{"job_id":"j1","status":"ready"}`)
+	})
+
+	start := time.Now()
+	j, err := c.GetJob(context.Background(), "j1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.JobID != "j1" || calls.Load() != 2 {
+		t.Errorf("job %q after %d calls, want j1 after 2", j.JobID, calls.Load())
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("retried after %v, before the Retry-After", waited)
+	}
+}
+
+func TestRetriesAreCapped(t *testing.T) {
+	var calls atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"error":"quota exceeded"}`)
+	})
+	c.MaxRetries = 1
+
+	_, err := c.GetJob(context.Background(), "j1")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want *Error", err)
+	}
+	if apiErr.StatusCode != http.StatusTooManyRequests || apiErr.Message != "quota exceeded" || apiErr.RetryAfter != time.Second {
+		t.Errorf("err = %+v", apiErr)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("%d calls, want 2 with MaxRetries 1", got)
+	}
+
+	calls.Store(0)
+	c.MaxRetries = 0
+	if _, err := c.GetJob(context.Background(), "j1"); err == nil || calls.Load() != 1 {
+		t.Errorf("MaxRetries 0: err %v after %d calls, want an error after 1", err, calls.Load())
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":"job not found"}`)
+	})
+	_, err := c.GetJob(context.Background(), "missing")
+	if !IsNotFound(err) {
+		t.Errorf("IsNotFound(%v) = false", err)
+	}
+	if err == nil || err.Error() != "api: 404 job not found" {
+		t.Errorf("err = %v", err)
+	}
+	for _, err := range []error{nil, errors.New("404"), &Error{StatusCode: http.StatusGone}} {
+		if IsNotFound(err) {
+			t.Errorf("IsNotFound(%v) = true", err)
+		}
+	}
+	if !IsNotFound(fmt.Errorf("wrapped: %w", &Error{StatusCode: http.StatusNotFound})) {
+		t.Error("IsNotFound is false for a wrapped 404")
+	}
+}
+
+func collectEvents(t *testing.T, c *Client) ([]api.Job, error) {
+	t.Helper()
+	var got []api.Job
+	err := c.StreamEvents(context.Background(), "j1", func(j api.Job) error {
+		got = append(got, j)
+		return nil
+	})
+	return got, err
+}
+
+func statuses(jobs []api.Job) []string {
+	var out []string
+	for _, j := range jobs {
+		out = append(out, j.Status)
+	}
+	return out
+}
+
+func TestStreamEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []string
+	}{
+		{
+			name: "done",
+			stream: "id: 1\ndata: {\"status\":\"queued\"}\n\n" +
+				": keep-alive\n\n" +
+				"id: 2\ndata: {\"status\":\"transcoding\"}\n\n" +
+				"id: 3\nevent: done\ndata: {\"status\":\"ready\"}\n\n" +
+				"data: {\"status\":\"ignored\"}\n\n",
+			want: []string{"queued", "transcoding", "ready"},
+		},
+		{
+			name:   "error",
+			stream: "data: {\"status\":\"downloading\"}\n\nevent: error\ndata: {\"status\":\"failed\",\"error\":\"no audio\"}\n\n",
+			want:   []string{"downloading", "failed"},
+		},
+		{
+			name:   "other events skipped",
+			stream: "event: ping\ndata: {\"status\":\"queued\"}\n\nevent: done\ndata: {\"status\":\"ready\"}\n\n",
+			want:   []string{"ready"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/jobs/j1/events" || r.Header.Get("Accept") != "text/event-stream" {
+					t.Errorf("request %s Accept %q", r.URL.Path, r.Header.Get("Accept"))
+				}
+				w.Header().Set("Content-Type", "text/event-stream")
+				fmt.Fprint(w, tt.stream)
+			})
+			got, err := collectEvents(t, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(statuses(got), tt.want) {
+				t.Errorf("statuses = %q, want %q", statuses(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamEventsMultiLineData(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "event: done\ndata: {\"status\":\"failed\",\ndata: \"error\":\"line\"}\n\n")
+	})
+	got, err := collectEvents(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Error == nil || *got[0].Error != "line" {
+		t.Errorf("events = %+v", got)
+	}
+}
+
+func TestStreamEventsResumes(t *testing.T) {
+	var calls atomic.Int32
+	var lastIDs []string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		lastIDs = append(lastIDs, r.Header.Get("Last-Event-ID"))
+		switch calls.Add(1) {
+		case 1:
+			// The server shuts down mid-job.
+			fmt.Fprint(w, "id: 4\ndata: {\"status\":\"downloading\"}\n\nid: 5\ndata: {\"status\":\"transcoding\"}\n\n")
+		default:
+			fmt.Fprint(w, "id: 6\nevent: done\ndata: {\"status\":\"ready\"}\n\n")
+		}
+	})
+	got, err := collectEvents(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"downloading", "transcoding", "ready"}; !slices.Equal(statuses(got), want) {
+		t.Errorf("statuses = %q, want %q", statuses(got), want)
+	}
+	if want := []string{"", "5"}; !slices.Equal(lastIDs, want) {
+		t.Errorf("Last-Event-ID = %q, want %q", lastIDs, want)
+	}
+}
+
+func TestStreamEventsNoContentOnReconnect(t *testing.T) {
+	var calls atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			fmt.Fprint(w, "id: 7\ndata: {\"status\":\"transcoding\"}\n\n")
+			return
+		}
+		// The job finished while the client was away.
+		if r.Header.Get("Last-Event-ID") != "7" {
+			t.Errorf("Last-Event-ID = %q, want 7", r.Header.Get("Last-Event-ID"))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	got, err := collectEvents(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || calls.Load() != 2 {
+		t.Errorf("%d events after %d calls, want 1 after 2", len(got), calls.Load())
+	}
+}
+
+func TestStreamEventsCallbackError(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"status\":\"queued\"}\n\n")
+	})
+	stop := errors.New("stop")
+	err := c.StreamEvents(context.Background(), "j1", func(api.Job) error { return stop })
+	if !errors.Is(err, stop) {
+		t.Errorf("err = %v, want the callback's error", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"", 0},
+		{"  ", 0},
+		{"0", 0},
+		{"-5", 0},
+		{"3", 3 * time.Second},
+		{" 3 ", 3 * time.Second},
+		{"3600", maxRetryWait},
+		{"soon", 0},
+		{"1.5", 0},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second},
+		{"Wed, 01 May 2024 12:00:45 GMT", 45 * time.Second},
+		{"Wednesday, 01-May-24 12:00:10 GMT", 10 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{now.Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.in, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestOwnerAcrossTokenRotation(t *testing.T) {
+	owner := func(tokens *apiTokens, token string) string {
+		var got string
+		h := ownerMiddleware(tokens, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = requestOwner(r)
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		return got
+	}
+
+	rotated := newAPITokens("new", "old", "")
+	if got, want := owner(rotated, "old"), tokenOwner("new"); got != want {
+		t.Errorf("previous token owner = %q, want the active token's %q", got, want)
+	}
+	if got, want := owner(rotated, "new"), tokenOwner("new"); got != want {
+		t.Errorf("active token owner = %q, want %q", got, want)
+	}
+	if got, want := owner(rotated, "other"), tokenOwner("other"); got != want {
+		t.Errorf("unknown token owner = %q, want %q", got, want)
+	}
+	if got := owner(rotated, ""); got != anonymousOwner {
+		t.Errorf("anonymous owner = %q, want %q", got, anonymousOwner)
+	}
+
+	stable := newAPITokens("new", "old", "tok_0123abcd4567ef89")
+	for _, token := range []string{"new", "old"} {
+		if got := owner(stable, token); got != "tok_0123abcd4567ef89" {
+			t.Errorf("owner of %q = %q, want API_TOKEN_OWNER", token, got)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"video2mp3/internal/store"
+)
+
+func TestReadCacheForgetJob(t *testing.T) {
+	cache := newReadCache(time.Minute, 10)
+	a, b := store.Job{ID: "a"}, store.Job{ID: "b"}
+	cache.putJob(a)
+	cache.putList("all", []store.Job{a, b})
+	cache.putList("other", []store.Job{b})
+	served, _ := cache.list("all")
+
+	cache.forgetJob("a")
+
+	if _, ok := cache.job("a"); ok {
+		t.Error("deleted job still cached")
+	}
+	for key, want := range map[string][]string{"all": {"b"}, "other": {"b"}} {
+		list, ok := cache.list(key)
+		if !ok {
+			t.Fatalf("list %q dropped", key)
+		}
+		var ids []string
+		for _, j := range list {
+			ids = append(ids, j.ID)
+		}
+		if len(ids) != len(want) || ids[0] != want[0] {
+			t.Errorf("list %q = %v, want %v", key, ids, want)
+		}
+	}
+	// A list already handed out is left as it was.
+	if len(served) != 2 || served[0].ID != "a" {
+		t.Errorf("served list changed to %v", served)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"video2mp3/internal/config"
+	"video2mp3/internal/jobs"
+	"video2mp3/internal/store"
+)
+
+func TestServeDownloadChecksum(t *testing.T) {
+	objects, s3 := newObjectServer(t)
+	content := []byte(strings.Repeat("mp3 frame ", 300))
+	objects.put("jobs/ready.mp3", content)
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+	cfg := config.Config{DownloadMode: downloadModeProxy, MP3KeysOnly: true}
+	j := store.Job{
+		ID:           "ready",
+		Status:       jobs.StatusReady,
+		MP3URL:       sql.NullString{String: "jobs/ready.mp3", Valid: true},
+		OutputSHA256: sql.NullString{String: checksum, Valid: true},
+	}
+
+	rec := httptest.NewRecorder()
+	serveDownload(rec, httptest.NewRequest(http.MethodGet, "/jobs/ready/download", nil), cfg, s3, j)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	served := sha256.Sum256(rec.Body.Bytes())
+	if got := rec.Header().Get(checksumHeader); got != hex.EncodeToString(served[:]) {
+		t.Errorf("%s = %q, want the SHA-256 of the body served", checksumHeader, got)
+	}
+	if got := rec.Header().Get("ETag"); got != `"`+checksum+`"` {
+		t.Errorf("ETag = %q, want the quoted checksum", got)
+	}
+
+	// The checksum is a strong validator, so If-None-Match short-circuits.
+	req := httptest.NewRequest(http.MethodGet, "/jobs/ready/download", nil)
+	req.Header.Set("If-None-Match", `"`+checksum+`"`)
+	rec = httptest.NewRecorder()
+	serveDownload(rec, req, cfg, s3, j)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match status = %d, want 304", rec.Code)
+	}
+}
+
+func TestServeDownloadRange(t *testing.T) {
+	objects, s3 := newObjectServer(t)
+	content := []byte(strings.Repeat("0123456789", 100))
+	objects.put("jobs/ready.mp3", content)
+	cfg := config.Config{DownloadMode: downloadModeProxy, MP3KeysOnly: true}
+	j := store.Job{ID: "ready", Status: jobs.StatusReady, MP3URL: sql.NullString{String: "jobs/ready.mp3", Valid: true}}
+
+	cases := []struct {
+		rangeHeader  string
+		code         int
+		contentRange string
+		body         []byte
+	}{
+		{"", http.StatusOK, "", content},
+		{"bytes=500-", http.StatusPartialContent, "bytes 500-999/1000", content[500:]},
+		{"bytes=-500", http.StatusPartialContent, "bytes 500-999/1000", content[500:]},
+		{"bytes=10-19", http.StatusPartialContent, "bytes 10-19/1000", content[10:20]},
+		{"bytes=1000-", http.StatusRequestedRangeNotSatisfiable, "bytes */1000", nil},
+	}
+	for _, c := range cases {
+		name := c.rangeHeader
+		if name == "" {
+			name = "no range"
+		}
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/jobs/ready/download", nil)
+			if c.rangeHeader != "" {
+				req.Header.Set("Range", c.rangeHeader)
+			}
+			rec := httptest.NewRecorder()
+			serveDownload(rec, req, cfg, s3, j)
+
+			if rec.Code != c.code {
+				t.Fatalf("status = %d, want %d", rec.Code, c.code)
+			}
+			if got := rec.Header().Get("Content-Range"); got != c.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, c.contentRange)
+			}
+			if c.body != nil && rec.Body.String() != string(c.body) {
+				t.Errorf("body = %d bytes, want %d", rec.Body.Len(), len(c.body))
+			}
+			if got := rec.Header().Get("Accept-Ranges"); c.code != http.StatusRequestedRangeNotSatisfiable && got != "bytes" {
+				t.Errorf("Accept-Ranges = %q, want bytes", got)
+			}
+		})
+	}
+
+	// Seeking the object turns into a ranged GET, so only the requested
+	// bytes are fetched from storage.
+	if got := objects.rangesRequested(); !slices.Contains(got, "bytes=10-") {
+		t.Errorf("storage GETs had Range %q, want one starting at byte 10", got)
+	}
+}
+
+func TestHeadDownloadExternalURL(t *testing.T) {
+	j := store.Job{
+		ID:          "ext",
+		Status:      jobs.StatusReady,
+		MP3URL:      sql.NullString{String: "https://cdn.example.com/a.mp3", Valid: true},
+		OutputBytes: sql.NullInt64{Int64: 1234, Valid: true},
+	}
+	for _, mode := range []string{downloadModeProxy, downloadModeRedirect, downloadModeAccel} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := config.Config{DownloadMode: mode}
+			rec := httptest.NewRecorder()
+			// A nil storage panics if the HEAD tries to stat or sign anything.
+			serveDownload(rec, httptest.NewRequest(http.MethodHead, "/jobs/ext/download", nil), cfg, nil, j)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if got := rec.Header().Get("Location"); got != "" {
+				t.Errorf("Location = %q, want no redirect", got)
+			}
+			if got := rec.Header().Get("Content-Length"); got != "1234" {
+				t.Errorf("Content-Length = %q, want the recorded output size", got)
+			}
+			if rec.Header().Get("Content-Disposition") == "" {
+				t.Error("no Content-Disposition")
+			}
+			if rec.Body.Len() != 0 {
+				t.Errorf("HEAD wrote a %d byte body", rec.Body.Len())
+			}
+		})
+	}
+
+	j.MP3URL = sql.NullString{}
+	rec := httptest.NewRecorder()
+	serveDownload(rec, httptest.NewRequest(http.MethodHead, "/jobs/ext/download", nil), config.Config{DownloadMode: downloadModeRedirect}, nil, j)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("job without output: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestMP3KeyCandidatesUseCreationDate(t *testing.T) {
+	cfg := config.Config{S3KeyTemplate: "archive/{yyyy}/{mm}/{dd}/{id}.{ext}"}
+	j := store.Job{
+		ID:          "abc",
+		Status:      jobs.StatusReady,
+		CreatedAt:   time.Date(2024, 1, 31, 23, 59, 0, 0, time.UTC),
+		UpdatedAt:   time.Date(2024, 2, 1, 0, 5, 0, 0, time.UTC),
+		CompletedAt: sql.NullTime{Time: time.Date(2024, 2, 1, 0, 5, 0, 0, time.UTC), Valid: true},
+	}
+	got := mp3KeyCandidates(cfg, j)
+	want := []string{"archive/2024/01/31/abc.mp3", "archive/2024/02/01/abc.mp3"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("candidates = %v, want %v", got, want)
+	}
+}
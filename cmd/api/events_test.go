@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"video2mp3/api"
+	"video2mp3/internal/config"
+	"video2mp3/internal/jobs"
+	"video2mp3/internal/store"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+func TestStreamJobEventsAfterCompletion(t *testing.T) {
+	st := testStore(t)
+	ctx := context.Background()
+	// Without Redis the stream polls the database, which is enough here.
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	t.Cleanup(func() { rdb.Close() })
+	cfg := config.Config{SSEPollInterval: time.Second, SSEKeepaliveInterval: time.Second}
+
+	id := uuid.NewString()
+	if err := st.CreateJob(ctx, store.Job{ID: id, SourceURL: "https://v.douyin.com/iRNBho6u/", Platform: "douyin", Status: jobs.StatusQueued}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.DeleteJob(ctx, id) })
+	msg := "boom"
+	if err := st.UpdateJobStatus(ctx, id, jobs.StatusFailed, &msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	j, err := st.GetJob(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := func(lastID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/jobs/"+id+"/events", nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		rec := httptest.NewRecorder()
+		streamJobEvents(rec, req, st, nil, rdb, nil, cfg, nil, id)
+		return rec
+	}
+
+	t.Run("seen final state", func(t *testing.T) {
+		if rec := stream(jobEventID(j.UpdatedAt)); rec.Code != http.StatusNoContent {
+			t.Fatalf("status = %d, want 204: %s", rec.Code, rec.Body)
+		}
+	})
+	t.Run("missed final state", func(t *testing.T) {
+		rec := stream(jobEventID(j.UpdatedAt.Add(-time.Second)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+		want := "id: " + jobEventID(j.UpdatedAt) + "\nevent: error\ndata: "
+		if body := rec.Body.String(); !strings.Contains(body, want) || strings.Count(body, "data: ") != 1 {
+			t.Errorf("final state not sent exactly once as an error event:\n%s", body)
+		}
+	})
+}
+
+func TestEmitJobUpdate(t *testing.T) {
+	tests := []struct {
+		status string
+		want   string
+	}{
+		{jobs.StatusTranscoding, "id: 7\ndata: "},
+		{jobs.StatusReady, "id: 7\nevent: done\ndata: "},
+		{jobs.StatusFailed, "id: 7\nevent: error\ndata: "},
+		{jobs.StatusDead, "id: 7\nevent: error\ndata: "},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		if err := emitJobUpdate(rec, "7", api.Job{JobID: "j", Status: tt.status}); err != nil {
+			t.Fatal(err)
+		}
+		body := rec.Body.String()
+		if !strings.HasPrefix(body, tt.want) || strings.Count(body, "data: ") != 1 {
+			t.Errorf("%s: sent\n%s\nwant one frame starting %q", tt.status, body, tt.want)
+		}
+	}
+}
+
+// stalledWriter is a ResponseWriter whose client stopped reading or went
+// away: every write fails with err. It records the write deadline it was
+// given, which http.ResponseController sets through SetWriteDeadline.
+type stalledWriter struct {
+	header   http.Header
+	err      error
+	deadline time.Time
+	writes   int
+	flushes  int
+}
+
+func (w *stalledWriter) Header() http.Header { return w.header }
+func (w *stalledWriter) WriteHeader(int)     {}
+func (w *stalledWriter) Flush()              { w.flushes++ }
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, w.err
+}
+
+func (w *stalledWriter) SetWriteDeadline(t time.Time) error {
+	w.deadline = t
+	return nil
+}
+
+func TestSSESinkStalledClient(t *testing.T) {
+	job := api.Job{JobID: "j", Status: jobs.StatusTranscoding}
+	tests := map[string]error{
+		"broken pipe": syscall.EPIPE,
+		// A client that does not read blocks the write until its deadline.
+		"slow client": os.ErrDeadlineExceeded,
+	}
+	for name, writeErr := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := &stalledWriter{header: http.Header{}, err: writeErr}
+			sink := newSSESink(context.Background(), w)
+
+			before := time.Now()
+			if err := sink.send(store.Job{UpdatedAt: before}, job); !errors.Is(err, writeErr) {
+				t.Fatalf("send err = %v, want %v", err, writeErr)
+			}
+			if err := sink.keepalive(); !errors.Is(err, writeErr) {
+				t.Errorf("keepalive err = %v, want %v", err, writeErr)
+			}
+			if w.flushes != 0 {
+				t.Errorf("flushed %d times after failed writes", w.flushes)
+			}
+			if w.deadline.Before(before.Add(sseWriteTimeout)) || w.deadline.After(time.Now().Add(sseWriteTimeout)) {
+				t.Errorf("write deadline %v is not %v from the write", w.deadline.Sub(before), sseWriteTimeout)
+			}
+			sink.close()
+			if !w.deadline.IsZero() {
+				t.Errorf("deadline %v left set after close", w.deadline)
+			}
+		})
+	}
+}
+
+func TestSSESinkCancelledRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := &stalledWriter{header: http.Header{}}
+	sink := newSSESink(ctx, w)
+
+	if err := sink.send(store.Job{}, api.Job{JobID: "j"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("send err = %v, want context.Canceled", err)
+	}
+	if w.writes != 0 {
+		t.Errorf("wrote %d times to a gone client", w.writes)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"video2mp3/internal/config"
+	"video2mp3/internal/jobs"
+	"video2mp3/internal/queue"
+	"video2mp3/internal/store"
+
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+)
+
+// testStore connects to TEST_DATABASE_URL and applies the migrations. Tests
+// that need Postgres are skipped when it is unset.
+func testStore(t *testing.T) *store.Store {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	st, err := store.New(context.Background(), dsn)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	if err := st.Init(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return st
+}
+
+// unreachableQueue returns an asynq client for a Redis address nothing
+// listens on, so every enqueue fails as it does when Redis is down.
+func unreachableQueue(t *testing.T) *asynq.Client {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestCreateJobEnqueueFailureMarksJobFailed(t *testing.T) {
+	st := testStore(t)
+	ctx := context.Background()
+	cfg := config.Config{EnqueueFailureMode: enqueueFailureFail}
+	clientJobID := "enqueue-failure-" + uuid.NewString()
+	body := `{"url": "https://v.douyin.com/iRNBho6u/", "client_job_id": "` + clientJobID + `"}`
+
+	rec := httptest.NewRecorder()
+	createJob(rec, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body)), cfg, st, nil, unreachableQueue(t), &dailyQuota{}, nil)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503: %s", rec.Code, rec.Body)
+	}
+	j, err := st.GetJobByClientID(ctx, clientJobID)
+	if err != nil {
+		t.Fatalf("job not kept: %v", err)
+	}
+	t.Cleanup(func() { st.DeleteJob(ctx, j.ID) })
+	if j.Status != jobs.StatusFailed {
+		t.Errorf("job status = %s, want failed", j.Status)
+	}
+	if !strings.HasPrefix(j.Error.String, "queue unavailable") {
+		t.Errorf("job error = %q, want a queue unavailable error", j.Error.String)
+	}
+}
+
+func TestCreateJobWhileRedisDown(t *testing.T) {
+	st := testStore(t)
+	queue := unreachableQueue(t)
+	for _, mode := range []string{enqueueFailureFail, enqueueFailureRollback} {
+		t.Run(mode, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := config.Config{EnqueueFailureMode: mode}
+			clientJobID := "redis-down-" + uuid.NewString()
+			body := `{"url": "https://v.douyin.com/iRNBho6u/", "client_job_id": "` + clientJobID + `"}`
+
+			rec := httptest.NewRecorder()
+			createJob(rec, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body)), cfg, st, nil, queue, &dailyQuota{}, nil)
+
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Fatalf("status = %d, want 503: %s", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Retry-After"); got != "10" {
+				t.Errorf("Retry-After = %q, want 10", got)
+			}
+			j, err := st.GetJobByClientID(ctx, clientJobID)
+			switch mode {
+			case enqueueFailureRollback:
+				if !errors.Is(err, sql.ErrNoRows) {
+					t.Errorf("rolled back job still stored (err %v)", err)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("job not kept: %v", err)
+				}
+				t.Cleanup(func() { st.DeleteJob(ctx, j.ID) })
+				if j.Status != jobs.StatusFailed {
+					t.Errorf("job status = %s, want failed", j.Status)
+				}
+			}
+		})
+	}
+}
+
+func TestStagedObjectEnqueueFailure(t *testing.T) {
+	st := testStore(t)
+	client := unreachableQueue(t)
+	for mode, wantKept := range map[string]bool{enqueueFailureFail: true, enqueueFailureRollback: false} {
+		t.Run(mode, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := config.Config{EnqueueFailureMode: mode, MaxFileSizeBytes: 1 << 20}
+			s3 := newFakeStorage()
+			jobID := uuid.NewString()
+			key := queue.StagedUploadKey(jobID)
+			s3.put(key, []byte("video"))
+			t.Cleanup(func() { st.DeleteJob(ctx, jobID) })
+
+			rec := httptest.NewRecorder()
+			body := `{"object_key": "` + key + `", "filename": "talk.mp4"}`
+			createJob(rec, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body)), cfg, st, s3, client, &dailyQuota{}, nil)
+
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Fatalf("status = %d, want 503: %s", rec.Code, rec.Body)
+			}
+			if got := s3.has(key); got != wantKept {
+				t.Errorf("staged object kept = %v, want %v", got, wantKept)
+			}
+		})
+	}
+}
+
+func TestCreateJobEnqueueFailureReleasesIdempotencyKey(t *testing.T) {
+	st := testStore(t)
+	ctx := context.Background()
+	cfg := config.Config{EnqueueFailureMode: enqueueFailureFail, IdempotencyKeyTTL: time.Hour}
+	key := "key-" + uuid.NewString()
+	clientJobID := "idem-" + uuid.NewString()
+	req := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(`{"url": "https://v.douyin.com/iRNBho6u/", "client_job_id": "`+clientJobID+`"}`))
+	req.Header.Set(idempotencyKeyHeader, key)
+
+	rec := httptest.NewRecorder()
+	createJob(rec, req, cfg, st, nil, unreachableQueue(t), &dailyQuota{}, nil)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503: %s", rec.Code, rec.Body)
+	}
+	if j, err := st.GetJobByClientID(ctx, clientJobID); err == nil {
+		t.Cleanup(func() { st.DeleteJob(ctx, j.ID) })
+	}
+	if id, err := st.GetIdempotentJobID(ctx, requestOwner(req), key, time.Now().Add(-time.Hour)); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("key still bound to job %q (err %v)", id, err)
+	}
+}
+
+// testQueue connects to the Redis at TEST_REDIS_ADDR. Tests that need Redis
+// are skipped when it is unset.
+func testQueue(t *testing.T) (*asynq.Client, *asynq.Inspector) {
+	t.Helper()
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR not set")
+	}
+	opt := asynq.RedisClientOpt{Addr: addr}
+	client := asynq.NewClient(opt)
+	inspector := asynq.NewInspector(opt)
+	t.Cleanup(func() {
+		client.Close()
+		inspector.Close()
+	})
+	return client, inspector
+}
+
+func TestRetryJobTwiceEnqueuesOneTask(t *testing.T) {
+	st := testStore(t)
+	client, inspector := testQueue(t)
+	ctx := context.Background()
+	retryQueue := "test-retry-" + uuid.NewString()
+	t.Cleanup(func() { inspector.DeleteQueue(retryQueue, true) })
+	cfg := config.Config{JobUniqueTasks: true, JobTimeout: time.Minute, RetryQueue: retryQueue}
+
+	id := uuid.NewString()
+	if err := st.CreateJob(ctx, store.Job{ID: id, SourceURL: "https://v.douyin.com/iRNBho6u/", Platform: "douyin", Status: jobs.StatusFailed}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.DeleteJob(ctx, id) })
+
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			rec := httptest.NewRecorder()
+			retryJob(rec, httptest.NewRequest(http.MethodPost, "/jobs/"+id+"/retry", nil), cfg, st, client, inspector, id)
+			codes <- rec.Code
+		}()
+	}
+	accepted := 0
+	for i := 0; i < 2; i++ {
+		switch code := <-codes; code {
+		case http.StatusAccepted:
+			accepted++
+		case http.StatusConflict:
+		default:
+			t.Errorf("retry status = %d, want 202 or 409", code)
+		}
+	}
+	if accepted != 1 {
+		t.Errorf("%d retries accepted, want 1", accepted)
+	}
+	tasks, err := inspector.ListPendingTasks(retryQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 {
+		t.Errorf("%d tasks enqueued, want 1", len(tasks))
+	}
+}
+
+func TestExpireJobsKeepsJobsWithUndeletedObjects(t *testing.T) {
+	st := testStore(t)
+	ctx := context.Background()
+	s3 := newFakeStorage()
+	cfg := config.Config{CleanupConcurrency: 2, MP3KeysOnly: true}
+
+	ready := func() (string, string) {
+		id, key := uuid.NewString(), "mp3/"+uuid.NewString()+".mp3"
+		if err := st.CreateJob(ctx, store.Job{ID: id, SourceURL: "https://v.douyin.com/iRNBho6u/", Platform: "douyin", Status: jobs.StatusQueued}); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { st.DeleteJob(ctx, id) })
+		if err := st.UpdateJobStatus(ctx, id, jobs.StatusReady, nil, &key); err != nil {
+			t.Fatal(err)
+		}
+		s3.put(key, []byte("mp3"))
+		return id, key
+	}
+	okID, okKey := ready()
+	stuckID, stuckKey := ready()
+	s3.deleteErrs[stuckKey] = errors.New("storage unavailable")
+
+	if _, _, err := expireJobs(ctx, st, s3, cfg, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[string]string{okID: jobs.StatusExpired, stuckID: jobs.StatusReady} {
+		j, err := st.GetJob(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.Status != want {
+			t.Errorf("job %s status = %s, want %s", id, j.Status, want)
+		}
+	}
+	if s3.has(okKey) || !s3.has(stuckKey) {
+		t.Errorf("objects left: %s=%v %s=%v", okKey, s3.has(okKey), stuckKey, s3.has(stuckKey))
+	}
+}
+
+func TestJobObjectKeys(t *testing.T) {
+	cfg := config.Config{MP3KeysOnly: true}
+	j := store.Job{
+		ID:       "job1",
+		MP3URL:   sql.NullString{String: "mp3/job1.mp3", Valid: true},
+		CoverKey: sql.NullString{String: "covers/job1.jpg", Valid: true},
+	}
+	want := []string{"mp3/job1.mp3", "covers/job1.jpg", queue.StagedUploadKey("job1")}
+	if got := jobObjectKeys(cfg, j); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("keys = %q, want %q", got, want)
+	}
+	// A job that never produced output still owns its staged upload.
+	if got := jobObjectKeys(cfg, store.Job{ID: "job2"}); len(got) != 1 || got[0] != queue.StagedUploadKey("job2") {
+		t.Errorf("keys = %q, want only the staged upload", got)
+	}
+}
+
+func TestDeleteJobRemovesCompanionObjects(t *testing.T) {
+	st := testStore(t)
+	ctx := context.Background()
+	s3 := newFakeStorage()
+	cfg := config.Config{CleanupConcurrency: 2, MP3KeysOnly: true}
+
+	id := uuid.NewString()
+	mp3Key, coverKey, stagedKey := "mp3/"+id+".mp3", "covers/"+id+".jpg", queue.StagedUploadKey(id)
+	if err := st.CreateJob(ctx, store.Job{ID: id, SourceURL: "https://v.douyin.com/iRNBho6u/", Platform: "douyin", Status: jobs.StatusQueued}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.DeleteJob(ctx, id) })
+	if err := st.UpdateJobCover(ctx, id, coverKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateJobStatus(ctx, id, jobs.StatusReady, nil, &mp3Key); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{mp3Key, coverKey, stagedKey}
+	for _, key := range keys {
+		s3.put(key, []byte(key))
+	}
+
+	rec := httptest.NewRecorder()
+	deleteJob(rec, httptest.NewRequest(http.MethodDelete, "/jobs/"+id, nil), cfg, st, s3, nil, id)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204: %s", rec.Code, rec.Body)
+	}
+	for _, key := range keys {
+		if s3.has(key) {
+			t.Errorf("%s left behind", key)
+		}
+	}
+	if _, err := st.GetJob(ctx, id); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("job still stored (err %v)", err)
+	}
+}
@@ -1,435 +1,3151 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/maphash"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"path"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"video2mp3/api"
 	"video2mp3/internal/config"
+	"video2mp3/internal/events"
+	"video2mp3/internal/heartbeat"
 	"video2mp3/internal/jobs"
+	"video2mp3/internal/logging"
+	"video2mp3/internal/metrics"
+	"video2mp3/internal/parser"
 	"video2mp3/internal/platform"
 	"video2mp3/internal/queue"
 	"video2mp3/internal/storage"
 	"video2mp3/internal/store"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
 )
 
-type createJobRequest struct {
-	URL string `json:"url"`
+// Build info, set at build time with
+// -ldflags "-X main.Version=... -X main.Commit=... -X main.BuildTime=...".
+var Version, Commit, BuildTime string
+
+type presignUploadResponse struct {
+	UploadURL string    `json:"upload_url"`
+	ObjectKey string    `json:"object_key"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxBytes  int64     `json:"max_bytes"`
 }
 
-type createJobResponse struct {
-	JobID  string `json:"job_id"`
-	Status string `json:"status"`
+// jobMetadataResponse is the technical description of a job, without the
+// signed URLs of api.Job.
+type jobMetadataResponse struct {
+	JobID           string       `json:"job_id"`
+	SourceURL       string       `json:"source_url"`
+	Platform        string       `json:"platform"`
+	Title           *string      `json:"title,omitempty"`
+	VideoID         *string      `json:"video_id,omitempty"`
+	Status          string       `json:"status"`
+	Format          string       `json:"format"`
+	ContentType     string       `json:"content_type"`
+	Options         jobs.Options `json:"options"`
+	DurationSeconds *float64     `json:"duration_seconds,omitempty"`
+	FileSizeBytes   *int64       `json:"file_size_bytes,omitempty"`
+	// BitrateKbps is the average bitrate of the output, derived from its
+	// size and duration.
+	BitrateKbps    *int64  `json:"bitrate_kbps,omitempty"`
+	ChecksumSHA256 *string `json:"checksum_sha256,omitempty"`
+	Attempts       int     `json:"attempts"`
+	CreatedAt      string  `json:"created_at"`
+	UpdatedAt      string  `json:"updated_at"`
+	CompletedAt    *string `json:"completed_at,omitempty"`
+	// DownloadMs, TranscodeMs and UploadMs time the stages of the last
+	// successful run. Streaming merges stages: the streamed part is counted
+	// in transcode_ms and the others are left out.
+	DownloadMs  *int64 `json:"download_ms,omitempty"`
+	TranscodeMs *int64 `json:"transcode_ms,omitempty"`
+	UploadMs    *int64 `json:"upload_ms,omitempty"`
+}
+
+type settingsResponse struct {
+	Defaults jobs.Options `json:"defaults"`
+}
+
+type workerCheckRequest struct {
+	Bypass bool `json:"bypass"`
+}
+
+type workerCheckResponse struct {
+	Enabled        bool `json:"enabled"`
+	Bypass         bool `json:"bypass"`
+	HealthyWorkers int  `json:"healthy_workers"`
+}
+
+type workersResponse struct {
+	Workers []workerItem `json:"workers"`
+}
+
+type workerItem struct {
+	heartbeat.Worker
+	// Stale is set when the worker has not reported within
+	// WORKER_STALE_AFTER; it probably died or is wedged.
+	Stale bool `json:"stale"`
+}
+
+type statsResponse struct {
+	// Jobs counts jobs by status, with every status present.
+	Jobs              map[string]int64 `json:"jobs"`
+	Queues            []queueStats     `json:"queues"`
+	CompletedLastHour int64            `json:"completed_last_hour"`
+}
+
+type queueStats struct {
+	Name      string `json:"name"`
+	Size      int    `json:"size"`
+	Pending   int    `json:"pending"`
+	Active    int    `json:"active"`
+	Scheduled int    `json:"scheduled"`
+	Retry     int    `json:"retry"`
+	Archived  int    `json:"archived"`
+}
+
+type quotaExceededResponse struct {
+	Error   string `json:"error"`
+	Limit   int    `json:"limit"`
+	ResetAt string `json:"reset_at"`
+}
+
+type unsupportedPlatformResponse struct {
+	Error              string   `json:"error"`
+	SupportedPlatforms []string `json:"supported_platforms"`
+}
+
+type platformsResponse struct {
+	Platforms []platformItem `json:"platforms"`
+}
+
+type platformItem struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// BestEffort marks platforms the parser may reject (see platform.Global).
+	BestEffort bool `json:"best_effort"`
 }
 
-type listJobsResponse struct {
-	Jobs []jobResponse `json:"jobs"`
+type healthResponse struct {
+	Status    string `json:"status"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	Env       string `json:"env"`
 }
 
-type jobResponse struct {
-	JobID     string  `json:"job_id"`
-	SourceURL string  `json:"source_url"`
-	Platform  string  `json:"platform"`
-	Status    string  `json:"status"`
-	Error     *string `json:"error,omitempty"`
-	MP3URL    *string `json:"mp3_url,omitempty"`
-	CreatedAt string  `json:"created_at"`
-	UpdatedAt string  `json:"updated_at"`
+type readinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
 }
 
-type errorResponse struct {
-	Error string `json:"error"`
+type usageResponse struct {
+	Since string      `json:"since"`
+	Usage []usageItem `json:"usage"`
 }
 
-type rateLimitResponse struct {
-	Error      string `json:"error"`
-	RetryAfter int    `json:"retry_after"`
+type usageItem struct {
+	Owner               string  `json:"owner"`
+	Platform            string  `json:"platform"`
+	Jobs                int64   `json:"jobs"`
+	DownloadBytes       int64   `json:"download_bytes"`
+	OutputBytes         int64   `json:"output_bytes"`
+	TranscodeCPUSeconds float64 `json:"transcode_cpu_seconds"`
 }
 
 type cleanupRequest struct {
 	RetentionDays int `json:"retention_days"`
 }
 
+type expireRequest struct {
+	// OlderThan is a Go duration such as "168h".
+	OlderThan string `json:"older_than"`
+}
+
+type expireResponse struct {
+	ExpiredJobs    int64 `json:"expired_jobs"`
+	DeletedObjects int   `json:"deleted_objects"`
+}
+
+type requeueFailedRequest struct {
+	// Since is RFC3339 or YYYY-MM-DD; only jobs created since then are
+	// requeued. Defaults to 24 hours ago.
+	Since    string `json:"since"`
+	Platform string `json:"platform"`
+	// Status limits the requeue to failed, expired or dead jobs.
+	Status string `json:"status"`
+}
+
+type requeueFailedResponse struct {
+	Requeued int `json:"requeued"`
+	Skipped  int `json:"skipped"`
+	Failed   int `json:"failed"`
+}
+
 type cleanupResponse struct {
 	DeletedJobs    int64 `json:"deleted_jobs"`
 	DeletedObjects int   `json:"deleted_objects"`
+	// PurgedJobs counts soft-deleted rows removed for good.
+	PurgedJobs int64 `json:"purged_jobs"`
+}
+
+// exportRecord is one job in GET /admin/export.
+type exportRecord struct {
+	JobID       string  `json:"job_id"`
+	ClientJobID *string `json:"client_job_id,omitempty"`
+	SourceURL   string  `json:"source_url"`
+	Platform    string  `json:"platform"`
+	Status      string  `json:"status"`
+	Error       *string `json:"error,omitempty"`
+	Title       *string `json:"title,omitempty"`
+	Owner       *string `json:"owner,omitempty"`
+	CreatedAt   string  `json:"created_at"`
+	UpdatedAt   string  `json:"updated_at"`
+	CompletedAt *string `json:"completed_at,omitempty"`
+}
+
+var exportCSVHeader = []string{"job_id", "client_job_id", "source_url", "platform", "status", "error", "title", "owner", "created_at", "updated_at", "completed_at"}
+
+type gcObjectsRequest struct {
+	MinAge string `json:"min_age"`
+}
+
+type gcObjectsResponse struct {
+	ScannedObjects  int `json:"scanned_objects"`
+	OrphanedObjects int `json:"orphaned_objects"`
+	DeletedObjects  int `json:"deleted_objects"`
+}
+
+// jobHistoryResponse is GET /jobs/{id}/history: the job's status changes,
+// oldest first.
+type jobHistoryResponse struct {
+	JobID  string             `json:"job_id"`
+	Events []jobEventResponse `json:"events"`
+}
+
+type jobEventResponse struct {
+	FromStatus *string `json:"from_status"`
+	ToStatus   string  `json:"to_status"`
+	Message    *string `json:"message,omitempty"`
+	At         string  `json:"at"`
+}
+
+type purgeQueueRequest struct {
+	Queue string `json:"queue"`
+	// FailJobs marks the jobs of the deleted tasks failed.
+	FailJobs bool `json:"fail_jobs,omitempty"`
 }
 
+// purgeQueueResponse counts the tasks deleted from a queue per state.
+type purgeQueueResponse struct {
+	Queue      string `json:"queue"`
+	Pending    int    `json:"pending"`
+	Scheduled  int    `json:"scheduled"`
+	Retry      int    `json:"retry"`
+	FailedJobs int    `json:"failed_jobs"`
+}
+
+// repairURLsResponse reports POST /admin/repair-urls: ready jobs whose
+// mp3_url was rewritten to a bare key, left alone, or whose object was not
+// found under any candidate key.
+type repairURLsResponse struct {
+	Repaired int `json:"repaired"`
+	Skipped  int `json:"skipped"`
+	Missing  int `json:"missing"`
+}
+
+type detectRequest struct {
+	URLs []string `json:"urls"`
+}
+
+type detectResponse struct {
+	Items []detectItem `json:"items"`
+}
+
+type detectItem struct {
+	Input         string `json:"input"`
+	NormalizedURL string `json:"normalized_url,omitempty"`
+	Platform      string `json:"platform,omitempty"`
+	Supported     bool   `json:"supported"`
+}
+
+type validateJobRequest struct {
+	URL string `json:"url"`
+	// Resolve also asks the parser whether the link can be resolved.
+	Resolve bool `json:"resolve,omitempty"`
+	// StrictURL checks url as POST /jobs does with strict_url.
+	StrictURL bool `json:"strict_url,omitempty"`
+	jobs.Options
+}
+
+type validateJobResponse struct {
+	detectItem
+	// Resolvable is only set when the parser was asked.
+	Resolvable   *bool  `json:"resolvable,omitempty"`
+	Title        string `json:"title,omitempty"`
+	ResolveError string `json:"resolve_error,omitempty"`
+}
+
+// maxDetectURLs caps a single /platforms/detect batch.
+const maxDetectURLs = 100
+
+// maxLookupIDs caps the ids of a single GET /jobs?ids= lookup.
+const maxLookupIDs = 100
+
 var urlRe = regexp.MustCompile(`https?://\S+`)
 
+var clientJobIDRe = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+var errTaskInFlight = errors.New("task in flight")
+
 func main() {
 	cfg := config.Load()
+	if err := logging.Setup(cfg.LogLevel, cfg.LogFormat); err != nil {
+		logging.Fatal("invalid logging config", "err", err)
+	}
+
+	// appCtx is cancelled on SIGINT/SIGTERM; background loops and SSE streams
+	// watch it so the server can drain before exiting.
+	appCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	ctx := context.Background()
 	st, err := store.New(ctx, cfg.DatabaseURL)
 	if err != nil {
-		log.Fatalf("store init: %v", err)
+		logging.Fatal("store init failed", "err", err)
 	}
 	defer st.Close()
+	st.SetPoolConfig(store.PoolConfig{
+		MaxOpenConns:    cfg.DBMaxOpenConns,
+		MaxIdleConns:    cfg.DBMaxIdleConns,
+		ConnMaxLifetime: cfg.DBConnMaxLifetime,
+		QueryTimeout:    cfg.DBQueryTimeout,
+	})
 	if err := st.Init(ctx); err != nil {
-		log.Fatalf("store schema: %v", err)
+		logging.Fatal("store schema failed", "err", err)
+	}
+	if cfg.MP3KeysOnly {
+		if err := normalizeMP3Keys(ctx, st, cfg); err != nil {
+			logging.Fatal("normalize mp3 keys failed", "err", err)
+		}
 	}
 
-	client := asynq.NewClient(asynq.RedisClientOpt{Addr: cfg.RedisAddr, DB: cfg.RedisDB})
+	redisOpt, err := queue.RedisClientOpt(queue.RedisOptions{
+		URL:      cfg.RedisURL,
+		Addr:     cfg.RedisAddr,
+		DB:       cfg.RedisDB,
+		Username: cfg.RedisUsername,
+		Password: cfg.RedisPassword,
+		TLS:      cfg.RedisTLS,
+	})
+	if err != nil {
+		logging.Fatal("invalid redis config", "err", err)
+	}
+	client := asynq.NewClient(redisOpt)
 	defer client.Close()
+	inspector := asynq.NewInspector(redisOpt)
+	defer inspector.Close()
+	rdb := redisOpt.MakeRedisClient().(*redis.Client)
+	defer rdb.Close()
+	pingCtx, pingCancel := context.WithTimeout(ctx, 5*time.Second)
+	if err := rdb.Ping(pingCtx).Err(); err != nil {
+		if queue.IsRedisAuthError(err) {
+			logging.Fatal("redis authentication failed", "addr", redisOpt.Addr, "err", err)
+		}
+		slog.Error("redis unreachable at startup", "addr", redisOpt.Addr, "tls", redisOpt.TLSConfig != nil, "err", err)
+	}
+	pingCancel()
+
+	var s3 storage.Storage
+	switch cfg.StorageBackend {
+	case storage.BackendS3:
+		s3, err = storage.NewS3(
+			cfg.S3Endpoint,
+			cfg.S3AccessKey,
+			cfg.S3SecretKey,
+			cfg.S3Region,
+			cfg.S3Bucket,
+			cfg.S3UsePathStyle,
+			cfg.S3PublicEndpoint,
+		)
+	case storage.BackendLocal:
+		s3, err = storage.NewLocal(cfg.LocalStorageDir, cfg.LocalStorageURL, cfg.LocalStorageSecret)
+	default:
+		logging.Fatal("invalid STORAGE_BACKEND, want s3 or local", "value", cfg.StorageBackend)
+	}
+	if err != nil {
+		logging.Fatal("storage init failed", "backend", cfg.StorageBackend, "err", err)
+	}
+	bucketCtx, bucketCancel := context.WithTimeout(ctx, 10*time.Second)
+	err = s3.EnsureBucket(bucketCtx, cfg.S3CreateBucket)
+	bucketCancel()
+	if err != nil {
+		logging.Fatal("storage unavailable", "backend", cfg.StorageBackend, "err", err)
+	}
+	// Staged uploads are written by the API, so they are encrypted too, and
+	// their parts are sized for MAX_FILE_SIZE.
+	sse, err := storage.ServerSideEncryption(cfg.S3SSE, cfg.S3SSEKMSKeyID)
+	if err != nil {
+		logging.Fatal("invalid s3 encryption config", "err", err)
+	}
+	if err := s3.SetUploadConfig(storage.UploadConfig{Encryption: sse, MaxObjectSize: cfg.MaxFileSizeBytes}); err != nil {
+		logging.Fatal("invalid s3 upload config", "err", err)
+	}
+
+	cache := newReadCache(cfg.ReadCacheTTL, cfg.ReadCacheSize)
+
+	workers := &workerCheck{inspector: inspector, ttl: 5 * time.Second}
+	quotaOverrides, err := parseQuotaOverrides(cfg.DailyJobQuotaOverrides)
+	if err != nil {
+		logging.Fatal("invalid daily job quota overrides", "err", err)
+	}
+	quotas := &dailyQuota{rdb: rdb, limit: cfg.DailyJobQuota, overrides: quotaOverrides}
+	enabledPlatforms, err := parseEnabledPlatforms(cfg.EnabledPlatforms)
+	if err != nil {
+		logging.Fatal("invalid ENABLED_PLATFORMS", "err", err)
+	}
+	if _, err := queue.ParseWeights(cfg.QueueWeights); err != nil {
+		logging.Fatal("invalid QUEUE_WEIGHTS", "err", err)
+	}
+	if cfg.JobsListDefaultLimit < 1 || cfg.JobsListMaxLimit < cfg.JobsListDefaultLimit {
+		logging.Fatal("invalid jobs list limits, want 1 <= JOBS_LIST_DEFAULT_LIMIT <= JOBS_LIST_MAX_LIMIT",
+			"default", cfg.JobsListDefaultLimit, "max", cfg.JobsListMaxLimit)
+	}
+	if cfg.SSEPollInterval < minSSEPollInterval || cfg.SSEPollInterval > maxSSEInterval {
+		logging.Fatal("invalid SSE_POLL_INTERVAL", "value", cfg.SSEPollInterval.String(), "min", minSSEPollInterval.String(), "max", maxSSEInterval.String())
+	}
+	if cfg.SSEKeepaliveInterval < minSSEKeepaliveInterval || cfg.SSEKeepaliveInterval > maxSSEInterval {
+		logging.Fatal("invalid SSE_KEEPALIVE_INTERVAL", "value", cfg.SSEKeepaliveInterval.String(), "min", minSSEKeepaliveInterval.String(), "max", maxSSEInterval.String())
+	}
+	if cfg.RetentionReadyDays < 0 || cfg.RetentionFailedDays < 0 || cfg.RetentionExpiredDays < 0 {
+		logging.Fatal("invalid retention days, want >= 0",
+			"ready", cfg.RetentionReadyDays, "failed", cfg.RetentionFailedDays, "expired", cfg.RetentionExpiredDays)
+	}
+	parserAuth, err := parser.NewSigner(cfg.ParserAuthMode, cfg.ParserAPIKey)
+	if err != nil {
+		logging.Fatal("invalid parser auth config", "err", err)
+	}
+	parserEndpoint, err := parser.NewEndpoint(cfg.ParserAPIURL, cfg.ParserEndpointPath, cfg.ParserURLField)
+	if err != nil {
+		logging.Fatal("invalid parser endpoint config", "err", err)
+	}
 
-	s3, err := storage.NewS3(
-		cfg.S3Endpoint,
-		cfg.S3AccessKey,
-		cfg.S3SecretKey,
-		cfg.S3Region,
-		cfg.S3Bucket,
-		cfg.S3UsePathStyle,
-		cfg.S3PublicEndpoint,
-	)
+	openAPI, err := openAPIDocument()
 	if err != nil {
-		log.Fatalf("s3 init: %v", err)
+		logging.Fatal("failed to build OpenAPI document", "err", err)
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	mux := newRouteMux()
+	if local, ok := s3.(*storage.LocalStorage); ok {
+		// Presigned URLs of the local backend carry their own signature.
+		mux.Handle(storage.LocalFilesPath, local.Handler())
+	}
+	mux.handle(http.MethodGet, "/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, healthResponse{
+			Status:    "ok",
+			Version:   Version,
+			Commit:    Commit,
+			BuildTime: BuildTime,
+			Env:       cfg.Env,
+		})
 	})
-	mux.HandleFunc("/admin/cleanup", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
+	mux.handle(http.MethodGet, "/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(openAPI)
+	})
+	mux.handle(http.MethodGet, "/readyz", func(w http.ResponseWriter, r *http.Request) {
+		checks := map[string]func(context.Context) error{
+			"database": st.Ping,
+			"redis": func(ctx context.Context) error {
+				return rdb.Ping(ctx).Err()
+			},
+			"s3": s3.BucketExists,
 		}
-		retentionDays := cfg.JobRetentionDays
-		if r.Body != nil {
-			var req cleanupRequest
-			if err := json.NewDecoder(r.Body).Decode(&req); err == nil && req.RetentionDays > 0 {
-				retentionDays = req.RetentionDays
+		results := runReadinessChecks(r.Context(), checks, 2*time.Second)
+		status := http.StatusOK
+		resp := readinessResponse{Status: "ok", Checks: results}
+		for _, res := range results {
+			if res != "ok" {
+				status = http.StatusServiceUnavailable
+				resp.Status = "unavailable"
 			}
 		}
-		if retentionDays <= 0 {
-			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "retention_days is required"})
+		writeJSON(w, status, resp)
+	})
+	if cfg.MetricsEnabled {
+		reg := metrics.NewRegistry(metrics.JobsCreated, metrics.DeprecatedTokenRequests, metrics.NewQueueCollector(inspector, queue.Names(cfg.RetryQueue, cfg.QueueWeights)...))
+		mux.Handle("/metrics", reg.Handler())
+	}
+	mux.handle(http.MethodPost, "/admin/cleanup", func(w http.ResponseWriter, r *http.Request) {
+		retentionDays := cfg.JobRetentionDays
+		var req cleanupRequest
+		if !decodeJSON(w, r, cfg, &req, true) {
+			return
+		}
+		if req.RetentionDays > 0 {
+			retentionDays = req.RetentionDays
+		}
+		if !hasRetention(cfg, retentionDays) {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "retention_days is required"})
 			return
 		}
-		before := time.Now().AddDate(0, 0, -retentionDays)
-		deletedJobs, deletedObjects, err := cleanupJobs(r.Context(), st, s3, cfg, before)
+		deletedJobs, deletedObjects, purgedJobs, err := cleanupJobs(r.Context(), st, s3, cfg, retentionDays)
 		if err != nil {
-			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "cleanup failed"})
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "cleanup failed"})
 			return
 		}
 		writeJSON(w, http.StatusOK, cleanupResponse{
 			DeletedJobs:    deletedJobs,
 			DeletedObjects: deletedObjects,
+			PurgedJobs:     purgedJobs,
 		})
 	})
-	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodPost:
-			var req createJobRequest
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-				writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid json"})
-				return
-			}
-			if strings.TrimSpace(req.URL) == "" {
-				writeJSON(w, http.StatusBadRequest, errorResponse{Error: "url is required"})
-				return
-			}
-			normalizedURL, ok := extractURL(req.URL)
-			if !ok {
-				writeJSON(w, http.StatusBadRequest, errorResponse{Error: "no valid url found"})
-				return
-			}
-			plat, ok := platform.Detect(normalizedURL)
-			if !ok {
-				writeJSON(w, http.StatusBadRequest, errorResponse{Error: "unsupported platform"})
-				return
-			}
-
-			jobID := uuid.NewString()
-			job := store.Job{
-				ID:        jobID,
-				SourceURL: normalizedURL,
-				Platform:  plat,
-				Status:    jobs.StatusQueued,
-			}
-			if err := st.CreateJob(r.Context(), job); err != nil {
-				writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to create job"})
-				return
-			}
-
-			task, err := queue.NewProcessTask(queue.ProcessPayload{JobID: jobID, SourceURL: normalizedURL})
-			if err != nil {
-				writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to enqueue"})
-				return
-			}
-			_, err = client.Enqueue(task, asynq.MaxRetry(3), asynq.Timeout(cfg.JobTimeout))
-			if err != nil {
-				writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to enqueue"})
-				return
-			}
-
-			writeJSON(w, http.StatusAccepted, createJobResponse{JobID: jobID, Status: jobs.StatusQueued})
+	mux.handle(http.MethodPost, "/admin/expire", func(w http.ResponseWriter, r *http.Request) {
+		var req expireRequest
+		if !decodeJSON(w, r, cfg, &req, true) {
 			return
-		case http.MethodGet:
-			limit := 20
-			if raw := r.URL.Query().Get("limit"); raw != "" {
-				if v, err := strconv.Atoi(raw); err == nil {
-					limit = v
-				}
-			}
-			if limit <= 0 {
-				limit = 20
-			}
-			if limit > 100 {
-				limit = 100
-			}
-			items, err := st.ListJobs(r.Context(), limit)
+		}
+		olderThan := cfg.JobExpireAfter
+		if raw := strings.TrimSpace(req.OlderThan); raw != "" {
+			d, err := time.ParseDuration(raw)
 			if err != nil {
-				writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to load jobs"})
+				writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "older_than must be a positive duration"})
 				return
 			}
-			resp := listJobsResponse{Jobs: make([]jobResponse, 0, len(items))}
-			for _, j := range items {
-				item, err := buildJobResponse(r.Context(), cfg, s3, j)
-				if err != nil {
-					writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to sign mp3 url"})
-					return
-				}
-				resp.Jobs = append(resp.Jobs, item)
-			}
-			writeJSON(w, http.StatusOK, resp)
+			olderThan = d
+		}
+		if olderThan <= 0 {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "older_than must be a positive duration"})
 			return
-		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		expiredJobs, deletedObjects, err := expireJobs(r.Context(), st, s3, cfg, time.Now().Add(-olderThan))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "expire failed"})
 			return
 		}
+		writeJSON(w, http.StatusOK, expireResponse{
+			ExpiredJobs:    expiredJobs,
+			DeletedObjects: deletedObjects,
+		})
 	})
-	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
-		path := strings.TrimPrefix(r.URL.Path, "/jobs/")
-		if strings.HasSuffix(path, "/download") {
-			if r.Method != http.MethodGet {
-				w.WriteHeader(http.StatusMethodNotAllowed)
-				return
-			}
-			id := strings.TrimSuffix(path, "/download")
-			id = strings.TrimSuffix(id, "/")
-			if id == "" || strings.Contains(id, "/") {
-				writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
-				return
-			}
-			j, err := st.GetJob(r.Context(), id)
-			if err != nil {
-				if errors.Is(err, sql.ErrNoRows) {
-					writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
-					return
-				}
-				writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to load job"})
-				return
-			}
-			if j.Status != jobs.StatusReady {
-				writeJSON(w, http.StatusConflict, errorResponse{Error: "job not ready"})
-				return
-			}
-			key := objectKeyFromJob(cfg, j)
-			if key == "" {
-				mp3URL, err := mp3DownloadURLForJob(r.Context(), cfg, s3, j)
-				if err != nil {
-					writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to sign mp3 url"})
-					return
-				}
-				if mp3URL == nil {
-					writeJSON(w, http.StatusNotFound, errorResponse{Error: "mp3 not found"})
-					return
-				}
-				http.Redirect(w, r, *mp3URL, http.StatusFound)
-				return
-			}
-			obj, info, err := s3.OpenObject(r.Context(), key)
-			if err != nil {
-				if errors.Is(err, storage.ErrObjectNotFound) {
-					writeJSON(w, http.StatusNotFound, errorResponse{Error: "mp3 not found"})
-					return
-				}
-				writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to load mp3"})
-				return
-			}
-			defer obj.Close()
-			filename := fmt.Sprintf("video2mp3-%s.mp3", j.ID)
-			contentType := "audio/mpeg"
-			if info != nil && info.ContentType != "" {
-				contentType = info.ContentType
-			}
-			w.Header().Set("Content-Type", contentType)
-			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
-			if info != nil && info.Size > 0 {
-				w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
-			}
-			if _, err := io.Copy(w, obj); err != nil {
-				log.Printf("download stream error job=%s: %v", j.ID, err)
-			}
+	adminJobRoutes := newResourceRoutes("/admin/jobs/", "id")
+	adminJobRoutes.handle(http.MethodPost, "restore", func(w http.ResponseWriter, r *http.Request, id string) {
+		if uuid.Validate(id) != nil {
+			writeJSON(w, http.StatusNotFound, api.ErrorResponse{Error: "not found"})
 			return
 		}
-		if strings.HasSuffix(path, "/events") {
-			if r.Method != http.MethodGet {
-				w.WriteHeader(http.StatusMethodNotAllowed)
-				return
-			}
-			id := strings.TrimSuffix(path, "/events")
-			id = strings.TrimSuffix(id, "/")
-			if id == "" || strings.Contains(id, "/") {
-				writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
-				return
-			}
-			streamJobEvents(w, r, st, s3, cfg, id)
+		ok, err := st.RestoreJob(r.Context(), id)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to restore job"})
 			return
 		}
-		if strings.HasSuffix(path, "/retry") {
-			if r.Method != http.MethodPost {
-				w.WriteHeader(http.StatusMethodNotAllowed)
-				return
-			}
-			id := strings.TrimSuffix(path, "/retry")
-			id = strings.TrimSuffix(id, "/")
-			if id == "" || strings.Contains(id, "/") {
-				writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
-				return
-			}
-			j, err := st.GetJob(r.Context(), id)
-			if err != nil {
-				if errors.Is(err, sql.ErrNoRows) {
-					writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
-					return
-				}
-				writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to load job"})
-				return
-			}
-			if j.Status != jobs.StatusFailed && j.Status != jobs.StatusExpired {
-				writeJSON(w, http.StatusConflict, errorResponse{Error: "job not retryable"})
-				return
-			}
-			if err := st.UpdateJobStatus(r.Context(), j.ID, jobs.StatusQueued, nil, nil); err != nil {
-				writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to update job"})
-				return
-			}
-			task, err := queue.NewProcessTask(queue.ProcessPayload{JobID: j.ID, SourceURL: j.SourceURL})
+		if !ok {
+			writeJSON(w, http.StatusNotFound, api.ErrorResponse{Error: "no deleted job with this id"})
+			return
+		}
+		slog.InfoContext(r.Context(), "job restored", "job_id", id)
+		writeExistingJob(w, r, st, id)
+	})
+	mux.mount("/admin/jobs/", adminJobRoutes)
+	mux.handle(http.MethodPost, "/admin/requeue-failed", func(w http.ResponseWriter, r *http.Request) {
+		var req requeueFailedRequest
+		if !decodeJSON(w, r, cfg, &req, true) {
+			return
+		}
+		since := time.Now().Add(-24 * time.Hour)
+		if raw := strings.TrimSpace(req.Since); raw != "" {
+			t, err := parseTimeParam(raw)
 			if err != nil {
-				writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to enqueue"})
-				return
-			}
-			if _, err := client.Enqueue(task, asynq.MaxRetry(3), asynq.Timeout(cfg.JobTimeout)); err != nil {
-				writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to enqueue"})
+				writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "since must be RFC3339 or YYYY-MM-DD"})
 				return
 			}
-			writeJSON(w, http.StatusAccepted, createJobResponse{JobID: j.ID, Status: jobs.StatusQueued})
+			since = t
+		}
+		filter := store.RetryableFilter{Since: since, Platform: strings.TrimSpace(req.Platform), Status: strings.TrimSpace(req.Status)}
+		if filter.Status != "" && !jobs.IsRetryable(filter.Status) {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "status must be failed, expired or dead"})
 			return
 		}
-
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+		resp, err := requeueFailedJobs(r.Context(), cfg, st, client, inspector, filter)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to list jobs"})
 			return
 		}
-		id := path
-		if id == "" {
-			writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
+		slog.InfoContext(r.Context(), "failed jobs requeued", "since", since, "platform", filter.Platform, "status", filter.Status, "requeued", resp.Requeued, "skipped", resp.Skipped, "failed", resp.Failed)
+		writeJSON(w, http.StatusAccepted, resp)
+	})
+	mux.handle(http.MethodGet, "/admin/export", func(w http.ResponseWriter, r *http.Request) {
+		format := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("format")))
+		if format == "" {
+			format = "csv"
+		}
+		if format != "csv" && format != "ndjson" {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "format must be csv or ndjson"})
 			return
 		}
-		j, err := st.GetJob(r.Context(), id)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
+		exportJobs(w, r, st, format)
+	})
+	mux.handle(http.MethodPost, "/admin/gc-objects", func(w http.ResponseWriter, r *http.Request) {
+		var req gcObjectsRequest
+		if !decodeJSON(w, r, cfg, &req, true) {
+			return
+		}
+		minAge := cfg.ObjectGCMinAge
+		if raw := strings.TrimSpace(req.MinAge); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "min_age must be a positive duration"})
 				return
 			}
-			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to load job"})
+			minAge = d
+		}
+		if minAge <= 0 {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "min_age must be a positive duration"})
 			return
 		}
-		resp, err := buildJobResponse(r.Context(), cfg, s3, j)
+		resp, err := gcObjects(r.Context(), st, s3, cfg, time.Now().Add(-minAge))
 		if err != nil {
-			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to sign mp3 url"})
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "object gc failed"})
 			return
 		}
 		writeJSON(w, http.StatusOK, resp)
 	})
-
-	handler := corsMiddleware(cfg.CORSAllowOrigins, rateLimitMiddleware(cfg.RateLimitPerMinute, time.Minute, authMiddleware(cfg.APIToken, mux)))
-
-	if cfg.CleanupInterval > 0 && cfg.JobRetentionDays > 0 {
-		go func() {
-			ticker := time.NewTicker(cfg.CleanupInterval)
-			defer ticker.Stop()
-			for range ticker.C {
-				before := time.Now().AddDate(0, 0, -cfg.JobRetentionDays)
-				if _, _, err := cleanupJobs(context.Background(), st, s3, cfg, before); err != nil {
-					log.Printf("cleanup failed: %v", err)
-				}
-			}
-		}()
-	}
-
-	srv := &http.Server{
-		Addr:              cfg.HTTPAddr,
-		Handler:           handler,
-		ReadHeaderTimeout: 5 * time.Second,
-	}
-	log.Printf("api listening on %s", cfg.HTTPAddr)
-	log.Fatal(srv.ListenAndServe())
-}
-
-func writeJSON(w http.ResponseWriter, status int, v any) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	_ = json.NewEncoder(w).Encode(v)
-}
-
-func writeSSE(w http.ResponseWriter, event string, data []byte) error {
-	if event != "" {
-		if _, err := fmt.Fprintf(w, "event: %s\n", event); err != nil {
-			return err
+	mux.handle(http.MethodPost, "/admin/purge-queue", func(w http.ResponseWriter, r *http.Request) {
+		var req purgeQueueRequest
+		if !decodeJSON(w, r, cfg, &req, false) {
+			return
 		}
-	}
-	if len(data) > 0 {
-		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
-			return err
+		req.Queue = strings.TrimSpace(req.Queue)
+		if req.Queue == "" {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "queue is required"})
+			return
 		}
-	} else {
-		if _, err := fmt.Fprintf(w, "data: {}\n\n"); err != nil {
-			return err
+		known, err := inspector.Queues()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to list queues"})
+			return
 		}
-	}
+		if !slices.Contains(known, req.Queue) {
+			writeJSON(w, http.StatusNotFound, api.ErrorResponse{Error: "unknown queue: " + req.Queue})
+			return
+		}
+		resp, err := purgeQueue(r.Context(), inspector, st, req.Queue, req.FailJobs)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "purge failed"})
+			return
+		}
+		slog.InfoContext(r.Context(), "queue purged", "queue", resp.Queue, "pending", resp.Pending, "scheduled", resp.Scheduled, "retry", resp.Retry, "failed_jobs", resp.FailedJobs)
+		writeJSON(w, http.StatusOK, resp)
+	})
+	mux.handle(http.MethodPost, "/admin/repair-urls", func(w http.ResponseWriter, r *http.Request) {
+		resp, err := repairMP3URLs(r.Context(), st, s3, cfg)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "repair failed"})
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+	writeWorkerCheck := func(w http.ResponseWriter) {
+		n, err := workers.count()
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, api.ErrorResponse{Error: "failed to list workers"})
+			return
+		}
+		writeJSON(w, http.StatusOK, workerCheckResponse{Enabled: cfg.RejectWithoutWorkers, Bypass: workers.bypass.Load(), HealthyWorkers: n})
+	}
+	mux.handle(http.MethodGet, "/admin/worker-check", func(w http.ResponseWriter, r *http.Request) {
+		writeWorkerCheck(w)
+	})
+	mux.handle(http.MethodPut, "/admin/worker-check", func(w http.ResponseWriter, r *http.Request) {
+		var req workerCheckRequest
+		if !decodeJSON(w, r, cfg, &req, false) {
+			return
+		}
+		workers.bypass.Store(req.Bypass)
+		slog.InfoContext(r.Context(), "worker check bypass changed", "bypass", req.Bypass)
+		writeWorkerCheck(w)
+	})
+	mux.handle(http.MethodGet, "/admin/workers", func(w http.ResponseWriter, r *http.Request) {
+		items, err := heartbeat.List(r.Context(), rdb)
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, api.ErrorResponse{Error: "failed to list workers"})
+			return
+		}
+		resp := workersResponse{Workers: make([]workerItem, 0, len(items))}
+		for _, hb := range items {
+			stale := time.Since(hb.UpdatedAt) > cfg.WorkerStaleAfter
+			resp.Workers = append(resp.Workers, workerItem{Worker: hb, Stale: stale})
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+	mux.handle(http.MethodGet, "/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		counts, err := st.CountJobsByStatus(r.Context())
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to count jobs"})
+			return
+		}
+		completed, err := st.CountJobsCompletedSince(r.Context(), time.Now().Add(-time.Hour))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to count jobs"})
+			return
+		}
+		resp := statsResponse{Jobs: make(map[string]int64, len(jobs.Statuses)), CompletedLastHour: completed}
+		for _, s := range jobs.Statuses {
+			resp.Jobs[s] = counts[s]
+		}
+		known, err := inspector.Queues()
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, api.ErrorResponse{Error: "failed to read queue stats"})
+			return
+		}
+		for _, name := range queue.Names(cfg.RetryQueue, cfg.QueueWeights) {
+			qs := queueStats{Name: name}
+			// A queue nothing was ever enqueued to does not exist yet.
+			if slices.Contains(known, name) {
+				info, err := inspector.GetQueueInfo(name)
+				if err != nil {
+					writeJSON(w, http.StatusServiceUnavailable, api.ErrorResponse{Error: "failed to read queue stats"})
+					return
+				}
+				qs.Size, qs.Pending, qs.Active = info.Size, info.Pending, info.Active
+				qs.Scheduled, qs.Retry, qs.Archived = info.Scheduled, info.Retry, info.Archived
+			}
+			resp.Queues = append(resp.Queues, qs)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+	mux.handle(http.MethodGet, "/admin/usage", func(w http.ResponseWriter, r *http.Request) {
+		since := time.Now().AddDate(0, 0, -30)
+		if raw := r.URL.Query().Get("since"); raw != "" {
+			t, err := parseTimeParam(raw)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "since must be RFC3339 or YYYY-MM-DD"})
+				return
+			}
+			since = t
+		}
+		rows, err := st.SummarizeUsage(r.Context(), since)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load usage"})
+			return
+		}
+		resp := usageResponse{Since: since.Format(time.RFC3339), Usage: make([]usageItem, 0, len(rows))}
+		for _, u := range rows {
+			resp.Usage = append(resp.Usage, usageItem{
+				Owner:               u.Owner,
+				Platform:            u.Platform,
+				Jobs:                u.Jobs,
+				DownloadBytes:       u.DownloadBytes,
+				OutputBytes:         u.OutputBytes,
+				TranscodeCPUSeconds: float64(u.TranscodeCPUMs) / 1000,
+			})
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+	// settingsOwner returns the caller settings are stored for; anonymous
+	// callers have none.
+	settingsOwner := func(w http.ResponseWriter, r *http.Request) (string, bool) {
+		owner := requestOwner(r)
+		if owner == anonymousOwner {
+			writeJSON(w, http.StatusUnauthorized, api.ErrorResponse{Error: "settings require an api token"})
+			return "", false
+		}
+		return owner, true
+	}
+	mux.handle(http.MethodGet, "/settings", func(w http.ResponseWriter, r *http.Request) {
+		owner, ok := settingsOwner(w, r)
+		if !ok {
+			return
+		}
+		defaults, err := ownerDefaults(r.Context(), st, owner)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load settings"})
+			return
+		}
+		writeJSON(w, http.StatusOK, settingsResponse{Defaults: defaults})
+	})
+	mux.handle(http.MethodPut, "/settings", func(w http.ResponseWriter, r *http.Request) {
+		owner, ok := settingsOwner(w, r)
+		if !ok {
+			return
+		}
+		var req settingsResponse
+		if !decodeJSON(w, r, cfg, &req, false) {
+			return
+		}
+		if err := req.Defaults.ValidateDefaults(); err != nil {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: err.Error()})
+			return
+		}
+		// Saved as sent (not normalized) so unset fields stay unset and
+		// don't override the built-in defaults.
+		payload, err := json.Marshal(req.Defaults)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to save settings"})
+			return
+		}
+		if err := st.PutOwnerSettings(r.Context(), owner, payload); err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to save settings"})
+			return
+		}
+		writeJSON(w, http.StatusOK, req)
+	})
+	mux.handle(http.MethodGet, "/platforms", func(w http.ResponseWriter, r *http.Request) {
+		supported := enabledPlatforms.supported()
+		resp := platformsResponse{Platforms: make([]platformItem, 0, len(supported))}
+		for _, id := range supported {
+			name, _ := platform.Info(id)
+			resp.Platforms = append(resp.Platforms, platformItem{ID: id, Name: name, BestEffort: platform.IsGlobal(id)})
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+	mux.handle(http.MethodPost, "/platforms/detect", func(w http.ResponseWriter, r *http.Request) {
+		var req detectRequest
+		if !decodeJSON(w, r, cfg, &req, false) {
+			return
+		}
+		if len(req.URLs) == 0 {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "urls is required"})
+			return
+		}
+		if len(req.URLs) > maxDetectURLs {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: fmt.Sprintf("at most %d urls per request", maxDetectURLs)})
+			return
+		}
+		resp := detectResponse{Items: make([]detectItem, 0, len(req.URLs))}
+		for _, input := range req.URLs {
+			resp.Items = append(resp.Items, detectURL(input, enabledPlatforms))
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+	mux.handle(http.MethodPost, "/jobs", func(w http.ResponseWriter, r *http.Request) {
+		if !workers.admit(w, r, cfg) {
+			return
+		}
+		createJob(w, r, cfg, st, s3, client, quotas, enabledPlatforms)
+	})
+	mux.handle(http.MethodGet, "/jobs", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("ids") {
+			lookupJobs(w, r, cfg, st, s3, r.URL.Query().Get("ids"))
+			return
+		}
+		limit := cfg.JobsListDefaultLimit
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			v, err := strconv.Atoi(raw)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "limit must be a number"})
+				return
+			}
+			if v > 0 {
+				limit = v
+			}
+		}
+		if limit > cfg.JobsListMaxLimit {
+			limit = cfg.JobsListMaxLimit
+		}
+		filter := store.ListFilter{
+			Status:   strings.TrimSpace(r.URL.Query().Get("status")),
+			Platform: strings.TrimSpace(r.URL.Query().Get("platform")),
+		}
+		if filter.Status != "" && !jobs.IsValidStatus(filter.Status) {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "unknown status: " + filter.Status})
+			return
+		}
+		if filter.Platform != "" && !platform.IsKnown(filter.Platform) {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "unknown platform: " + filter.Platform})
+			return
+		}
+		if raw := strings.TrimSpace(r.URL.Query().Get("order_by")); raw != "" {
+			if !slices.Contains(store.SortColumns, raw) {
+				writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "order_by must be one of " + strings.Join(store.SortColumns, ", ")})
+				return
+			}
+			filter.OrderBy = raw
+		}
+		switch strings.ToLower(strings.TrimSpace(r.URL.Query().Get("order"))) {
+		case "", "desc":
+		case "asc":
+			filter.Asc = true
+		default:
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "order must be asc or desc"})
+			return
+		}
+		cacheKey := fmt.Sprintf("%s|%s|%s|%t|%d", filter.Status, filter.Platform, filter.OrderBy, filter.Asc, limit)
+		items, err := st.ListJobs(r.Context(), filter, limit)
+		if err != nil {
+			cached, ok := cache.list(cacheKey)
+			if !ok {
+				writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load jobs"})
+				return
+			}
+			slog.WarnContext(r.Context(), "serving cached job list", "err", err)
+			w.Header().Set(staleHeader, "true")
+			items = cached
+		} else {
+			cache.putList(cacheKey, items)
+		}
+		list, err := buildJobResponses(r.Context(), cfg, s3, items)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to sign mp3 url"})
+			return
+		}
+		writeJSON(w, http.StatusOK, api.ListJobsResponse{Jobs: list})
+	})
+	jobRoutes := newResourceRoutes("/jobs/", "id")
+	jobRoutes.handle(http.MethodGet, "", func(w http.ResponseWriter, r *http.Request, id string) {
+		j, ok := loadJob(w, r, st, cache, id)
+		if !ok {
+			return
+		}
+		serveJob(w, r, cfg, s3, inspector, j)
+	})
+	jobRoutes.handle(http.MethodDelete, "", func(w http.ResponseWriter, r *http.Request, id string) {
+		deleteJob(w, r, cfg, st, s3, cache, id)
+	})
+	download := func(w http.ResponseWriter, r *http.Request, id string) {
+		j, ok := loadJob(w, r, st, cache, id)
+		if !ok {
+			return
+		}
+		serveDownload(w, r, cfg, s3, j)
+	}
+	jobRoutes.handle(http.MethodGet, "download", download)
+	jobRoutes.handle(http.MethodHead, "download", download)
+	jobRoutes.handle(http.MethodGet, "url", func(w http.ResponseWriter, r *http.Request, id string) {
+		j, ok := loadJob(w, r, st, cache, id)
+		if !ok {
+			return
+		}
+		serveDownloadURL(w, r, cfg, s3, j)
+	})
+	jobRoutes.handle(http.MethodGet, "events", func(w http.ResponseWriter, r *http.Request, id string) {
+		streamJobEvents(w, r, st, s3, rdb, inspector, cfg, appCtx.Done(), id)
+	})
+	jobRoutes.handle(http.MethodGet, "ws", func(w http.ResponseWriter, r *http.Request, id string) {
+		streamJobWebSocket(w, r, st, s3, rdb, inspector, cfg, appCtx.Done(), id)
+	})
+	jobRoutes.handle(http.MethodPost, "retry", func(w http.ResponseWriter, r *http.Request, id string) {
+		retryJob(w, r, cfg, st, client, inspector, id)
+	})
+	jobRoutes.handle(http.MethodGet, "metadata", func(w http.ResponseWriter, r *http.Request, id string) {
+		j, ok := loadJob(w, r, st, cache, id)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, buildJobMetadata(j))
+	})
+	jobRoutes.handle(http.MethodGet, "history", func(w http.ResponseWriter, r *http.Request, id string) {
+		j, ok := loadJob(w, r, st, cache, id)
+		if !ok {
+			return
+		}
+		items, err := st.ListJobEvents(r.Context(), j.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load history"})
+			return
+		}
+		resp := jobHistoryResponse{JobID: j.ID, Events: make([]jobEventResponse, 0, len(items))}
+		for _, e := range items {
+			resp.Events = append(resp.Events, jobEventResponse{
+				FromStatus: nullStringPtr(e.FromStatus),
+				ToStatus:   e.ToStatus,
+				Message:    nullStringPtr(e.Message),
+				At:         e.At.In(time.Local).Format(time.RFC3339),
+			})
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+	jobRoutes.handle(http.MethodPost, "retranscode", func(w http.ResponseWriter, r *http.Request, id string) {
+		retranscodeJob(w, r, cfg, st, s3, client, inspector, id)
+	})
+	mux.mount("/jobs/", jobRoutes)
+	mux.handle(http.MethodPost, "/jobs/upload", func(w http.ResponseWriter, r *http.Request) {
+		if !workers.admit(w, r, cfg) {
+			return
+		}
+		// Checked before the body is read, so a replayed upload is answered
+		// without storing the file again.
+		idemKey, ok := idempotencyKey(w, r, cfg, st)
+		if !ok {
+			return
+		}
+		mr, err := r.MultipartReader()
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "multipart/form-data body required"})
+			return
+		}
+		var opts jobs.Options
+		jobID := uuid.NewString()
+		stagedKey := queue.StagedUploadKey(jobID)
+		filename := ""
+		// Fields must precede the file part; the file is streamed to the
+		// staging object one part at a time, so the API holds at most one
+		// part of each upload in memory.
+		for filename == "" {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "file is required"})
+				return
+			}
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "invalid multipart body"})
+				return
+			}
+			switch part.FormName() {
+			case "options":
+				if err := decodeStrict(io.LimitReader(part, 64<<10), &opts); err != nil {
+					writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "invalid options json: " + jsonErrorDetail(err)})
+					return
+				}
+			case "file":
+				filename = uploadFilename(part.FileName())
+				src := http.MaxBytesReader(w, part, cfg.MaxFileSizeBytes)
+				if err := s3.PutObject(r.Context(), stagedKey, src, -1, "application/octet-stream"); err != nil {
+					var tooLarge *http.MaxBytesError
+					if errors.As(err, &tooLarge) {
+						writeJSON(w, http.StatusRequestEntityTooLarge, api.ErrorResponse{Error: fmt.Sprintf("file exceeds %d bytes", cfg.MaxFileSizeBytes)})
+						return
+					}
+					writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to store upload"})
+					return
+				}
+			}
+			_ = part.Close()
+		}
+		defaults, err := ownerDefaults(r.Context(), st, requestOwner(r))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load settings"})
+			return
+		}
+		opts = opts.WithDefaults(defaults)
+		if err := opts.Normalize(); err != nil {
+			_ = s3.DeleteObject(context.WithoutCancel(r.Context()), stagedKey)
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: err.Error()})
+			return
+		}
+		if err := checkPriority(cfg, opts); err != nil {
+			_ = s3.DeleteObject(context.WithoutCancel(r.Context()), stagedKey)
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: err.Error()})
+			return
+		}
+		if err := submitUpload(w, r, cfg, st, client, quotas, jobID, filename, idemKey, opts); err != nil {
+			_ = s3.DeleteObject(context.WithoutCancel(r.Context()), stagedKey)
+		}
+	})
+	mux.handle(http.MethodPost, "/uploads/presign", func(w http.ResponseWriter, r *http.Request) {
+		key := queue.StagedUploadKey(uuid.NewString())
+		uploadURL, err := s3.PresignPut(r.Context(), key, cfg.UploadURLTTL)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to sign upload url"})
+			return
+		}
+		writeJSON(w, http.StatusOK, presignUploadResponse{
+			UploadURL: uploadURL,
+			ObjectKey: key,
+			ExpiresAt: time.Now().Add(cfg.UploadURLTTL).UTC(),
+			MaxBytes:  cfg.MaxFileSizeBytes,
+		})
+	})
+	mux.handle(http.MethodGet, "/jobs/active", func(w http.ResponseWriter, r *http.Request) {
+		limit := 50
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+				limit = v
+			}
+		}
+		if limit > 200 {
+			limit = 200
+		}
+		items, err := st.ListActiveJobs(r.Context(), limit)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load jobs"})
+			return
+		}
+		list, err := buildJobResponses(r.Context(), cfg, s3, items)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to sign mp3 url"})
+			return
+		}
+		writeJSON(w, http.StatusOK, api.ListJobsResponse{Jobs: list})
+	})
+	mux.handle(http.MethodPost, "/jobs/validate", func(w http.ResponseWriter, r *http.Request) {
+		var req validateJobRequest
+		if !decodeJSON(w, r, cfg, &req, false) {
+			return
+		}
+		if strings.TrimSpace(req.URL) == "" {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "url is required"})
+			return
+		}
+		opts := req.Options
+		if err := opts.Normalize(); err != nil {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: err.Error()})
+			return
+		}
+		if err := checkPriority(cfg, opts); err != nil {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: err.Error()})
+			return
+		}
+		if req.StrictURL && !isStrictURL(req.URL) {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: errStrictURL})
+			return
+		}
+		resp := validateJobResponse{detectItem: detectURL(req.URL, enabledPlatforms)}
+		if req.Resolve && resp.Supported && cfg.ValidateParserTimeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), cfg.ValidateParserTimeout)
+			defer cancel()
+			client := &http.Client{Timeout: cfg.ValidateParserTimeout}
+			parsed, err := parser.Parse(ctx, client, parserEndpoint, parserAuth, resp.NormalizedURL)
+			ok := err == nil
+			resp.Resolvable = &ok
+			switch {
+			case err == nil:
+				resp.Title = parsed.Title
+			case errors.Is(err, parser.ErrRejected):
+				resp.ResolveError = err.Error()
+			default:
+				// Transport errors name the parser's address; keep it internal.
+				slog.WarnContext(r.Context(), "validate parse failed", "err", err)
+				resp.ResolveError = "parser unavailable"
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+	// byClientID resolves a client_job_id before handing off to handle.
+	byClientID := func(handle func(http.ResponseWriter, *http.Request, store.Job)) func(http.ResponseWriter, *http.Request, string) {
+		return func(w http.ResponseWriter, r *http.Request, clientJobID string) {
+			j, err := st.GetJobByClientID(r.Context(), clientJobID)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					writeJSON(w, http.StatusNotFound, api.ErrorResponse{Error: "not found"})
+					return
+				}
+				writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load job"})
+				return
+			}
+			handle(w, r, j)
+		}
+	}
+	clientRoutes := newResourceRoutes("/jobs/by-client/", "client_job_id")
+	clientRoutes.handle(http.MethodGet, "", byClientID(func(w http.ResponseWriter, r *http.Request, j store.Job) {
+		serveJob(w, r, cfg, s3, inspector, j)
+	}))
+	clientRoutes.handle(http.MethodGet, "download", byClientID(func(w http.ResponseWriter, r *http.Request, j store.Job) {
+		serveDownload(w, r, cfg, s3, j)
+	}))
+	clientRoutes.handle(http.MethodGet, "events", byClientID(func(w http.ResponseWriter, r *http.Request, j store.Job) {
+		streamJobEvents(w, r, st, s3, rdb, inspector, cfg, appCtx.Done(), j.ID)
+	}))
+	clientRoutes.handle(http.MethodGet, "ws", byClientID(func(w http.ResponseWriter, r *http.Request, j store.Job) {
+		streamJobWebSocket(w, r, st, s3, rdb, inspector, cfg, appCtx.Done(), j.ID)
+	}))
+	mux.mount("/jobs/by-client/", clientRoutes)
+
+	switch cfg.DownloadMode {
+	case downloadModeProxy, downloadModeRedirect, downloadModeAccel:
+	default:
+		logging.Fatal("invalid DOWNLOAD_MODE, want proxy, redirect or accel", "value", cfg.DownloadMode)
+	}
+	switch cfg.EnqueueFailureMode {
+	case enqueueFailureFail, enqueueFailureRollback:
+	default:
+		logging.Fatal("invalid ENQUEUE_FAILURE_MODE, want fail or rollback", "value", cfg.EnqueueFailureMode)
+	}
+
+	if err := verifyRoutes(mux, apiOperations); err != nil {
+		logging.Fatal("route table out of sync", "err", err)
+	}
+
+	signingSecrets, err := parseSigningSecrets(cfg.AdminSigningSecrets)
+	if err != nil {
+		logging.Fatal("invalid admin signing secrets", "err", err)
+	}
+	signer := adminSigner{secrets: signingSecrets, maxSkew: cfg.AdminSignatureMaxSkew}
+	tokens := newAPITokens(cfg.APIToken, cfg.PreviousAPITokens, cfg.APITokenOwner)
+	if tokens.active == "" && len(tokens.previous) > 0 {
+		logging.Fatal("PREVIOUS_API_TOKENS requires API_TOKEN")
+	}
+	handler := requestIDMiddleware(gzipMiddleware(cfg.GzipMinSize, corsMiddleware(cfg, ownerMiddleware(tokens, rateLimitMiddleware(appCtx, cfg.RateLimitPerMinute, time.Minute, tokens, authMiddleware(tokens, signer, mux))))))
+
+	if cfg.CleanupInterval > 0 && hasRetention(cfg, cfg.JobRetentionDays) {
+		go func() {
+			ticker := time.NewTicker(cfg.CleanupInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-appCtx.Done():
+					return
+				case <-ticker.C:
+				}
+				if _, _, _, err := cleanupJobs(appCtx, st, s3, cfg, cfg.JobRetentionDays); err != nil {
+					slog.Error("cleanup failed", "err", err)
+				}
+			}
+		}()
+	}
+	if cfg.JobExpireAfter > 0 && cfg.ExpireInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(cfg.ExpireInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-appCtx.Done():
+					return
+				case <-ticker.C:
+				}
+				if _, _, err := expireJobs(appCtx, st, s3, cfg, time.Now().Add(-cfg.JobExpireAfter)); err != nil {
+					slog.Error("expire failed", "err", err)
+				}
+			}
+		}()
+	}
+	if cfg.StallThreshold > 0 && cfg.StallCheckInterval > 0 {
+		if cfg.StallAction != stallActionFail && cfg.StallAction != stallActionRequeue {
+			logging.Fatal("invalid STALL_ACTION, want fail or requeue", "value", cfg.StallAction)
+		}
+		// Without task ids a slow but live task cannot be told from a dead one.
+		if !cfg.JobUniqueTasks {
+			logging.Fatal("STALL_THRESHOLD requires JOB_UNIQUE_TASKS=true")
+		}
+		go func() {
+			ticker := time.NewTicker(cfg.StallCheckInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-appCtx.Done():
+					return
+				case <-ticker.C:
+				}
+				if err := recoverStalledJobs(appCtx, cfg, st, client, inspector); err != nil {
+					slog.Error("stalled job check failed", "err", err)
+				}
+			}
+		}()
+	}
+	if cfg.OrphanCheckInterval > 0 && cfg.OrphanMinAge > 0 {
+		if !cfg.JobUniqueTasks {
+			logging.Fatal("ORPHAN_CHECK_INTERVAL requires JOB_UNIQUE_TASKS=true")
+		}
+		go func() {
+			ticker := time.NewTicker(cfg.OrphanCheckInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-appCtx.Done():
+					return
+				case <-ticker.C:
+				}
+				if err := recoverOrphanedJobs(appCtx, cfg, st, client, inspector); err != nil {
+					slog.Error("orphaned job check failed", "err", err)
+				}
+			}
+		}()
+	}
+	if cfg.ObjectGCInterval > 0 && cfg.ObjectGCMinAge > 0 {
+		go func() {
+			ticker := time.NewTicker(cfg.ObjectGCInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-appCtx.Done():
+					return
+				case <-ticker.C:
+				}
+				if _, err := gcObjects(appCtx, st, s3, cfg, time.Now().Add(-cfg.ObjectGCMinAge)); err != nil {
+					slog.Error("object gc failed", "err", err)
+				}
+			}
+		}()
+	}
+	if cfg.JobsAnalyzeInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(cfg.JobsAnalyzeInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-appCtx.Done():
+					return
+				case <-ticker.C:
+				}
+				maintainJobsTable(appCtx, st, "analyze")
+			}
+		}()
+	}
+
+	srv := &http.Server{
+		Addr:              cfg.HTTPAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("api listening", "addr", cfg.HTTPAddr, "version", Version, "commit", Commit)
+		serveErr <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		logging.Fatal("api listen failed", "err", err)
+	case <-appCtx.Done():
+	}
+
+	slog.Info("api shutting down", "timeout", cfg.ShutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("api shutdown failed", "err", err)
+	}
+}
+
+// createJob handles POST /jobs: it validates the submission, stores the job
+// and enqueues its task.
+func createJob(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store, s3 storage.Storage, client *asynq.Client, quotas *dailyQuota, enabledPlatforms platformSet) {
+	var req api.CreateJobRequest
+	if !decodeJSON(w, r, cfg, &req, false) {
+		return
+	}
+	if req.ObjectKey != "" {
+		if strings.TrimSpace(req.URL) != "" || req.ClientJobID != "" {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "object_key cannot be combined with url or client_job_id"})
+			return
+		}
+		submitStagedObject(w, r, cfg, st, s3, client, quotas, req)
+		return
+	}
+	if strings.TrimSpace(req.URL) == "" && !req.StrictURL {
+		req.URL = req.Text
+	}
+	if strings.TrimSpace(req.URL) == "" {
+		writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "url is required"})
+		return
+	}
+	idemKey, ok := idempotencyKey(w, r, cfg, st)
+	if !ok {
+		return
+	}
+	req.ClientJobID = strings.TrimSpace(req.ClientJobID)
+	if req.ClientJobID != "" {
+		if !clientJobIDRe.MatchString(req.ClientJobID) {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "client_job_id must be 1-128 characters of letters, digits, '.', '_', ':' or '-'"})
+			return
+		}
+		existing, err := st.GetJobByClientID(r.Context(), req.ClientJobID)
+		if err == nil {
+			writeJSON(w, http.StatusOK, api.CreateJobResponse{JobID: existing.ID, Status: existing.Status})
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load job"})
+			return
+		}
+	}
+	opts := req.Options
+	defaults, err := ownerDefaults(r.Context(), st, requestOwner(r))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load settings"})
+		return
+	}
+	opts = opts.WithDefaults(defaults)
+	if err := opts.Normalize(); err != nil {
+		writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err := checkPriority(cfg, opts); err != nil {
+		writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: err.Error()})
+		return
+	}
+	normalizedURL, ok := extractURL(req.URL)
+	if req.StrictURL {
+		if !isStrictURL(req.URL) {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: errStrictURL})
+			return
+		}
+		normalizedURL = req.URL
+	} else if !ok {
+		writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "no valid url found"})
+		return
+	}
+	text := shareText(req, normalizedURL)
+	plat, ok := platform.Detect(normalizedURL)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, unsupportedPlatformResponse{Error: "unsupported platform", SupportedPlatforms: enabledPlatforms.supported()})
+		return
+	}
+	if !enabledPlatforms.allows(plat) {
+		writeJSON(w, http.StatusBadRequest, unsupportedPlatformResponse{
+			Error:              fmt.Sprintf("platform %s is not enabled on this server", plat),
+			SupportedPlatforms: enabledPlatforms.supported(),
+		})
+		return
+	}
+	normalizedURL = platform.Canonicalize(plat, normalizedURL)
+
+	optionsJSON, err := json.Marshal(opts)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to create job"})
+		return
+	}
+
+	release, ok := quotas.admit(w, r)
+	if !ok {
+		return
+	}
+	created := false
+	defer func() {
+		if !created {
+			release()
+		}
+	}()
+
+	jobID := uuid.NewString()
+	job := store.Job{
+		ID:        jobID,
+		SourceURL: normalizedURL,
+		Platform:  plat,
+		Status:    jobs.StatusQueued,
+		Options:   optionsJSON,
+		Owner:     sql.NullString{String: requestOwner(r), Valid: true},
+		RequestID: sql.NullString{String: requestID(r.Context()), Valid: true},
+	}
+	if req.ClientJobID != "" {
+		job.ClientJobID = sql.NullString{String: req.ClientJobID, Valid: true}
+	}
+	if text != "" {
+		job.SourceText = sql.NullString{String: text, Valid: true}
+	}
+	if err := st.CreateJob(r.Context(), job); err != nil {
+		if errors.Is(err, store.ErrConflict) && req.ClientJobID != "" {
+			// Lost a race with a concurrent submission using the same client id.
+			if existing, err := st.GetJobByClientID(r.Context(), req.ClientJobID); err == nil {
+				writeJSON(w, http.StatusOK, api.CreateJobResponse{JobID: existing.ID, Status: existing.Status})
+				return
+			}
+		}
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to create job"})
+		return
+	}
+	if !claimIdempotencyKey(w, r, cfg, st, idemKey, jobID) {
+		return
+	}
+
+	task, err := queue.NewProcessTask(queue.ProcessPayload{JobID: jobID, SourceURL: normalizedURL, Platform: plat, Options: opts, RequestID: requestID(r.Context()), FreshParse: req.FreshParse})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to enqueue"})
+		return
+	}
+	_, err = client.Enqueue(task, enqueueOptions(cfg, jobQueue(cfg, opts), jobID)...)
+	if err != nil {
+		abandonJob(r.Context(), cfg, st, jobID, cfg.EnqueueFailureMode == enqueueFailureRollback, err)
+		releaseIdempotencyKey(r, st, idemKey, jobID)
+		writeQueueUnavailable(w)
+		return
+	}
+	metrics.JobsCreated.WithLabelValues(plat).Inc()
+	created = true
+
+	writeJSON(w, http.StatusAccepted, api.CreateJobResponse{JobID: jobID, Status: jobs.StatusQueued})
+}
+
+const (
+	enqueueFailureFail     = "fail"
+	enqueueFailureRollback = "rollback"
+)
+
+// queueRetryAfter is the Retry-After hint sent when the queue is unreachable.
+const queueRetryAfter = 10 * time.Second
+
+// abandonJob cleans up a job whose task could not be enqueued so it is not
+// left in "queued" forever: the row is deleted when rollback is set, otherwise
+// marked failed (and therefore retryable) with a queue error.
+func abandonJob(ctx context.Context, cfg config.Config, st *store.Store, jobID string, rollback bool, cause error) {
+	// Finish the cleanup even if the client has already gone away.
+	ctx = context.WithoutCancel(ctx)
+	slog.ErrorContext(ctx, "enqueue failed", "job_id", jobID, "mode", cfg.EnqueueFailureMode, "err", cause)
+	if rollback {
+		if err := st.DeleteJob(ctx, jobID); err != nil {
+			slog.ErrorContext(ctx, "rollback job failed", "job_id", jobID, "err", err)
+		}
+		return
+	}
+	msg := "queue unavailable: " + cause.Error()
+	if err := st.UpdateJobStatus(ctx, jobID, jobs.StatusFailed, &msg, nil); err != nil {
+		slog.ErrorContext(ctx, "mark job failed", "job_id", jobID, "err", err)
+	}
+}
+
+func writeQueueUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(queueRetryAfter.Seconds())))
+	writeJSON(w, http.StatusServiceUnavailable, api.ErrorResponse{Error: "queue unavailable"})
+}
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+var idempotencyKeyRe = regexp.MustCompile(`^[\x21-\x7e]{1,255}$`)
+
+// idempotencyKey returns the request's Idempotency-Key, empty when there is
+// none or keys are disabled. If the owner already used the key within
+// IDEMPOTENCY_KEY_TTL it answers with that job instead and returns false, as
+// it does for an invalid key.
+func idempotencyKey(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store) (string, bool) {
+	if cfg.IdempotencyKeyTTL <= 0 {
+		return "", true
+	}
+	key := strings.TrimSpace(r.Header.Get(idempotencyKeyHeader))
+	if key == "" {
+		return "", true
+	}
+	if !idempotencyKeyRe.MatchString(key) {
+		writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "Idempotency-Key must be 1-255 printable ASCII characters"})
+		return "", false
+	}
+	existingID, err := st.GetIdempotentJobID(r.Context(), requestOwner(r), key, time.Now().Add(-cfg.IdempotencyKeyTTL))
+	if err == nil {
+		writeExistingJob(w, r, st, existingID)
+		return "", false
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load job"})
+		return "", false
+	}
+	return key, true
+}
+
+// claimIdempotencyKey binds key to the just created job. A concurrent request
+// with the same key may have won; then the job is deleted, that request's job
+// is written instead and it returns false.
+func claimIdempotencyKey(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store, key, jobID string) bool {
+	if key == "" {
+		return true
+	}
+	claimed, err := st.ClaimIdempotencyKey(r.Context(), requestOwner(r), key, jobID, time.Now().Add(-cfg.IdempotencyKeyTTL))
+	if err == nil && claimed == jobID {
+		return true
+	}
+	_ = st.DeleteJob(context.WithoutCancel(r.Context()), jobID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to create job"})
+		return false
+	}
+	writeExistingJob(w, r, st, claimed)
+	return false
+}
+
+// releaseIdempotencyKey unbinds key from a job that could not be enqueued, so
+// the client's retry with the same key submits again instead of getting the
+// abandoned job back.
+func releaseIdempotencyKey(r *http.Request, st *store.Store, key, jobID string) {
+	if key == "" {
+		return
+	}
+	if err := st.ReleaseIdempotencyKey(context.WithoutCancel(r.Context()), requestOwner(r), key, jobID); err != nil {
+		slog.ErrorContext(r.Context(), "release idempotency key failed", "job_id", jobID, "err", err)
+	}
+}
+
+// writeExistingJob answers a repeated submission with the job it created.
+func writeExistingJob(w http.ResponseWriter, r *http.Request, st *store.Store, jobID string) {
+	j, err := st.GetJob(r.Context(), jobID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load job"})
+		return
+	}
+	writeJSON(w, http.StatusOK, api.CreateJobResponse{JobID: j.ID, Status: j.Status})
+}
+
+// uploadFilename reduces a client-supplied file name to its base name.
+func uploadFilename(name string) string {
+	name = path.Base(strings.TrimSpace(name))
+	if name == "" || name == "." || name == "/" {
+		return "upload"
+	}
+	return name
+}
+
+// submitUpload creates and enqueues a job for media already staged at
+// queue.StagedUploadKey(jobID). It writes the response and returns an error
+// when no job was created, so the caller can decide about the staged object.
+func submitUpload(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store, client *asynq.Client, quotas *dailyQuota, jobID, filename, idemKey string, opts jobs.Options) error {
+	release, ok := quotas.admit(w, r)
+	if !ok {
+		return errQuotaExceeded
+	}
+	created := false
+	defer func() {
+		if !created {
+			release()
+		}
+	}()
+	optionsJSON, err := json.Marshal(opts)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to create job"})
+		return err
+	}
+	sourceURL := queue.UploadScheme + filename
+	job := store.Job{
+		ID:        jobID,
+		SourceURL: sourceURL,
+		Platform:  platform.PlatformUpload,
+		Status:    jobs.StatusQueued,
+		Options:   optionsJSON,
+		Owner:     sql.NullString{String: requestOwner(r), Valid: true},
+		RequestID: sql.NullString{String: requestID(r.Context()), Valid: true},
+	}
+	if err := st.CreateJob(r.Context(), job); err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			writeJSON(w, http.StatusConflict, api.ErrorResponse{Error: "upload already used by a job"})
+			return err
+		}
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to create job"})
+		return err
+	}
+	if !claimIdempotencyKey(w, r, cfg, st, idemKey, jobID) {
+		return errIdempotentReplay
+	}
+	task, err := queue.NewProcessTask(queue.ProcessPayload{JobID: jobID, SourceURL: sourceURL, Platform: platform.PlatformUpload, Options: opts, RequestID: requestID(r.Context()), StagedKey: queue.StagedUploadKey(jobID)})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to enqueue"})
+		return nil
+	}
+	if _, err := client.Enqueue(task, enqueueOptions(cfg, jobQueue(cfg, opts), jobID)...); err != nil {
+		rollback := cfg.EnqueueFailureMode == enqueueFailureRollback
+		abandonJob(r.Context(), cfg, st, jobID, rollback, err)
+		releaseIdempotencyKey(r, st, idemKey, jobID)
+		writeQueueUnavailable(w)
+		if rollback {
+			// A failed job keeps its staged object for a retry; a rolled
+			// back one no longer references it.
+			return errJobRolledBack
+		}
+		return nil
+	}
+	metrics.JobsCreated.WithLabelValues(platform.PlatformUpload).Inc()
+	created = true
+	writeJSON(w, http.StatusAccepted, api.CreateJobResponse{JobID: jobID, Status: jobs.StatusQueued})
+	return nil
+}
+
+// stagedJobID returns the job id a presigned staging key was issued for. Only
+// keys of the form uploads/{uuid} are accepted, so clients cannot point a job
+// at arbitrary objects in the bucket.
+func stagedJobID(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, queue.StagedUploadPrefix)
+	if !ok {
+		return "", false
+	}
+	id, err := uuid.Parse(rest)
+	if err != nil || id.String() != rest {
+		return "", false
+	}
+	return rest, true
+}
+
+// submitStagedObject handles POST /jobs with an object_key from
+// /uploads/presign. The job takes the id embedded in the key, so the staged
+// object is found, retried and cleaned up like a regular upload.
+func submitStagedObject(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store, s3 storage.Storage, client *asynq.Client, quotas *dailyQuota, req api.CreateJobRequest) {
+	jobID, ok := stagedJobID(strings.TrimSpace(req.ObjectKey))
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "object_key must be a key issued by /uploads/presign"})
+		return
+	}
+	idemKey, ok := idempotencyKey(w, r, cfg, st)
+	if !ok {
+		return
+	}
+	defaults, err := ownerDefaults(r.Context(), st, requestOwner(r))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load settings"})
+		return
+	}
+	opts := req.Options.WithDefaults(defaults)
+	if err := opts.Normalize(); err != nil {
+		writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err := checkPriority(cfg, opts); err != nil {
+		writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: err.Error()})
+		return
+	}
+	key := queue.StagedUploadKey(jobID)
+	info, err := s3.StatObject(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "object not uploaded"})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to check upload"})
+		return
+	}
+	if info.Size > cfg.MaxFileSizeBytes {
+		_ = s3.DeleteObject(context.WithoutCancel(r.Context()), key)
+		writeJSON(w, http.StatusRequestEntityTooLarge, api.ErrorResponse{Error: fmt.Sprintf("file exceeds %d bytes", cfg.MaxFileSizeBytes)})
+		return
+	}
+	if err := submitUpload(w, r, cfg, st, client, quotas, jobID, uploadFilename(req.Filename), idemKey, opts); errors.Is(err, errJobRolledBack) {
+		if err := s3.DeleteObject(context.WithoutCancel(r.Context()), key); err != nil {
+			slog.ErrorContext(r.Context(), "delete staged upload failed", "job_id", jobID, "err", err)
+		}
+	}
+}
+
+// workerCheck answers whether any worker is alive, based on the heartbeats
+// asynq servers keep in Redis. Results are cached for ttl so submissions do
+// not hit Redis every time.
+type workerCheck struct {
+	inspector *asynq.Inspector
+	ttl       time.Duration
+	// bypass is an admin override that accepts submissions regardless.
+	bypass atomic.Bool
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	healthy   int
+}
+
+func (c *workerCheck) count() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checkedAt) < c.ttl {
+		return c.healthy, nil
+	}
+	servers, err := c.inspector.Servers()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, s := range servers {
+		if s.Status == "active" {
+			n++
+		}
+	}
+	c.healthy, c.checkedAt = n, time.Now()
+	return n, nil
+}
+
+var errQuotaExceeded = errors.New("daily job quota exceeded")
+
+// errJobRolledBack is returned by submitUpload when the job was deleted again
+// because its task could not be enqueued (ENQUEUE_FAILURE_MODE=rollback).
+var errJobRolledBack = errors.New("job rolled back")
+
+// errIdempotentReplay is returned by submitUpload when a concurrent request
+// with the same Idempotency-Key created the job instead.
+var errIdempotentReplay = errors.New("idempotency key already used")
+
+// dailyQuota caps the jobs each owner (API token) creates per UTC day. Counts
+// live in Redis under v2m:quota:{owner}:{yyyymmdd}; limit 0 means unlimited.
+type dailyQuota struct {
+	rdb       *redis.Client
+	limit     int
+	overrides map[string]int
+}
+
+// parseQuotaOverrides reads "owner=limit,..." where owner is the id shown in
+// /admin/usage (tok_... or anonymous) and 0 lifts the quota.
+func parseQuotaOverrides(raw string) (map[string]int, error) {
+	out := make(map[string]int)
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		owner, value, ok := strings.Cut(item, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || strings.TrimSpace(owner) == "" || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid quota override %q", item)
+		}
+		out[strings.TrimSpace(owner)] = n
+	}
+	return out, nil
+}
+
+func (q *dailyQuota) limitFor(owner string) int {
+	if n, ok := q.overrides[owner]; ok {
+		return n
+	}
+	return q.limit
+}
+
+// admit counts one job against the caller's quota for today. When the quota
+// is used up it writes 429 and returns false. The returned release undoes the
+// count and must be called if the job ends up not being created, so only
+// successful creations are counted. Redis errors fail open.
+func (q *dailyQuota) admit(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	noop := func() {}
+	owner := requestOwner(r)
+	limit := q.limitFor(owner)
+	if limit <= 0 {
+		return noop, true
+	}
+	now := time.Now().UTC()
+	key := "v2m:quota:" + owner + ":" + now.Format("20060102")
+	n, err := q.rdb.Incr(r.Context(), key).Result()
+	if err != nil {
+		slog.WarnContext(r.Context(), "quota check failed", "owner", owner, "err", err)
+		return noop, true
+	}
+	if n == 1 {
+		q.rdb.Expire(r.Context(), key, 48*time.Hour)
+	}
+	release := func() { q.rdb.Decr(context.WithoutCancel(r.Context()), key) }
+	if n <= int64(limit) {
+		return release, true
+	}
+	release()
+	reset := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+	writeJSON(w, http.StatusTooManyRequests, quotaExceededResponse{
+		Error:   errQuotaExceeded.Error(),
+		Limit:   limit,
+		ResetAt: reset.Format(time.RFC3339),
+	})
+	return nil, false
+}
+
+// admit rejects a submission with 503 when REJECT_WITHOUT_WORKERS is set and
+// no worker has checked in, unless an admin has enabled the bypass.
+func (c *workerCheck) admit(w http.ResponseWriter, r *http.Request, cfg config.Config) bool {
+	if !cfg.RejectWithoutWorkers || c.bypass.Load() {
+		return true
+	}
+	n, err := c.count()
+	if err != nil {
+		slog.WarnContext(r.Context(), "worker check failed", "err", err)
+	}
+	if err == nil && n > 0 {
+		return true
+	}
+	w.Header().Set("Retry-After", "30")
+	writeJSON(w, http.StatusServiceUnavailable, api.ErrorResponse{Error: "no healthy worker available"})
+	return false
+}
+
+// retryPayload rebuilds the task payload for a stored job. Uploaded jobs point
+// back at their staging object.
+func retryPayload(j store.Job, requestID string) queue.ProcessPayload {
+	p := queue.ProcessPayload{JobID: j.ID, SourceURL: j.SourceURL, Platform: j.Platform, Options: jobOptions(j), RequestID: requestID}
+	if j.Platform == platform.PlatformUpload {
+		p.StagedKey = queue.StagedUploadKey(j.ID)
+	}
+	return p
+}
+
+// checkPriority rejects a priority whose queue QUEUE_WEIGHTS does not
+// configure, since no worker would consume it.
+func checkPriority(cfg config.Config, opts jobs.Options) error {
+	if opts.Priority == "" || slices.Contains(queue.Names(cfg.RetryQueue, cfg.QueueWeights), opts.Priority) {
+		return nil
+	}
+	return fmt.Errorf("priority %s is not enabled on this server", opts.Priority)
+}
+
+// jobQueue is the queue fresh tasks for a job with opts go to. A priority
+// whose queue is no longer configured falls back to the default queue.
+func jobQueue(cfg config.Config, opts jobs.Options) string {
+	if checkPriority(cfg, opts) != nil {
+		return queue.QueueDefault
+	}
+	return queue.ForPriority(opts.Priority)
+}
+
+func enqueueOptions(cfg config.Config, queueName, jobID string) []asynq.Option {
+	if queueName == "" {
+		queueName = queue.QueueDefault
+	}
+	opts := []asynq.Option{
+		asynq.Queue(queueName),
+		asynq.MaxRetry(cfg.JobMaxRetry),
+		asynq.Timeout(cfg.JobTimeout),
+	}
+	if cfg.JobUniqueTasks {
+		// Using the job id as the task id lets Redis reject a second live task
+		// for the same job; the uniqueness lock expires with the job timeout so
+		// a task lost without finishing cannot block the job forever.
+		opts = append(opts, asynq.TaskID(jobID), asynq.Unique(uniqueTaskTTL(cfg)))
+	}
+	return opts
+}
+
+// uniqueTaskTTL is how long the uniqueness lock of a job's task is held:
+// the job timeout, but at least the one second asynq requires.
+func uniqueTaskTTL(cfg config.Config) time.Duration {
+	if cfg.JobTimeout < time.Second {
+		return time.Second
+	}
+	return cfg.JobTimeout
+}
+
+// isDuplicateTask reports whether an enqueue failed because the job already
+// has a live task.
+func isDuplicateTask(err error) bool {
+	return errors.Is(err, asynq.ErrTaskIDConflict) || errors.Is(err, asynq.ErrDuplicateTask)
+}
+
+// releaseStaleTask removes finished tasks still holding the job's task id so
+// the job can be enqueued again. Task ids are only unique per queue, so every
+// queue a job may have used is checked. Pending, scheduled, retrying or active
+// tasks are left alone and reported as errTaskInFlight.
+func releaseStaleTask(inspector *asynq.Inspector, jobID string, queues []string) error {
+	for _, q := range queues {
+		info, err := inspector.GetTaskInfo(q, jobID)
+		if err != nil {
+			if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+				continue
+			}
+			return err
+		}
+		switch info.State {
+		case asynq.TaskStateArchived, asynq.TaskStateCompleted:
+			if err := inspector.DeleteTask(q, jobID); err != nil {
+				return err
+			}
+		default:
+			return errTaskInFlight
+		}
+	}
+	return nil
+}
+
+// runReadinessChecks runs the dependency checks concurrently, each bounded by
+// timeout, and returns "ok" or the error text per check name.
+func runReadinessChecks(ctx context.Context, checks map[string]func(context.Context) error, timeout time.Duration) map[string]string {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]string, len(checks))
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			res := "ok"
+			if err := check(cctx); err != nil {
+				res = err.Error()
+			}
+			mu.Lock()
+			results[name] = res
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+	return results
+}
+
+// lookupJobs answers GET /jobs?ids=a,b,c with the listed jobs that exist, in
+// the order requested. Ids that are not job ids are skipped like missing ones.
+func lookupJobs(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store, s3 storage.Storage, raw string) {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" || seen[part] {
+			continue
+		}
+		seen[part] = true
+		ids = append(ids, part)
+	}
+	if len(ids) == 0 {
+		writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "ids is required"})
+		return
+	}
+	if len(ids) > maxLookupIDs {
+		writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: fmt.Sprintf("at most %d ids per request", maxLookupIDs)})
+		return
+	}
+	valid := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, err := uuid.Parse(id); err == nil {
+			valid = append(valid, id)
+		}
+	}
+	var items []store.Job
+	if len(valid) > 0 {
+		found, err := st.GetJobsByID(r.Context(), valid)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load jobs"})
+			return
+		}
+		byID := make(map[string]store.Job, len(found))
+		for _, j := range found {
+			byID[j.ID] = j
+		}
+		for _, id := range valid {
+			if j, ok := byID[id]; ok {
+				items = append(items, j)
+			}
+		}
+	}
+	list, err := buildJobResponses(r.Context(), cfg, s3, items)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to sign mp3 url"})
+		return
+	}
+	writeJSON(w, http.StatusOK, api.ListJobsResponse{Jobs: list})
+}
+
+func loadJob(w http.ResponseWriter, r *http.Request, st *store.Store, cache *readCache, id string) (store.Job, bool) {
+	j, err := st.GetJob(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSON(w, http.StatusNotFound, api.ErrorResponse{Error: "not found"})
+			return store.Job{}, false
+		}
+		if cached, ok := cache.job(id); ok {
+			slog.WarnContext(r.Context(), "serving cached job", "job_id", id, "err", err)
+			w.Header().Set(staleHeader, "true")
+			return cached, true
+		}
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load job"})
+		return store.Job{}, false
+	}
+	cache.putJob(j)
+	return j, true
+}
+
+// retranscodeJob queues a ready job again with its options overlaid by the
+// request body. The worker reuses the retained source when there is one and
+// otherwise downloads it again; uploads without a retained source cannot be
+// re-transcoded.
+func retranscodeJob(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store, s3 storage.Storage, client *asynq.Client, inspector *asynq.Inspector, id string) {
+	j, err := st.GetJob(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSON(w, http.StatusNotFound, api.ErrorResponse{Error: "not found"})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load job"})
+		return
+	}
+	if j.Status != jobs.StatusReady {
+		writeJSON(w, http.StatusConflict, api.ErrorResponse{Error: "job not ready"})
+		return
+	}
+	opts := jobOptions(j)
+	if !decodeJSON(w, r, cfg, &opts, false) {
+		return
+	}
+	if err := opts.Normalize(); err != nil {
+		writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err := checkPriority(cfg, opts); err != nil {
+		writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: err.Error()})
+		return
+	}
+	optionsJSON, err := json.Marshal(opts)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to update job"})
+		return
+	}
+
+	payload := queue.ProcessPayload{
+		JobID:       j.ID,
+		SourceURL:   j.SourceURL,
+		Platform:    j.Platform,
+		Options:     opts,
+		RequestID:   requestID(r.Context()),
+		ReplacesKey: objectKeyFromJob(cfg, j),
+	}
+	sourceKey := queue.StagedUploadKey(j.ID)
+	if _, err := s3.StatObject(r.Context(), sourceKey); err == nil {
+		payload.StagedKey = sourceKey
+	} else if !errors.Is(err, storage.ErrObjectNotFound) {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to check source"})
+		return
+	} else if j.Platform == platform.PlatformUpload {
+		writeJSON(w, http.StatusConflict, api.ErrorResponse{Error: "source no longer available"})
+		return
+	}
+
+	if cfg.JobUniqueTasks {
+		if err := releaseStaleTask(inspector, j.ID, queue.Names(cfg.RetryQueue, cfg.QueueWeights)); err != nil {
+			if errors.Is(err, errTaskInFlight) {
+				writeJSON(w, http.StatusConflict, api.ErrorResponse{Error: "job already queued"})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to inspect queue"})
+			return
+		}
+	}
+	task, err := queue.NewProcessTask(payload)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to enqueue"})
+		return
+	}
+	ok, err := st.RequeueReadyJob(r.Context(), j.ID, optionsJSON)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to update job"})
+		return
+	}
+	if !ok {
+		writeJSON(w, http.StatusConflict, api.ErrorResponse{Error: "job not ready"})
+		return
+	}
+	if _, err := client.Enqueue(task, enqueueOptions(cfg, jobQueue(cfg, opts), j.ID)...); err != nil {
+		if isDuplicateTask(err) {
+			writeJSON(w, http.StatusConflict, api.ErrorResponse{Error: "job already queued"})
+			return
+		}
+		abandonJob(r.Context(), cfg, st, j.ID, false, err)
+		writeQueueUnavailable(w)
+		return
+	}
+	slog.InfoContext(r.Context(), "job retranscode queued", "job_id", j.ID, "reuse_source", payload.StagedKey != "")
+	writeJSON(w, http.StatusAccepted, api.CreateJobResponse{JobID: j.ID, Status: jobs.StatusQueued})
+}
+
+// routeMux is the API's mux. Routes registered with handle answer other
+// methods on their path with 405; handle and mount record every route so
+// verifyRoutes can compare them with the API description.
+type routeMux struct {
+	*http.ServeMux
+	paths  map[string]bool
+	routes []string
+	mounts map[string]*resourceRoutes
+}
+
+func newRouteMux() *routeMux {
+	return &routeMux{ServeMux: http.NewServeMux(), paths: make(map[string]bool), mounts: make(map[string]*resourceRoutes)}
+}
+
+// handle registers h for method on path.
+func (m *routeMux) handle(method, path string, h http.HandlerFunc) {
+	if !m.paths[path] {
+		m.paths[path] = true
+		m.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		})
+	}
+	pattern := method + " " + path
+	m.routes = append(m.routes, pattern)
+	m.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		// GET patterns also match HEAD; only routes registering HEAD serve it.
+		if r.Method != method {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// mount serves the routes of s under its prefix.
+func (m *routeMux) mount(prefix string, s *resourceRoutes) {
+	m.mounts[prefix] = s
+	m.Handle(prefix, s)
+}
+
+// route returns the pattern serving r, looking into mounted routes.
+func (m *routeMux) route(r *http.Request) string {
+	_, pattern := m.Handler(r)
+	if s, ok := m.mounts[pattern]; ok {
+		_, pattern = s.mux.Handler(r)
+	}
+	return pattern
+}
+
+// registered returns the patterns of every route registered with handle or
+// mounted.
+func (m *routeMux) registered() []string {
+	routes := slices.Clone(m.routes)
+	for _, s := range m.mounts {
+		routes = append(routes, s.routes...)
+	}
+	return routes
+}
+
+// resourceRoutes serves {prefix}{param} and {prefix}{param}/{name} with Go
+// method patterns, passing the path value to the handler. Its own mux keeps
+// these wildcard patterns apart from the literal routes under the same prefix
+// (e.g. /jobs/upload, /jobs/by-client/). Ids containing a slash and paths no
+// pattern matches get a 404, or a 405 when the method is not one the named
+// sub-resource (the job itself for unknown names) accepts.
+type resourceRoutes struct {
+	prefix  string
+	param   string
+	mux     *http.ServeMux
+	methods map[string][]string
+	// routes are the registered patterns, checked by verifyRoutes.
+	routes []string
+}
+
+func newResourceRoutes(prefix, param string) *resourceRoutes {
+	s := &resourceRoutes{prefix: prefix, param: param, mux: http.NewServeMux(), methods: make(map[string][]string)}
+	s.mux.HandleFunc(prefix, s.unmatched)
+	return s
+}
+
+// handle registers h for method on the resource itself (name "") or its
+// sub-resource name.
+func (s *resourceRoutes) handle(method, name string, h func(w http.ResponseWriter, r *http.Request, id string)) {
+	pattern := method + " " + s.prefix + "{" + s.param + "}"
+	if name != "" {
+		pattern += "/" + name
+	}
+	s.methods[name] = append(s.methods[name], method)
+	s.routes = append(s.routes, pattern)
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		// GET patterns also match HEAD; only routes registering HEAD serve it.
+		if r.Method != method {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id := r.PathValue(s.param)
+		if strings.Contains(id, "/") {
+			writeJSON(w, http.StatusNotFound, api.ErrorResponse{Error: "not found"})
+			return
+		}
+		h(w, r, id)
+	})
+}
+
+func (s *resourceRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// An empty id is answered here rather than redirected to a cleaned path.
+	if rest := strings.TrimPrefix(r.URL.Path, s.prefix); rest == "" || strings.HasPrefix(rest, "/") {
+		s.unmatched(w, r)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *resourceRoutes) unmatched(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, s.prefix)
+	name := ""
+	if i := strings.LastIndex(rest, "/"); i >= 0 {
+		name = rest[i+1:]
+	}
+	methods, ok := s.methods[name]
+	if !ok {
+		methods = s.methods[""]
+	}
+	if rest != "" && !slices.Contains(methods, r.Method) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusNotFound, api.ErrorResponse{Error: "not found"})
+}
+
+func deleteJob(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store, s3 storage.Storage, cache *readCache, id string) {
+	j, err := st.GetJob(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSON(w, http.StatusNotFound, api.ErrorResponse{Error: "not found"})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load job"})
+		return
+	}
+	if !jobs.IsTerminal(j.Status) {
+		writeJSON(w, http.StatusConflict, api.ErrorResponse{Error: "job still in progress"})
+		return
+	}
+	keys := jobObjectKeys(cfg, j)
+	if deleted := deleteObjects(r.Context(), s3, keys, cfg.CleanupConcurrency); deleted < len(keys) {
+		// Keep the row so the delete can be retried; it is the only
+		// record of the remaining objects.
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to delete job files"})
+		return
+	}
+	if cfg.SoftDelete {
+		_, err = st.SoftDeleteJobsByID(r.Context(), []string{j.ID})
+	} else {
+		err = st.DeleteJob(r.Context(), j.ID)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to delete job"})
+		return
+	}
+	cache.forgetJob(j.ID)
+	slog.InfoContext(r.Context(), "job deleted", "job_id", j.ID, "objects", len(keys))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func retryJob(w http.ResponseWriter, r *http.Request, cfg config.Config, st *store.Store, client *asynq.Client, inspector *asynq.Inspector, id string) {
+	j, err := st.GetJob(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSON(w, http.StatusNotFound, api.ErrorResponse{Error: "not found"})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load job"})
+		return
+	}
+	if !jobs.IsRetryable(j.Status) {
+		writeJSON(w, http.StatusConflict, api.ErrorResponse{Error: "job not retryable"})
+		return
+	}
+	if cfg.JobUniqueTasks {
+		if err := releaseStaleTask(inspector, j.ID, queue.Names(cfg.RetryQueue, cfg.QueueWeights)); err != nil {
+			if errors.Is(err, errTaskInFlight) {
+				writeJSON(w, http.StatusConflict, api.ErrorResponse{Error: "job already queued"})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to inspect queue"})
+			return
+		}
+	}
+	if err := st.UpdateJobStatus(r.Context(), j.ID, jobs.StatusQueued, nil, nil); err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to update job"})
+		return
+	}
+	payload := retryPayload(j, requestID(r.Context()))
+	payload.FreshParse = r.URL.Query().Get("fresh_parse") == "true"
+	task, err := queue.NewProcessTask(payload)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to enqueue"})
+		return
+	}
+	if _, err := client.Enqueue(task, enqueueOptions(cfg, cfg.RetryQueue, j.ID)...); err != nil {
+		if isDuplicateTask(err) {
+			writeJSON(w, http.StatusConflict, api.ErrorResponse{Error: "job already queued"})
+			return
+		}
+		// The job existed before this request, so it is never rolled back.
+		abandonJob(r.Context(), cfg, st, j.ID, false, err)
+		writeQueueUnavailable(w)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, api.CreateJobResponse{JobID: j.ID, Status: jobs.StatusQueued})
+}
+
+// requeueFailedJobs re-enqueues every failed, expired or dead job matching f,
+// like /jobs/{id}/retry in bulk. Jobs whose task is still live in asynq, or
+// that another request requeued first, are skipped.
+func requeueFailedJobs(ctx context.Context, cfg config.Config, st *store.Store, client *asynq.Client, inspector *asynq.Inspector, f store.RetryableFilter) (requeueFailedResponse, error) {
+	var resp requeueFailedResponse
+	const batchSize = 200
+	var afterCreated, afterID any
+	for {
+		items, err := st.ListRetryableJobs(ctx, f, afterCreated, afterID, batchSize)
+		if err != nil {
+			return resp, err
+		}
+		for _, j := range items {
+			if cfg.JobUniqueTasks {
+				if err := releaseStaleTask(inspector, j.ID, queue.Names(cfg.RetryQueue, cfg.QueueWeights)); err != nil {
+					if !errors.Is(err, errTaskInFlight) {
+						slog.WarnContext(ctx, "requeue failed job: inspect queue failed", "job_id", j.ID, "err", err)
+					}
+					resp.Skipped++
+					continue
+				}
+			}
+			ok, err := st.RequeueFailedJob(ctx, j.ID)
+			if err != nil {
+				slog.ErrorContext(ctx, "requeue failed job failed", "job_id", j.ID, "err", err)
+				resp.Failed++
+				continue
+			}
+			if !ok {
+				resp.Skipped++
+				continue
+			}
+			task, err := queue.NewProcessTask(retryPayload(j, requestID(ctx)))
+			if err == nil {
+				_, err = client.Enqueue(task, enqueueOptions(cfg, cfg.RetryQueue, j.ID)...)
+			}
+			if err != nil {
+				if isDuplicateTask(err) {
+					resp.Skipped++
+					continue
+				}
+				abandonJob(ctx, cfg, st, j.ID, false, err)
+				resp.Failed++
+				continue
+			}
+			resp.Requeued++
+		}
+		if len(items) < batchSize {
+			return resp, nil
+		}
+		last := items[len(items)-1]
+		afterCreated, afterID = last.CreatedAt, last.ID
+	}
+}
+
+// minURLTTL is the shortest signed URL lifetime a request may ask for.
+const minURLTTL = 10 * time.Second
+
+// withURLTTL applies the ?ttl= override of the signed URL lifetime, as a Go
+// duration or seconds, to cfg. It writes a 400 and returns false for values
+// outside [minURLTTL, MP3_URL_MAX_TTL].
+func withURLTTL(w http.ResponseWriter, r *http.Request, cfg config.Config) (config.Config, bool) {
+	raw := strings.TrimSpace(r.URL.Query().Get("ttl"))
+	if raw == "" {
+		return cfg, true
+	}
+	ttl, err := time.ParseDuration(raw)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(raw)
+		if convErr != nil {
+			writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "ttl must be a duration or seconds"})
+			return cfg, false
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	maxTTL := max(cfg.MP3URLMaxTTL, cfg.MP3URLTTL)
+	if ttl < minURLTTL || ttl > maxTTL {
+		writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: fmt.Sprintf("ttl must be between %s and %s", minURLTTL, maxTTL)})
+		return cfg, false
+	}
+	cfg.MP3URLTTL = ttl
+	return cfg, true
+}
+
+func serveJob(w http.ResponseWriter, r *http.Request, cfg config.Config, s3 storage.Storage, inspector *asynq.Inspector, j store.Job) {
+	cfg, ok := withURLTTL(w, r, cfg)
+	if !ok {
+		return
+	}
+	position := queuePosition(r.Context(), inspector, cfg, j)
+	etag := jobETag(j, position)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	resp, err := buildJobResponse(r.Context(), cfg, s3, j)
+	if err != nil {
+		w.Header().Del("ETag")
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to sign mp3 url"})
+		return
+	}
+	resp.QueuePosition = position
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// jobETag is a weak validator of the stored job state plus its queue
+// position. Every stored change bumps updated_at. The presigned URLs are left
+// out: they differ on every response without the job changing.
+func jobETag(j store.Job, position *int) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%s|%d", j.ID, j.Status, j.UpdatedAt.UnixNano())
+	if position != nil {
+		fmt.Fprintf(h, "|%d", *position)
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:12]) + `"`
+}
+
+// etagMatches applies the weak comparison of If-None-Match.
+func etagMatches(header, etag string) bool {
+	for _, part := range strings.Split(header, ",") {
+		candidate := strings.TrimSpace(part)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Queue positions are only looked up this deep; jobs further back report none.
+const (
+	queuePositionPageSize = 100
+	queuePositionMaxPages = 20
+)
+
+// queuePosition returns the 1-based position of a queued job among the
+// pending tasks of its queue, or nil when it is not queued, not pending (e.g.
+// waiting for a retry), too deep, or the inspector fails. The value is
+// approximate: the queue moves while it is read.
+func queuePosition(ctx context.Context, inspector *asynq.Inspector, cfg config.Config, j store.Job) *int {
+	if j.Status != jobs.StatusQueued {
+		return nil
+	}
+	for _, q := range queue.Names(cfg.RetryQueue, cfg.QueueWeights) {
+		for page := 1; page <= queuePositionMaxPages; page++ {
+			tasks, err := inspector.ListPendingTasks(q, asynq.PageSize(queuePositionPageSize), asynq.Page(page))
+			if err != nil {
+				slog.WarnContext(ctx, "list pending tasks failed", "queue", q, "err", err)
+				return nil
+			}
+			for i, t := range tasks {
+				if taskJobID(t) == j.ID {
+					pos := (page-1)*queuePositionPageSize + i + 1
+					return &pos
+				}
+			}
+			if len(tasks) < queuePositionPageSize {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	// purgeMessage is the error stored on jobs whose task was purged.
+	purgeMessage  = "purged from queue by an administrator"
+	purgePageSize = 100
+)
+
+// purgeQueue deletes the pending, scheduled and retry tasks of q, leaving
+// active ones to finish. Without failJobs whole states are deleted at once;
+// with it each task is listed and deleted on its own so exactly the jobs of
+// deleted tasks are marked failed.
+func purgeQueue(ctx context.Context, inspector *asynq.Inspector, st *store.Store, q string, failJobs bool) (purgeQueueResponse, error) {
+	resp := purgeQueueResponse{Queue: q}
+	states := []struct {
+		count     *int
+		deleteAll func(string) (int, error)
+		list      func(string, ...asynq.ListOption) ([]*asynq.TaskInfo, error)
+	}{
+		{&resp.Pending, inspector.DeleteAllPendingTasks, inspector.ListPendingTasks},
+		{&resp.Scheduled, inspector.DeleteAllScheduledTasks, inspector.ListScheduledTasks},
+		{&resp.Retry, inspector.DeleteAllRetryTasks, inspector.ListRetryTasks},
+	}
+	var jobIDs []string
+	for _, s := range states {
+		if !failJobs {
+			n, err := s.deleteAll(q)
+			if err != nil {
+				return resp, err
+			}
+			*s.count = n
+			continue
+		}
+		var tasks []*asynq.TaskInfo
+		for page := 1; ; page++ {
+			batch, err := s.list(q, asynq.PageSize(purgePageSize), asynq.Page(page))
+			if err != nil {
+				return resp, err
+			}
+			tasks = append(tasks, batch...)
+			if len(batch) < purgePageSize {
+				break
+			}
+		}
+		for _, t := range tasks {
+			if err := inspector.DeleteTask(q, t.ID); err != nil {
+				// The task started or finished since it was listed.
+				slog.WarnContext(ctx, "purge skipped task", "queue", q, "task_id", t.ID, "err", err)
+				continue
+			}
+			*s.count++
+			jobIDs = append(jobIDs, taskJobID(t))
+		}
+	}
+	if len(jobIDs) == 0 {
+		return resp, nil
+	}
+	items, err := st.GetJobsByID(ctx, jobIDs)
+	if err != nil {
+		return resp, err
+	}
+	msg := purgeMessage
+	for _, j := range items {
+		if j.Status != jobs.StatusQueued && j.Status != jobs.StatusFailed {
+			continue
+		}
+		if err := st.UpdateJobStatus(ctx, j.ID, jobs.StatusFailed, &msg, nil); err != nil {
+			return resp, err
+		}
+		resp.FailedJobs++
+	}
+	return resp, nil
+}
+
+func taskJobID(t *asynq.TaskInfo) string {
+	var p queue.ProcessPayload
+	if err := json.Unmarshal(t.Payload, &p); err != nil {
+		return t.ID
+	}
+	return p.JobID
+}
+
+const (
+	downloadModeProxy    = "proxy"
+	downloadModeRedirect = "redirect"
+	// downloadModeAccel hands the transfer to nginx via X-Accel-Redirect.
+	downloadModeAccel = "accel"
+)
+
+// checksumHeader carries the hex SHA-256 of a download.
+const checksumHeader = "X-Checksum-SHA256"
+
+func serveDownload(w http.ResponseWriter, r *http.Request, cfg config.Config, s3 storage.Storage, j store.Job) {
+	cfg, ok := withURLTTL(w, r, cfg)
+	if !ok {
+		return
+	}
+	if j.Status != jobs.StatusReady {
+		writeJSON(w, http.StatusConflict, api.ErrorResponse{Error: "job not ready"})
+		return
+	}
+	if j.OutputSHA256.Valid {
+		// A strong validator of the content, so Range/If-Range resumes
+		// cannot mix two versions of the output.
+		w.Header().Set("ETag", `"`+j.OutputSHA256.String+`"`)
+		w.Header().Set(checksumHeader, j.OutputSHA256.String)
+	}
+	key := objectKeyFromJob(cfg, j)
+	if r.Method == http.MethodHead {
+		headDownload(w, r, s3, j, key)
+		return
+	}
+	if key != "" && cfg.DownloadMode == downloadModeAccel {
+		setDownloadHeaders(w, r, j, nil)
+		w.Header().Set("X-Accel-Redirect", accelRedirectPath(cfg.AccelRedirectPrefix, key))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if key == "" || cfg.DownloadMode == downloadModeRedirect {
+		mp3URL, err := mp3DownloadURLForJob(r.Context(), cfg, s3, j, r.URL.Query().Get("filename"))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to sign mp3 url"})
+			return
+		}
+		if mp3URL == nil {
+			writeJSON(w, http.StatusNotFound, api.ErrorResponse{Error: "mp3 not found"})
+			return
+		}
+		http.Redirect(w, r, *mp3URL, http.StatusFound)
+		return
+	}
+	obj, info, err := s3.OpenObject(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			writeJSON(w, http.StatusNotFound, api.ErrorResponse{Error: "mp3 not found"})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load mp3"})
+		return
+	}
+	defer obj.Close()
+	filename := setDownloadHeaders(w, r, j, info)
+	var modTime time.Time
+	if info != nil {
+		modTime = info.LastModified
+	}
+	// ServeContent handles Range/If-Range for resumable downloads (206 with
+	// Content-Range, 416 for unsatisfiable ranges) and sets Content-Length
+	// and Accept-Ranges. Seeking the object turns into a ranged S3 GET, so
+	// only the requested bytes are fetched.
+	http.ServeContent(w, r, filename, modTime, obj)
+}
+
+// serveDownloadURL returns the signed attachment URL that the redirect
+// download mode would send the client to, with its expiry, for clients that
+// want the link itself (e.g. to copy it).
+func serveDownloadURL(w http.ResponseWriter, r *http.Request, cfg config.Config, s3 storage.Storage, j store.Job) {
+	cfg, ok := withURLTTL(w, r, cfg)
+	if !ok {
+		return
+	}
+	if j.Status != jobs.StatusReady {
+		writeJSON(w, http.StatusConflict, api.ErrorResponse{Error: "job not ready"})
+		return
+	}
+	// Taken before signing, so the reported expiry is never late.
+	signedAt := time.Now()
+	mp3URL, err := mp3DownloadURLForJob(r.Context(), cfg, s3, j, r.URL.Query().Get("filename"))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to sign mp3 url"})
+		return
+	}
+	if mp3URL == nil {
+		writeJSON(w, http.StatusNotFound, api.ErrorResponse{Error: "mp3 not found"})
+		return
+	}
+	resp := api.DownloadURLResponse{URL: *mp3URL}
+	if objectKeyFromJob(cfg, j) != "" {
+		expiresAt := signedAt.Add(cfg.MP3URLTTL).UTC().Truncate(time.Second)
+		resp.ExpiresAt = &expiresAt
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// accelRedirectPath is the nginx internal location serving key, with each
+// path segment escaped.
+func accelRedirectPath(prefix, key string) string {
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + strings.Join(segments, "/")
+}
+
+// headDownload answers HEAD with the headers a GET would send, using only
+// object metadata. It never redirects, so download managers can learn the
+// size and resumability up front regardless of DOWNLOAD_MODE.
+func headDownload(w http.ResponseWriter, r *http.Request, s3 storage.Storage, j store.Job, key string) {
+	if key == "" {
+		// An external mp3_url has no object to stat, so only what the job
+		// records about its output is sent.
+		if !j.MP3URL.Valid || strings.TrimSpace(j.MP3URL.String) == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		setDownloadHeaders(w, r, j, nil)
+		if j.OutputBytes.Valid {
+			w.Header().Set("Content-Length", strconv.FormatInt(j.OutputBytes.Int64, 10))
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	info, err := s3.StatObject(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		slog.ErrorContext(r.Context(), "stat mp3 failed", "job_id", j.ID, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	setDownloadHeaders(w, r, j, info)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if !info.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// setDownloadHeaders sets Content-Type and Content-Disposition for a job's
+// output and returns the attachment file name.
+func setDownloadHeaders(w http.ResponseWriter, r *http.Request, j store.Job, info *storage.ObjectInfo) string {
+	output := jobOptions(j).Output()
+	filename := downloadFilename(j, output, r.URL.Query().Get("filename"))
+	contentType := output.ContentType
+	if info != nil && info.ContentType != "" {
+		contentType = info.ContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", storage.ContentDisposition(filename))
+	return filename
+}
+
+// downloadFilename is the attachment name for a job's output: the requested
+// name, else the stored title, else video2mp3-{id}. The format's extension is
+// added when missing.
+func downloadFilename(j store.Job, output jobs.OutputFormat, requested string) string {
+	name := safeFilename(requested)
+	if name == "" && j.Title.Valid {
+		name = safeFilename(j.Title.String)
+	}
+	if name == "" {
+		name = "video2mp3-" + j.ID
+	}
+	if !strings.EqualFold(path.Ext(name), "."+output.Ext) {
+		name += "." + output.Ext
+	}
+	return name
+}
+
+// maxFilenameRunes keeps attachment names within common file system limits.
+const maxFilenameRunes = 150
+
+// safeFilename makes s usable as a file name: path separators become "_",
+// control characters are dropped, whitespace is collapsed and leading dots
+// are removed. Non-ASCII text is kept.
+func safeFilename(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '/' || r == '\\':
+			b.WriteRune('_')
+		case unicode.IsControl(r) || r == utf8.RuneError:
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name := strings.Join(strings.Fields(b.String()), " ")
+	name = strings.TrimLeft(name, ". ")
+	if runes := []rune(name); len(runes) > maxFilenameRunes {
+		name = strings.TrimSpace(string(runes[:maxFilenameRunes]))
+	}
+	return name
+}
+
+// decodeJSON reads r's body into v as a single JSON value, rejecting unknown
+// fields and bodies over MAX_JSON_BODY_BYTES. On failure it writes a 400 (413
+// for an oversized body) naming the problem and returns false. With
+// allowEmpty an empty body leaves v unchanged.
+func decodeJSON(w http.ResponseWriter, r *http.Request, cfg config.Config, v any, allowEmpty bool) bool {
+	if r.Body == nil {
+		if allowEmpty {
+			return true
+		}
+		writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "invalid json: request body is empty"})
+		return false
+	}
+	body := r.Body
+	if cfg.MaxJSONBodyBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, cfg.MaxJSONBodyBytes)
+	}
+	err := decodeStrict(body, v)
+	if err == nil || (allowEmpty && errors.Is(err, io.EOF)) {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSON(w, http.StatusRequestEntityTooLarge, api.ErrorResponse{Error: fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit)})
+		return false
+	}
+	writeJSON(w, http.StatusBadRequest, api.ErrorResponse{Error: "invalid json: " + jsonErrorDetail(err)})
+	return false
+}
+
+// decodeStrict decodes exactly one JSON value from src into v, rejecting
+// unknown fields and trailing data.
+func decodeStrict(src io.Reader, v any) error {
+	dec := json.NewDecoder(src)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return errors.New("unexpected data after the JSON value")
+	}
+	return nil
+}
+
+// jsonErrorDetail describes a decode error for a client without Go type
+// names.
+func jsonErrorDetail(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.Is(err, io.EOF):
+		return "request body is empty"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "unexpected end of body"
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Sprintf("unexpected %s", typeErr.Value)
+		}
+		return fmt.Sprintf("field %q has the wrong type (got %s)", typeErr.Field, typeErr.Value)
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("%s at offset %d", syntaxErr.Error(), syntaxErr.Offset)
+	}
+	return strings.TrimPrefix(err.Error(), "json: ")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeSSE(w http.ResponseWriter, id, event string, data []byte) error {
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	if event != "" {
+		if _, err := fmt.Fprintf(w, "event: %s\n", event); err != nil {
+			return err
+		}
+	}
+	if len(data) > 0 {
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+	} else {
+		if _, err := fmt.Fprintf(w, "data: {}\n\n"); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// emitJobUpdate sends the job snapshot with the job's event id: as a default
+// message while the job runs, and once it has finished as a single named
+// "done" or "error" event, so clients that reconnect after completion get the
+// outcome immediately.
+func emitJobUpdate(w http.ResponseWriter, id string, resp api.Job) error {
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return writeSSE(w, id, terminalEvent(resp.Status), payload)
+}
+
+// jobEventID derives the SSE id from the job's updated_at (microseconds, the
+// precision Postgres stores), so ids grow with every change.
+func jobEventID(updatedAt time.Time) string {
+	return strconv.FormatInt(updatedAt.UnixMicro(), 10)
+}
+
+// lastEventID returns the Last-Event-ID sent by a reconnecting EventSource,
+// or 0 when absent or not one of ours.
+func lastEventID(r *http.Request) int64 {
+	v, err := strconv.ParseInt(strings.TrimSpace(r.Header.Get("Last-Event-ID")), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+func terminalEvent(status string) string {
+	switch status {
+	case jobs.StatusReady:
+		return "done"
+	case jobs.StatusFailed, jobs.StatusExpired, jobs.StatusDead:
+		return "error"
+	default:
+		return ""
+	}
+}
+
 func nullStringPtr(ns sql.NullString) *string {
 	if ns.Valid {
 		return &ns.String
 	}
-	return nil
+	return nil
+}
+
+func nullInt64Ptr(n sql.NullInt64) *int64 {
+	if n.Valid {
+		return &n.Int64
+	}
+	return nil
+}
+
+func nullFloat64Ptr(n sql.NullFloat64) *float64 {
+	if n.Valid {
+		return &n.Float64
+	}
+	return nil
+}
+
+func nullTimePtr(nt sql.NullTime) *string {
+	if !nt.Valid {
+		return nil
+	}
+	s := nt.Time.In(time.Local).Format(time.RFC3339)
+	return &s
+}
+
+// buildJobResponses builds responses for a list of jobs, presigning up to
+// PRESIGN_CONCURRENCY of them at once. Order is preserved; any error fails
+// the whole list.
+func buildJobResponses(ctx context.Context, cfg config.Config, s3 storage.Storage, items []store.Job) ([]api.Job, error) {
+	out := make([]api.Job, len(items))
+	concurrency := cfg.PresignConcurrency
+	if concurrency <= 1 || len(items) <= 1 {
+		for i, j := range items {
+			resp, err := buildJobResponse(ctx, cfg, s3, j)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = resp
+		}
+		return out, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	slots := make(chan struct{}, concurrency)
+	for i, j := range items {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, j store.Job) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			resp, err := buildJobResponse(ctx, cfg, s3, j)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			out[i] = resp
+		}(i, j)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return out, nil
+}
+
+func buildJobResponse(ctx context.Context, cfg config.Config, s3 storage.Storage, j store.Job) (api.Job, error) {
+	mp3URL, err := mp3URLForJob(ctx, cfg, s3, j)
+	if err != nil {
+		return api.Job{}, err
+	}
+	var coverURL *string
+	if j.CoverKey.Valid && j.CoverKey.String != "" {
+		signed, err := s3.PresignCover(ctx, j.CoverKey.String, cfg.MP3URLTTL)
+		if err != nil {
+			return api.Job{}, err
+		}
+		coverURL = &signed
+	}
+	opts := jobOptions(j)
+	platformName, platformIcon := platform.Info(j.Platform)
+	return api.Job{
+		JobID:              j.ID,
+		ClientJobID:        nullStringPtr(j.ClientJobID),
+		SourceURL:          j.SourceURL,
+		Title:              nullStringPtr(j.Title),
+		VideoID:            nullStringPtr(j.VideoID),
+		Platform:           j.Platform,
+		Status:             j.Status,
+		Options:            &opts,
+		Error:              nullStringPtr(j.Error),
+		MP3URL:             mp3URL,
+		CoverURL:           coverURL,
+		CreatedAt:          j.CreatedAt.In(time.Local).Format(time.RFC3339),
+		UpdatedAt:          j.UpdatedAt.In(time.Local).Format(time.RFC3339),
+		CompletedAt:        nullTimePtr(j.CompletedAt),
+		FileSizeBytes:      nullInt64Ptr(j.OutputBytes),
+		DurationSeconds:    nullFloat64Ptr(j.DurationSeconds),
+		ChecksumSHA256:     nullStringPtr(j.OutputSHA256),
+		Attempts:           j.Attempts,
+		NextRetryAt:        nextRetryAt(j),
+		ProgressBytes:      nullInt64Ptr(j.ProgressBytes),
+		ProgressTotalBytes: nullInt64Ptr(j.ProgressTotalBytes),
+		ETASeconds:         nullInt64Ptr(j.ETASeconds),
+		ErrorCategory:      nullStringPtr(j.ErrorCategory),
+		PlatformName:       platformName,
+		PlatformIcon:       platformIcon,
+		DetectedPlatform:   nullStringPtr(j.DetectedPlatform),
+	}, nil
+}
+
+func buildJobMetadata(j store.Job) jobMetadataResponse {
+	opts := jobOptions(j)
+	output := opts.Output()
+	format := opts.Format
+	if format == "" {
+		format = output.Ext
+	}
+	var bitrate *int64
+	if j.OutputBytes.Valid && j.DurationSeconds.Valid && j.DurationSeconds.Float64 > 0 {
+		kbps := int64(math.Round(float64(j.OutputBytes.Int64) * 8 / j.DurationSeconds.Float64 / 1000))
+		bitrate = &kbps
+	}
+	return jobMetadataResponse{
+		JobID:           j.ID,
+		SourceURL:       j.SourceURL,
+		Platform:        j.Platform,
+		Title:           nullStringPtr(j.Title),
+		VideoID:         nullStringPtr(j.VideoID),
+		Status:          j.Status,
+		Format:          format,
+		ContentType:     output.ContentType,
+		Options:         opts,
+		DurationSeconds: nullFloat64Ptr(j.DurationSeconds),
+		FileSizeBytes:   nullInt64Ptr(j.OutputBytes),
+		BitrateKbps:     bitrate,
+		ChecksumSHA256:  nullStringPtr(j.OutputSHA256),
+		Attempts:        j.Attempts,
+		CreatedAt:       j.CreatedAt.In(time.Local).Format(time.RFC3339),
+		UpdatedAt:       j.UpdatedAt.In(time.Local).Format(time.RFC3339),
+		CompletedAt:     nullTimePtr(j.CompletedAt),
+		DownloadMs:      nullInt64Ptr(j.DownloadMs),
+		TranscodeMs:     nullInt64Ptr(j.TranscodeMs),
+		UploadMs:        nullInt64Ptr(j.UploadMs),
+	}
+}
+
+func nextRetryAt(j store.Job) *string {
+	if j.Status != jobs.StatusFailed || !j.NextRetryAt.Valid {
+		return nil
+	}
+	return nullTimePtr(j.NextRetryAt)
+}
+
+func jobOptions(j store.Job) jobs.Options {
+	var opts jobs.Options
+	if len(j.Options) > 0 {
+		_ = json.Unmarshal(j.Options, &opts)
+	}
+	_ = opts.Normalize()
+	return opts
+}
+
+// platformSet is the ENABLED_PLATFORMS allowlist; nil allows every platform.
+type platformSet map[string]bool
+
+// parseEnabledPlatforms reads a comma-separated list of platform ids. An
+// empty list enables all platforms.
+func parseEnabledPlatforms(raw string) (platformSet, error) {
+	var out platformSet
+	for _, item := range strings.Split(raw, ",") {
+		id := strings.ToLower(strings.TrimSpace(item))
+		if id == "" {
+			continue
+		}
+		if !platform.IsKnown(id) || id == platform.PlatformUpload {
+			return nil, fmt.Errorf("unknown platform %q", id)
+		}
+		if out == nil {
+			out = make(platformSet)
+		}
+		out[id] = true
+	}
+	return out, nil
+}
+
+func (s platformSet) allows(id string) bool {
+	return s == nil || s[id]
+}
+
+// supported returns the enabled platforms links are accepted from.
+func (s platformSet) supported() []string {
+	all := platform.Supported()
+	if s == nil {
+		return all
+	}
+	out := make([]string, 0, len(s))
+	for _, id := range all {
+		if s[id] {
+			out = append(out, id)
+		}
+	}
+	return out
 }
 
-func buildJobResponse(ctx context.Context, cfg config.Config, s3 *storage.S3Client, j store.Job) (jobResponse, error) {
-	mp3URL, err := mp3URLForJob(ctx, cfg, s3, j)
-	if err != nil {
-		return jobResponse{}, err
-	}
-	return jobResponse{
-		JobID:     j.ID,
-		SourceURL: j.SourceURL,
-		Platform:  j.Platform,
-		Status:    j.Status,
-		Error:     nullStringPtr(j.Error),
-		MP3URL:    mp3URL,
-		CreatedAt: j.CreatedAt.In(time.Local).Format(time.RFC3339),
-		UpdatedAt: j.UpdatedAt.In(time.Local).Format(time.RFC3339),
-	}, nil
+// detectURL reports what POST /jobs would make of input, without calling
+// the parser.
+func detectURL(input string, enabled platformSet) detectItem {
+	item := detectItem{Input: input}
+	normalizedURL, ok := extractURL(input)
+	if !ok {
+		return item
+	}
+	item.NormalizedURL = normalizedURL
+	if plat, ok := platform.Detect(normalizedURL); ok {
+		item.NormalizedURL = platform.Canonicalize(plat, normalizedURL)
+		item.Platform = plat
+		item.Supported = enabled.allows(plat)
+	}
+	return item
 }
 
 func extractURL(input string) (string, bool) {
@@ -441,6 +3157,39 @@ func extractURL(input string) (string, bool) {
 	return match, true
 }
 
+// maxShareTextRunes caps the share message stored with a job.
+const maxShareTextRunes = 1000
+
+// shareText returns the share message to keep with a job whose link is
+// link: the request's text, else its url when that held more than the link.
+func shareText(req api.CreateJobRequest, link string) string {
+	text := strings.TrimSpace(req.Text)
+	if text == "" {
+		text = strings.TrimSpace(req.URL)
+	}
+	// Postgres text cannot hold NUL.
+	text = strings.ReplaceAll(text, "\x00", "")
+	if text == link {
+		return ""
+	}
+	if runes := []rune(text); len(runes) > maxShareTextRunes {
+		text = string(runes[:maxShareTextRunes])
+	}
+	return text
+}
+
+const errStrictURL = "url must be a single http or https url"
+
+// isStrictURL reports whether input is exactly one absolute http or https
+// URL, with nothing around it, for requests with strict_url.
+func isStrictURL(input string) bool {
+	if input == "" || strings.IndexFunc(input, unicode.IsSpace) >= 0 || !isHTTPURL(input) {
+		return false
+	}
+	u, err := url.Parse(input)
+	return err == nil && u.Host != ""
+}
+
 func isHTTPURL(raw string) bool {
 	u, err := url.Parse(raw)
 	if err != nil {
@@ -449,36 +3198,66 @@ func isHTTPURL(raw string) bool {
 	return u.Scheme == "http" || u.Scheme == "https"
 }
 
-func objectKeyFromURL(raw, bucket string) (string, bool) {
+// objectKeyFromURL extracts the object key from a URL into bucket, however
+// it was stored: virtual-host style (bucket.host/key) or path-style
+// (host/bucket/key). For a URL on one of endpoints, the endpoint's own path
+// (a public endpoint behind a proxy or CDN) is stripped before the bucket.
+// The query string of presigned URLs is ignored.
+func objectKeyFromURL(raw, bucket string, endpoints ...string) (string, bool) {
 	if strings.TrimSpace(bucket) == "" {
 		return "", false
 	}
 	u, err := url.Parse(raw)
-	if err != nil {
+	if err != nil || u.Host == "" {
 		return "", false
 	}
+	host := strings.ToLower(u.Host)
 	path := strings.TrimPrefix(u.Path, "/")
-	if strings.HasPrefix(u.Host, bucket+".") {
-		if path == "" {
-			return "", false
+	if strings.HasPrefix(host, strings.ToLower(bucket)+".") {
+		return path, path != ""
+	}
+	for _, endpoint := range endpoints {
+		e, ok := parseEndpoint(endpoint)
+		if !ok || !strings.EqualFold(e.Host, host) {
+			continue
+		}
+		if prefix := strings.Trim(e.Path, "/"); prefix != "" {
+			if rest, ok := strings.CutPrefix(path, prefix+"/"); ok {
+				path = rest
+				break
+			}
 		}
-		return path, true
 	}
-	parts := strings.SplitN(path, "/", 2)
-	if len(parts) == 2 && parts[0] == bucket {
-		return parts[1], true
+	if key, ok := strings.CutPrefix(path, bucket+"/"); ok {
+		return key, key != ""
 	}
 	return "", false
 }
 
-func mp3URLForJob(ctx context.Context, cfg config.Config, s3 *storage.S3Client, j store.Job) (*string, error) {
+// parseEndpoint parses an S3 endpoint setting, which may omit the scheme.
+func parseEndpoint(raw string) (*url.URL, bool) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, false
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, false
+	}
+	return u, true
+}
+
+func mp3URLForJob(ctx context.Context, cfg config.Config, s3 storage.Storage, j store.Job) (*string, error) {
 	if !j.MP3URL.Valid || strings.TrimSpace(j.MP3URL.String) == "" {
 		return nil, nil
 	}
 	raw := strings.TrimSpace(j.MP3URL.String)
 	key := raw
-	if isHTTPURL(raw) {
-		if parsedKey, ok := objectKeyFromURL(raw, cfg.S3Bucket); ok {
+	if !cfg.MP3KeysOnly && isHTTPURL(raw) {
+		if parsedKey, ok := objectKeyFromURL(raw, cfg.S3Bucket, cfg.S3PublicEndpoint, cfg.S3Endpoint); ok {
 			key = parsedKey
 		} else {
 			return &raw, nil
@@ -491,45 +3270,289 @@ func mp3URLForJob(ctx context.Context, cfg config.Config, s3 *storage.S3Client,
 	return &signed, nil
 }
 
-func mp3DownloadURLForJob(ctx context.Context, cfg config.Config, s3 *storage.S3Client, j store.Job) (*string, error) {
+func mp3DownloadURLForJob(ctx context.Context, cfg config.Config, s3 storage.Storage, j store.Job, filename string) (*string, error) {
 	if !j.MP3URL.Valid || strings.TrimSpace(j.MP3URL.String) == "" {
 		return nil, nil
 	}
 	raw := strings.TrimSpace(j.MP3URL.String)
 	key := raw
-	if isHTTPURL(raw) {
-		if parsedKey, ok := objectKeyFromURL(raw, cfg.S3Bucket); ok {
+	if !cfg.MP3KeysOnly && isHTTPURL(raw) {
+		if parsedKey, ok := objectKeyFromURL(raw, cfg.S3Bucket, cfg.S3PublicEndpoint, cfg.S3Endpoint); ok {
 			key = parsedKey
 		} else {
 			return &raw, nil
 		}
 	}
-	filename := fmt.Sprintf("video2mp3-%s.mp3", j.ID)
-	signed, err := s3.PresignMP3Download(ctx, key, cfg.MP3URLTTL, filename)
+	output := jobOptions(j).Output()
+	signed, err := s3.PresignMP3Download(ctx, key, cfg.MP3URLTTL, downloadFilename(j, output, filename), output.ContentType)
 	if err != nil {
 		return nil, err
 	}
 	return &signed, nil
 }
 
-func authMiddleware(token string, next http.Handler) http.Handler {
-	if strings.TrimSpace(token) == "" {
+const requestIDHeader = "X-Request-ID"
+
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// requestIDMiddleware takes the caller's X-Request-ID (or generates a UUID),
+// echoes it in the response and attaches it to the request context, both for
+// storing on new jobs and for log lines.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSpace(r.Header.Get(requestIDHeader))
+		if !requestIDRe.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		ctx = logging.With(ctx, "request_id", id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func authMiddleware(tokens *apiTokens, signer adminSigner, next http.Handler) http.Handler {
+	if tokens.active == "" {
 		return next
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
-		if path == "/healthz" {
+		if path == "/healthz" || path == "/readyz" || path == "/metrics" || path == "/openapi.json" || strings.HasPrefix(path, storage.LocalFilesPath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get(signatureHeader) != "" && strings.HasPrefix(path, "/admin/") {
+			if err := signer.verify(r); err != nil {
+				writeJSON(w, http.StatusUnauthorized, api.ErrorResponse{Error: "invalid signature: " + err.Error()})
+				return
+			}
 			next.ServeHTTP(w, r)
 			return
 		}
-		if !isAuthorized(r, token) {
-			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "unauthorized"})
+		ok, deprecated := tokens.authorize(r)
+		if !ok {
+			writeJSON(w, http.StatusUnauthorized, api.ErrorResponse{Error: "unauthorized"})
 			return
 		}
+		if deprecated {
+			tokens.warnDeprecated(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiTokens are the tokens the API accepts: API_TOKEN and, while clients
+// migrate after a rotation, the deprecated PREVIOUS_API_TOKENS. Deprecated
+// tokens work exactly like the active one but each use is counted, and
+// logged at most once a minute per token. All of them act as one owner, so
+// jobs, quotas and defaults survive a rotation.
+type apiTokens struct {
+	active   string
+	previous []string
+	owner    string
+
+	mu       sync.Mutex
+	lastWarn map[string]time.Time
+}
+
+// newAPITokens returns the accepted tokens. owner is API_TOKEN_OWNER; when
+// empty the tokens are attributed to the owner of the active token.
+func newAPITokens(active, previous, owner string) *apiTokens {
+	t := &apiTokens{active: strings.TrimSpace(active), owner: strings.TrimSpace(owner), lastWarn: make(map[string]time.Time)}
+	if t.owner == "" && t.active != "" {
+		t.owner = tokenOwner(t.active)
+	}
+	for _, part := range strings.Split(previous, ",") {
+		if part = strings.TrimSpace(part); part != "" && part != t.active {
+			t.previous = append(t.previous, part)
+		}
+	}
+	return t
+}
+
+// authorize reports whether r presents an accepted token, checking the
+// active one first, and whether the match was a deprecated token.
+func (t *apiTokens) authorize(r *http.Request) (ok, deprecated bool) {
+	if isAuthorized(r, t.active) {
+		return true, false
+	}
+	for _, token := range t.previous {
+		if isAuthorized(r, token) {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+func (t *apiTokens) warnDeprecated(r *http.Request) {
+	metrics.DeprecatedTokenRequests.Inc()
+	// Identify the deprecated token itself, not the owner it shares.
+	owner := tokenOwner(presentedToken(r))
+	now := time.Now()
+	t.mu.Lock()
+	if now.Sub(t.lastWarn[owner]) < time.Minute {
+		t.mu.Unlock()
+		return
+	}
+	t.lastWarn[owner] = now
+	t.mu.Unlock()
+	slog.WarnContext(r.Context(), "deprecated API token used, switch to API_TOKEN", "owner", owner, "path", r.URL.Path)
+}
+
+// presentedToken returns the API token sent with the request, if any.
+func presentedToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key := r.Header.Get("X-API-KEY"); key != "" {
+		return key
+	}
+	if r.URL != nil {
+		return r.URL.Query().Get("token")
+	}
+	return ""
+}
+
+const anonymousOwner = "anonymous"
+
+type ownerKey struct{}
+
+// ownerMiddleware attributes requests presenting an accepted token to the
+// tokens' shared owner (see requestOwner).
+func ownerMiddleware(tokens *apiTokens, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tokens.active != "" && presentedToken(r) != "" {
+			if ok, _ := tokens.authorize(r); ok {
+				r = r.WithContext(context.WithValue(r.Context(), ownerKey{}, tokens.owner))
+			}
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
+// requestOwner identifies the caller so usage can be attributed without
+// storing its token: the owner of the configured tokens when it presented
+// one of them, otherwise a hash of the token it sent.
+func requestOwner(r *http.Request) string {
+	if owner, ok := r.Context().Value(ownerKey{}).(string); ok {
+		return owner
+	}
+	return tokenOwner(presentedToken(r))
+}
+
+func tokenOwner(token string) string {
+	if token == "" {
+		return anonymousOwner
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "tok_" + hex.EncodeToString(sum[:8])
+}
+
+const (
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+)
+
+// adminSigner verifies HMAC-signed admin requests. Each admin endpoint has its
+// own secret, so automation can be given e.g. cleanup rights without the API
+// token.
+type adminSigner struct {
+	secrets map[string][]byte
+	maxSkew time.Duration
+}
+
+// parseSigningSecrets parses ADMIN_SIGNING_SECRETS ("cleanup=secret,usage=secret").
+func parseSigningSecrets(raw string) (map[string][]byte, error) {
+	secrets := make(map[string][]byte)
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, secret, ok := strings.Cut(part, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.TrimSpace(secret) == "" {
+			return nil, fmt.Errorf("invalid entry %q, want endpoint=secret", part)
+		}
+		secrets[name] = []byte(strings.TrimSpace(secret))
+	}
+	return secrets, nil
+}
+
+// verify checks X-Signature, the hex HMAC-SHA256 of
+// "METHOD\nPATH\nTIMESTAMP\nBODY" keyed with the endpoint's secret, and rejects
+// timestamps outside maxSkew to limit replay. The body is restored for the
+// handler.
+func (s adminSigner) verify(r *http.Request) error {
+	endpoint := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/")
+	secret, ok := s.secrets[endpoint]
+	if !ok {
+		return errors.New("signing not enabled for this endpoint")
+	}
+	ts, err := strconv.ParseInt(r.Header.Get(signatureTimestampHeader), 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid timestamp")
+	}
+	skew := time.Since(time.Unix(ts, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > s.maxSkew {
+		return errors.New("stale timestamp")
+	}
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			return errors.New("failed to read body")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	sig, err := hex.DecodeString(r.Header.Get(signatureHeader))
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n", r.Method, r.URL.Path, ts)
+	mac.Write(body)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// ownerDefaults returns the owner's saved default options, or zero options
+// when nothing is saved.
+func ownerDefaults(ctx context.Context, st *store.Store, owner string) (jobs.Options, error) {
+	var defaults jobs.Options
+	if owner == anonymousOwner {
+		return defaults, nil
+	}
+	raw, err := st.GetOwnerSettings(ctx, owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return defaults, nil
+	}
+	if err != nil {
+		return defaults, err
+	}
+	err = json.Unmarshal(raw, &defaults)
+	return defaults, err
+}
+
+func parseTimeParam(raw string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", raw, time.Local)
+}
+
 func isAuthorized(r *http.Request, token string) bool {
 	if token == "" {
 		return true
@@ -549,14 +3572,14 @@ func isAuthorized(r *http.Request, token string) bool {
 	return false
 }
 
-func corsMiddleware(allowOrigins string, next http.Handler) http.Handler {
-	if strings.TrimSpace(allowOrigins) == "" {
+func corsMiddleware(cfg config.Config, next http.Handler) http.Handler {
+	if strings.TrimSpace(cfg.CORSAllowOrigins) == "" {
 		return next
 	}
 
 	allowAll := false
 	allowed := map[string]struct{}{}
-	for _, part := range strings.Split(allowOrigins, ",") {
+	for _, part := range strings.Split(cfg.CORSAllowOrigins, ",") {
 		origin := strings.TrimSpace(part)
 		if origin == "" {
 			continue
@@ -567,19 +3590,49 @@ func corsMiddleware(allowOrigins string, next http.Handler) http.Handler {
 		}
 		allowed[origin] = struct{}{}
 	}
+	allowAnyHeader := false
+	allowedHeaders := map[string]struct{}{}
+	for _, part := range strings.Split(cfg.CORSAllowHeaders, ",") {
+		header := strings.TrimSpace(part)
+		if header == "*" {
+			allowAnyHeader = true
+		} else if header != "" {
+			allowedHeaders[http.CanonicalHeaderKey(header)] = struct{}{}
+		}
+	}
+	maxAge := ""
+	if cfg.CORSMaxAge > 0 {
+		maxAge = strconv.Itoa(int(cfg.CORSMaxAge / time.Second))
+	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
 		if origin != "" && (allowAll || containsOrigin(allowed, origin)) {
-			if allowAll {
+			// A wildcard origin is not allowed with credentials, so the
+			// origin is echoed instead.
+			if allowAll && !cfg.CORSAllowCredentials {
 				w.Header().Set("Access-Control-Allow-Origin", "*")
 			} else {
 				w.Header().Set("Access-Control-Allow-Origin", origin)
 				w.Header().Add("Vary", "Origin")
 			}
-			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Authorization,Content-Type,X-API-KEY")
-			w.Header().Set("Access-Control-Expose-Headers", "Retry-After,X-RateLimit-Limit,X-RateLimit-Remaining")
+			if cfg.CORSAllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", cfg.CORSAllowMethods)
+			if preflight {
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+				if headers := allowedRequestHeaders(r, allowAnyHeader, allowedHeaders); headers != "" {
+					w.Header().Set("Access-Control-Allow-Headers", headers)
+				}
+				if maxAge != "" {
+					w.Header().Set("Access-Control-Max-Age", maxAge)
+				}
+			} else {
+				w.Header().Set("Access-Control-Allow-Headers", cfg.CORSAllowHeaders)
+			}
+			w.Header().Set("Access-Control-Expose-Headers", "ETag,X-Checksum-SHA256,Retry-After,X-RateLimit-Limit,X-RateLimit-Remaining,X-RateLimit-Reset,X-RateLimit-Window,X-RateLimit-Scope")
 		}
 
 		if r.Method == http.MethodOptions {
@@ -590,6 +3643,24 @@ func corsMiddleware(allowOrigins string, next http.Handler) http.Handler {
 	})
 }
 
+// allowedRequestHeaders returns the headers a preflight asked for in
+// Access-Control-Request-Headers that are allowed, in the order requested.
+func allowedRequestHeaders(r *http.Request, allowAny bool, allowed map[string]struct{}) string {
+	var out []string
+	for _, value := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, part := range strings.Split(value, ",") {
+			header := strings.TrimSpace(part)
+			if header == "" {
+				continue
+			}
+			if _, ok := allowed[http.CanonicalHeaderKey(header)]; ok || allowAny {
+				out = append(out, header)
+			}
+		}
+	}
+	return strings.Join(out, ",")
+}
+
 func containsOrigin(allowed map[string]struct{}, origin string) bool {
 	if len(allowed) == 0 {
 		return false
@@ -598,20 +3669,26 @@ func containsOrigin(allowed map[string]struct{}, origin string) bool {
 	return ok
 }
 
-func streamJobEvents(w http.ResponseWriter, r *http.Request, st *store.Store, s3 *storage.S3Client, cfg config.Config, id string) {
-	j, err := st.GetJob(r.Context(), id)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
-			return
-		}
-		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to load job"})
+// streamJobEvents sends the current job state over Server-Sent Events, then
+// every change until the job finishes (see jobStream).
+func streamJobEvents(w http.ResponseWriter, r *http.Request, st *store.Store, s3 storage.Storage, rdb *redis.Client, inspector *asynq.Inspector, cfg config.Config, shutdown <-chan struct{}, id string) {
+	stream, ok := openJobStream(w, r, st, rdb, id)
+	if !ok {
 		return
 	}
+	defer stream.close()
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "stream unsupported"})
+	if _, ok := w.(http.Flusher); !ok {
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "stream unsupported"})
+		return
+	}
+
+	j := stream.job
+	snapshot := r.URL.Query().Get("snapshot") == "true"
+	// A client reconnecting after it saw the final state has nothing left to
+	// receive; 204 stops an EventSource from reconnecting again.
+	if !snapshot && jobs.IsTerminal(j.Status) && j.UpdatedAt.UnixMicro() <= lastEventID(r) {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
@@ -622,65 +3699,347 @@ func streamJobEvents(w http.ResponseWriter, r *http.Request, st *store.Store, s3
 
 	resp, err := buildJobResponse(r.Context(), cfg, s3, j)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to sign mp3 url"})
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to sign mp3 url"})
+		return
+	}
+	resp.QueuePosition = queuePosition(r.Context(), inspector, cfg, j)
+	sink := newSSESink(r.Context(), w)
+	defer sink.close()
+	// A reconnecting client that already saw this state only gets newer events.
+	if snapshot || j.UpdatedAt.UnixMicro() > lastEventID(r) {
+		err = sink.send(j, resp)
+	} else {
+		err = sink.write(func() error { return nil })
+	}
+	if err != nil || snapshot || jobs.IsTerminal(j.Status) {
+		return
+	}
+
+	stream.run(r.Context(), shutdown, cfg, st, s3, sink)
+}
+
+// Bounds for SSE_POLL_INTERVAL and SSE_KEEPALIVE_INTERVAL, so a
+// misconfiguration cannot poll the database in a tight loop.
+const (
+	minSSEPollInterval      = 500 * time.Millisecond
+	minSSEKeepaliveInterval = time.Second
+	maxSSEInterval          = 5 * time.Minute
+)
+
+// jobSink is a transport job updates are pushed to.
+type jobSink interface {
+	send(j store.Job, resp api.Job) error
+	keepalive() error
+	// shutdown tells the client the server is going away and it should
+	// reconnect.
+	shutdown()
+}
+
+// sseWriteTimeout bounds each write to an SSE client, so a client that
+// stopped reading ends the stream instead of blocking it forever.
+const sseWriteTimeout = 10 * time.Second
+
+type sseSink struct {
+	ctx context.Context
+	w   http.ResponseWriter
+	rc  *http.ResponseController
+}
+
+func newSSESink(ctx context.Context, w http.ResponseWriter) sseSink {
+	return sseSink{ctx: ctx, w: w, rc: http.NewResponseController(w)}
+}
+
+// write runs fn and flushes its output, failing once the request is
+// cancelled, a write fails (e.g. a broken pipe) or the client does not take
+// the data within sseWriteTimeout.
+func (s sseSink) write(fn func() error) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	// Writers that cannot set deadlines leave the writes unbounded.
+	_ = s.rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+	if err := fn(); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// close clears the write deadline so it does not outlive the stream on a
+// kept-alive connection.
+func (s sseSink) close() {
+	_ = s.rc.SetWriteDeadline(time.Time{})
+}
+
+func (s sseSink) send(j store.Job, resp api.Job) error {
+	return s.write(func() error {
+		return emitJobUpdate(s.w, jobEventID(j.UpdatedAt), resp)
+	})
+}
+
+func (s sseSink) keepalive() error {
+	return s.write(func() error {
+		_, err := fmt.Fprint(s.w, ": keepalive\n\n")
+		return err
+	})
+}
+
+func (s sseSink) shutdown() {
+	// Tell the client to reconnect (to another instance) rather than
+	// treating the closed stream as an error.
+	_ = s.write(func() error {
+		return writeSSE(s.w, "", "shutdown", nil)
+	})
+}
+
+// jobStream follows one job for the live transports. The Redis subscription
+// is opened before the snapshot is read so no change in between is missed. If
+// Redis is unavailable the stream falls back to polling the database.
+type jobStream struct {
+	id      string
+	job     store.Job
+	sub     *redis.PubSub
+	updates <-chan *redis.Message
+}
+
+// openJobStream subscribes to the job's updates and loads its current state,
+// writing a 404 or 500 and returning false when the job cannot be loaded.
+func openJobStream(w http.ResponseWriter, r *http.Request, st *store.Store, rdb *redis.Client, id string) (*jobStream, bool) {
+	s := &jobStream{id: id, sub: rdb.Subscribe(r.Context(), events.Channel(id))}
+	if _, err := s.sub.Receive(r.Context()); err != nil {
+		slog.WarnContext(r.Context(), "job events subscribe failed, polling instead", "job_id", id, "err", err)
+	} else {
+		s.updates = s.sub.Channel()
+	}
+
+	j, err := st.GetJob(r.Context(), id)
+	if err != nil {
+		s.close()
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSON(w, http.StatusNotFound, api.ErrorResponse{Error: "not found"})
+			return nil, false
+		}
+		writeJSON(w, http.StatusInternalServerError, api.ErrorResponse{Error: "failed to load job"})
+		return nil, false
+	}
+	s.job = j
+	return s, true
+}
+
+func (s *jobStream) close() {
+	_ = s.sub.Close()
+}
+
+// run pushes every change after the snapshot to sink until the job finishes,
+// ctx ends, the server shuts down or the sink fails.
+func (s *jobStream) run(ctx context.Context, shutdown <-chan struct{}, cfg config.Config, st *store.Store, s3 storage.Storage, sink jobSink) {
+	j := s.job
+	var poll <-chan time.Time
+	if s.updates == nil {
+		ticker := time.NewTicker(cfg.SSEPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	keepalive := time.NewTicker(cfg.SSEKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		next := j
+		select {
+		case <-ctx.Done():
+			return
+		case <-shutdown:
+			sink.shutdown()
+			return
+		case <-keepalive.C:
+			if err := sink.keepalive(); err != nil {
+				return
+			}
+			continue
+		case msg, ok := <-s.updates:
+			if !ok {
+				return
+			}
+			u, err := events.Decode(msg.Payload)
+			if err != nil || !u.UpdatedAt.After(j.UpdatedAt) {
+				continue
+			}
+			next.Status = u.Status
+			next.Error = optionalString(u.Error)
+			next.ErrorCategory = optionalString(u.ErrorCategory)
+			next.MP3URL = optionalString(u.MP3Key)
+			if u.ProgressBytes != nil {
+				next.ProgressBytes = optionalInt64(u.ProgressBytes)
+				next.ProgressTotalBytes = optionalInt64(u.ProgressTotalBytes)
+			}
+			next.ETASeconds = optionalInt64(u.ETASeconds)
+			next.UpdatedAt = u.UpdatedAt
+		case <-poll:
+			var err error
+			next, err = st.GetJob(ctx, s.id)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return
+				}
+				continue
+			}
+			if !next.UpdatedAt.After(j.UpdatedAt) {
+				continue
+			}
+		}
+		j = next
+		resp, err := buildJobResponse(ctx, cfg, s3, j)
+		if err != nil {
+			continue
+		}
+		if err := sink.send(j, resp); err != nil {
+			return
+		}
+		if jobs.IsTerminal(j.Status) {
+			return
+		}
+	}
+}
+
+func optionalInt64(v *int64) sql.NullInt64 {
+	if v == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: *v, Valid: true}
+}
+
+func optionalString(v *string) sql.NullString {
+	if v == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: *v, Valid: true}
+}
+
+const staleHeader = "X-Data-Stale"
+
+// readCache keeps recently read jobs and job lists in memory so GET endpoints
+// can keep answering (flagged via staleHeader) while the database is briefly
+// unreachable. A nil cache is valid and stores nothing.
+type readCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	job      store.Job
+	list     []store.Job
+	storedAt time.Time
+}
+
+func newReadCache(ttl time.Duration, size int) *readCache {
+	if ttl <= 0 || size <= 0 {
+		return nil
+	}
+	return &readCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+func (c *readCache) job(id string) (store.Job, bool) {
+	e, ok := c.get("job:" + id)
+	return e.job, ok
+}
+
+func (c *readCache) list(key string) ([]store.Job, bool) {
+	e, ok := c.get("list:" + key)
+	return e.list, ok
+}
+
+func (c *readCache) putJob(j store.Job) {
+	c.put("job:"+j.ID, cacheEntry{job: j})
+}
+
+func (c *readCache) putList(key string, items []store.Job) {
+	c.put("list:"+key, cacheEntry{list: items})
+}
+
+// forgetJob drops a deleted job from the cache, including the cached lists
+// it appears in, so a stale answer never brings it back.
+func (c *readCache) forgetJob(id string) {
+	if c == nil {
 		return
 	}
-	if payload, err := json.Marshal(resp); err == nil {
-		_ = writeSSE(w, "", payload)
-		flusher.Flush()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, "job:"+id)
+	for key, e := range c.entries {
+		if !strings.HasPrefix(key, "list:") {
+			continue
+		}
+		isJob := func(j store.Job) bool { return j.ID == id }
+		if slices.ContainsFunc(e.list, isJob) {
+			e.list = slices.DeleteFunc(slices.Clone(e.list), isJob)
+			c.entries[key] = e
+		}
 	}
+}
 
-	if j.Status == jobs.StatusReady || j.Status == jobs.StatusFailed || j.Status == jobs.StatusExpired {
-		return
+func (c *readCache) get(key string) (cacheEntry, bool) {
+	if c == nil {
+		return cacheEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if time.Since(e.storedAt) > c.ttl {
+		delete(c.entries, key)
+		return cacheEntry{}, false
 	}
+	return e, true
+}
 
-	lastUpdated := j.UpdatedAt
-	ticker := time.NewTicker(3 * time.Second)
-	keepalive := time.NewTicker(15 * time.Second)
-	defer ticker.Stop()
-	defer keepalive.Stop()
+func (c *readCache) put(key string, e cacheEntry) {
+	if c == nil {
+		return
+	}
+	e.storedAt = time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.size {
+		c.evictOldestLocked()
+	}
+	c.entries[key] = e
+}
 
-	for {
-		select {
-		case <-r.Context().Done():
-			return
-		case <-keepalive.C:
-			_, _ = fmt.Fprint(w, ": keepalive\n\n")
-			flusher.Flush()
-		case <-ticker.C:
-			next, err := st.GetJob(r.Context(), id)
-			if err != nil {
-				if errors.Is(err, sql.ErrNoRows) {
-					return
-				}
-				continue
-			}
-			if !next.UpdatedAt.After(lastUpdated) && next.Status == j.Status {
-				continue
-			}
-			lastUpdated = next.UpdatedAt
-			j = next
-			resp, err := buildJobResponse(r.Context(), cfg, s3, j)
-			if err != nil {
-				continue
-			}
-			if payload, err := json.Marshal(resp); err == nil {
-				_ = writeSSE(w, "", payload)
-				flusher.Flush()
-			}
-			if j.Status == jobs.StatusReady || j.Status == jobs.StatusFailed || j.Status == jobs.StatusExpired {
-				return
-			}
+func (c *readCache) evictOldestLocked() {
+	var oldestKey string
+	var oldest time.Time
+	for key, e := range c.entries {
+		if oldestKey == "" || e.storedAt.Before(oldest) {
+			oldestKey = key
+			oldest = e.storedAt
 		}
 	}
+	delete(c.entries, oldestKey)
 }
 
+// rateLimitShards is how many independently locked maps the limiter spreads
+// its buckets over, so requests from different clients rarely contend.
+const rateLimitShards = 32
+
+// rateLimiter keeps a fixed-window counter per key. Expired buckets are swept
+// by run in the background, so allow only ever touches one bucket.
 type rateLimiter struct {
-	mu          sync.Mutex
-	limit       int
-	window      time.Duration
-	entries     map[string]*rateEntry
-	lastCleanup time.Time
+	limit  int
+	window time.Duration
+	seed   maphash.Seed
+	shards [rateLimitShards]rateShard
+}
+
+type rateShard struct {
+	mu      sync.Mutex
+	entries map[string]rateEntry
 }
 
 type rateEntry struct {
@@ -688,37 +4047,47 @@ type rateEntry struct {
 	reset time.Time
 }
 
-func rateLimitMiddleware(limit int, window time.Duration, next http.Handler) http.Handler {
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	rl := &rateLimiter{limit: limit, window: window, seed: maphash.MakeSeed()}
+	for i := range rl.shards {
+		rl.shards[i].entries = make(map[string]rateEntry)
+	}
+	return rl
+}
+
+func rateLimitMiddleware(ctx context.Context, limit int, window time.Duration, tokens *apiTokens, next http.Handler) http.Handler {
 	if limit <= 0 || window <= 0 {
 		return next
 	}
-	limiter := &rateLimiter{
-		limit:   limit,
-		window:  window,
-		entries: make(map[string]*rateEntry),
-	}
+	limiter := newRateLimiter(limit, window)
+	go limiter.run(ctx)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/healthz" {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == "/metrics" {
 			next.ServeHTTP(w, r)
 			return
 		}
-		if strings.HasSuffix(r.URL.Path, "/events") {
+		if strings.HasSuffix(r.URL.Path, "/events") || strings.HasSuffix(r.URL.Path, "/ws") {
 			next.ServeHTTP(w, r)
 			return
 		}
-		key := clientIP(r)
-		allowed, retryAfter, remaining := limiter.allow(key)
-		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
-		if remaining >= 0 {
-			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		key := rateLimitKey(r, tokens)
+		allowed, remaining, reset := limiter.allow(key)
+		scope := "ip"
+		if !strings.HasPrefix(key, "ip:") {
+			scope = "token"
 		}
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		w.Header().Set("X-RateLimit-Window", strconv.Itoa(int(window.Seconds())))
+		w.Header().Set("X-RateLimit-Scope", scope)
 		if !allowed {
-			seconds := int(retryAfter.Round(time.Second).Seconds())
+			seconds := int(time.Until(reset).Round(time.Second).Seconds())
 			if seconds < 1 {
 				seconds = 1
 			}
 			w.Header().Set("Retry-After", strconv.Itoa(seconds))
-			writeJSON(w, http.StatusTooManyRequests, rateLimitResponse{
+			writeJSON(w, http.StatusTooManyRequests, api.RateLimitResponse{
 				Error:      "rate limit exceeded",
 				RetryAfter: seconds,
 			})
@@ -728,45 +4097,65 @@ func rateLimitMiddleware(limit int, window time.Duration, next http.Handler) htt
 	})
 }
 
-func (rl *rateLimiter) allow(key string) (bool, time.Duration, int) {
-	if rl == nil || rl.limit <= 0 || rl.window <= 0 {
-		return true, 0, -1
+// rateLimitKey buckets requests by the hashed API token when a valid one is
+// presented (clients behind a shared NAT get separate limits) and by client
+// IP otherwise.
+func rateLimitKey(r *http.Request, tokens *apiTokens) string {
+	if tokens.active != "" && presentedToken(r) != "" {
+		if ok, _ := tokens.authorize(r); ok {
+			return requestOwner(r)
+		}
 	}
+	return "ip:" + clientIP(r)
+}
+
+// allow counts a request against key's bucket and reports whether it is
+// within the limit, the requests left in the window and when the window
+// resets. The remaining count is taken under the same lock as the increment.
+func (rl *rateLimiter) allow(key string) (bool, int, time.Time) {
 	now := time.Now()
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+	sh := &rl.shards[maphash.String(rl.seed, key)%rateLimitShards]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	entry := rl.entries[key]
-	if entry == nil || now.After(entry.reset) {
-		entry = &rateEntry{count: 0, reset: now.Add(rl.window)}
-		rl.entries[key] = entry
+	entry, ok := sh.entries[key]
+	if !ok || now.After(entry.reset) {
+		entry = rateEntry{reset: now.Add(rl.window)}
 	}
-
 	if entry.count >= rl.limit {
-		rl.cleanupLocked(now)
-		retryAfter := time.Until(entry.reset)
-		if retryAfter < 0 {
-			retryAfter = 0
-		}
-		return false, retryAfter, 0
+		return false, 0, entry.reset
 	}
-
 	entry.count++
-	remaining := rl.limit - entry.count
-	rl.cleanupLocked(now)
-	return true, 0, remaining
+	sh.entries[key] = entry
+	return true, rl.limit - entry.count, entry.reset
 }
 
-func (rl *rateLimiter) cleanupLocked(now time.Time) {
-	if now.Sub(rl.lastCleanup) < rl.window {
-		return
+// run sweeps expired buckets once per window until ctx is done, holding one
+// shard's lock at a time.
+func (rl *rateLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(rl.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			rl.sweep(now)
+		}
 	}
-	for key, entry := range rl.entries {
-		if now.After(entry.reset) {
-			delete(rl.entries, key)
+}
+
+func (rl *rateLimiter) sweep(now time.Time) {
+	for i := range rl.shards {
+		sh := &rl.shards[i]
+		sh.mu.Lock()
+		for key, entry := range sh.entries {
+			if now.After(entry.reset) {
+				delete(sh.entries, key)
+			}
 		}
+		sh.mu.Unlock()
 	}
-	rl.lastCleanup = now
 }
 
 func clientIP(r *http.Request) string {
@@ -794,33 +4183,493 @@ func clientIP(r *http.Request) string {
 	return "unknown"
 }
 
-func cleanupJobs(ctx context.Context, st *store.Store, s3 *storage.S3Client, cfg config.Config, before time.Time) (int64, int, error) {
+// cleanupJobs deletes jobs created before the cutoff in batches, removing
+// every object of a batch before its rows so a failure never leaves rows
+// pointing at deleted objects. With SOFT_DELETE the rows are only marked
+// deleted; rows marked more than PURGE_AFTER_DAYS ago are then removed.
+// statusRetentionDays returns how many days jobs in status are kept: its
+// RETENTION_<STATUS>_DAYS setting, or fallback when that is unset. Dead jobs
+// follow RETENTION_FAILED_DAYS. 0 keeps them forever.
+func statusRetentionDays(cfg config.Config, status string, fallback int) int {
+	days := 0
+	switch status {
+	case jobs.StatusReady:
+		days = cfg.RetentionReadyDays
+	case jobs.StatusFailed, jobs.StatusDead:
+		days = cfg.RetentionFailedDays
+	case jobs.StatusExpired:
+		days = cfg.RetentionExpiredDays
+	}
+	if days > 0 {
+		return days
+	}
+	return fallback
+}
+
+// hasRetention reports whether any status has a retention period, so that a
+// cleanup run could delete something.
+func hasRetention(cfg config.Config, fallback int) bool {
+	for _, status := range jobs.Statuses {
+		if statusRetentionDays(cfg, status, fallback) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanupJobs deletes jobs, and their objects, older than their status's
+// retention period; fallback is the period for statuses without their own.
+func cleanupJobs(ctx context.Context, st *store.Store, s3 storage.Storage, cfg config.Config, fallback int) (int64, int, int64, error) {
+	var deletedJobs, purgedJobs int64
+	var deletedObjects int
+	now := time.Now()
+	for _, status := range jobs.Statuses {
+		days := statusRetentionDays(cfg, status, fallback)
+		if days <= 0 {
+			continue
+		}
+		before := now.AddDate(0, 0, -days)
+		for {
+			items, err := st.ListJobsBeforeWithStatus(ctx, status, before, 200)
+			if err != nil {
+				return deletedJobs, deletedObjects, purgedJobs, err
+			}
+			if len(items) == 0 {
+				break
+			}
+			var keys []string
+			ids := make([]string, 0, len(items))
+			for _, j := range items {
+				keys = append(keys, jobObjectKeys(cfg, j)...)
+				ids = append(ids, j.ID)
+			}
+			deletedObjects += deleteObjects(ctx, s3, keys, cfg.CleanupConcurrency)
+			deleteJobs := st.DeleteJobsByID
+			if cfg.SoftDelete {
+				deleteJobs = st.SoftDeleteJobsByID
+			}
+			n, err := deleteJobs(ctx, ids)
+			if err != nil {
+				return deletedJobs, deletedObjects, purgedJobs, err
+			}
+			deletedJobs += n
+			if len(items) < 200 {
+				break
+			}
+		}
+	}
+	if cfg.PurgeAfterDays > 0 {
+		n, err := st.PurgeDeletedJobs(ctx, time.Now().AddDate(0, 0, -cfg.PurgeAfterDays))
+		if err != nil {
+			return deletedJobs, deletedObjects, purgedJobs, err
+		}
+		purgedJobs = n
+		if n > 0 {
+			slog.InfoContext(ctx, "soft-deleted jobs purged", "jobs", n)
+		}
+	}
+	if (purgedJobs > 0 || (deletedJobs > 0 && !cfg.SoftDelete)) && cfg.VacuumAfterCleanup {
+		maintainJobsTable(ctx, st, "vacuum")
+	}
+	return deletedJobs, deletedObjects, purgedJobs, nil
+}
+
+// maintainJobsTable runs ANALYZE or VACUUM (ANALYZE) on the jobs table and
+// logs the outcome; failures are not fatal to the caller.
+func maintainJobsTable(ctx context.Context, st *store.Store, op string) {
+	start := time.Now()
+	var err error
+	if op == "vacuum" {
+		err = st.VacuumJobs(ctx)
+	} else {
+		err = st.AnalyzeJobs(ctx)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "jobs table maintenance failed", "op", op, "err", err)
+		return
+	}
+	slog.InfoContext(ctx, "jobs table maintenance done", "op", op, "duration_ms", time.Since(start).Milliseconds())
+}
+
+// expireJobs deletes the objects of ready jobs completed before the given time
+// and marks them expired, keeping the rows as history. A job whose objects
+// could not all be deleted stays ready, so the next run retries it.
+func expireJobs(ctx context.Context, st *store.Store, s3 storage.Storage, cfg config.Config, before time.Time) (int64, int, error) {
+	var expiredJobs int64
 	var deletedObjects int
 	for {
-		items, err := st.ListJobsBefore(ctx, before, 200)
+		items, err := st.ListReadyJobsBefore(ctx, before, 200)
 		if err != nil {
-			return 0, deletedObjects, err
+			return expiredJobs, deletedObjects, err
 		}
 		if len(items) == 0 {
 			break
 		}
+		var keys []string
 		for _, j := range items {
-			key := objectKeyFromJob(cfg, j)
-			if key != "" {
-				if err := s3.DeleteObject(ctx, key); err == nil {
-					deletedObjects++
-				}
+			keys = append(keys, jobObjectKeys(cfg, j)...)
+		}
+		deleted, failed := deleteObjectsReport(ctx, s3, keys, cfg.CleanupConcurrency)
+		deletedObjects += deleted
+		ids := make([]string, 0, len(items))
+		for _, j := range items {
+			if !slices.ContainsFunc(jobObjectKeys(cfg, j), func(key string) bool { return failed[key] }) {
+				ids = append(ids, j.ID)
 			}
 		}
+		if len(ids) > 0 {
+			n, err := st.ExpireJobs(ctx, ids)
+			if err != nil {
+				return expiredJobs, deletedObjects, err
+			}
+			expiredJobs += n
+		}
+		// The jobs left ready would be listed again; leave them for the
+		// next run.
+		if len(ids) < len(items) {
+			slog.WarnContext(ctx, "jobs not expired, objects left", "jobs", len(items)-len(ids))
+			break
+		}
 		if len(items) < 200 {
 			break
 		}
 	}
-	deletedJobs, err := st.DeleteJobsBefore(ctx, before)
+	if expiredJobs > 0 {
+		slog.InfoContext(ctx, "jobs expired", "jobs", expiredJobs, "objects", deletedObjects)
+	}
+	return expiredJobs, deletedObjects, nil
+}
+
+// exportJobs streams every job as CSV or NDJSON. Rows are flushed per batch;
+// a failure after the first byte can only be logged and ends the body early.
+func exportJobs(w http.ResponseWriter, r *http.Request, st *store.Store, format string) {
+	const batch = 500
+	ext, contentType := "csv", "text/csv; charset=utf-8"
+	if format == "ndjson" {
+		ext, contentType = "ndjson", "application/x-ndjson"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "jobs-"+time.Now().UTC().Format("20060102-150405")+"."+ext))
+	flusher, _ := w.(http.Flusher)
+	var cw *csv.Writer
+	enc := json.NewEncoder(w)
+	if format == "csv" {
+		cw = csv.NewWriter(w)
+		_ = cw.Write(exportCSVHeader)
+	}
+	rows := 0
+	err := st.EachJob(r.Context(), batch, func(j store.Job) error {
+		rec := exportRecord{
+			JobID:       j.ID,
+			ClientJobID: nullStringPtr(j.ClientJobID),
+			SourceURL:   j.SourceURL,
+			Platform:    j.Platform,
+			Status:      j.Status,
+			Error:       nullStringPtr(j.Error),
+			Title:       nullStringPtr(j.Title),
+			Owner:       nullStringPtr(j.Owner),
+			CreatedAt:   j.CreatedAt.In(time.Local).Format(time.RFC3339),
+			UpdatedAt:   j.UpdatedAt.In(time.Local).Format(time.RFC3339),
+			CompletedAt: nullTimePtr(j.CompletedAt),
+		}
+		var err error
+		if cw != nil {
+			err = cw.Write(rec.csvRow())
+		} else {
+			err = enc.Encode(rec)
+		}
+		if err != nil {
+			return err
+		}
+		if rows++; rows%batch == 0 {
+			if cw != nil {
+				cw.Flush()
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if cw != nil {
+		cw.Flush()
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "job export failed", "rows", rows, "err", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "jobs exported", "format", format, "rows", rows)
+}
+
+func (e exportRecord) csvRow() []string {
+	str := func(p *string) string {
+		if p == nil {
+			return ""
+		}
+		return *p
+	}
+	return []string{e.JobID, str(e.ClientJobID), e.SourceURL, e.Platform, e.Status, str(e.Error), str(e.Title), str(e.Owner), e.CreatedAt, e.UpdatedAt, str(e.CompletedAt)}
+}
+
+const (
+	stallActionFail    = "fail"
+	stallActionRequeue = "requeue"
+)
+
+// recoverStalledJobs handles jobs stuck downloading or transcoding for longer
+// than STALL_THRESHOLD, typically because their worker died. Jobs whose task
+// asynq still holds live are skipped, since asynq recovers those itself. The
+// rest are failed with "stalled" or re-enqueued, per STALL_ACTION.
+func recoverStalledJobs(ctx context.Context, cfg config.Config, st *store.Store, client *asynq.Client, inspector *asynq.Inspector) error {
+	before := time.Now().Add(-cfg.StallThreshold)
+	items, err := st.ListStalledJobs(ctx, before, 100)
+	if err != nil {
+		return err
+	}
+	for _, j := range items {
+		if err := releaseStaleTask(inspector, j.ID, queue.Names(cfg.RetryQueue, cfg.QueueWeights)); err != nil {
+			if !errors.Is(err, errTaskInFlight) {
+				slog.WarnContext(ctx, "stalled job: inspect queue failed", "job_id", j.ID, "err", err)
+			}
+			continue
+		}
+		if cfg.StallAction == stallActionRequeue {
+			requeueStalledJob(ctx, cfg, st, client, j, before)
+			continue
+		}
+		msg := "stalled"
+		ok, err := st.ResetStalledJob(ctx, j.ID, jobs.StatusFailed, &msg, before)
+		if err != nil {
+			slog.ErrorContext(ctx, "mark stalled job failed", "job_id", j.ID, "err", err)
+			continue
+		}
+		if ok {
+			slog.WarnContext(ctx, "stalled job failed", "job_id", j.ID, "status", j.Status, "updated_at", j.UpdatedAt)
+		}
+	}
+	return nil
+}
+
+func requeueStalledJob(ctx context.Context, cfg config.Config, st *store.Store, client *asynq.Client, j store.Job, before time.Time) {
+	ok, err := st.ResetStalledJob(ctx, j.ID, jobs.StatusQueued, nil, before)
+	if err != nil || !ok {
+		if err != nil {
+			slog.ErrorContext(ctx, "requeue stalled job failed", "job_id", j.ID, "err", err)
+		}
+		return
+	}
+	task, err := queue.NewProcessTask(retryPayload(j, ""))
+	if err == nil {
+		_, err = client.Enqueue(task, enqueueOptions(cfg, cfg.RetryQueue, j.ID)...)
+	}
+	if err != nil && !isDuplicateTask(err) {
+		abandonJob(ctx, cfg, st, j.ID, false, err)
+		return
+	}
+	slog.WarnContext(ctx, "stalled job requeued", "job_id", j.ID, "status", j.Status, "updated_at", j.UpdatedAt)
+}
+
+// recoverOrphanedJobs enqueues jobs left queued for ORPHAN_MIN_AGE without a
+// task, e.g. because the API died between creating the row and enqueueing it,
+// or Redis was down and marking the job failed did not work either. Jobs whose
+// task asynq holds are left alone. Enqueue errors leave the job queued for
+// the next check.
+func recoverOrphanedJobs(ctx context.Context, cfg config.Config, st *store.Store, client *asynq.Client, inspector *asynq.Inspector) error {
+	const pageSize = 100
+	before := time.Now().Add(-cfg.OrphanMinAge)
+	// Jobs whose task is still waiting in the queue stay queued, so the scan
+	// pages past them instead of reading the same first rows every time.
+	var afterUpdated, afterID any
+	for {
+		items, err := st.ListQueuedJobsBefore(ctx, before, afterUpdated, afterID, pageSize)
+		if err != nil {
+			return err
+		}
+		for _, j := range items {
+			recoverOrphanedJob(ctx, cfg, st, client, inspector, j, before)
+		}
+		if len(items) < pageSize {
+			return nil
+		}
+		last := items[len(items)-1]
+		afterUpdated, afterID = last.UpdatedAt, last.ID
+	}
+}
+
+func recoverOrphanedJob(ctx context.Context, cfg config.Config, st *store.Store, client *asynq.Client, inspector *asynq.Inspector, j store.Job, before time.Time) {
+	if err := releaseStaleTask(inspector, j.ID, queue.Names(cfg.RetryQueue, cfg.QueueWeights)); err != nil {
+		if !errors.Is(err, errTaskInFlight) {
+			slog.WarnContext(ctx, "orphaned job: inspect queue failed", "job_id", j.ID, "err", err)
+		}
+		return
+	}
+	ok, err := st.ClaimQueuedJob(ctx, j.ID, before)
+	if err != nil || !ok {
+		if err != nil {
+			slog.ErrorContext(ctx, "claim orphaned job failed", "job_id", j.ID, "err", err)
+		}
+		return
+	}
+	task, err := queue.NewProcessTask(retryPayload(j, j.RequestID.String))
+	if err == nil {
+		_, err = client.Enqueue(task, enqueueOptions(cfg, jobQueue(cfg, jobOptions(j)), j.ID)...)
+	}
+	if err != nil && !isDuplicateTask(err) {
+		slog.ErrorContext(ctx, "enqueue orphaned job failed", "job_id", j.ID, "err", err)
+		return
+	}
+	slog.WarnContext(ctx, "orphaned job enqueued", "job_id", j.ID, "created_at", j.CreatedAt)
+}
+
+// objectJobIDRe finds the job id in an object key; S3_KEY_TEMPLATE always
+// contains {id} and job ids are UUIDs.
+var objectJobIDRe = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+
+// gcObjects deletes objects under the output and staging prefixes that were
+// last modified before the cutoff and that no job owns: the job row is gone,
+// or the job is finished and no longer references the key. Keys without a
+// job id and objects of unfinished jobs are left alone.
+func gcObjects(ctx context.Context, st *store.Store, s3 storage.Storage, cfg config.Config, before time.Time) (gcObjectsResponse, error) {
+	var resp gcObjectsResponse
+	prefixes := []string{queue.StagedUploadPrefix}
+	if p := storage.KeyTemplatePrefix(cfg.S3KeyTemplate); p == "" {
+		slog.WarnContext(ctx, "object gc skips outputs: S3_KEY_TEMPLATE has no fixed prefix")
+	} else if p != queue.StagedUploadPrefix {
+		prefixes = append(prefixes, p)
+	}
+	var batch []storage.ObjectInfo
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		orphans, err := orphanedKeys(ctx, st, cfg, batch)
+		batch = batch[:0]
+		if err != nil {
+			return err
+		}
+		resp.OrphanedObjects += len(orphans)
+		resp.DeletedObjects += deleteObjects(ctx, s3, orphans, cfg.CleanupConcurrency)
+		return nil
+	}
+	for _, prefix := range prefixes {
+		err := s3.ListObjects(ctx, prefix, func(obj storage.ObjectInfo) error {
+			resp.ScannedObjects++
+			if !obj.LastModified.Before(before) {
+				return nil
+			}
+			batch = append(batch, obj)
+			if len(batch) >= 200 {
+				return flush()
+			}
+			return nil
+		})
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			return resp, err
+		}
+	}
+	if resp.OrphanedObjects > 0 {
+		slog.InfoContext(ctx, "orphaned objects collected", "scanned", resp.ScannedObjects, "orphaned", resp.OrphanedObjects, "deleted", resp.DeletedObjects)
+	}
+	return resp, nil
+}
+
+// orphanedKeys returns the keys in objs that no job owns.
+func orphanedKeys(ctx context.Context, st *store.Store, cfg config.Config, objs []storage.ObjectInfo) ([]string, error) {
+	idOf := make(map[string]string, len(objs))
+	var ids []string
+	for _, obj := range objs {
+		id := objectJobIDRe.FindString(obj.Key)
+		if id == "" {
+			continue
+		}
+		idOf[obj.Key] = id
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	items, err := st.GetJobsByID(ctx, ids)
 	if err != nil {
-		return 0, deletedObjects, err
+		return nil, err
+	}
+	owned := make(map[string]bool)
+	active := make(map[string]bool)
+	for _, j := range items {
+		if !jobs.IsTerminal(j.Status) {
+			active[j.ID] = true
+			continue
+		}
+		for _, key := range jobObjectKeys(cfg, j) {
+			owned[key] = true
+		}
+	}
+	var orphans []string
+	for key, id := range idOf {
+		if !active[id] && !owned[key] {
+			orphans = append(orphans, key)
+		}
+	}
+	return orphans, nil
+}
+
+// jobObjectKeys lists every S3 object a job may own: the output, the cover and
+// the staged upload.
+func jobObjectKeys(cfg config.Config, j store.Job) []string {
+	var keys []string
+	if key := objectKeyFromJob(cfg, j); key != "" {
+		keys = append(keys, key)
+	}
+	if j.CoverKey.Valid && j.CoverKey.String != "" {
+		keys = append(keys, j.CoverKey.String)
+	}
+	// Uploads are staged here and, with RETAIN_SOURCE, downloaded sources
+	// are kept here too.
+	keys = append(keys, queue.StagedUploadKey(j.ID))
+	return keys
+}
+
+// deleteObjects removes keys with up to concurrency parallel requests and
+// returns how many were deleted. Failures are logged and not counted.
+func deleteObjects(ctx context.Context, s3 storage.Storage, keys []string, concurrency int) int {
+	deleted, _ := deleteObjectsReport(ctx, s3, keys, concurrency)
+	return deleted
+}
+
+// deleteObjectsReport is deleteObjects that also returns the keys whose
+// delete failed.
+func deleteObjectsReport(ctx context.Context, s3 storage.Storage, keys []string, concurrency int) (int, map[string]bool) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	deleted := 0
+	failed := map[string]bool{}
+	slots := make(chan struct{}, concurrency)
+	for _, key := range keys {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			err := s3.DeleteObject(ctx, key)
+			if err != nil {
+				slog.WarnContext(ctx, "delete object failed", "key", key, "err", err)
+			}
+			mu.Lock()
+			if err != nil {
+				failed[key] = true
+			} else {
+				deleted++
+			}
+			mu.Unlock()
+		}(key)
 	}
-	return deletedJobs, deletedObjects, nil
+	wg.Wait()
+	return deleted, failed
 }
 
 func objectKeyFromJob(cfg config.Config, j store.Job) string {
@@ -828,11 +4677,114 @@ func objectKeyFromJob(cfg config.Config, j store.Job) string {
 		return ""
 	}
 	raw := strings.TrimSpace(j.MP3URL.String)
-	if isHTTPURL(raw) {
-		if parsedKey, ok := objectKeyFromURL(raw, cfg.S3Bucket); ok {
+	if !cfg.MP3KeysOnly && isHTTPURL(raw) {
+		if parsedKey, ok := objectKeyFromURL(raw, cfg.S3Bucket, cfg.S3PublicEndpoint, cfg.S3Endpoint); ok {
 			return parsedKey
 		}
 		return ""
 	}
 	return raw
 }
+
+// mp3KeyCandidates lists the object keys a job's output may be stored under,
+// most likely first: the key objectKeyFromJob derives for presigning and
+// cleanup, the path of a URL on an endpoint that is no longer configured
+// (with and without the bucket), and the key S3_KEY_TEMPLATE gives the job.
+func mp3KeyCandidates(cfg config.Config, j store.Job) []string {
+	var keys []string
+	add := func(key string) {
+		if key != "" && !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	add(objectKeyFromJob(cfg, j))
+	if raw := strings.TrimSpace(j.MP3URL.String); isHTTPURL(raw) {
+		if u, err := url.Parse(raw); err == nil {
+			path := strings.TrimPrefix(u.Path, "/")
+			if key, ok := strings.CutPrefix(path, cfg.S3Bucket+"/"); ok {
+				add(key)
+			}
+			add(path)
+		}
+	}
+	// Workers date keys by the job's creation; older ones used the time the
+	// output was stored, close to its completion.
+	completed := j.UpdatedAt
+	if j.CompletedAt.Valid {
+		completed = j.CompletedAt.Time
+	}
+	for _, t := range []time.Time{j.CreatedAt, completed} {
+		add(storage.ExpandKey(cfg.S3KeyTemplate, storage.KeyVars{
+			JobID:    j.ID,
+			Platform: j.Platform,
+			Ext:      jobOptions(j).Output().Ext,
+			Time:     t,
+		}))
+	}
+	return keys
+}
+
+// repairMP3URLs rewrites the mp3_url of ready jobs stored as full URLs to the
+// bare key of an object that exists, so they presign against the current
+// endpoint. Jobs already storing a key are skipped; jobs whose object is
+// found under no candidate key are counted missing and left alone.
+func repairMP3URLs(ctx context.Context, st *store.Store, s3 storage.Storage, cfg config.Config) (repairURLsResponse, error) {
+	var resp repairURLsResponse
+	err := st.EachJob(ctx, 200, func(j store.Job) error {
+		if j.Status != jobs.StatusReady {
+			return nil
+		}
+		raw := strings.TrimSpace(j.MP3URL.String)
+		if !isHTTPURL(raw) {
+			resp.Skipped++
+			return nil
+		}
+		for _, key := range mp3KeyCandidates(cfg, j) {
+			_, err := s3.StatObject(ctx, key)
+			if errors.Is(err, storage.ErrObjectNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := st.UpdateJobMP3Key(ctx, j.ID, key); err != nil {
+				return err
+			}
+			resp.Repaired++
+			return nil
+		}
+		slog.WarnContext(ctx, "mp3_url repair found no object", "job_id", j.ID, "mp3_url", raw)
+		resp.Missing++
+		return nil
+	})
+	if resp.Repaired > 0 || resp.Missing > 0 {
+		slog.InfoContext(ctx, "mp3_url repair done", "repaired", resp.Repaired, "skipped", resp.Skipped, "missing", resp.Missing)
+	}
+	return resp, err
+}
+
+// normalizeMP3Keys rewrites mp3_url values stored as full URLs to bare object
+// keys. It is idempotent and runs at startup when MP3_KEYS_ONLY is set. URLs
+// that do not point into the bucket are left alone and logged.
+func normalizeMP3Keys(ctx context.Context, st *store.Store, cfg config.Config) error {
+	items, err := st.ListJobsWithMP3URLs(ctx)
+	if err != nil {
+		return err
+	}
+	rewritten := 0
+	for _, j := range items {
+		key, ok := objectKeyFromURL(strings.TrimSpace(j.MP3URL.String), cfg.S3Bucket, cfg.S3PublicEndpoint, cfg.S3Endpoint)
+		if !ok {
+			slog.Warn("mp3_url not in bucket, leaving as is", "job_id", j.ID, "bucket", cfg.S3Bucket)
+			continue
+		}
+		if err := st.UpdateJobMP3Key(ctx, j.ID, key); err != nil {
+			return err
+		}
+		rewritten++
+	}
+	if rewritten > 0 {
+		slog.Info("normalized mp3_url to object keys", "jobs", rewritten)
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"video2mp3/api"
+	"video2mp3/internal/jobs"
+)
+
+// apiOperation documents one operation of the HTTP API. apiOperations is the
+// one list of the public API: /openapi.json is generated from it, with JSON
+// schemas reflected from the same request and response types the handlers
+// use, and verifyRoutes checks at startup that the mux serves exactly these
+// operations.
+type apiOperation struct {
+	Method  string
+	Path    string
+	Summary string
+	// Request and Response are zero values of the JSON body types; nil
+	// means no JSON body.
+	Request  any
+	Response any
+	// Status is the success status (200 when zero).
+	Status int
+	// Content is the success media type for non-JSON responses.
+	Content string
+	Query   []apiParam
+	Headers []apiParam
+	Admin   bool
+}
+
+type apiParam struct {
+	Name        string
+	Description string
+}
+
+var apiOperations = []apiOperation{
+	{Method: http.MethodPost, Path: "/jobs", Summary: "Create a job from a link or a presigned upload", Request: api.CreateJobRequest{}, Response: api.CreateJobResponse{}, Status: http.StatusAccepted,
+		Headers: []apiParam{{"Idempotency-Key", "Repeat-safe submission key"}}},
+	{Method: http.MethodGet, Path: "/jobs", Summary: "List jobs", Response: api.ListJobsResponse{},
+		Query: []apiParam{{"limit", "Page size, default JOBS_LIST_DEFAULT_LIMIT (20), at most JOBS_LIST_MAX_LIMIT (100)"}, {"status", "Filter by status"}, {"platform", "Filter by platform"}, {"order_by", "Sort column"}, {"order", "asc or desc"},
+			{"ids", "Comma-separated job ids to fetch instead of listing (at most 100); missing ids are skipped"}}},
+	{Method: http.MethodPost, Path: "/jobs/validate", Summary: "Check a link and options without creating a job", Request: validateJobRequest{}, Response: validateJobResponse{}},
+	{Method: http.MethodGet, Path: "/jobs/active", Summary: "List unfinished jobs", Response: api.ListJobsResponse{}, Query: []apiParam{{"limit", "1-200, default 50"}}},
+	{Method: http.MethodPost, Path: "/jobs/upload", Summary: "Create a job from an uploaded file (multipart/form-data: options, file)", Response: api.CreateJobResponse{}, Status: http.StatusAccepted},
+	{Method: http.MethodPost, Path: "/uploads/presign", Summary: "Get a presigned PUT URL for a direct upload", Response: presignUploadResponse{}},
+	{Method: http.MethodGet, Path: "/jobs/{id}", Summary: "Get a job", Response: api.Job{}, Query: []apiParam{{"ttl", "Signed URL lifetime, up to MP3_URL_MAX_TTL"}}},
+	{Method: http.MethodDelete, Path: "/jobs/{id}", Summary: "Delete a finished job and its files", Status: http.StatusNoContent},
+	{Method: http.MethodGet, Path: "/jobs/{id}/download", Summary: "Download the output (proxied, redirected or X-Accel-Redirect per DOWNLOAD_MODE)", Content: "application/octet-stream",
+		Query: []apiParam{{"filename", "Attachment file name"}, {"ttl", "Signed URL lifetime in redirect mode, up to MP3_URL_MAX_TTL"}}},
+	{Method: http.MethodHead, Path: "/jobs/{id}/download", Summary: "Headers of the download without its body", Content: "application/octet-stream"},
+	{Method: http.MethodGet, Path: "/jobs/{id}/url", Summary: "Get a signed download URL as JSON instead of a redirect", Response: api.DownloadURLResponse{},
+		Query: []apiParam{{"filename", "Attachment file name"}, {"ttl", "Signed URL lifetime, up to MP3_URL_MAX_TTL"}}},
+	{Method: http.MethodPost, Path: "/jobs/{id}/retry", Summary: "Retry a failed or expired job", Response: api.CreateJobResponse{}, Status: http.StatusAccepted,
+		Query: []apiParam{{"fresh_parse", "true to bypass the parser cache"}}},
+	{Method: http.MethodGet, Path: "/jobs/{id}/metadata", Summary: "Get a job's technical metadata", Response: jobMetadataResponse{}},
+	{Method: http.MethodGet, Path: "/jobs/{id}/history", Summary: "List a job's status changes, oldest first", Response: jobHistoryResponse{}},
+	{Method: http.MethodPost, Path: "/jobs/{id}/retranscode", Summary: "Transcode a ready job again with other options", Request: jobs.Options{}, Response: api.CreateJobResponse{}, Status: http.StatusAccepted},
+	{Method: http.MethodGet, Path: "/jobs/{id}/events", Summary: "Stream job updates (Server-Sent Events)", Content: "text/event-stream",
+		Query: []apiParam{{"snapshot", "true to send the current state and close"}}},
+	{Method: http.MethodGet, Path: "/jobs/{id}/ws", Summary: "Stream job updates over a WebSocket (one job JSON text frame per change)", Status: http.StatusSwitchingProtocols},
+	{Method: http.MethodGet, Path: "/jobs/by-client/{client_job_id}", Summary: "Get a job by client_job_id", Response: api.Job{}},
+	{Method: http.MethodGet, Path: "/jobs/by-client/{client_job_id}/download", Summary: "Download the output of a job by client_job_id", Content: "application/octet-stream"},
+	{Method: http.MethodGet, Path: "/jobs/by-client/{client_job_id}/events", Summary: "Stream updates of a job by client_job_id (Server-Sent Events)", Content: "text/event-stream"},
+	{Method: http.MethodGet, Path: "/jobs/by-client/{client_job_id}/ws", Summary: "Stream updates of a job by client_job_id over a WebSocket", Status: http.StatusSwitchingProtocols},
+	{Method: http.MethodGet, Path: "/platforms", Summary: "List the platforms links are accepted from", Response: platformsResponse{}},
+	{Method: http.MethodPost, Path: "/platforms/detect", Summary: "Check which links are supported", Request: detectRequest{}, Response: detectResponse{}},
+	{Method: http.MethodGet, Path: "/settings", Summary: "Get the caller's default job options", Response: settingsResponse{}},
+	{Method: http.MethodPut, Path: "/settings", Summary: "Set the caller's default job options", Request: settingsResponse{}, Response: settingsResponse{}},
+	{Method: http.MethodPost, Path: "/admin/cleanup", Summary: "Delete old jobs and their files", Request: cleanupRequest{}, Response: cleanupResponse{}, Admin: true},
+	{Method: http.MethodPost, Path: "/admin/expire", Summary: "Expire ready jobs, keeping their rows", Request: expireRequest{}, Response: expireResponse{}, Admin: true},
+	{Method: http.MethodPost, Path: "/admin/requeue-failed", Summary: "Requeue failed and expired jobs in bulk", Request: requeueFailedRequest{}, Response: requeueFailedResponse{}, Status: http.StatusAccepted, Admin: true},
+	{Method: http.MethodPost, Path: "/admin/gc-objects", Summary: "Delete S3 objects no job owns", Request: gcObjectsRequest{}, Response: gcObjectsResponse{}, Admin: true},
+	{Method: http.MethodPost, Path: "/admin/purge-queue", Summary: "Delete the waiting tasks of an asynq queue", Request: purgeQueueRequest{}, Response: purgeQueueResponse{}, Admin: true},
+	{Method: http.MethodPost, Path: "/admin/repair-urls", Summary: "Rewrite stale mp3_url values to object keys", Response: repairURLsResponse{}, Admin: true},
+	{Method: http.MethodGet, Path: "/admin/export", Summary: "Export all jobs as CSV or NDJSON", Content: "text/csv", Query: []apiParam{{"format", "csv or ndjson"}}, Admin: true},
+	{Method: http.MethodPost, Path: "/admin/jobs/{id}/restore", Summary: "Undo a soft delete", Response: api.CreateJobResponse{}, Admin: true},
+	{Method: http.MethodGet, Path: "/admin/stats", Summary: "Job counts by status, queue depths and last-hour throughput", Response: statsResponse{}, Admin: true},
+	{Method: http.MethodGet, Path: "/admin/usage", Summary: "Usage per owner and platform", Response: usageResponse{}, Query: []apiParam{{"since", "RFC3339 or YYYY-MM-DD"}}, Admin: true},
+	{Method: http.MethodGet, Path: "/admin/worker-check", Summary: "Worker availability check state", Response: workerCheckResponse{}, Admin: true},
+	{Method: http.MethodPut, Path: "/admin/worker-check", Summary: "Toggle the worker check bypass", Request: workerCheckRequest{}, Response: workerCheckResponse{}, Admin: true},
+	{Method: http.MethodGet, Path: "/admin/workers", Summary: "Worker heartbeats, flagging stale workers", Response: workersResponse{}, Admin: true},
+	{Method: http.MethodGet, Path: "/healthz", Summary: "Liveness"},
+	{Method: http.MethodGet, Path: "/openapi.json", Summary: "This document", Content: "application/json"},
+	{Method: http.MethodGet, Path: "/readyz", Summary: "Readiness of Postgres, Redis and S3", Response: readinessResponse{}},
+}
+
+var pathParamRe = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// verifyRoutes fails when a documented operation is not served by its own
+// method and path pattern on mux, or a registered route is not documented,
+// so the document cannot drift from the registered handlers.
+func verifyRoutes(mux *routeMux, ops []apiOperation) error {
+	documented := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		route := op.Method + " " + op.Path
+		documented[route] = true
+		req, err := http.NewRequest(op.Method, pathParamRe.ReplaceAllString(op.Path, "x"), nil)
+		if err != nil {
+			return err
+		}
+		if pattern := mux.route(req); pattern != route {
+			return fmt.Errorf("documented route %s is not registered (served by %q)", route, pattern)
+		}
+	}
+	for _, route := range mux.registered() {
+		if !documented[route] {
+			return fmt.Errorf("route %s is not documented", route)
+		}
+	}
+	return nil
+}
+
+// openAPIDocument renders apiOperations as an OpenAPI 3 document.
+func openAPIDocument() ([]byte, error) {
+	schemas := make(map[string]any)
+	paths := make(map[string]map[string]any)
+	for _, op := range apiOperations {
+		if paths[op.Path] == nil {
+			paths[op.Path] = make(map[string]any)
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = openAPIOperation(op, schemas)
+	}
+	schemaOf(reflect.TypeOf(api.ErrorResponse{}), schemas)
+	doc := map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "video2mp3 API",
+			"version": "1",
+			"description": "Authenticate with `Authorization: Bearer <API_TOKEN>` or `X-API-KEY` when API_TOKEN is set. " +
+				"Admin routes also accept X-Signature/X-Signature-Timestamp HMAC signatures. " +
+				"Every response echoes X-Request-ID. With RATE_LIMIT_PER_MIN set, responses carry " +
+				"X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, X-RateLimit-Window and X-RateLimit-Scope " +
+				"and 429 responses carry Retry-After.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+				"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-KEY"},
+			},
+		},
+		"security": []any{map[string]any{"bearer": []string{}}, map[string]any{"apiKey": []string{}}},
+	}
+	return json.Marshal(doc)
+}
+
+func openAPIOperation(op apiOperation, schemas map[string]any) map[string]any {
+	out := map[string]any{"summary": op.Summary}
+	if op.Admin {
+		out["tags"] = []string{"admin"}
+	}
+	var params []any
+	for _, m := range pathParamRe.FindAllStringSubmatch(op.Path, -1) {
+		params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+	}
+	for _, q := range op.Query {
+		params = append(params, map[string]any{"name": q.Name, "in": "query", "description": q.Description, "schema": map[string]any{"type": "string"}})
+	}
+	for _, h := range op.Headers {
+		params = append(params, map[string]any{"name": h.Name, "in": "header", "description": h.Description, "schema": map[string]any{"type": "string"}})
+	}
+	params = append(params, map[string]any{"name": requestIDHeader, "in": "header", "description": "Caller-chosen request id", "schema": map[string]any{"type": "string"}})
+	out["parameters"] = params
+	if op.Request != nil {
+		out["requestBody"] = map[string]any{
+			"content": map[string]any{"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(op.Request), schemas)}},
+		}
+	}
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	switch {
+	case op.Response != nil:
+		success["content"] = map[string]any{"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(op.Response), schemas)}}
+	case op.Content != "":
+		success["content"] = map[string]any{op.Content: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}
+	}
+	errRef := map[string]any{"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/ErrorResponse"}}}
+	out["responses"] = map[string]any{
+		strconv.Itoa(status): success,
+		"429":                map[string]any{"description": "Rate limit or daily quota exceeded", "headers": map[string]any{"Retry-After": map[string]any{"schema": map[string]any{"type": "integer"}}}},
+		"default":            map[string]any{"description": "Error", "content": errRef},
+	}
+	return out
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf returns the JSON schema of t as encoding/json would marshal it.
+// Named structs are added to schemas once and referenced.
+func schemaOf(t reflect.Type, schemas map[string]any) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = nil // placeholder for recursive types
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		return structSchema(t, schemas)
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	default:
+		return map[string]any{}
+	}
+}
+
+func structSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	props := make(map[string]any)
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				addFields(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = schemaOf(f.Type, schemas)
+			if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+	out := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		out["required"] = required
+	}
+	return out
+}
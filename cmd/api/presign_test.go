@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"video2mp3/internal/config"
+	"video2mp3/internal/jobs"
+	"video2mp3/internal/store"
+)
+
+// slowPresignStorage adds a fixed delay to every presign, standing in for the
+// signing and bucket-location round trips of a real S3 client.
+type slowPresignStorage struct {
+	*fakeStorage
+	delay time.Duration
+	fail  string
+}
+
+func (s *slowPresignStorage) PresignMP3(ctx context.Context, objectKey string, expiry time.Duration) (string, error) {
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	if objectKey == s.fail {
+		return "", errors.New("presign failed")
+	}
+	return s.fakeStorage.PresignMP3(ctx, objectKey, expiry)
+}
+
+func readyJobs(n int) []store.Job {
+	items := make([]store.Job, n)
+	for i := range items {
+		items[i] = store.Job{
+			ID:     fmt.Sprintf("job%d", i),
+			Status: jobs.StatusReady,
+			MP3URL: sql.NullString{String: fmt.Sprintf("mp3/job%d.mp3", i), Valid: true},
+		}
+	}
+	return items
+}
+
+func TestBuildJobResponses(t *testing.T) {
+	ctx := context.Background()
+	items := readyJobs(20)
+	for _, concurrency := range []int{1, 8} {
+		cfg := config.Config{MP3KeysOnly: true, PresignConcurrency: concurrency}
+		t.Run(fmt.Sprint(concurrency), func(t *testing.T) {
+			s3 := &slowPresignStorage{fakeStorage: newFakeStorage(), delay: time.Millisecond}
+			out, err := buildJobResponses(ctx, cfg, s3, items)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, j := range out {
+				want := "https://storage.test/mp3/job" + fmt.Sprint(i) + ".mp3"
+				if j.JobID != items[i].ID || j.MP3URL == nil || *j.MP3URL != want {
+					t.Fatalf("response %d = %s %v, want %s %s", i, j.JobID, j.MP3URL, items[i].ID, want)
+				}
+			}
+
+			s3.fail = "mp3/job13.mp3"
+			if out, err := buildJobResponses(ctx, cfg, s3, items); err == nil {
+				t.Errorf("presign failure ignored, got %d responses", len(out))
+			}
+		})
+	}
+}
+
+// BenchmarkBuildJobResponses compares serial and parallel presigning of a
+// full page of jobs.
+func BenchmarkBuildJobResponses(b *testing.B) {
+	ctx := context.Background()
+	items := readyJobs(100)
+	s3 := &slowPresignStorage{fakeStorage: newFakeStorage(), delay: 200 * time.Microsecond}
+	for _, concurrency := range []int{1, 8, 32} {
+		cfg := config.Config{MP3KeysOnly: true, PresignConcurrency: concurrency}
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := buildJobResponses(ctx, cfg, s3, items); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
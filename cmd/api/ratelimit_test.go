@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	rl := newRateLimiter(2, 50*time.Millisecond)
+	for i, want := range []struct {
+		allowed   bool
+		remaining int
+	}{{true, 1}, {true, 0}, {false, 0}} {
+		allowed, remaining, _ := rl.allow("ip:a")
+		if allowed != want.allowed || remaining != want.remaining {
+			t.Errorf("request %d = %v, %d; want %v, %d", i+1, allowed, remaining, want.allowed, want.remaining)
+		}
+	}
+	if allowed, _, _ := rl.allow("ip:b"); !allowed {
+		t.Error("another key shares the exhausted bucket")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if allowed, remaining, _ := rl.allow("ip:a"); !allowed || remaining != 1 {
+		t.Errorf("after the window = %v, %d; want a fresh bucket", allowed, remaining)
+	}
+	rl.sweep(time.Now())
+	if n := rateLimiterSize(rl); n != 1 {
+		t.Errorf("%d buckets after sweep, want only the live one", n)
+	}
+}
+
+func rateLimiterSize(rl *rateLimiter) int {
+	n := 0
+	for i := range rl.shards {
+		sh := &rl.shards[i]
+		sh.mu.Lock()
+		n += len(sh.entries)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// lockedLimiter is the limiter as it was before sharding: one lock, with
+// expired buckets swept inline by whichever request is first past the window.
+type lockedLimiter struct {
+	mu          sync.Mutex
+	limit       int
+	window      time.Duration
+	entries     map[string]*rateEntry
+	lastCleanup time.Time
+}
+
+func (rl *lockedLimiter) allow(key string) (bool, int, time.Time) {
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	entry := rl.entries[key]
+	if entry == nil || now.After(entry.reset) {
+		entry = &rateEntry{reset: now.Add(rl.window)}
+		rl.entries[key] = entry
+	}
+	if now.Sub(rl.lastCleanup) >= rl.window {
+		for k, e := range rl.entries {
+			if now.After(e.reset) {
+				delete(rl.entries, k)
+			}
+		}
+		rl.lastCleanup = now
+	}
+	if entry.count >= rl.limit {
+		return false, 0, entry.reset
+	}
+	entry.count++
+	return true, rl.limit - entry.count, entry.reset
+}
+
+// BenchmarkRateLimiter reports the p99 latency of allow with many distinct
+// clients and a window short enough that sweeps happen during the run.
+func BenchmarkRateLimiter(b *testing.B) {
+	const clients = 100_000
+	const window = 20 * time.Millisecond
+	keys := make([]string, clients)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("ip:10.%d.%d.%d", i>>16, i>>8&0xff, i&0xff)
+	}
+
+	b.Run("sharded", func(b *testing.B) {
+		rl := newRateLimiter(60, window)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go rl.run(ctx)
+		benchmarkAllow(b, keys, rl.allow)
+	})
+	b.Run("single-lock", func(b *testing.B) {
+		rl := &lockedLimiter{limit: 60, window: window, entries: make(map[string]*rateEntry)}
+		benchmarkAllow(b, keys, rl.allow)
+	})
+}
+
+func benchmarkAllow(b *testing.B, keys []string, allow func(string) (bool, int, time.Time)) {
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var workers atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// Each goroutine strides through the keys from its own offset.
+		i := int(workers.Add(1)) * 104729
+		var local []time.Duration
+		for pb.Next() {
+			start := time.Now()
+			allow(keys[i%len(keys)])
+			local = append(local, time.Since(start))
+			i += 7919
+		}
+		mu.Lock()
+		latencies = append(latencies, local...)
+		mu.Unlock()
+	})
+	b.StopTimer()
+	if len(latencies) == 0 {
+		return
+	}
+	slices.Sort(latencies)
+	b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResourceRoutes(t *testing.T) {
+	routes := newResourceRoutes("/jobs/", "id")
+	stub := func(name string) func(http.ResponseWriter, *http.Request, string) {
+		return func(w http.ResponseWriter, r *http.Request, id string) {
+			w.Write([]byte(name + " " + id))
+		}
+	}
+	routes.handle(http.MethodGet, "", stub("get"))
+	routes.handle(http.MethodDelete, "", stub("delete"))
+	routes.handle(http.MethodGet, "download", stub("download"))
+	routes.handle(http.MethodHead, "download", stub("download"))
+	routes.handle(http.MethodGet, "events", stub("events"))
+	routes.handle(http.MethodPost, "retry", stub("retry"))
+
+	cases := []struct {
+		method, path string
+		code         int
+		body         string
+	}{
+		{http.MethodGet, "/jobs/abc", http.StatusOK, "get abc"},
+		{http.MethodDelete, "/jobs/abc", http.StatusOK, "delete abc"},
+		{http.MethodPut, "/jobs/abc", http.StatusMethodNotAllowed, ""},
+		{http.MethodHead, "/jobs/abc", http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, "/jobs/abc/download", http.StatusOK, "download abc"},
+		{http.MethodHead, "/jobs/abc/download", http.StatusOK, ""},
+		{http.MethodPost, "/jobs/abc/download", http.StatusMethodNotAllowed, ""},
+		{http.MethodHead, "/jobs/abc/events", http.StatusMethodNotAllowed, ""},
+		{http.MethodPost, "/jobs/abc/retry", http.StatusOK, "retry abc"},
+		{http.MethodGet, "/jobs/abc/retry", http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, "/jobs/abc/unknown", http.StatusNotFound, `{"error":"not found"}`},
+		{http.MethodPost, "/jobs/abc/unknown", http.StatusMethodNotAllowed, ""},
+
+		// Trailing slash.
+		{http.MethodGet, "/jobs/abc/", http.StatusNotFound, `{"error":"not found"}`},
+		{http.MethodPost, "/jobs/abc/", http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, "/jobs/abc/download/", http.StatusNotFound, `{"error":"not found"}`},
+
+		// Empty id.
+		{http.MethodGet, "/jobs/", http.StatusNotFound, `{"error":"not found"}`},
+		{http.MethodPost, "/jobs/", http.StatusNotFound, `{"error":"not found"}`},
+		{http.MethodGet, "/jobs//download", http.StatusNotFound, `{"error":"not found"}`},
+		{http.MethodPost, "/jobs//download", http.StatusMethodNotAllowed, ""},
+
+		// Embedded slash, literal or escaped.
+		{http.MethodGet, "/jobs/a/b", http.StatusNotFound, `{"error":"not found"}`},
+		{http.MethodGet, "/jobs/a/b/download", http.StatusNotFound, `{"error":"not found"}`},
+		{http.MethodPost, "/jobs/a/b/download", http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, "/jobs/a%2Fb/download", http.StatusNotFound, `{"error":"not found"}`},
+		{http.MethodPost, "/jobs/a%2Fb/retry", http.StatusNotFound, `{"error":"not found"}`},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest(c.method, c.path, nil))
+		if rec.Code != c.code {
+			t.Errorf("%s %s: status = %d, want %d", c.method, c.path, rec.Code, c.code)
+			continue
+		}
+		if got := rec.Body.String(); c.body != "" && got != c.body && got != c.body+"\n" {
+			t.Errorf("%s %s: body = %q, want %q", c.method, c.path, got, c.body)
+		}
+	}
+}
+
+// The by-client routes share the /jobs/ prefix with the job routes; both
+// must register on one mux without conflicting patterns.
+func TestJobAndClientRoutesRegister(t *testing.T) {
+	jobs := newResourceRoutes("/jobs/", "id")
+	jobs.handle(http.MethodGet, "", func(w http.ResponseWriter, r *http.Request, id string) { w.Write([]byte("job " + id)) })
+	jobs.handle(http.MethodGet, "download", func(w http.ResponseWriter, r *http.Request, id string) { w.Write([]byte("job download " + id)) })
+	clients := newResourceRoutes("/jobs/by-client/", "client_job_id")
+	clients.handle(http.MethodGet, "", func(w http.ResponseWriter, r *http.Request, id string) { w.Write([]byte("client " + id)) })
+	clients.handle(http.MethodGet, "download", func(w http.ResponseWriter, r *http.Request, id string) { w.Write([]byte("client download " + id)) })
+
+	mux := http.NewServeMux()
+	mux.Handle("/jobs/", jobs)
+	mux.Handle("/jobs/by-client/", clients)
+	mux.HandleFunc("/jobs/upload", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("upload")) })
+
+	for path, want := range map[string]string{
+		"/jobs/abc":                   "job abc",
+		"/jobs/abc/download":          "job download abc",
+		"/jobs/by-client/download":    "client download",
+		"/jobs/by-client/c1":          "client c1",
+		"/jobs/by-client/c1/download": "client download c1",
+		"/jobs/upload":                "upload",
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := rec.Body.String(); got != want {
+			t.Errorf("GET %s = %d %q, want %q", path, rec.Code, got, want)
+		}
+	}
+}
+
+func TestVerifyRoutes(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	build := func(extra func(m *routeMux, jobs *resourceRoutes)) *routeMux {
+		m := newRouteMux()
+		m.handle(http.MethodGet, "/jobs", ok)
+		jobs := newResourceRoutes("/jobs/", "id")
+		jobs.handle(http.MethodGet, "", func(w http.ResponseWriter, r *http.Request, id string) {})
+		jobs.handle(http.MethodPost, "retry", func(w http.ResponseWriter, r *http.Request, id string) {})
+		if extra != nil {
+			extra(m, jobs)
+		}
+		m.mount("/jobs/", jobs)
+		return m
+	}
+	ops := []apiOperation{
+		{Method: http.MethodGet, Path: "/jobs"},
+		{Method: http.MethodGet, Path: "/jobs/{id}"},
+		{Method: http.MethodPost, Path: "/jobs/{id}/retry"},
+	}
+
+	if err := verifyRoutes(build(nil), ops); err != nil {
+		t.Errorf("matching routes: %v", err)
+	}
+	cases := map[string]struct {
+		ops   []apiOperation
+		extra func(m *routeMux, jobs *resourceRoutes)
+	}{
+		"undocumented route": {ops, func(m *routeMux, jobs *resourceRoutes) {
+			m.handle(http.MethodPost, "/platforms", ok)
+		}},
+		"undocumented method": {ops, func(m *routeMux, jobs *resourceRoutes) {
+			m.handle(http.MethodPost, "/jobs", ok)
+		}},
+		"undocumented sub-resource": {ops, func(m *routeMux, jobs *resourceRoutes) {
+			jobs.handle(http.MethodPost, "cancel", func(w http.ResponseWriter, r *http.Request, id string) {})
+		}},
+		"missing method":       {append(ops, apiOperation{Method: http.MethodDelete, Path: "/jobs/{id}"}), nil},
+		"missing sub-resource": {append(ops, apiOperation{Method: http.MethodGet, Path: "/jobs/{id}/history"}), nil},
+		"wrong parameter name": {[]apiOperation{ops[0], {Method: http.MethodGet, Path: "/jobs/{job_id}"}, ops[2]}, nil},
+	}
+	for name, c := range cases {
+		if err := verifyRoutes(build(c.extra), c.ops); err == nil {
+			t.Errorf("%s: verifyRoutes passed", name)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"video2mp3/internal/storage"
+)
+
+const testBucket = "test-bucket"
+
+// objectServer is a read-only S3 endpoint for path-style keys in testBucket.
+// It answers GET and HEAD, honouring Range, and records the Range header of
+// every GET. Signatures are not checked.
+type objectServer struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	ranges  []string
+}
+
+// objectModTime is the LastModified of every served object.
+var objectModTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func newObjectServer(t *testing.T) (*objectServer, *storage.S3Client) {
+	t.Helper()
+	o := &objectServer{objects: map[string][]byte{}}
+	srv := httptest.NewServer(o)
+	t.Cleanup(srv.Close)
+	s3, err := storage.NewS3(srv.URL, "key", "secret", "us-east-1", testBucket, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o, s3
+}
+
+func (o *objectServer) put(key string, data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.objects[key] = data
+}
+
+// rangesRequested returns the Range headers of the GETs served so far.
+func (o *objectServer) rangesRequested() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string(nil), o.ranges...)
+}
+
+func (o *objectServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+testBucket+"/")
+	if !ok || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+		return
+	}
+	o.mu.Lock()
+	data, found := o.objects[key]
+	if r.Method == http.MethodGet {
+		o.ranges = append(o.ranges, r.Header.Get("Range"))
+	}
+	o.mu.Unlock()
+	if !found {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "audio/mpeg")
+	w.Header().Set("ETag", `"fake-etag"`)
+	http.ServeContent(w, r, key, objectModTime, bytes.NewReader(data))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"video2mp3/internal/storage"
+)
+
+// fakeStorage keeps objects in memory. Methods a test does not need are left
+// to the embedded nil interface and panic when called.
+type fakeStorage struct {
+	storage.Storage
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	// deleteErrs makes DeleteObject fail for the given keys.
+	deleteErrs map[string]error
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{objects: make(map[string][]byte), deleteErrs: make(map[string]error)}
+}
+
+// fakeModTime is the LastModified of every fake object.
+var fakeModTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func (s *fakeStorage) put(key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+}
+
+func (s *fakeStorage) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.objects[key]
+	return ok
+}
+
+func (s *fakeStorage) PutObject(ctx context.Context, objectKey string, r io.Reader, size int64, contentType string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.put(objectKey, data)
+	return nil
+}
+
+func (s *fakeStorage) OpenObject(ctx context.Context, objectKey string) (io.ReadSeekCloser, *storage.ObjectInfo, error) {
+	s.mu.Lock()
+	data, ok := s.objects[objectKey]
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil, storage.ErrObjectNotFound
+	}
+	return nopSeekCloser{bytes.NewReader(data)}, &storage.ObjectInfo{Key: objectKey, Size: int64(len(data)), LastModified: fakeModTime}, nil
+}
+
+func (s *fakeStorage) StatObject(ctx context.Context, objectKey string) (*storage.ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[objectKey]
+	if !ok {
+		return nil, storage.ErrObjectNotFound
+	}
+	return &storage.ObjectInfo{Key: objectKey, Size: int64(len(data)), LastModified: fakeModTime}, nil
+}
+
+func (s *fakeStorage) DeleteObject(ctx context.Context, objectKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.deleteErrs[objectKey]; err != nil {
+		return err
+	}
+	delete(s.objects, objectKey)
+	return nil
+}
+
+func (s *fakeStorage) ListObjects(ctx context.Context, prefix string, fn func(storage.ObjectInfo) error) error {
+	s.mu.Lock()
+	var infos []storage.ObjectInfo
+	for key, data := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, storage.ObjectInfo{Key: key, Size: int64(len(data)), LastModified: fakeModTime})
+		}
+	}
+	s.mu.Unlock()
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeStorage) PresignMP3(ctx context.Context, objectKey string, expiry time.Duration) (string, error) {
+	return "https://storage.test/" + objectKey, nil
+}
+
+func (s *fakeStorage) PresignCover(ctx context.Context, objectKey string, expiry time.Duration) (string, error) {
+	return "https://storage.test/" + objectKey, nil
+}
+
+func (s *fakeStorage) PresignPut(ctx context.Context, objectKey string, expiry time.Duration) (string, error) {
+	return "https://storage.test/" + objectKey + "?put", nil
+}
+
+func (s *fakeStorage) PresignMP3Download(ctx context.Context, objectKey string, expiry time.Duration, filename, contentType string) (string, error) {
+	return "https://storage.test/" + objectKey + "?download", nil
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
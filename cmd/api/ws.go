@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"video2mp3/api"
+	"video2mp3/internal/config"
+	"video2mp3/internal/jobs"
+	"video2mp3/internal/storage"
+	"video2mp3/internal/store"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+	"github.com/hibiken/asynq"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	// wsPongTimeout is how long a client may go without answering a ping
+	// (sent on every keepalive) before the connection is dropped.
+	wsPongTimeout = 45 * time.Second
+)
+
+// streamJobWebSocket is the WebSocket transport of streamJobEvents, for
+// clients behind proxies that buffer text/event-stream. Each text frame is
+// the job JSON; the server closes the connection once the job finishes.
+func streamJobWebSocket(w http.ResponseWriter, r *http.Request, st *store.Store, s3 storage.Storage, rdb *redis.Client, inspector *asynq.Inspector, cfg config.Config, shutdown <-chan struct{}, id string) {
+	stream, ok := openJobStream(w, r, st, rdb, id)
+	if !ok {
+		return
+	}
+	defer stream.close()
+
+	upgrader := websocket.Upgrader{CheckOrigin: wsOriginChecker(cfg.CORSAllowOrigins)}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already written the error response.
+		slog.InfoContext(r.Context(), "websocket upgrade failed", "job_id", id, "err", err)
+		return
+	}
+	defer conn.Close()
+
+	// The connection is hijacked, so the request context no longer tracks
+	// it; the read loop notices when the client closes or stops answering
+	// pings.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	sink := wsSink{conn: conn}
+	j := stream.job
+	resp, err := buildJobResponse(ctx, cfg, s3, j)
+	if err != nil {
+		sink.closeWith(websocket.CloseInternalServerErr, "failed to sign mp3 url")
+		return
+	}
+	resp.QueuePosition = queuePosition(ctx, inspector, cfg, j)
+	if err := sink.send(j, resp); err != nil || jobs.IsTerminal(j.Status) {
+		return
+	}
+	stream.run(ctx, shutdown, cfg, st, s3, sink)
+}
+
+type wsSink struct {
+	conn *websocket.Conn
+}
+
+func (s wsSink) send(j store.Job, resp api.Job) error {
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := s.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+		return err
+	}
+	if jobs.IsTerminal(j.Status) {
+		s.closeWith(websocket.CloseNormalClosure, terminalEvent(j.Status))
+	}
+	return nil
+}
+
+func (s wsSink) keepalive() error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+}
+
+func (s wsSink) shutdown() {
+	s.closeWith(websocket.CloseGoingAway, "shutdown")
+}
+
+func (s wsSink) closeWith(code int, reason string) {
+	_ = s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteTimeout))
+}
+
+// wsOriginChecker admits browser connections from the CORS allow list, or
+// from the API's own host when CORS is not configured. Non-browser clients
+// send no Origin and are always admitted.
+func wsOriginChecker(allowOrigins string) func(*http.Request) bool {
+	allowAll := false
+	allowed := map[string]struct{}{}
+	for _, part := range strings.Split(allowOrigins, ",") {
+		origin := strings.TrimSpace(part)
+		if origin == "*" {
+			allowAll = true
+		} else if origin != "" {
+			allowed[origin] = struct{}{}
+		}
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || allowAll || containsOrigin(allowed, origin) {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"video2mp3/internal/storage"
+)
+
+// recordingStorage keeps what UploadMP3Stream read, to hash it independently.
+type recordingStorage struct {
+	storage.Storage
+	uploaded []byte
+}
+
+func (s *recordingStorage) UploadMP3Stream(ctx context.Context, r io.Reader, objectKey, contentType string) (string, error) {
+	b, err := io.ReadAll(r)
+	s.uploaded = b
+	return objectKey, err
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestPipeUploadChecksum(t *testing.T) {
+	s3 := &recordingStorage{}
+	out, err := pipeUpload(context.Background(), s3, "mp3/a.mp3", "audio/mpeg", func(w io.Writer) error {
+		for i := 0; i < 100; i++ {
+			if _, err := io.WriteString(w, strings.Repeat("frame", 1000)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Size != int64(len(s3.uploaded)) || out.Size != 500000 {
+		t.Errorf("size = %d, uploaded %d bytes", out.Size, len(s3.uploaded))
+	}
+	if want := sha256Hex(s3.uploaded); out.SHA256 != want {
+		t.Errorf("checksum = %s, want %s of the uploaded object", out.SHA256, want)
+	}
+}
+
+func TestPipeUploadTranscodeFailure(t *testing.T) {
+	boom := errors.New("ffmpeg exited 1")
+	_, err := pipeUpload(context.Background(), &recordingStorage{}, "mp3/a.mp3", "audio/mpeg", func(w io.Writer) error {
+		_, _ = io.WriteString(w, "partial")
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Errorf("err = %v, want the transcode error", err)
+	}
+}
+
+func TestFileSHA256(t *testing.T) {
+	data := testMedia(1<<20 + 3)
+	path := filepath.Join(t.TempDir(), "out.mp3")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fileSHA256(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256Hex(data); got != want {
+		t.Errorf("fileSHA256 = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeServer serves data with byte-range support and records the Range
+// header of every request. failRange, when set, makes that range fail.
+type rangeServer struct {
+	data      []byte
+	ranges    bool
+	failRange string
+
+	mu   sync.Mutex
+	seen []string
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rng := r.Header.Get("Range")
+	s.mu.Lock()
+	s.seen = append(s.seen, rng)
+	s.mu.Unlock()
+	if rng != "" && rng == s.failRange {
+		http.Error(w, "boom", http.StatusInternalServerError)
+		return
+	}
+	if !s.ranges {
+		r.Header.Del("Range")
+	}
+	http.ServeContent(w, r, "media.mp4", time.Time{}, bytes.NewReader(s.data))
+}
+
+func (s *rangeServer) requested() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := append([]string(nil), s.seen...)
+	sort.Strings(out)
+	return out
+}
+
+func testMedia(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestDownloadChunked(t *testing.T) {
+	ctx := context.Background()
+	large := testMedia(10<<20 + 7)
+
+	t.Run("ranges", func(t *testing.T) {
+		rs := &rangeServer{data: large, ranges: true}
+		srv := httptest.NewServer(rs)
+		defer srv.Close()
+		dest := filepath.Join(t.TempDir(), "video")
+
+		ok, err := downloadChunked(ctx, srv.URL, dest, nil, time.Minute, nil, 3)
+		if !ok || err != nil {
+			t.Fatalf("downloadChunked = %v, %v", ok, err)
+		}
+		got, err := os.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, large) {
+			t.Errorf("reassembled %d bytes differ from the %d served", len(got), len(large))
+		}
+		// 10 MiB allows two chunks of at least minChunkSize, after the probe.
+		want := []string{"bytes=0-0", "bytes=0-5242883", "bytes=5242884-10485766"}
+		if got := rs.requested(); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+			t.Errorf("ranges requested %q, want %q", got, want)
+		}
+		if _, err := os.Stat(dest + ".part"); !os.IsNotExist(err) {
+			t.Errorf(".part file left behind: %v", err)
+		}
+	})
+
+	fallbacks := map[string]*rangeServer{
+		"no range support": {data: large},
+		"small file":       {data: testMedia(2*minChunkSize - 1), ranges: true},
+	}
+	for name, rs := range fallbacks {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(rs)
+			defer srv.Close()
+			dest := filepath.Join(t.TempDir(), "video")
+
+			ok, err := downloadChunked(ctx, srv.URL, dest, nil, time.Minute, nil, 4)
+			if ok || err != nil {
+				t.Fatalf("downloadChunked = %v, %v; want a fallback", ok, err)
+			}
+			if _, err := os.Stat(dest); !os.IsNotExist(err) {
+				t.Errorf("fallback left a file: %v", err)
+			}
+		})
+	}
+
+	t.Run("failed range", func(t *testing.T) {
+		rs := &rangeServer{data: large, ranges: true, failRange: "bytes=5242884-10485766"}
+		srv := httptest.NewServer(rs)
+		defer srv.Close()
+		dest := filepath.Join(t.TempDir(), "video")
+
+		ok, err := downloadChunked(ctx, srv.URL, dest, nil, time.Minute, nil, 2)
+		if !ok || err == nil {
+			t.Fatalf("downloadChunked = %v, %v; want a failure", ok, err)
+		}
+		// Nothing may be left for downloadOnce to resume from.
+		for _, p := range []string{dest, dest + ".part"} {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("%s left behind: %v", filepath.Base(p), err)
+			}
+		}
+	})
+}
+
+func TestDownloadOnceResumes(t *testing.T) {
+	data := testMedia(64 << 10)
+	rs := &rangeServer{data: data, ranges: true}
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+	dest := filepath.Join(t.TempDir(), "video")
+	if err := os.WriteFile(dest, data[:1000], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := downloadOnce(context.Background(), srv.URL, dest, nil, time.Minute, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("resumed file has %d bytes, want the %d served", len(got), len(data))
+	}
+	if req := rs.requested(); len(req) != 1 || req[0] != "bytes=1000-" {
+		t.Errorf("requests %q, want one resuming at 1000", req)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// hostLimiter caps how many downloads run against one host at a time,
+// independently of the worker's concurrency. A limit of 0 disables it.
+type hostLimiter struct {
+	limit int
+
+	mu    sync.Mutex
+	hosts map[string]*hostSlots
+}
+
+// hostSlots is one host's semaphore; users counts holders and waiters so the
+// entry can be dropped once nobody needs it.
+type hostSlots struct {
+	slots chan struct{}
+	users int
+}
+
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{limit: limit, hosts: make(map[string]*hostSlots)}
+}
+
+// acquire waits for a download slot for rawURL's host and returns the func
+// that frees it, or ctx's error if ctx ends first.
+func (l *hostLimiter) acquire(ctx context.Context, rawURL string) (func(), error) {
+	if l == nil || l.limit <= 0 {
+		return func() {}, nil
+	}
+	host := downloadHost(rawURL)
+	l.mu.Lock()
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostSlots{slots: make(chan struct{}, l.limit)}
+		l.hosts[host] = h
+	}
+	h.users++
+	l.mu.Unlock()
+
+	select {
+	case h.slots <- struct{}{}:
+	case <-ctx.Done():
+		l.leave(host, h)
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-h.slots
+			l.leave(host, h)
+		})
+	}, nil
+}
+
+func (l *hostLimiter) leave(host string, h *hostSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h.users--
+	if h.users == 0 {
+		delete(l.hosts, host)
+	}
+}
+
+// downloadHost is the lowercased host of rawURL, or rawURL itself when it
+// does not parse.
+func downloadHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	return strings.ToLower(u.Hostname())
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadsPerHostCapped(t *testing.T) {
+	const limit = 2
+	prev := downloadHosts
+	downloadHosts = newHostLimiter(limit)
+	t.Cleanup(func() { downloadHosts = prev })
+
+	var mu sync.Mutex
+	active, peak := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		peak = max(peak, active)
+		mu.Unlock()
+		time.Sleep(30 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+		w.Write([]byte("media"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- downloadToFile(context.Background(), srv.URL, filepath.Join(dir, fmt.Sprint(i)), nil, time.Minute, nil)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if peak > limit {
+		t.Errorf("%d simultaneous downloads from one host, want at most %d", peak, limit)
+	}
+	if peak < limit {
+		t.Errorf("peak %d downloads, want the limit of %d reached", peak, limit)
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := newHostLimiter(1)
+
+	release, err := l.acquire(ctx, "https://cdn-a.example/1.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another host is not held up by cdn-a.
+	other, err := l.acquire(ctx, "https://CDN-B.example:8443/2.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	// The same host, whatever the port or case, waits until ctx ends.
+	waitCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(waitCtx, "https://CDN-A.example:443/3.mp4"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("second cdn-a download: err = %v, want it to wait", err)
+	}
+
+	release()
+	release() // Releasing twice must not free a second slot.
+	if _, err := l.acquire(ctx, "https://cdn-a.example/4.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	waitCtx, cancel = context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(waitCtx, "https://cdn-a.example/5.mp4"); err == nil {
+		t.Error("double release freed an extra slot")
+	}
+}
+
+func TestHostLimiterDisabled(t *testing.T) {
+	for _, l := range []*hostLimiter{nil, newHostLimiter(0)} {
+		for i := 0; i < 3; i++ {
+			if _, err := l.acquire(context.Background(), "https://cdn.example/x"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -3,55 +3,299 @@ package main
 import (
 	"bytes"
 	"context"
-	crand "crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math/big"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
 	"video2mp3/internal/config"
+	"video2mp3/internal/events"
+	"video2mp3/internal/heartbeat"
 	"video2mp3/internal/jobs"
+	"video2mp3/internal/logging"
+	"video2mp3/internal/metrics"
+	"video2mp3/internal/netguard"
+	"video2mp3/internal/parser"
+	"video2mp3/internal/platform"
 	"video2mp3/internal/queue"
 	"video2mp3/internal/storage"
 	"video2mp3/internal/store"
 
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
 )
 
+// Build info, set at build time with
+// -ldflags "-X main.Version=... -X main.Commit=... -X main.BuildTime=...".
+var Version, Commit, BuildTime string
+
+// retryRules is set once at startup from RETRY_RULES; the first matching rule
+// decides whether an error is retried, ahead of its error category.
+var retryRules []retryRule
+
+// retryBaseDelay and retryMaxDelay drive the task retry backoff; see
+// queue.RetryDelay.
+var retryBaseDelay, retryMaxDelay time.Duration
+
+// recordDeadJobs writes jobs the worker gives up on to dead_jobs
+// (RECORD_DEAD_JOBS).
+var recordDeadJobs bool
+
+// downloadTimeouts holds PLATFORM_DOWNLOAD_TIMEOUTS; platforms not listed use
+// the global timeout.
+var downloadTimeouts map[string]time.Duration
+
+// mediaTransport and parserTransport refuse connections to blocked (private,
+// loopback, metadata) addresses. The parser's configured host is trusted; any
+// host it redirects to is not. Both honor DOWNLOAD_PROXY_URL or the
+// HTTP(S)_PROXY/NO_PROXY environment.
+var mediaTransport, parserTransport http.RoundTripper
+
+// platformHeaders holds the extra download headers per platform: the
+// built-in defaults merged with PLATFORM_DOWNLOAD_HEADERS and then
+// PLATFORM_HEADERS_JSON.
+var platformHeaders map[string]http.Header
+
+// parserHeaders holds the PLATFORM_HEADERS_JSON headers and cookies that are
+// also sent with parser requests, per platform.
+var parserHeaders map[string]http.Header
+
+// defaultPlatformHeaders are sent on media downloads for CDNs that reject
+// requests without a matching Referer/Origin.
+var defaultPlatformHeaders = map[string]http.Header{
+	platform.PlatformBilibili: {
+		"Referer": {"https://www.bilibili.com/"},
+		"Origin":  {"https://www.bilibili.com"},
+	},
+	platform.PlatformDouyin: {
+		"Referer": {"https://www.douyin.com/"},
+	},
+}
+
+// streamSkipPlatforms lists STREAM_TRANSCODE_SKIP_PLATFORMS, whose media
+// always goes through a temp file (e.g. containers ffmpeg must seek in).
+var streamSkipPlatforms map[string]bool
+
+// parserSlots bounds concurrent parser calls when PARSER_CONCURRENCY is set;
+// nil means unlimited.
+var parserSlots chan struct{}
+
+var errParserBusy = errors.New("parser busy: no slot available")
+
+// errParserUnavailable is returned without calling the parser while
+// parserBreaker is open. Like errParserBusy it is retried.
+var errParserUnavailable = errors.New("parser unavailable")
+
+// parserAuth signs every parser request; set once at startup.
+var parserAuth parser.Signer
+
+// parserEndpoint is where parser requests go; set once at startup.
+var parserEndpoint parser.Endpoint
+
+// parserBreaker trips after PARSER_BREAKER_THRESHOLD consecutive parser calls
+// that failed even after retries.
+var parserBreaker *circuitBreaker
+
+// errNotMedia is the terminal error for downloads that turn out to be an
+// error page or API response instead of media.
+var errNotMedia = errors.New("downloaded content is not media")
+
+// errParserUnsupported is the terminal error for links on platforms the
+// parser rejects outright.
+var errParserUnsupported = errors.New("platform not supported by parser")
+
+// errEmptyMedia is the terminal error for parser results without a media URL
+// the worker can use.
+var errEmptyMedia = errors.New("parser returned empty media url")
+
+// enabledArtifacts holds the side artifacts this worker produces by default
+// (SIDE_ARTIFACTS, plus "cover" when FETCH_COVER is set).
+var enabledArtifacts []string
+
+// downloadChunks is how many ranges a large media download is split into
+// (DOWNLOAD_CHUNKS); 1 keeps single-stream downloads.
+var downloadChunks int
+
+// downloadHosts caps concurrent media downloads per host
+// (MAX_DOWNLOADS_PER_HOST).
+var downloadHosts *hostLimiter
+
+// downloadRetryAfterMax caps how long a download retry waits when the server
+// sends Retry-After (DOWNLOAD_RETRY_AFTER_MAX); 0 ignores the header.
+var downloadRetryAfterMax time.Duration
+
+// rdb is the worker's Redis client: it publishes job status changes for SSE
+// subscribers and holds the parser cache.
+var rdb *redis.Client
+
 func main() {
 	cfg := config.Load()
+	if err := logging.Setup(cfg.LogLevel, cfg.LogFormat); err != nil {
+		logging.Fatal("invalid logging config", "err", err)
+	}
+
+	rules, err := parseRetryRules(cfg.RetryRules)
+	if err != nil {
+		logging.Fatal("invalid retry rules", "err", err)
+	}
+	retryRules = rules
+	retryBaseDelay, retryMaxDelay = cfg.RetryBaseDelay, cfg.RetryMaxDelay
+	recordDeadJobs = cfg.RecordDeadJobs
+	if !jobs.IsValidPrefer(cfg.MediaPrefer) {
+		logging.Fatal("invalid MEDIA_PREFER, want audio, video or best", "value", cfg.MediaPrefer)
+	}
+	if !jobs.IsValidSampleRate(cfg.AudioSampleRate) {
+		logging.Fatal("invalid AUDIO_SAMPLE_RATE", "value", cfg.AudioSampleRate, "allowed", jobs.SampleRates)
+	}
+	if cfg.AudioChannels != 0 && !jobs.IsValidChannels(cfg.AudioChannels) {
+		logging.Fatal("invalid AUDIO_CHANNELS, want 1 or 2 (0 keeps the source's)", "value", cfg.AudioChannels)
+	}
+
+	downloadChunks = max(cfg.DownloadChunks, 1)
+	downloadRetryAfterMax = max(cfg.DownloadRetryAfterMax, 0)
+	downloadHosts = newHostLimiter(cfg.MaxDownloadsPerHost)
+	downloadTimeouts, err = parsePlatformTimeouts(cfg.PlatformDownloadTimeouts)
+	if err != nil {
+		logging.Fatal("invalid platform download timeouts", "err", err)
+	}
+	for _, plat := range platform.All {
+		slog.Info("download timeout", "platform", plat, "timeout", downloadTimeoutFor(cfg, plat).String())
+	}
+	mediaGuard, err := netguard.New(cfg.OutboundBlockCIDRs, cfg.OutboundAllowCIDRs)
+	if err != nil {
+		logging.Fatal("invalid outbound cidrs", "err", err)
+	}
+	if err := mediaGuard.UseProxy(cfg.DownloadProxyURL); err != nil {
+		logging.Fatal("invalid download proxy", "err", err)
+	}
+	mediaTransport = mediaGuard.Transport()
+	var parserHost string
+	if u, err := url.Parse(cfg.ParserAPIURL); err == nil {
+		parserHost = u.Hostname()
+	}
+	parserGuard, err := netguard.New(cfg.OutboundBlockCIDRs, cfg.OutboundAllowCIDRs, parserHost)
+	if err != nil {
+		logging.Fatal("invalid outbound cidrs", "err", err)
+	}
+	if err := parserGuard.UseProxy(cfg.DownloadProxyURL); err != nil {
+		logging.Fatal("invalid download proxy", "err", err)
+	}
+	parserTransport = parserGuard.Transport()
+	if mediaGuard.ProxyEnabled() {
+		slog.Info("outbound requests use a proxy", "explicit", cfg.DownloadProxyURL != "")
+	}
+
+	platformHeaders, err = parsePlatformHeaders(cfg.PlatformDownloadHeaders)
+	if err != nil {
+		logging.Fatal("invalid platform download headers", "err", err)
+	}
+	parserHeaders, err = applyPlatformHeadersJSON(cfg.PlatformHeadersJSON, platformHeaders)
+	if err != nil {
+		logging.Fatal("invalid PLATFORM_HEADERS_JSON", "err", err)
+	}
+	streamSkipPlatforms, err = parsePlatformSet(cfg.StreamSkipPlatforms)
+	if err != nil {
+		logging.Fatal("invalid STREAM_TRANSCODE_SKIP_PLATFORMS", "err", err)
+	}
+	if _, err := queue.ParseWeights(cfg.QueueWeights); err != nil {
+		logging.Fatal("invalid QUEUE_WEIGHTS", "err", err)
+	}
+	if cfg.TempSweepAge > 0 {
+		sweepJobDirs(cfg.TempDir, cfg.TempSweepAge)
+		if strings.TrimSpace(cfg.OutputDir) != "" {
+			sweepJobDirs(cfg.OutputDir, cfg.TempSweepAge)
+		}
+	}
 
 	ctx := context.Background()
+	if err := checkBinary(ctx, cfg.FFmpegPath); err != nil {
+		logging.Fatal("ffmpeg not usable", "path", cfg.FFmpegPath, "err", err)
+	}
+	if err := checkBinary(ctx, cfg.FFprobePath); err != nil {
+		slog.Warn("ffprobe not usable", "path", cfg.FFprobePath, "err", err)
+	}
+
 	st, err := store.New(ctx, cfg.DatabaseURL)
 	if err != nil {
-		log.Fatalf("store init: %v", err)
+		logging.Fatal("store init failed", "err", err)
 	}
 	defer st.Close()
+	st.SetPoolConfig(store.PoolConfig{
+		MaxOpenConns:    cfg.DBMaxOpenConns,
+		MaxIdleConns:    cfg.DBMaxIdleConns,
+		ConnMaxLifetime: cfg.DBConnMaxLifetime,
+		QueryTimeout:    cfg.DBQueryTimeout,
+	})
 	if err := st.Init(ctx); err != nil {
-		log.Fatalf("store schema: %v", err)
+		logging.Fatal("store schema failed", "err", err)
 	}
 
-	s3, err := storage.NewS3(
-		cfg.S3Endpoint,
-		cfg.S3AccessKey,
-		cfg.S3SecretKey,
-		cfg.S3Region,
-		cfg.S3Bucket,
-		cfg.S3UsePathStyle,
-		cfg.S3PublicEndpoint,
-	)
+	var s3 storage.Storage
+	switch cfg.StorageBackend {
+	case storage.BackendS3:
+		s3, err = storage.NewS3(
+			cfg.S3Endpoint,
+			cfg.S3AccessKey,
+			cfg.S3SecretKey,
+			cfg.S3Region,
+			cfg.S3Bucket,
+			cfg.S3UsePathStyle,
+			cfg.S3PublicEndpoint,
+		)
+	case storage.BackendLocal:
+		s3, err = storage.NewLocal(cfg.LocalStorageDir, cfg.LocalStorageURL, cfg.LocalStorageSecret)
+	default:
+		logging.Fatal("invalid STORAGE_BACKEND, want s3 or local", "value", cfg.StorageBackend)
+	}
+	if err != nil {
+		logging.Fatal("storage init failed", "backend", cfg.StorageBackend, "err", err)
+	}
+	bucketCtx, bucketCancel := context.WithTimeout(ctx, 10*time.Second)
+	err = s3.EnsureBucket(bucketCtx, cfg.S3CreateBucket)
+	bucketCancel()
 	if err != nil {
-		log.Fatalf("s3 init: %v", err)
+		logging.Fatal("storage unavailable", "backend", cfg.StorageBackend, "err", err)
+	}
+	if err := storage.ValidateKeyTemplate(cfg.S3KeyTemplate); err != nil {
+		logging.Fatal("invalid S3_KEY_TEMPLATE", "err", err)
+	}
+	if cfg.FFmpegThreads < 0 {
+		logging.Fatal("invalid FFMPEG_THREADS", "threads", cfg.FFmpegThreads)
+	}
+	if cfg.FFmpegNice < 0 || cfg.FFmpegNice > 19 {
+		logging.Fatal("invalid FFMPEG_NICE, want 0-19", "nice", cfg.FFmpegNice)
+	}
+	sse, err := storage.ServerSideEncryption(cfg.S3SSE, cfg.S3SSEKMSKeyID)
+	if err != nil {
+		logging.Fatal("invalid s3 encryption config", "err", err)
+	}
+	if err := s3.SetUploadConfig(storage.UploadConfig{
+		MultipartThreshold: cfg.S3MultipartThreshold,
+		PartSize:           uint64(max(cfg.S3PartSize, 0)),
+		Concurrency:        uint(max(cfg.S3UploadConcurrency, 1)),
+		Encryption:         sse,
+	}); err != nil {
+		logging.Fatal("invalid s3 upload config", "err", err)
 	}
 
 	concurrency := cfg.DownloadConcurrency
@@ -59,96 +303,1065 @@ func main() {
 		concurrency = 1
 	}
 
+	enabledArtifacts, err = parseArtifacts(cfg.SideArtifacts, cfg.FetchCover)
+	if err != nil {
+		logging.Fatal("invalid side artifacts", "err", err)
+	}
+
+	parserAuth, err = parser.NewSigner(cfg.ParserAuthMode, cfg.ParserAPIKey)
+	if err != nil {
+		logging.Fatal("invalid parser auth config", "err", err)
+	}
+	parserEndpoint, err = parser.NewEndpoint(cfg.ParserAPIURL, cfg.ParserEndpointPath, cfg.ParserURLField)
+	if err != nil {
+		logging.Fatal("invalid parser endpoint config", "err", err)
+	}
+	parserBreaker = newCircuitBreaker(cfg.ParserBreakerThreshold, cfg.ParserBreakerCooldown)
+	if cfg.ParserConcurrency > 0 {
+		parserSlots = make(chan struct{}, cfg.ParserConcurrency)
+	}
+
+	redisOpt, err := queue.RedisClientOpt(queue.RedisOptions{
+		URL:      cfg.RedisURL,
+		Addr:     cfg.RedisAddr,
+		DB:       cfg.RedisDB,
+		Username: cfg.RedisUsername,
+		Password: cfg.RedisPassword,
+		TLS:      cfg.RedisTLS,
+	})
+	if err != nil {
+		logging.Fatal("invalid redis config", "err", err)
+	}
+	rdb = redisOpt.MakeRedisClient().(*redis.Client)
+	defer rdb.Close()
+	pingCtx, pingCancel := context.WithTimeout(ctx, 5*time.Second)
+	if err := rdb.Ping(pingCtx).Err(); err != nil {
+		if queue.IsRedisAuthError(err) {
+			logging.Fatal("redis authentication failed", "addr", redisOpt.Addr, "err", err)
+		}
+		slog.Error("redis unreachable at startup", "addr", redisOpt.Addr, "tls", redisOpt.TLSConfig != nil, "err", err)
+	}
+	pingCancel()
+
 	srv := asynq.NewServer(
-		asynq.RedisClientOpt{Addr: cfg.RedisAddr, DB: cfg.RedisDB},
-		asynq.Config{Concurrency: concurrency},
+		redisOpt,
+		asynq.Config{
+			Concurrency: concurrency,
+			Queues:      queue.Weights(cfg.RetryQueue, cfg.RetryQueueWeight, cfg.QueueWeights),
+			RetryDelayFunc: func(n int, _ error, _ *asynq.Task) time.Duration {
+				return queue.RetryDelay(n, retryBaseDelay, retryMaxDelay)
+			},
+		},
 	)
 
+	var state workerState
 	mux := asynq.NewServeMux()
 	mux.HandleFunc(queue.TaskProcessVideo, func(ctx context.Context, t *asynq.Task) error {
 		var p queue.ProcessPayload
 		if err := json.Unmarshal(t.Payload(), &p); err != nil {
 			return err
 		}
-		return processJob(ctx, cfg, st, s3, p)
+		state.inFlight.Add(1)
+		err := processJob(ctx, cfg, st, s3, p)
+		state.inFlight.Add(-1)
+		state.lastJobAt.Store(time.Now().UnixNano())
+		plat := p.Platform
+		if plat == "" {
+			plat = "unknown"
+		}
+		if err != nil {
+			// An attempt asynq will retry has not failed the job yet.
+			if finalAttempt(ctx, err) {
+				metrics.JobsFailed.WithLabelValues(plat).Inc()
+			}
+		} else {
+			metrics.JobsSucceeded.WithLabelValues(plat).Inc()
+		}
+		return err
 	})
 
-	log.Printf("worker started with concurrency=%d", concurrency)
-	if err := srv.Run(mux); err != nil {
-		log.Fatalf("worker error: %v", err)
+	if cfg.MetricsEnabled && cfg.WorkerMetricsAddr != "" {
+		reg := metrics.NewRegistry(metrics.JobsSucceeded, metrics.JobsFailed, metrics.TranscodeDuration, metrics.DownloadBytes, metrics.MediaDownloads, metrics.MediaDownloadBytes, metrics.ParserWaitDuration, metrics.ParserWaitTimeouts)
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", reg.Handler())
+		go func() {
+			slog.Info("worker metrics listening", "addr", cfg.WorkerMetricsAddr)
+			if err := http.ListenAndServe(cfg.WorkerMetricsAddr, metricsMux); err != nil {
+				slog.Error("worker metrics server failed", "err", err)
+			}
+		}()
+	}
+
+	hostname, _ := os.Hostname()
+	self := heartbeat.Worker{
+		ID:          fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		Hostname:    hostname,
+		PID:         os.Getpid(),
+		StartedAt:   time.Now().UTC(),
+		Concurrency: concurrency,
+		Version:     Version,
+		Commit:      Commit,
+	}
+	hbCtx, stopHeartbeat := context.WithCancel(context.Background())
+	if cfg.WorkerHeartbeatInterval > 0 {
+		go runHeartbeat(hbCtx, self, &state, cfg.WorkerHeartbeatInterval)
+	}
+
+	slog.Info("worker started", "concurrency", concurrency, "worker_id", self.ID, "version", Version, "commit", Commit)
+	err = srv.Run(mux)
+	stopHeartbeat()
+	if cfg.WorkerHeartbeatInterval > 0 {
+		rmCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := heartbeat.Remove(rmCtx, rdb, self.ID); err != nil {
+			slog.Warn("remove worker heartbeat failed", "err", err)
+		}
+		cancel()
 	}
+	if err != nil {
+		logging.Fatal("worker failed", "err", err)
+	}
+}
+
+// workerState is what this process reports in its heartbeat besides its
+// identity.
+type workerState struct {
+	inFlight atomic.Int64
+	// lastJobAt is the unix nano time the last job finished, 0 if none has.
+	lastJobAt atomic.Int64
 }
 
-func processJob(ctx context.Context, cfg config.Config, st *store.Store, s3 *storage.S3Client, p queue.ProcessPayload) error {
-	log.Printf("job start id=%s url=%s", p.JobID, p.SourceURL)
-	workRoot := strings.TrimSpace(cfg.TempDir)
-	if workRoot == "" {
-		workRoot = os.TempDir()
+// runHeartbeat writes the worker's heartbeat (see GET /admin/workers) every
+// interval until ctx is cancelled.
+func runHeartbeat(ctx context.Context, self heartbeat.Worker, state *workerState, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		self.InFlight = int(state.inFlight.Load())
+		if at := state.lastJobAt.Load(); at > 0 {
+			t := time.Unix(0, at).UTC()
+			self.LastJobAt = &t
+		}
+		writeCtx, cancel := context.WithTimeout(ctx, interval)
+		if err := heartbeat.Write(writeCtx, rdb, self); err != nil && ctx.Err() == nil {
+			slog.Warn("write worker heartbeat failed", "err", err)
+		}
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+var errInvalidOptions = errors.New("invalid job options")
+
+// errStageTimeout marks a download or transcode stage that ran past its
+// DOWNLOAD_TIMEOUT/TRANSCODE_TIMEOUT budget.
+var errStageTimeout = errors.New("stage timed out")
+
+// withStageTimeout bounds one stage of a job; 0 leaves only the job's own
+// deadline, which also still applies when it is sooner.
+func withStageTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// stageError replaces the error of a stage that hit its own deadline (not the
+// job's) with a message naming the stage.
+func stageError(jobCtx, stageCtx context.Context, stage string, d time.Duration, err error) error {
+	if err == nil || jobCtx.Err() != nil || !errors.Is(stageCtx.Err(), context.DeadlineExceeded) {
+		return err
 	}
-	workDir := filepath.Join(workRoot, p.JobID)
-	if err := os.MkdirAll(workDir, 0o755); err != nil {
-		return recordFailure(ctx, st, p.JobID, err)
+	return fmt.Errorf("%w: %s exceeded %s", errStageTimeout, stage, d)
+}
+
+// jobDirRoot is the directory job directories are created in: root, or
+// os.TempDir when empty.
+func jobDirRoot(root string) string {
+	root = strings.TrimSpace(root)
+	if root == "" {
+		return os.TempDir()
+	}
+	return root
+}
+
+// makeJobDir creates the per-job directory under root (os.TempDir when empty).
+func makeJobDir(root, jobID string) (string, error) {
+	dir := filepath.Join(jobDirRoot(root), jobID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// sweepJobDirs removes job directories under root left behind by a crashed
+// worker: entries named like a job id and not modified for maxAge. Anything
+// else in root is left alone.
+func sweepJobDirs(root string, maxAge time.Duration) {
+	root = jobDirRoot(root)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("sweep job dirs failed", "dir", root, "err", err)
+		}
+		return
+	}
+	removed := 0
+	for _, e := range entries {
+		if !e.IsDir() || uuid.Validate(e.Name()) != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, e.Name())); err != nil {
+			slog.Warn("remove stale job dir failed", "dir", e.Name(), "err", err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		slog.Info("stale job dirs removed", "dir", root, "count", removed)
+	}
+}
+
+// errInsufficientDisk fails a job before its download when the temp or
+// output filesystem has less than DISK_MIN_FREE_MB available. It is retried
+// like other transient failures.
+var errInsufficientDisk = errors.New("insufficient disk space")
+
+// checkDiskSpace returns errInsufficientDisk if any of dirs has less than
+// minFreeMB available. Filesystems whose free space cannot be read pass.
+func checkDiskSpace(minFreeMB int, dirs ...string) error {
+	if minFreeMB <= 0 {
+		return nil
+	}
+	need := uint64(minFreeMB) << 20
+	for _, dir := range dirs {
+		free, ok, err := freeBytes(dir)
+		if err != nil || !ok {
+			continue
+		}
+		if free < need {
+			return fmt.Errorf("%w: %d MiB free in %s, need %d MiB", errInsufficientDisk, free>>20, dir, minFreeMB)
+		}
+	}
+	return nil
+}
+
+func processJob(ctx context.Context, cfg config.Config, st *store.Store, s3 storage.Storage, p queue.ProcessPayload) error {
+	start := time.Now()
+	ctx = logging.With(ctx, "job_id", p.JobID, "request_id", p.RequestID)
+	retried, _ := asynq.GetRetryCount(ctx)
+	slog.InfoContext(ctx, "job start", "platform", p.Platform, "url", p.SourceURL, "attempt", retried+1)
+	if err := st.UpdateJobAttempts(ctx, p.JobID, retried+1); err != nil {
+		slog.WarnContext(ctx, "record attempt failed", "err", err)
+	}
+	workDir, err := makeJobDir(cfg.TempDir, p.JobID)
+	if err != nil {
+		return recordFailure(ctx, st, p, err)
 	}
 	defer func() {
 		_ = os.RemoveAll(workDir)
 	}()
+	outDir := workDir
+	if strings.TrimSpace(cfg.OutputDir) != "" {
+		outDir, err = makeJobDir(cfg.OutputDir, p.JobID)
+		if err != nil {
+			return recordFailure(ctx, st, p, err)
+		}
+		defer func() {
+			_ = os.RemoveAll(outDir)
+		}()
+	}
 
-	if err := st.UpdateJobStatus(ctx, p.JobID, jobs.StatusDownloading, nil, nil); err != nil {
+	if err := checkDiskSpace(cfg.DiskMinFreeMB, workDir, outDir); err != nil {
+		return recordFailure(ctx, st, p, err)
+	}
+
+	if err := setJobStatus(ctx, st, p.JobID, jobs.StatusDownloading, nil, nil); err != nil {
 		return err
 	}
 
-	videoPath, err := downloadWithParser(ctx, cfg, workDir, p.SourceURL, p.JobID)
+	opts := p.Options
+	if err := opts.Normalize(); err != nil {
+		return recordFailure(ctx, st, p, fmt.Errorf("%w: %v", errInvalidOptions, err))
+	}
+	output := opts.Output()
+	stream := p.StagedKey == "" && canStreamTranscode(cfg, p.Platform, opts)
+	keyTime, err := jobKeyTime(ctx, st, p.JobID)
 	if err != nil {
-		return recordFailure(ctx, st, p.JobID, err)
+		return err
 	}
 
-	if err := st.UpdateJobStatus(ctx, p.JobID, jobs.StatusTranscoding, nil, nil); err != nil {
+	var (
+		videoPath string
+		parsed    parser.Result
+		// timings are recorded once the job is ready.
+		timings store.JobTimings
+	)
+	downloadStart := time.Now()
+	dlCtx, dlCancel := withStageTimeout(ctx, cfg.DownloadStageTimeout)
+	if p.StagedKey != "" {
+		videoPath, parsed, err = fetchStaged(dlCtx, s3, workDir, p)
+		if err == nil && p.Platform != platform.PlatformUpload {
+			parsed, err = retainedSourceInfo(ctx, st, p.JobID)
+		}
+	} else {
+		parsed, err = resolveWithParser(dlCtx, cfg, p)
+		if err == nil && !stream {
+			videoPath, err = downloadMedia(dlCtx, cfg, st, workDir, p, parsed)
+			if err != nil && cfg.ParserCacheTTL > 0 {
+				forgetParse(ctx, p.SourceURL)
+			}
+		}
+	}
+	err = stageError(ctx, dlCtx, "download", cfg.DownloadStageTimeout, err)
+	dlCancel()
+	if err != nil {
+		return recordFailure(ctx, st, p, err)
+	}
+	if !stream {
+		timings.DownloadMs = time.Since(downloadStart).Milliseconds()
+	}
+	if strings.TrimSpace(parsed.Title) == "" {
+		parsed.Title = shareTextTitle(ctx, st, p.JobID)
+	}
+	parsed.Title = sanitizeTitle(parsed.Title, cfg.TitleMaxRunes)
+	if err := st.UpdateJobSourceInfo(ctx, p.JobID, parsed.Title, strings.TrimSpace(parsed.VideoID)); err != nil {
+		slog.WarnContext(ctx, "store source info failed", "err", err)
+	}
+	// The parser knows where a short link really leads; keep the platform
+	// detected from the link in detected_platform.
+	if reported := strings.ToLower(strings.TrimSpace(parsed.Platform)); reported != p.Platform && platform.IsKnown(reported) && p.Platform != platform.PlatformUpload {
+		if err := st.UpdateJobPlatform(ctx, p.JobID, reported); err != nil {
+			slog.WarnContext(ctx, "store parser platform failed", "err", err)
+		} else {
+			slog.InfoContext(ctx, "parser platform differs from detection", "detected", p.Platform, "platform", reported)
+		}
+	}
+
+	if err := setJobStatus(ctx, st, p.JobID, jobs.StatusTranscoding, nil, nil); err != nil {
 		return err
 	}
 
-	mp3Path := filepath.Join(workDir, p.JobID+".mp3")
-	if err := transcodeWithFFmpeg(ctx, videoPath, mp3Path); err != nil {
-		return recordFailure(ctx, st, p.JobID, err)
+	var side []sideArtifact
+	for _, name := range jobArtifacts(opts) {
+		switch name {
+		case jobs.ArtifactCover:
+			if coverURL := strings.TrimSpace(parsed.CoverURL); coverURL != "" {
+				side = append(side, sideArtifact{name: name, run: func(ctx context.Context) error {
+					return fetchCover(ctx, cfg, st, s3, workDir, p, coverURL, keyTime)
+				}})
+			}
+		}
+	}
+	runSideArtifacts(ctx, cfg, side)
+
+	if opts.Start > 0 || opts.End > 0 {
+		if err := checkTrimRange(ctx, cfg, videoPath, opts); err != nil {
+			return recordFailure(ctx, st, p, err)
+		}
 	}
 
-	objectKey := fmt.Sprintf("jobs/%s.mp3", p.JobID)
-	mp3Key, err := s3.UploadMP3(ctx, mp3Path, objectKey)
+	mp3Path := filepath.Join(outDir, p.JobID+"."+output.Ext)
+	transcodeStart := time.Now()
+	meta := trackMeta{Title: parsed.Title, Artist: p.Platform, Comment: p.SourceURL}
+	if meta.Artist == "" {
+		meta.Artist = parsed.Platform
+	}
+	var (
+		stats         transcodeStats
+		downloadBytes int64
+		// streamed is set once the output was uploaded straight from ffmpeg.
+		streamed *streamedOutput
+	)
+	objectKey := jobObjectKey(cfg, p, output.Ext, keyTime)
+	// Lossless containers need to seek back to finish their headers. A
+	// streamed transcode always uploads as it goes; file mode only with
+	// STREAM_UPLOAD.
+	streamUpload := cfg.StreamUpload && !output.Lossless
+	if stream {
+		// Streaming downloads and transcodes at once, so it gets both budgets.
+		budget := cfg.DownloadStageTimeout + cfg.TranscodeStageTimeout
+		if cfg.DownloadStageTimeout <= 0 || cfg.TranscodeStageTimeout <= 0 {
+			budget = 0
+		}
+		streamCtx, streamCancel := withStageTimeout(ctx, budget)
+		if !output.Lossless {
+			var out streamedOutput
+			out, err = pipeUpload(streamCtx, s3, objectKey, output.ContentType, func(w io.Writer) error {
+				var err error
+				stats, downloadBytes, err = streamTranscode(streamCtx, cfg, p, parsed, mp3Path, opts, meta, w)
+				return err
+			})
+			if err == nil {
+				streamed = &out
+			}
+		} else {
+			stats, downloadBytes, err = streamTranscode(streamCtx, cfg, p, parsed, mp3Path, opts, meta, nil)
+		}
+		err = stageError(ctx, streamCtx, "streaming transcode", budget, err)
+		streamCancel()
+		if err != nil && ctx.Err() == nil {
+			slog.WarnContext(ctx, "streaming transcode failed, falling back to file mode", "err", truncate(err.Error(), 200))
+			stream = false
+			downloadStart := time.Now()
+			dlCtx, dlCancel := withStageTimeout(ctx, cfg.DownloadStageTimeout)
+			videoPath, err = downloadMedia(dlCtx, cfg, st, workDir, p, parsed)
+			err = stageError(ctx, dlCtx, "download", cfg.DownloadStageTimeout, err)
+			dlCancel()
+			timings.DownloadMs = time.Since(downloadStart).Milliseconds()
+			if err != nil && cfg.ParserCacheTTL > 0 {
+				forgetParse(ctx, p.SourceURL)
+			}
+		}
+	}
+	if err == nil && !stream {
+		tcStart := time.Now()
+		tcCtx, tcCancel := withStageTimeout(ctx, cfg.TranscodeStageTimeout)
+		duration := transcodeDuration(tcCtx, cfg, videoPath, opts)
+		if streamUpload {
+			var out streamedOutput
+			out, err = pipeUpload(tcCtx, s3, objectKey, output.ContentType, func(w io.Writer) error {
+				var err error
+				stats, err = runTranscode(tcCtx, cfg, videoPath, nil, mp3Path, opts, meta, nil, w)
+				return err
+			})
+			if err == nil {
+				out.Duration = duration
+				streamed = &out
+			} else if tcCtx.Err() == nil {
+				slog.WarnContext(ctx, "streaming upload failed, falling back to file mode", "err", truncate(err.Error(), 200))
+			}
+		}
+		if streamed == nil && tcCtx.Err() == nil {
+			progress := newTranscodeProgress(st, p.JobID, duration)
+			stats, err = transcodeWithFFmpeg(tcCtx, cfg, videoPath, mp3Path, opts, meta, progress)
+		}
+		err = stageError(ctx, tcCtx, "transcode", cfg.TranscodeStageTimeout, err)
+		tcCancel()
+		downloadBytes = fileSize(videoPath)
+		timings.TranscodeMs = time.Since(tcStart).Milliseconds()
+	} else if err == nil {
+		timings.TranscodeMs = time.Since(transcodeStart).Milliseconds()
+	}
 	if err != nil {
-		return recordFailure(ctx, st, p.JobID, err)
+		return recordFailure(ctx, st, p, err)
 	}
+	metrics.TranscodeDuration.Observe(time.Since(transcodeStart).Seconds())
 
-	if err := st.UpdateJobStatus(ctx, p.JobID, jobs.StatusReady, nil, &mp3Key); err != nil {
+	var mp3Key string
+	if streamed != nil {
+		mp3Key = streamed.Key
+		if cfg.CostMetricsEnabled {
+			recordUsage(ctx, st, p.JobID, downloadBytes, streamed.Size, stats)
+		}
+		var duration *float64
+		if streamed.Duration > 0 {
+			duration = &streamed.Duration
+		}
+		if err := st.UpdateJobOutputInfo(ctx, p.JobID, streamed.Size, duration, streamed.SHA256); err != nil {
+			slog.WarnContext(ctx, "record output info failed", "err", err)
+		}
+	} else {
+		if cfg.CostMetricsEnabled {
+			recordUsage(ctx, st, p.JobID, downloadBytes, fileSize(mp3Path), stats)
+		}
+		checksum, err := fileSHA256(mp3Path)
+		if err != nil {
+			return recordFailure(ctx, st, p, err)
+		}
+		recordOutputInfo(ctx, cfg, st, p.JobID, mp3Path, checksum)
+
+		uploadStart := time.Now()
+		mp3Key, err = s3.UploadMP3(ctx, mp3Path, objectKey, output.ContentType, map[string]string{"sha256": checksum})
+		if err != nil {
+			return recordFailure(ctx, st, p, err)
+		}
+		timings.UploadMs = time.Since(uploadStart).Milliseconds()
+	}
+	if err := st.UpdateJobTimings(ctx, p.JobID, timings); err != nil {
+		slog.WarnContext(ctx, "record stage timings failed", "err", err)
+	}
+
+	if cfg.RetainSource && p.StagedKey == "" && videoPath != "" {
+		if _, err := s3.UploadMP3(ctx, videoPath, queue.StagedUploadKey(p.JobID), "application/octet-stream", nil); err != nil {
+			slog.WarnContext(ctx, "retain source failed", "err", err)
+		}
+	}
+
+	if err := setJobStatus(ctx, st, p.JobID, jobs.StatusReady, nil, &mp3Key); err != nil {
 		return err
 	}
-	log.Printf("job done id=%s mp3=%s", p.JobID, mp3Key)
+	if p.StagedKey != "" && !cfg.RetainSource {
+		if err := s3.DeleteObject(ctx, p.StagedKey); err != nil {
+			slog.WarnContext(ctx, "delete staged upload failed", "key", p.StagedKey, "err", err)
+		}
+	}
+	if p.ReplacesKey != "" && p.ReplacesKey != mp3Key {
+		if err := s3.DeleteObject(ctx, p.ReplacesKey); err != nil {
+			slog.WarnContext(ctx, "delete replaced output failed", "key", p.ReplacesKey, "err", err)
+		}
+	}
+	slog.InfoContext(ctx, "job done", "platform", p.Platform, "status", jobs.StatusReady, "duration_ms", time.Since(start).Milliseconds(), "mp3", mp3Key, "streamed", stream)
 	return nil
 }
 
-func transcodeWithFFmpeg(ctx context.Context, inputPath, outputPath string) error {
-	cmd := exec.CommandContext(
-		ctx,
-		"ffmpeg",
+func parseArtifacts(raw string, fetchCover bool) ([]string, error) {
+	names := []string{}
+	for _, name := range strings.Split(raw, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if fetchCover {
+		names = append(names, jobs.ArtifactCover)
+	}
+	opts := jobs.Options{Artifacts: &names}
+	if err := opts.Normalize(); err != nil {
+		return nil, err
+	}
+	return *opts.Artifacts, nil
+}
+
+// sideArtifact is an optional extra output of a job, e.g. the cover image.
+type sideArtifact struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// jobArtifacts returns the side artifacts to produce: the job's own list
+// limited to those enabled on this worker, or all enabled ones by default.
+func jobArtifacts(opts jobs.Options) []string {
+	if opts.Artifacts == nil {
+		return enabledArtifacts
+	}
+	var out []string
+	for _, name := range *opts.Artifacts {
+		for _, enabled := range enabledArtifacts {
+			if name == enabled {
+				out = append(out, name)
+			}
+		}
+	}
+	return out
+}
+
+// runSideArtifacts runs the artifacts at most SIDE_ARTIFACT_CONCURRENCY at a
+// time, each under its own SIDE_ARTIFACT_TIMEOUT. Failures are logged and
+// never fail the job.
+func runSideArtifacts(ctx context.Context, cfg config.Config, side []sideArtifact) {
+	if len(side) == 0 {
+		return
+	}
+	limit := cfg.SideArtifactConcurrency
+	if limit < 1 {
+		limit = 1
+	}
+	slots := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for _, a := range side {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(a sideArtifact) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			actx, cancel := context.WithTimeout(ctx, cfg.SideArtifactTimeout)
+			defer cancel()
+			if err := a.run(actx); err != nil {
+				slog.WarnContext(ctx, "side artifact failed", "artifact", a.name, "err", err)
+			}
+		}(a)
+	}
+	wg.Wait()
+}
+
+// jobObjectKey names a job's object from S3_KEY_TEMPLATE.
+func jobObjectKey(cfg config.Config, p queue.ProcessPayload, ext string, keyTime time.Time) string {
+	return storage.ExpandKey(cfg.S3KeyTemplate, storage.KeyVars{JobID: p.JobID, Platform: p.Platform, Ext: ext, Time: keyTime})
+}
+
+// jobKeyTime is the time S3_KEY_TEMPLATE dates a job's objects by: its
+// creation, so the output and cover share a date however long the job runs
+// and the API can derive the same key.
+func jobKeyTime(ctx context.Context, st *store.Store, jobID string) (time.Time, error) {
+	j, err := st.GetJob(ctx, jobID)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("load job: %w", err)
+	}
+	return j.CreatedAt, nil
+}
+
+// fetchCover stores the parser-reported cover image next to the audio.
+func fetchCover(ctx context.Context, cfg config.Config, st *store.Store, s3 storage.Storage, workDir string, p queue.ProcessPayload, coverURL string, keyTime time.Time) error {
+	coverPath := filepath.Join(workDir, "cover.jpg")
+	headers := downloadHeaders(downloadPlatform(p, parser.Result{}), p.SourceURL)
+	if err := downloadOnce(ctx, coverURL, coverPath, headers, cfg.SideArtifactTimeout, nil); err != nil {
+		return err
+	}
+	f, err := os.Open(coverPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	key := jobObjectKey(cfg, p, "jpg", keyTime)
+	if err := s3.PutObject(ctx, key, f, fi.Size(), "image/jpeg"); err != nil {
+		return err
+	}
+	return st.UpdateJobCover(ctx, p.JobID, key)
+}
+
+// shareBracketRe matches the 【...】 brackets Chinese share messages put the
+// title (or the app's name) in.
+var shareBracketRe = regexp.MustCompile(`【([^】]+)】`)
+
+var shareURLRe = regexp.MustCompile(`https?://\S+`)
+
+// shareAppNames are bracketed names that are not a title, as in
+// "打开【小红书】App查看".
+var shareAppNames = map[string]bool{"抖音": true, "快手": true, "小红书": true, "哔哩哔哩": true, "微视": true, "好看视频": true}
+
+// shareTextTitle derives a title from the share message the job was
+// submitted with, for when the parser reports none; "" when there is none.
+func shareTextTitle(ctx context.Context, st *store.Store, jobID string) string {
+	j, err := st.GetJob(ctx, jobID)
+	if err != nil || !j.SourceText.Valid {
+		return ""
+	}
+	return titleFromShareText(j.SourceText.String)
+}
+
+// titleFromShareText returns the first bracketed title in a share message,
+// else the text before its link.
+func titleFromShareText(text string) string {
+	for _, m := range shareBracketRe.FindAllStringSubmatch(text, -1) {
+		title := strings.TrimSpace(m[1])
+		title = strings.TrimSuffix(strings.TrimSuffix(title, "_哔哩哔哩_bilibili"), "-哔哩哔哩")
+		if title != "" && !shareAppNames[title] {
+			return title
+		}
+	}
+	if loc := shareURLRe.FindStringIndex(text); loc != nil {
+		text = text[:loc[0]]
+	}
+	return strings.TrimSpace(text)
+}
+
+// sanitizeTitle makes a parser-reported title safe for JSON and ffmpeg
+// arguments: invalid UTF-8 becomes U+FFFD, control and invisible format
+// characters are dropped, whitespace runs collapse to one space, and the
+// result is cut to maxRunes (0 means no limit).
+func sanitizeTitle(raw string, maxRunes int) string {
+	var b strings.Builder
+	space := false
+	n := 0
+	for _, r := range strings.ToValidUTF8(raw, "\uFFFD") {
+		if unicode.IsSpace(r) {
+			space = b.Len() > 0
+			continue
+		}
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			continue
+		}
+		need := 1
+		if space {
+			need = 2
+		}
+		if maxRunes > 0 && n+need > maxRunes {
+			break
+		}
+		if space {
+			b.WriteByte(' ')
+			n++
+			space = false
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return b.String()
+}
+
+// trackMeta is written into the output for formats that support tags.
+type trackMeta struct {
+	Title   string
+	Artist  string
+	Comment string
+}
+
+func (m trackMeta) args() []string {
+	var args []string
+	if m.Title != "" {
+		args = append(args, "-metadata", "title="+m.Title)
+	}
+	if m.Artist != "" {
+		args = append(args, "-metadata", "artist="+m.Artist)
+	}
+	if m.Comment != "" {
+		args = append(args, "-metadata", "comment="+m.Comment)
+	}
+	return args
+}
+
+type transcodeStats struct {
+	CPUTime time.Duration
+}
+
+func transcodeWithFFmpeg(ctx context.Context, cfg config.Config, inputPath, outputPath string, opts jobs.Options, meta trackMeta, progress *transcodeProgress) (transcodeStats, error) {
+	stats, err := runTranscode(ctx, cfg, inputPath, nil, outputPath, opts, meta, progress, nil)
+	if err != nil && cfg.FFmpegHWAccel != "" && ctx.Err() == nil && isHWAccelError(err) {
+		slog.WarnContext(ctx, "hardware decode unavailable, retrying in software", "hwaccel", cfg.FFmpegHWAccel, "err", truncate(err.Error(), 200))
+		cfg.FFmpegHWAccel = ""
+		return runTranscode(ctx, cfg, inputPath, nil, outputPath, opts, meta, progress, nil)
+	}
+	return stats, err
+}
+
+// isHWAccelError reports whether ffmpeg failed to set up the -hwaccel
+// decoder rather than on the media itself.
+func isHWAccelError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, marker := range []string{"hwaccel", "device creation failed", "hardware device", "failed setup for format"} {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// runTranscode runs ffmpeg on inputPath, or on stdin when it is non-nil
+// (inputPath is then "pipe:0"). A non-nil out receives the output as MP3
+// instead of outputPath. A non-nil progress receives ffmpeg's -progress
+// output unless out is set.
+func runTranscode(ctx context.Context, cfg config.Config, inputPath string, stdin io.Reader, outputPath string, opts jobs.Options, meta trackMeta, progress *transcodeProgress, out io.Writer) (transcodeStats, error) {
+	args := []string{
 		"-hide_banner",
 		"-loglevel",
 		"error",
 		"-y",
-		"-i",
-		inputPath,
-		"-vn",
-		"-acodec",
-		"libmp3lame",
-		"-ar",
-		"44100",
-		"-b:a",
-		"128k",
-		outputPath,
+	}
+	if cfg.FFmpegHWAccel != "" {
+		args = append(args, "-hwaccel", cfg.FFmpegHWAccel)
+	}
+	if opts.Start > 0 {
+		args = append(args, "-ss", formatSeconds(float64(opts.Start)))
+	}
+	args = append(args, "-i", inputPath, "-vn")
+	if cfg.FFmpegThreads > 0 {
+		args = append(args, "-threads", strconv.Itoa(cfg.FFmpegThreads))
+	}
+	if opts.End > 0 {
+		args = append(args, "-t", formatSeconds(float64(opts.End-opts.Start)))
+	}
+	loudnorm := cfg.AudioLoudnorm
+	if opts.Loudnorm != nil {
+		loudnorm = *opts.Loudnorm
+	}
+	var filters []string
+	if loudnorm {
+		filter := loudnormFilter
+		if cfg.LoudnormTwoPass {
+			m, err := measureLoudness(ctx, cfg, inputPath)
+			if err != nil {
+				return transcodeStats{}, err
+			}
+			filter = fmt.Sprintf("%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+				loudnormFilter, m.InputI, m.InputTP, m.InputLRA, m.InputThresh, m.TargetOffset)
+		}
+		filters = append(filters, filter)
+	}
+	// Fades go after loudnorm, which would otherwise lift them back up.
+	fades, err := fadeFilters(ctx, cfg, inputPath, opts)
+	if err != nil {
+		return transcodeStats{}, err
+	}
+	filters = append(filters, fades...)
+	if len(filters) > 0 {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
+	sampleRate, channels := cfg.AudioSampleRate, cfg.AudioChannels
+	if opts.SampleRate > 0 {
+		sampleRate = opts.SampleRate
+	}
+	if opts.Channels > 0 {
+		channels = opts.Channels
+	}
+	if opts.Output().Lossless {
+		args = append(args, opts.CodecArgs()...)
+	} else {
+		args = append(args, "-acodec", "libmp3lame", "-b:a", "128k", "-id3v2_version", "3")
+	}
+	args = append(args, "-ar", strconv.Itoa(sampleRate))
+	if channels > 0 {
+		args = append(args, "-ac", strconv.Itoa(channels))
+	}
+	if opts.Output().Tags {
+		args = append(args, "-map_metadata", "-1")
+		args = append(args, meta.args()...)
+	}
+	var stdout io.Writer
+	switch {
+	case out != nil:
+		args = append(args, "-f", "mp3", "pipe:1")
+		stdout = out
+	case progress != nil:
+		args = append(args, "-progress", "pipe:1", "-nostats", outputPath)
+		stdout = progress
+	default:
+		args = append(args, outputPath)
+	}
+	cmd := exec.CommandContext(ctx, cfg.FFmpegPath, args...)
+	cmd.Stdin = stdin
+	output, err := runFFmpeg(cmd, stdout, cfg.FFmpegNice)
+	var stats transcodeStats
+	if cmd.ProcessState != nil {
+		stats.CPUTime = cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+	}
+	if err != nil {
+		if cfg.FFmpegLenient && out == nil && ctx.Err() == nil && usableOutput(ctx, cfg, outputPath) {
+			slog.WarnContext(ctx, "ffmpeg failed but produced usable output", "output", filepath.Base(outputPath), "err", err, "stderr", strings.TrimSpace(output))
+			return stats, nil
+		}
+		if output == "" {
+			return stats, fmt.Errorf("ffmpeg failed: %w", err)
+		}
+		return stats, fmt.Errorf("ffmpeg failed: %w: %s", err, output)
+	}
+	return stats, nil
+}
+
+// usableOutput reports whether a file left behind by a failed ffmpeg run
+// probes as audio with a positive duration.
+func usableOutput(ctx context.Context, cfg config.Config, path string) bool {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Size() == 0 {
+		return false
+	}
+	duration, err := probeDuration(ctx, cfg, path)
+	return err == nil && duration > 0
+}
+
+func formatSeconds(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
+
+// checkTrimRange rejects trims that fall outside the probed media duration.
+// If the duration cannot be probed the trim is passed to ffmpeg unchecked.
+func checkTrimRange(ctx context.Context, cfg config.Config, inputPath string, opts jobs.Options) error {
+	duration, err := probeDuration(ctx, cfg, inputPath)
+	if err != nil {
+		slog.WarnContext(ctx, "trim check skipped, probe failed", "err", err)
+		return nil
+	}
+	if float64(opts.Start) >= duration {
+		return fmt.Errorf("%w: start %.3fs is beyond media duration %.3fs", errInvalidOptions, float64(opts.Start), duration)
+	}
+	if float64(opts.End) > duration {
+		return fmt.Errorf("%w: end %.3fs is beyond media duration %.3fs", errInvalidOptions, float64(opts.End), duration)
+	}
+	return nil
+}
+
+// transcodeDuration is the length of the output ffmpeg will produce from
+// inputPath, or 0 when it is unknown.
+func transcodeDuration(ctx context.Context, cfg config.Config, inputPath string, opts jobs.Options) float64 {
+	if opts.End > 0 {
+		return float64(opts.End - opts.Start)
+	}
+	duration, err := probeDuration(ctx, cfg, inputPath)
+	if err != nil {
+		return 0
+	}
+	return math.Max(duration-float64(opts.Start), 0)
+}
+
+// fadeFilters returns the afade filters for the job's fade_in and fade_out.
+// The fade-out starts fade_out seconds before the end of the output, so it
+// needs the trimmed or probed duration; fades longer than the output are
+// rejected.
+func fadeFilters(ctx context.Context, cfg config.Config, inputPath string, opts jobs.Options) ([]string, error) {
+	if opts.FadeIn <= 0 && opts.FadeOut <= 0 {
+		return nil, nil
+	}
+	duration := transcodeDuration(ctx, cfg, inputPath, opts)
+	if duration > 0 && opts.FadeIn+opts.FadeOut > duration {
+		return nil, fmt.Errorf("%w: fades of %.3fs exceed the output duration %.3fs", errInvalidOptions, opts.FadeIn+opts.FadeOut, duration)
+	}
+	var filters []string
+	if opts.FadeIn > 0 {
+		filters = append(filters, "afade=t=in:st=0:d="+formatSeconds(opts.FadeIn))
+	}
+	if opts.FadeOut > 0 {
+		if duration <= 0 {
+			return nil, fmt.Errorf("%w: fade_out needs the media duration, which could not be probed", errInvalidOptions)
+		}
+		filters = append(filters, fmt.Sprintf("afade=t=out:st=%s:d=%s", formatSeconds(duration-opts.FadeOut), formatSeconds(opts.FadeOut)))
+	}
+	return filters, nil
+}
+
+func probeDuration(ctx context.Context, cfg config.Config, path string) (float64, error) {
+	cmd := exec.CommandContext(ctx, cfg.FFprobePath,
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path,
 	)
 	output, err := runCommand(cmd)
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe failed: %w: %s", err, output)
+	}
+	duration, err := strconv.ParseFloat(strings.TrimSpace(output), 64)
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe duration %q: %w", output, err)
+	}
+	return duration, nil
+}
+
+const loudnormFilter = "loudnorm=I=-16:TP=-1.5:LRA=11"
+
+type loudnormMeasurement struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// measureLoudness runs the loudnorm analysis pass and parses the JSON summary
+// ffmpeg prints at the end of stderr.
+func measureLoudness(ctx context.Context, cfg config.Config, inputPath string) (loudnormMeasurement, error) {
+	cmd := exec.CommandContext(ctx, cfg.FFmpegPath,
+		"-hide_banner",
+		"-nostats",
+		"-i", inputPath,
+		"-vn",
+		"-af", loudnormFilter+":print_format=json",
+		"-f", "null",
+		"-",
+	)
+	var buf bytes.Buffer
+	cmd.Stderr = &buf
+	if err := cmd.Run(); err != nil {
+		return loudnormMeasurement{}, fmt.Errorf("loudnorm analysis failed: %w: %s", err, truncate(strings.TrimSpace(buf.String()), 800))
+	}
+	out := buf.String()
+	start := strings.LastIndex(out, "{")
+	end := strings.LastIndex(out, "}")
+	if start < 0 || end < start {
+		return loudnormMeasurement{}, errors.New("loudnorm analysis produced no measurements")
+	}
+	var m loudnormMeasurement
+	if err := json.Unmarshal([]byte(out[start:end+1]), &m); err != nil {
+		return loudnormMeasurement{}, fmt.Errorf("loudnorm analysis output: %w", err)
+	}
+	return m, nil
+}
+
+// recordUsage stores per-job resource usage. It is best-effort: a failure is
+// logged and never fails the job.
+func recordUsage(ctx context.Context, st *store.Store, jobID string, downloadBytes, outputBytes int64, stats transcodeStats) {
+	usage := store.JobUsage{DownloadBytes: downloadBytes, OutputBytes: outputBytes}
+	usage.TranscodeCPUMs = stats.CPUTime.Milliseconds()
+	if err := st.UpdateJobUsage(ctx, jobID, usage); err != nil {
+		slog.WarnContext(ctx, "record usage failed", "err", err)
+	}
+}
+
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// recordOutputInfo stores the output size, checksum and duration shown to
+// API clients.
+func recordOutputInfo(ctx context.Context, cfg config.Config, st *store.Store, jobID, outputPath, checksum string) {
+	fi, err := os.Stat(outputPath)
+	if err != nil {
+		slog.WarnContext(ctx, "stat output failed", "err", err)
+		return
+	}
+	var duration *float64
+	if d, err := probeDuration(ctx, cfg, outputPath); err == nil {
+		duration = &d
+	} else {
+		slog.WarnContext(ctx, "probe output duration failed", "err", err)
+	}
+	if err := st.UpdateJobOutputInfo(ctx, jobID, fi.Size(), duration, checksum); err != nil {
+		slog.WarnContext(ctx, "record output info failed", "err", err)
+	}
+}
+
+// streamedOutput is an output uploaded straight from ffmpeg's stdout.
+// Duration is the expected output length in seconds, 0 when unknown, since
+// there is no file to probe.
+type streamedOutput struct {
+	Key      string
+	Size     int64
+	SHA256   string
+	Duration float64
+}
+
+// pipeUpload uploads what transcode writes to key while it is written,
+// counting and hashing it on the way. A failed transcode aborts the upload,
+// and a failed upload makes transcode's writes fail.
+func pipeUpload(ctx context.Context, s3 storage.Storage, key, contentType string, transcode func(w io.Writer) error) (streamedOutput, error) {
+	pr, pw := io.Pipe()
+	h := sha256.New()
+	body := &progressReader{r: io.TeeReader(pr, h), report: func(int64) {}}
+	uploaded := make(chan error, 1)
+	go func() {
+		_, err := s3.UploadMP3Stream(ctx, body, key, contentType)
+		pr.CloseWithError(err)
+		uploaded <- err
+	}()
+	err := transcode(pw)
+	pw.CloseWithError(err)
+	uploadErr := <-uploaded
+	if err != nil {
+		return streamedOutput{}, err
+	}
+	if uploadErr != nil {
+		return streamedOutput{}, uploadErr
+	}
+	return streamedOutput{Key: key, Size: body.done, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkBinary runs "<path> -version" to make sure the tool resolves and starts.
+func checkBinary(ctx context.Context, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	output, err := runCommand(exec.CommandContext(ctx, path, "-version"))
 	if err != nil {
 		if output == "" {
-			return fmt.Errorf("ffmpeg failed: %w", err)
+			return err
 		}
-		return fmt.Errorf("ffmpeg failed: %w: %s", err, output)
+		return fmt.Errorf("%w: %s", err, output)
 	}
 	return nil
 }
@@ -163,6 +1376,28 @@ func runCommand(cmd *exec.Cmd) (string, error) {
 	return out, err
 }
 
+// runFFmpeg is runCommand for a transcode. A non-nil stdout receives
+// ffmpeg's standard output instead of the returned text, and a positive nice
+// lowers the process's CPU priority as soon as it has started.
+func runFFmpeg(cmd *exec.Cmd, stdout io.Writer, nice int) (string, error) {
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	if stdout != nil {
+		cmd.Stdout = stdout
+	}
+	cmd.Stderr = &buf
+	err := cmd.Start()
+	if err == nil {
+		if nice > 0 {
+			if err := setNice(cmd.Process.Pid, nice); err != nil {
+				slog.Warn("lower ffmpeg priority failed", "nice", nice, "err", err)
+			}
+		}
+		err = cmd.Wait()
+	}
+	return truncate(strings.TrimSpace(buf.String()), 800), err
+}
+
 func truncate(s string, max int) string {
 	if max <= 0 || len(s) <= max {
 		return s
@@ -170,133 +1405,401 @@ func truncate(s string, max int) string {
 	return s[:max] + "..."
 }
 
-type parserResponse struct {
-	Retcode int    `json:"retcode"`
-	Retdesc string `json:"retdesc"`
-	Data    struct {
-		VideoID  string `json:"video_id"`
-		Platform string `json:"platform"`
-		Title    string `json:"title"`
-		VideoURL string `json:"video_url"`
-		CoverURL string `json:"cover_url"`
-		AudioURL string `json:"audio_url"`
-	} `json:"data"`
-	Succ bool `json:"succ"`
+// resolveWithParser asks the parser for the job's media URLs, holding a
+// parser slot only for the call itself.
+func resolveWithParser(ctx context.Context, cfg config.Config, p queue.ProcessPayload) (parser.Result, error) {
+	if cfg.ParserCacheTTL > 0 && !p.FreshParse {
+		if parsed, ok := cachedParse(ctx, p.SourceURL); ok {
+			slog.InfoContext(ctx, "parser cache hit")
+			return parsed, nil
+		}
+	}
+	if !parserBreaker.allow() {
+		return parser.Result{}, errParserUnavailable
+	}
+	release, err := acquireParserSlot(ctx, cfg.ParserMaxWait)
+	if err != nil {
+		return parser.Result{}, err
+	}
+	parsed, err := parseWithRetries(ctx, cfg, p.SourceURL, p.Platform)
+	release()
+	if err != nil {
+		if platform.IsGlobal(p.Platform) && errors.Is(err, parser.ErrRejected) {
+			return parser.Result{}, fmt.Errorf("%w: %s (%v)", errParserUnsupported, p.Platform, err)
+		}
+		return parser.Result{}, err
+	}
+	if cfg.ParserCacheTTL > 0 {
+		storeParse(ctx, p.SourceURL, parsed, cfg.ParserCacheTTL)
+	}
+	return parsed, nil
 }
 
-type parserRequest struct {
-	Text string `json:"text"`
+// The parser cache keeps resolved media URLs in Redis for PARSER_CACHE_TTL so
+// retries of the same link skip the parser. Cache errors only cost a parser
+// call.
+func parseCacheKey(sourceURL string) string {
+	sum := sha256.Sum256([]byte(sourceURL))
+	return "v2m:parse:" + hex.EncodeToString(sum[:])
 }
 
-type parserResult struct {
-	VideoURL string
-	AudioURL string
-	Platform string
+func cachedParse(ctx context.Context, sourceURL string) (parser.Result, bool) {
+	raw, err := rdb.Get(ctx, parseCacheKey(sourceURL)).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			slog.WarnContext(ctx, "parser cache read failed", "err", err)
+		}
+		return parser.Result{}, false
+	}
+	var parsed parser.Result
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		return parser.Result{}, false
+	}
+	return parsed, true
 }
 
-func downloadWithParser(ctx context.Context, cfg config.Config, workDir, sourceURL, jobID string) (string, error) {
-	parsed, err := parseWithParser(ctx, cfg, sourceURL)
+func storeParse(ctx context.Context, sourceURL string, parsed parser.Result, ttl time.Duration) {
+	raw, err := json.Marshal(parsed)
 	if err != nil {
-		return "", err
+		return
 	}
+	if err := rdb.Set(ctx, parseCacheKey(sourceURL), raw, ttl).Err(); err != nil {
+		slog.WarnContext(ctx, "parser cache write failed", "err", err)
+	}
+}
 
-	downloadURL := parsed.VideoURL
-	fileExt := ".mp4"
-	if strings.TrimSpace(parsed.AudioURL) != "" {
-		downloadURL = parsed.AudioURL
-		fileExt = ".m4a"
+// forgetParse drops a cached result whose media URLs failed to download, as
+// they have probably expired.
+func forgetParse(ctx context.Context, sourceURL string) {
+	if err := rdb.Del(ctx, parseCacheKey(sourceURL)).Err(); err != nil {
+		slog.WarnContext(ctx, "parser cache delete failed", "err", err)
 	}
-	if strings.TrimSpace(downloadURL) == "" {
-		return "", errors.New("parser returned empty media url")
+}
+
+// downloadMedia downloads the preferred media URL into workDir, falling back
+// to the next one when a download fails.
+func downloadMedia(ctx context.Context, cfg config.Config, st *store.Store, workDir string, p queue.ProcessPayload, parsed parser.Result) (string, error) {
+	prefer := mediaPreference(cfg, p)
+	sources := mediaSources(parsed, prefer)
+	if len(sources) == 0 {
+		return "", errEmptyMedia
 	}
 
-	outPath := filepath.Join(workDir, jobID+fileExt)
-	if err := downloadToFile(ctx, downloadURL, outPath, sourceURL, cfg.JobTimeout); err != nil {
-		return "", err
+	var err error
+	headers := downloadHeaders(downloadPlatform(p, parsed), p.SourceURL)
+	progress := &downloadProgress{st: st, jobID: p.JobID}
+	for i, src := range sources {
+		outPath := filepath.Join(workDir, p.JobID+src.ext)
+		err = downloadToFile(ctx, src.url, outPath, headers, downloadTimeoutFor(cfg, p.Platform), progress)
+		if err == nil {
+			err = checkMedia(ctx, cfg, outPath)
+		}
+		if err == nil {
+			slog.InfoContext(ctx, "parser resolved", "platform", parsed.Platform, "media", src.kind, "prefer", prefer, "url", src.url)
+			recordMediaDownload(ctx, src.kind, prefer, fileSize(outPath))
+			return outPath, nil
+		}
+		_ = os.Remove(outPath)
+		if i < len(sources)-1 && ctx.Err() == nil {
+			slog.WarnContext(ctx, "media download failed, trying fallback", "media", src.kind, "fallback", sources[i+1].kind, "err", truncate(err.Error(), 200))
+		}
 	}
+	return "", err
+}
 
-	log.Printf("parser resolved platform=%s url=%s", parsed.Platform, downloadURL)
-	return outPath, nil
+// checkMedia sniffs the first bytes of a download and rejects text (HTML
+// error pages, JSON "URL expired" blobs) before it reaches ffmpeg. With
+// MEDIA_PROBE_CHECK it also requires ffprobe to find a duration.
+func checkMedia(ctx context.Context, cfg config.Config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	_ = f.Close()
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: empty file", errNotMedia)
+	}
+	if contentType := http.DetectContentType(head[:n]); strings.HasPrefix(contentType, "text/") {
+		snippet := strings.Join(strings.Fields(string(head[:min(n, 120)])), " ")
+		return fmt.Errorf("%w: got %s (%q)", errNotMedia, contentType, snippet)
+	}
+	if cfg.MediaProbeCheck {
+		if _, err := probeDuration(ctx, cfg, path); err != nil {
+			return fmt.Errorf("%w: %v", errNotMedia, err)
+		}
+	}
+	return nil
 }
 
-func parseWithParser(ctx context.Context, cfg config.Config, sourceURL string) (parserResult, error) {
-	baseURL := strings.TrimSpace(cfg.ParserAPIURL)
-	if baseURL == "" {
-		return parserResult{}, errors.New("PARSER_API_URL is required")
+func mediaPreference(cfg config.Config, p queue.ProcessPayload) string {
+	if p.Options.Prefer != "" {
+		return p.Options.Prefer
 	}
-	endpoint, err := url.JoinPath(baseURL, "api/parse")
-	if err != nil {
-		return parserResult{}, err
+	return cfg.MediaPrefer
+}
+
+// canStreamTranscode reports whether the job can be transcoded straight from
+// the download. Trims and two-pass loudnorm need to read the source more
+// than once, so they always use a temp file.
+func canStreamTranscode(cfg config.Config, plat string, opts jobs.Options) bool {
+	if !cfg.StreamTranscode || streamSkipPlatforms[plat] {
+		return false
 	}
+	// A fade-out is placed from the probed duration, which a stream lacks.
+	if opts.Start > 0 || opts.End > 0 || opts.FadeOut > 0 {
+		return false
+	}
+	loudnorm := cfg.AudioLoudnorm
+	if opts.Loudnorm != nil {
+		loudnorm = *opts.Loudnorm
+	}
+	return !(loudnorm && cfg.LoudnormTwoPass)
+}
 
-	ts := fmt.Sprintf("%d", time.Now().UnixMilli())
-	gclt, err := randomLetters(32)
+// streamTranscode pipes the preferred media URL's response body straight
+// into ffmpeg, so the source never touches disk. It returns the number of
+// source bytes read. There is no resume or fallback URL here: on failure the
+// caller falls back to the file path. A non-nil out receives the output
+// instead of outputPath, as in runTranscode.
+func streamTranscode(ctx context.Context, cfg config.Config, p queue.ProcessPayload, parsed parser.Result, outputPath string, opts jobs.Options, meta trackMeta, out io.Writer) (transcodeStats, int64, error) {
+	sources := mediaSources(parsed, mediaPreference(cfg, p))
+	if len(sources) == 0 {
+		return transcodeStats{}, 0, errEmptyMedia
+	}
+	src := sources[0]
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.url, nil)
 	if err != nil {
-		return parserResult{}, err
+		return transcodeStats{}, 0, err
 	}
-	egct := vigenereEncrypt(gclt, timestampToKey(ts))
-
-	body, err := json.Marshal(parserRequest{Text: sourceURL})
+	req.Header = downloadHeaders(downloadPlatform(p, parsed), p.SourceURL)
+	release, err := downloadHosts.acquire(ctx, src.url)
 	if err != nil {
-		return parserResult{}, err
+		return transcodeStats{}, 0, err
 	}
+	defer release()
+	client := &http.Client{Timeout: downloadTimeoutFor(cfg, p.Platform), Transport: mediaTransport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return transcodeStats{}, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return transcodeStats{}, 0, fmt.Errorf("download http status %d", resp.StatusCode)
+	}
+	body := &progressReader{r: resp.Body, report: func(int64) {}}
+	slog.InfoContext(ctx, "streaming transcode", "platform", parsed.Platform, "media", src.kind, "url", src.url)
+	stats, err := runTranscode(ctx, cfg, "pipe:0", body, outputPath, opts, meta, nil, out)
+	metrics.DownloadBytes.Add(float64(body.done))
+	if err == nil {
+		recordMediaDownload(ctx, src.kind, mediaPreference(cfg, p), body.done)
+	}
+	return stats, body.done, err
+}
+
+// recordMediaDownload counts a fetched source by stream kind, and logs when
+// the full video had to be fetched although audio was preferred, so the
+// bandwidth cost of missing audio streams shows up in metrics and logs.
+func recordMediaDownload(ctx context.Context, kind, prefer string, size int64) {
+	metrics.MediaDownloads.WithLabelValues(kind).Inc()
+	metrics.MediaDownloadBytes.WithLabelValues(kind).Add(float64(size))
+	if kind == "video" && prefer != jobs.PreferVideo {
+		slog.InfoContext(ctx, "no usable audio stream, fetched video", "prefer", prefer, "bytes", size)
+	}
+}
+
+type mediaSource struct {
+	kind string
+	url  string
+	ext  string
+}
+
+// mediaSources orders the parser's media URLs by preference; later entries
+// are fallbacks when an earlier download fails.
+func mediaSources(parsed parser.Result, prefer string) []mediaSource {
+	var audio, video []mediaSource
+	if u := strings.TrimSpace(parsed.AudioURL); u != "" {
+		audio = []mediaSource{{kind: "audio", url: u, ext: ".m4a"}}
+	}
+	if u := strings.TrimSpace(parsed.VideoURL); u != "" {
+		video = []mediaSource{{kind: "video", url: u, ext: ".mp4"}}
+	}
+	if prefer == jobs.PreferVideo {
+		return append(video, audio...)
+	}
+	return append(audio, video...)
+}
+
+// acquireParserSlot waits up to maxWait for a parser slot. Timing out returns
+// errParserBusy, which is retried like any other transient failure.
+func acquireParserSlot(ctx context.Context, maxWait time.Duration) (func(), error) {
+	if parserSlots == nil {
+		return func() {}, nil
+	}
+	start := time.Now()
+	select {
+	case parserSlots <- struct{}{}:
+		metrics.ParserWaitDuration.Observe(time.Since(start).Seconds())
+		return func() { <-parserSlots }, nil
+	default:
+	}
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case parserSlots <- struct{}{}:
+		metrics.ParserWaitDuration.Observe(time.Since(start).Seconds())
+		return func() { <-parserSlots }, nil
+	case <-timer.C:
+		metrics.ParserWaitTimeouts.Inc()
+		return nil, errParserBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+// fetchStaged copies an uploaded source file from its staging object into
+// workDir. The upload's file name (from the upload:// source URL) becomes the
+// title.
+func fetchStaged(ctx context.Context, s3 storage.Storage, workDir string, p queue.ProcessPayload) (string, parser.Result, error) {
+	obj, _, err := s3.OpenObject(ctx, p.StagedKey)
 	if err != nil {
-		return parserResult{}, err
+		return "", parser.Result{}, fmt.Errorf("open staged upload: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Timestamp", ts)
-	req.Header.Set("X-GCLT-Text", gclt)
-	req.Header.Set("X-EGCT-Text", egct)
+	defer obj.Close()
+	name := path.Base(strings.TrimPrefix(p.SourceURL, queue.UploadScheme))
+	outPath := filepath.Join(workDir, p.JobID+path.Ext(name))
+	f, err := os.Create(outPath)
+	if err != nil {
+		return "", parser.Result{}, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, obj); err != nil {
+		return "", parser.Result{}, fmt.Errorf("copy staged upload: %w", err)
+	}
+	return outPath, parser.Result{
+		Platform: platform.PlatformUpload,
+		Title:    strings.TrimSuffix(name, path.Ext(name)),
+	}, nil
+}
 
-	client := &http.Client{Timeout: boundedTimeout(cfg.JobTimeout)}
-	resp, err := client.Do(req)
+// retainedSourceInfo describes a source kept by RETAIN_SOURCE from what the
+// first run stored, since the staged file itself carries no metadata.
+func retainedSourceInfo(ctx context.Context, st *store.Store, jobID string) (parser.Result, error) {
+	j, err := st.GetJob(ctx, jobID)
 	if err != nil {
-		return parserResult{}, err
+		return parser.Result{}, fmt.Errorf("load job: %w", err)
 	}
-	defer resp.Body.Close()
+	return parser.Result{Platform: j.Platform, Title: j.Title.String, VideoID: j.VideoID.String}, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return parserResult{}, fmt.Errorf("parser http status %d", resp.StatusCode)
+// parseWithRetries calls the parser, retrying up to PARSER_RETRIES times with
+// a growing backoff when it times out, is unreachable or answers 5xx. The
+// outcome feeds parserBreaker; answers that show the parser is up (including
+// 4xx and rejections) reset it.
+func parseWithRetries(ctx context.Context, cfg config.Config, sourceURL, plat string) (parser.Result, error) {
+	for attempt := 1; ; attempt++ {
+		parsed, err := parseWithParser(ctx, cfg, sourceURL, plat)
+		if err == nil {
+			parserBreaker.record(true)
+			return parsed, nil
+		}
+		if ctx.Err() != nil {
+			return parser.Result{}, err
+		}
+		if !isRetryableParse(err) {
+			parserBreaker.record(true)
+			return parser.Result{}, err
+		}
+		if attempt > cfg.ParserRetries {
+			if parserBreaker.record(false) {
+				slog.WarnContext(ctx, "parser circuit open", "cooldown", cfg.ParserBreakerCooldown, "err", truncate(err.Error(), 200))
+			}
+			return parser.Result{}, err
+		}
+		backoff := time.Duration(attempt) * time.Second
+		slog.WarnContext(ctx, "parser retrying", "attempt", attempt+1, "err", truncate(err.Error(), 200))
+		select {
+		case <-ctx.Done():
+			return parser.Result{}, ctx.Err()
+		case <-time.After(backoff):
+		}
 	}
+}
 
-	var parsed parserResponse
-	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
-		return parserResult{}, err
+// isRetryableParse reports whether a parser call failed because the parser
+// was unreachable, timed out or had a server error. RETRY_RULES take
+// precedence.
+func isRetryableParse(err error) bool {
+	if errors.Is(err, netguard.ErrBlocked) {
+		return false
 	}
-	if !parsed.Succ || parsed.Retcode != 200 {
-		return parserResult{}, fmt.Errorf("parser error: %d %s", parsed.Retcode, parsed.Retdesc)
+	if retryable, ok := classifyError(err); ok {
+		return retryable
 	}
-	if strings.TrimSpace(parsed.Data.VideoURL) == "" && strings.TrimSpace(parsed.Data.AudioURL) == "" {
-		return parserResult{}, errors.New("parser returned no media url")
+	var se parser.StatusError
+	if errors.As(err, &se) {
+		return se.Code >= 500
 	}
+	var ue *url.Error
+	return errors.As(err, &ue)
+}
 
-	return parserResult{
-		VideoURL: parsed.Data.VideoURL,
-		AudioURL: parsed.Data.AudioURL,
-		Platform: parsed.Data.Platform,
-	}, nil
+// parseWithParser makes one parser call for sourceURL, a link on plat.
+func parseWithParser(ctx context.Context, cfg config.Config, sourceURL, plat string) (parser.Result, error) {
+	timeout := boundedTimeout(cfg.JobTimeout)
+	if cfg.ParserTimeout > 0 {
+		timeout = cfg.ParserTimeout
+	}
+	client := &http.Client{Timeout: timeout, Transport: parserTransport}
+	return parser.Parse(ctx, client, parserEndpoint, parser.WithHeaders(parserAuth, parserHeaders[plat]), sourceURL)
 }
 
-func downloadToFile(ctx context.Context, sourceURL, destPath, referer string, timeout time.Duration) error {
+func downloadToFile(ctx context.Context, sourceURL, destPath string, headers http.Header, timeout time.Duration, progress *downloadProgress) error {
 	if strings.TrimSpace(sourceURL) == "" {
 		return errors.New("download url is empty")
 	}
 
+	if downloadChunks > 1 {
+		release, err := downloadHosts.acquire(ctx, sourceURL)
+		if err != nil {
+			return err
+		}
+		ok, err := downloadChunked(ctx, sourceURL, destPath, headers, timeout, progress, downloadChunks)
+		release()
+		if ok && err == nil {
+			return nil
+		}
+		if ok {
+			slog.WarnContext(ctx, "chunked download failed, using a single stream", "err", truncate(err.Error(), 200))
+		}
+	}
+
 	const maxAttempts = 3
 	var lastErr error
 	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		err := downloadOnce(ctx, sourceURL, destPath, referer, timeout)
+		release, err := downloadHosts.acquire(ctx, sourceURL)
+		if err != nil {
+			return err
+		}
+		err = downloadOnce(ctx, sourceURL, destPath, headers, timeout, progress)
+		release()
 		if err == nil {
 			return nil
 		}
 		lastErr = err
-		if !isRetryableDownload(err) || attempt == maxAttempts {
+		if ctx.Err() != nil || !isRetryableDownload(err) || attempt == maxAttempts {
 			return err
 		}
 		backoff := time.Duration(attempt) * time.Second
-		log.Printf("download retrying attempt=%d err=%s", attempt+1, truncate(err.Error(), 200))
+		var de downloadError
+		if errors.As(err, &de) && de.retryAfter > 0 && downloadRetryAfterMax > 0 {
+			backoff = min(de.retryAfter, downloadRetryAfterMax)
+		}
+		slog.WarnContext(ctx, "download retrying", "attempt", attempt+1, "backoff", backoff.String(), "err", truncate(err.Error(), 200))
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
@@ -306,6 +1809,184 @@ func downloadToFile(ctx context.Context, sourceURL, destPath, referer string, ti
 	return lastErr
 }
 
+// parsePlatformTimeouts reads "platform=duration" pairs separated by commas.
+func parsePlatformTimeouts(raw string) (map[string]time.Duration, error) {
+	out := make(map[string]time.Duration)
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid entry %q: expected platform=duration", part)
+		}
+		if !platform.IsKnown(name) {
+			return nil, fmt.Errorf("unknown platform %q", name)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid duration for %s: %q", name, value)
+		}
+		out[name] = d
+	}
+	return out, nil
+}
+
+// downloadPlatform picks the platform whose download headers apply: the one
+// detected at submission, else the one the parser reported.
+func downloadPlatform(p queue.ProcessPayload, parsed parser.Result) string {
+	if p.Platform != "" {
+		return p.Platform
+	}
+	return strings.ToLower(strings.TrimSpace(parsed.Platform))
+}
+
+// downloadHeaders returns the headers for a media download: the browser
+// User-Agent, the source page as Referer, then the platform's overrides.
+func downloadHeaders(plat, referer string) http.Header {
+	h := make(http.Header)
+	h.Set("User-Agent", downloadUserAgent)
+	if strings.TrimSpace(referer) != "" {
+		h.Set("Referer", referer)
+	}
+	for name, values := range platformHeaders[plat] {
+		if len(values) == 0 || values[0] == "" {
+			h.Del(name)
+			continue
+		}
+		h[name] = values
+	}
+	return h
+}
+
+// parsePlatformHeaders reads "platform.Header=value" entries separated by
+// semicolons on top of defaultPlatformHeaders. An empty value drops the header.
+func parsePlatformHeaders(raw string) (map[string]http.Header, error) {
+	out := make(map[string]http.Header, len(defaultPlatformHeaders))
+	for plat, h := range defaultPlatformHeaders {
+		out[plat] = h.Clone()
+	}
+	for _, part := range strings.Split(raw, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		plat, name, okName := strings.Cut(strings.TrimSpace(key), ".")
+		plat = strings.TrimSpace(plat)
+		name = strings.TrimSpace(name)
+		if !ok || !okName || plat == "" || name == "" {
+			return nil, fmt.Errorf("invalid entry %q: expected platform.Header=value", part)
+		}
+		if !platform.IsKnown(plat) {
+			return nil, fmt.Errorf("unknown platform %q", plat)
+		}
+		if out[plat] == nil {
+			out[plat] = make(http.Header)
+		}
+		// Keep empty values so they override the built-in default.
+		out[plat][http.CanonicalHeaderKey(name)] = []string{strings.TrimSpace(value)}
+	}
+	return out, nil
+}
+
+// platformHeaderConfig is one platform's entry in PLATFORM_HEADERS_JSON.
+type platformHeaderConfig struct {
+	Headers map[string]string `json:"headers"`
+	Cookies map[string]string `json:"cookies"`
+	// Parser also sends the headers and cookies with parser requests for
+	// the platform's links.
+	Parser bool `json:"parser"`
+}
+
+// applyPlatformHeadersJSON merges PLATFORM_HEADERS_JSON, an object keyed by
+// platform id, into headers, overriding earlier values; an empty header
+// value drops the header. Cookies are sent as one Cookie header. It returns
+// the headers of the platforms that forward them to the parser.
+func applyPlatformHeadersJSON(raw string, headers map[string]http.Header) (map[string]http.Header, error) {
+	forwarded := make(map[string]http.Header)
+	if strings.TrimSpace(raw) == "" {
+		return forwarded, nil
+	}
+	var entries map[string]platformHeaderConfig
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&entries); err != nil {
+		return nil, err
+	}
+	for plat, entry := range entries {
+		if !platform.IsKnown(plat) {
+			return nil, fmt.Errorf("unknown platform %q", plat)
+		}
+		h := make(http.Header)
+		for name, value := range entry.Headers {
+			if strings.TrimSpace(name) == "" {
+				return nil, fmt.Errorf("%s: empty header name", plat)
+			}
+			h[http.CanonicalHeaderKey(strings.TrimSpace(name))] = []string{strings.TrimSpace(value)}
+		}
+		if len(entry.Cookies) > 0 {
+			if _, ok := h["Cookie"]; ok {
+				return nil, fmt.Errorf("%s: set Cookie either as a header or as cookies", plat)
+			}
+			names := make([]string, 0, len(entry.Cookies))
+			for name := range entry.Cookies {
+				if name == "" || strings.ContainsAny(name, "=; ") {
+					return nil, fmt.Errorf("%s: invalid cookie name %q", plat, name)
+				}
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			pairs := make([]string, 0, len(names))
+			for _, name := range names {
+				pairs = append(pairs, name+"="+entry.Cookies[name])
+			}
+			h.Set("Cookie", strings.Join(pairs, "; "))
+		}
+		if headers[plat] == nil {
+			headers[plat] = make(http.Header)
+		}
+		for name, values := range h {
+			headers[plat][name] = values
+		}
+		if entry.Parser {
+			fh := make(http.Header)
+			for name, values := range h {
+				if values[0] != "" {
+					fh[name] = values
+				}
+			}
+			forwarded[plat] = fh
+		}
+	}
+	return forwarded, nil
+}
+
+// parsePlatformSet reads a comma-separated list of known platforms.
+func parsePlatformSet(raw string) (map[string]bool, error) {
+	out := make(map[string]bool)
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !platform.IsKnown(name) {
+			return nil, fmt.Errorf("unknown platform %q", name)
+		}
+		out[name] = true
+	}
+	return out, nil
+}
+
+func downloadTimeoutFor(cfg config.Config, plat string) time.Duration {
+	if d, ok := downloadTimeouts[plat]; ok {
+		return d
+	}
+	return boundedTimeout(cfg.JobTimeout)
+}
+
 func boundedTimeout(t time.Duration) time.Duration {
 	if t <= 0 {
 		return 10 * time.Minute
@@ -316,6 +1997,8 @@ func boundedTimeout(t time.Duration) time.Duration {
 type downloadError struct {
 	err       error
 	retryable bool
+	// retryAfter is the server's Retry-After delay, 0 when it sent none.
+	retryAfter time.Duration
 }
 
 func (e downloadError) Error() string {
@@ -326,10 +2009,33 @@ func (e downloadError) Unwrap() error {
 	return e.err
 }
 
+// parseRetryAfter reads a Retry-After header, in seconds or as an HTTP date,
+// as a delay from now; 0 when it is missing, invalid or in the past.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		return time.Duration(min(secs, int64(math.MaxInt64/time.Second))) * time.Second
+	}
+	t, err := http.ParseTime(v)
+	if err != nil || !t.After(now) {
+		return 0
+	}
+	return t.Sub(now)
+}
+
 func isRetryableDownload(err error) bool {
-	if err == nil {
+	if err == nil || errors.Is(err, context.Canceled) {
 		return false
 	}
+	if retryable, ok := classifyError(err); ok {
+		return retryable
+	}
 	var de downloadError
 	if errors.As(err, &de) {
 		return de.retryable
@@ -343,7 +2049,9 @@ func isRetryableDownload(err error) bool {
 	return true
 }
 
-func downloadOnce(ctx context.Context, sourceURL, destPath, referer string, timeout time.Duration) error {
+const downloadUserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+
+func downloadOnce(ctx context.Context, sourceURL, destPath string, headers http.Header, timeout time.Duration, progress *downloadProgress) error {
 	var offset int64
 	if fi, err := os.Stat(destPath); err == nil {
 		offset = fi.Size()
@@ -356,29 +2064,40 @@ func downloadOnce(ctx context.Context, sourceURL, destPath, referer string, time
 	if err != nil {
 		return downloadError{err: err, retryable: true}
 	}
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36")
-	if strings.TrimSpace(referer) != "" {
-		req.Header.Set("Referer", referer)
+	req.Header = headers.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
 	}
 	if offset > 0 {
 		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
 	}
 
-	client := &http.Client{Timeout: boundedTimeout(timeout)}
+	client := &http.Client{Timeout: boundedTimeout(timeout), Transport: mediaTransport}
 	resp, err := client.Do(req)
 	if err != nil {
-		return downloadError{err: err, retryable: true}
+		return downloadError{err: err, retryable: !errors.Is(err, netguard.ErrBlocked) && !errors.Is(err, context.Canceled)}
 	}
 	defer resp.Body.Close()
 
 	switch resp.StatusCode {
 	case http.StatusOK, http.StatusPartialContent:
+		if resp.StatusCode == http.StatusPartialContent && offset > 0 &&
+			!strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			// Appending a range that does not start where the file ends
+			// would corrupt it.
+			_ = os.Remove(destPath)
+			return downloadError{err: fmt.Errorf("%w: resume got content range %q", errDownloadTruncated, resp.Header.Get("Content-Range")), retryable: true}
+		}
 	case http.StatusRequestedRangeNotSatisfiable:
 		_ = os.Remove(destPath)
 		return downloadError{err: fmt.Errorf("download http status %d", resp.StatusCode), retryable: true}
 	default:
 		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
-		return downloadError{err: fmt.Errorf("download http status %d", resp.StatusCode), retryable: retryable}
+		var retryAfter time.Duration
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		return downloadError{err: fmt.Errorf("download http status %d", resp.StatusCode), retryable: retryable, retryAfter: retryAfter}
 	}
 
 	var f *os.File
@@ -397,94 +2116,559 @@ func downloadOnce(ctx context.Context, sourceURL, destPath, referer string, time
 		_ = f.Close()
 	}()
 
-	if _, err := io.Copy(f, resp.Body); err != nil {
-		if errors.Is(err, io.ErrUnexpectedEOF) || strings.Contains(err.Error(), "unexpected EOF") {
-			return downloadError{err: err, retryable: true}
-		}
-		return downloadError{err: err, retryable: true}
+	if resp.StatusCode != http.StatusPartialContent {
+		offset = 0
+	}
+	var total int64
+	if resp.ContentLength > 0 {
+		total = offset + resp.ContentLength
+	}
+	progress.start(offset, total)
+	body := &progressReader{r: resp.Body, done: offset, report: func(done int64) { progress.update(ctx, done) }}
+	n, err := io.Copy(f, body)
+	metrics.DownloadBytes.Add(float64(n))
+	if err == nil {
+		progress.finish(ctx, offset+n)
+	}
+	if err != nil {
+		return downloadError{err: err, retryable: !errors.Is(err, context.Canceled)}
+	}
+	if total > 0 && offset+n != total {
+		// The body ended cleanly at the wrong length. The prefix cannot be
+		// trusted, so the next attempt starts over instead of resuming.
+		_ = os.Remove(destPath)
+		return downloadError{err: fmt.Errorf("%w: got %d of %d bytes", errDownloadTruncated, offset+n, total), retryable: true}
 	}
 	return nil
 }
 
-func timestampToKey(ts string) string {
-	const digitsToLetters = "abcdefghijklmnopqrstuvwxyz"
-	var b strings.Builder
-	for _, r := range ts {
-		if r < '0' || r > '9' {
-			b.WriteRune('?')
-			continue
+// errDownloadTruncated marks a download whose size does not match what the
+// server advertised; the partial file is discarded.
+var errDownloadTruncated = errors.New("download size mismatch")
+
+// minChunkSize keeps chunked downloads from splitting small files into many
+// tiny requests.
+const minChunkSize = 4 << 20
+
+// downloadChunked fetches sourceURL as up to chunks concurrent byte ranges
+// into destPath. It returns ok=false without downloading anything when the
+// server does not serve ranges or the size is unknown or small, so the caller
+// falls back to downloadOnce. Ranges are written to a separate .part file that
+// is renamed on success, so destPath only ever holds a contiguous prefix for
+// downloadOnce to resume.
+func downloadChunked(ctx context.Context, sourceURL, destPath string, headers http.Header, timeout time.Duration, progress *downloadProgress, chunks int) (bool, error) {
+	client := &http.Client{Timeout: boundedTimeout(timeout), Transport: mediaTransport}
+	total, err := probeRangeSize(ctx, client, sourceURL, headers)
+	if err != nil || total < 2*minChunkSize {
+		return false, nil
+	}
+	chunks = min(chunks, int(total/minChunkSize))
+
+	partPath := destPath + ".part"
+	f, err := os.Create(partPath)
+	if err != nil {
+		return true, err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(partPath)
+	}()
+	if err := f.Truncate(total); err != nil {
+		return true, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu       sync.Mutex
+		done     int64
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	progress.start(0, total)
+	report := func(n int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		done += n
+		progress.update(ctx, done)
+	}
+	size := (total + int64(chunks) - 1) / int64(chunks)
+	for start := int64(0); start < total; start += size {
+		end := min(start+size, total) - 1
+		wg.Add(1)
+		go func(start, end int64) {
+			defer wg.Done()
+			if err := downloadRange(ctx, client, sourceURL, headers, f, start, end, report); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return true, firstErr
+	}
+	if err := f.Close(); err != nil {
+		return true, err
+	}
+	if err := os.Rename(partPath, destPath); err != nil {
+		return true, err
+	}
+	progress.finish(ctx, total)
+	return true, nil
+}
+
+// probeRangeSize asks for the first byte and returns the full size from
+// Content-Range, or an error when the server does not honor ranges.
+func probeRangeSize(ctx context.Context, client *http.Client, sourceURL string, headers http.Header) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header = headers.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<10))
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("ranges not supported: http status %d", resp.StatusCode)
+	}
+	_, size, ok := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	total, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+	if !ok || err != nil || total <= 0 {
+		return 0, errors.New("unknown content length")
+	}
+	return total, nil
+}
+
+// downloadRange writes bytes start..end (inclusive) of sourceURL into f at
+// their offset.
+func downloadRange(ctx context.Context, client *http.Client, sourceURL string, headers http.Header, f *os.File, start, end int64, report func(n int64)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = headers.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	want := end - start + 1
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("range %d-%d: http status %d", start, end, resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", start, end)) {
+		return fmt.Errorf("range %d-%d: unexpected content range %q", start, end, resp.Header.Get("Content-Range"))
+	}
+	var last int64
+	body := &progressReader{r: io.LimitReader(resp.Body, want), report: func(done int64) {
+		report(done - last)
+		last = done
+	}}
+	n, err := io.Copy(io.NewOffsetWriter(f, start), body)
+	metrics.DownloadBytes.Add(float64(n))
+	if err != nil {
+		return err
+	}
+	if n != want {
+		return fmt.Errorf("range %d-%d: %w", start, end, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// progressReader counts the bytes read through it and reports the running
+// total after every read.
+type progressReader struct {
+	r      io.Reader
+	done   int64
+	report func(done int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.done += int64(n)
+		p.report(p.done)
+	}
+	return n, err
+}
+
+// Progress is written at most every progressInterval, or sooner once another
+// 1/progressSteps of a known total has arrived.
+const (
+	progressInterval = 2 * time.Second
+	progressSteps    = 20
+)
+
+// downloadProgress throttles download progress into the jobs table and the
+// job's event channel. A nil *downloadProgress discards everything.
+type downloadProgress struct {
+	st       *store.Store
+	jobID    string
+	total    int64
+	lastAt   time.Time
+	lastDone int64
+	// startAt and startDone anchor the observed throughput for the ETA.
+	startAt   time.Time
+	startDone int64
+}
+
+func (d *downloadProgress) start(done, total int64) {
+	if d == nil {
+		return
+	}
+	d.total = total
+	d.lastDone = done
+	d.lastAt = time.Time{}
+	d.startAt = time.Now()
+	d.startDone = done
+}
+
+func (d *downloadProgress) update(ctx context.Context, done int64) {
+	if d == nil {
+		return
+	}
+	stepDue := d.total > 0 && (done-d.lastDone)*progressSteps >= d.total
+	if time.Since(d.lastAt) < progressInterval && !stepDue {
+		return
+	}
+	d.flush(ctx, done)
+}
+
+// finish always writes, so the last throttled update is never lost and the
+// final value equals the total.
+func (d *downloadProgress) finish(ctx context.Context, done int64) {
+	if d == nil {
+		return
+	}
+	d.total = done
+	d.flush(ctx, done)
+}
+
+func (d *downloadProgress) flush(ctx context.Context, done int64) {
+	d.lastAt = time.Now()
+	d.lastDone = done
+	var total *int64
+	if d.total > 0 {
+		t := d.total
+		total = &t
+	}
+	eta := d.eta(done)
+	updatedAt, err := d.st.UpdateJobProgress(ctx, d.jobID, done, total, eta)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.WarnContext(ctx, "record download progress failed", "err", err)
+		}
+		return
+	}
+	if rdb != nil {
+		u := events.JobUpdate{JobID: d.jobID, Status: jobs.StatusDownloading, ProgressBytes: &done, ProgressTotalBytes: total, ETASeconds: eta, UpdatedAt: updatedAt}
+		if err := events.Publish(ctx, rdb, u); err != nil {
+			slog.WarnContext(ctx, "publish progress failed", "err", err)
 		}
-		b.WriteByte(digitsToLetters[int(r-'0')])
 	}
-	return b.String()
 }
 
-func vigenereEncrypt(text, key string) string {
-	if key == "" {
-		return text
+// eta divides the bytes remaining by the throughput observed since start.
+// It is nil without a known total or before any bytes have arrived.
+func (d *downloadProgress) eta(done int64) *int64 {
+	if d.total <= 0 {
+		return nil
 	}
-	var b strings.Builder
-	keyIndex := 0
-	keyRunes := []rune(strings.ToLower(key))
-	for _, r := range text {
-		if !unicode.IsLetter(r) {
-			b.WriteRune(r)
-			continue
+	if done >= d.total {
+		return new(int64)
+	}
+	elapsed := time.Since(d.startAt).Seconds()
+	if done <= d.startDone || elapsed <= 0 {
+		return nil
+	}
+	rate := float64(done-d.startDone) / elapsed
+	eta := int64(math.Ceil(float64(d.total-done) / rate))
+	return &eta
+}
+
+// transcodeProgress reads ffmpeg's -progress output and throttles the
+// transcode ETA into the jobs table and the job's event channel. The ETA is
+// the media left to process divided by ffmpeg's reported speed.
+type transcodeProgress struct {
+	st       *store.Store
+	jobID    string
+	duration float64
+	buf      []byte
+	outTime  float64
+	speed    float64
+	lastAt   time.Time
+}
+
+// newTranscodeProgress returns nil when duration, in seconds of output, is
+// unknown, which leaves the ETA unset.
+func newTranscodeProgress(st *store.Store, jobID string, duration float64) *transcodeProgress {
+	if st == nil || duration <= 0 {
+		return nil
+	}
+	return &transcodeProgress{st: st, jobID: jobID, duration: duration}
+}
+
+// Write buffers ffmpeg's key=value lines; each "progress=" line ends a block.
+func (t *transcodeProgress) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	for {
+		i := bytes.IndexByte(t.buf, '\n')
+		if i < 0 {
+			return len(p), nil
 		}
-		shiftBase := 'a'
-		if unicode.IsUpper(r) {
-			shiftBase = 'A'
+		key, value, _ := strings.Cut(strings.TrimSpace(string(t.buf[:i])), "=")
+		t.buf = t.buf[i+1:]
+		switch key {
+		case "out_time_us":
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+				t.outTime = float64(us) / 1e6
+			}
+		case "speed":
+			t.speed, _ = strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "x"), 64)
+		case "progress":
+			if value == "end" || time.Since(t.lastAt) >= progressInterval {
+				t.flush(value == "end")
+			}
 		}
-		keyChar := keyRunes[keyIndex%len(keyRunes)]
-		keyShift := keyChar - 'a'
-		enc := (r-shiftBase+keyShift)%26 + shiftBase
-		b.WriteRune(enc)
-		keyIndex++
 	}
-	return b.String()
 }
 
-func randomLetters(n int) (string, error) {
-	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	if n <= 0 {
-		return "", nil
+func (t *transcodeProgress) flush(end bool) {
+	t.lastAt = time.Now()
+	var eta *int64
+	switch {
+	case end:
+		eta = new(int64)
+	case t.speed > 0:
+		left := int64(math.Ceil(math.Max(t.duration-t.outTime, 0) / t.speed))
+		eta = &left
 	}
-	var b strings.Builder
-	b.Grow(n)
-	max := big.NewInt(int64(len(letters)))
-	for i := 0; i < n; i++ {
-		r, err := crand.Int(crand.Reader, max)
-		if err != nil {
-			return "", err
+	// Write runs on exec's copying goroutine, so it gets its own context.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	updatedAt, err := t.st.UpdateJobTranscodeETA(ctx, t.jobID, eta)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Warn("record transcode eta failed", "job_id", t.jobID, "err", err)
+		}
+		return
+	}
+	if rdb != nil {
+		u := events.JobUpdate{JobID: t.jobID, Status: jobs.StatusTranscoding, ETASeconds: eta, UpdatedAt: updatedAt}
+		if err := events.Publish(ctx, rdb, u); err != nil {
+			slog.Warn("publish transcode eta failed", "job_id", t.jobID, "err", err)
+		}
+	}
+}
+
+// setJobFailed stores a failed or dead status with its error and category and
+// publishes it like setJobStatus.
+func setJobFailed(ctx context.Context, st *store.Store, jobID, status, errMsg, category string) error {
+	var cat *string
+	if category != "" {
+		cat = &category
+	}
+	updatedAt, err := st.UpdateJobFailure(ctx, jobID, status, &errMsg, cat)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rdb != nil {
+		u := events.JobUpdate{JobID: jobID, Status: status, Error: &errMsg, ErrorCategory: cat, UpdatedAt: updatedAt}
+		if err := events.Publish(ctx, rdb, u); err != nil {
+			slog.WarnContext(ctx, "publish status failed", "status", status, "err", err)
+		}
+	}
+	return nil
+}
+
+// setJobStatus stores the new status and publishes it to SSE subscribers.
+// Publishing is best effort; streams still show the change on reconnect.
+func setJobStatus(ctx context.Context, st *store.Store, jobID, status string, errMsg, mp3Key *string) error {
+	updatedAt, err := st.UpdateJobStatusAt(ctx, jobID, status, errMsg, mp3Key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rdb != nil {
+		u := events.JobUpdate{JobID: jobID, Status: status, Error: errMsg, MP3Key: mp3Key, UpdatedAt: updatedAt}
+		if err := events.Publish(ctx, rdb, u); err != nil {
+			slog.WarnContext(ctx, "publish status failed", "status", status, "err", err)
 		}
-		b.WriteByte(letters[r.Int64()])
 	}
-	return b.String(), nil
+	return nil
 }
 
-func recordFailure(ctx context.Context, st *store.Store, jobID string, err error) error {
+// recordFailure marks the job failed, or dead when asynq will not run it
+// again: the error is not retryable or this was the last attempt.
+func recordFailure(ctx context.Context, st *store.Store, p queue.ProcessPayload, err error) error {
 	if err == nil {
 		return nil
 	}
 	msg := truncate(err.Error(), 800)
-	log.Printf("job failed id=%s err=%s", jobID, msg)
-	_ = st.UpdateJobStatus(ctx, jobID, jobs.StatusFailed, &msg, nil)
-	if shouldSkipRetry(err) {
+	category := errorCategory(err)
+	skip := shouldSkipRetry(err)
+	retried, ok := asynq.GetRetryCount(ctx)
+	dead := skip || finalAttempt(ctx, err)
+	status := jobs.StatusFailed
+	if dead {
+		status = jobs.StatusDead
+	}
+	slog.ErrorContext(ctx, "job failed", "status", status, "category", category, "err", msg)
+	_ = setJobFailed(ctx, st, p.JobID, status, msg, category)
+	if dead {
+		recordDeadJob(ctx, st, p, err, retried+1)
+	} else if ok {
+		next := time.Now().Add(queue.RetryDelay(retried, retryBaseDelay, retryMaxDelay))
+		if err := st.UpdateJobNextRetry(ctx, p.JobID, next); err != nil {
+			slog.WarnContext(ctx, "record next retry failed", "err", err)
+		}
+	}
+	if skip {
 		return fmt.Errorf("%w: %s", asynq.SkipRetry, msg)
 	}
 	return err
 }
 
+// finalAttempt reports whether a failed attempt is the job's last: its error
+// skips retries or the task has none left.
+func finalAttempt(ctx context.Context, err error) bool {
+	if errors.Is(err, asynq.SkipRetry) {
+		return true
+	}
+	retried, ok := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	return ok && retried >= maxRetry
+}
+
+func recordDeadJob(ctx context.Context, st *store.Store, p queue.ProcessPayload, err error, attempts int) {
+	if !recordDeadJobs {
+		return
+	}
+	payload, merr := json.Marshal(p)
+	if merr != nil {
+		slog.WarnContext(ctx, "record dead job failed", "err", merr)
+		return
+	}
+	d := store.DeadJob{JobID: p.JobID, Error: err.Error(), Payload: payload, Attempts: attempts}
+	if err := st.RecordDeadJob(ctx, d); err != nil {
+		slog.WarnContext(ctx, "record dead job failed", "err", err)
+	}
+}
+
 func shouldSkipRetry(err error) bool {
 	if err == nil {
 		return false
 	}
-	msg := err.Error()
-	if strings.Contains(msg, "parser returned no media url") {
+	if errors.Is(err, errInvalidOptions) || errors.Is(err, netguard.ErrBlocked) || errors.Is(err, errNotMedia) {
 		return true
 	}
-	if strings.Contains(msg, "parser returned empty media url") {
-		return true
+	if retryable, ok := classifyError(err); ok {
+		return !retryable
 	}
-	return false
+	// Retrying cannot get past storage that denies the upload, but may get
+	// past an outage.
+	var uploadErr *storage.UploadError
+	if errors.As(err, &uploadErr) {
+		return uploadErr.Permanent
+	}
+	retryable, ok := jobs.IsRetryableCategory(errorCategory(err))
+	return ok && !retryable
+}
+
+// errorCategory maps a job error to the user-facing category stored with
+// it, or "" when the error does not say whether a retry can help.
+func errorCategory(err error) string {
+	var rejected *parser.RejectedError
+	var se parser.StatusError
+	var ue *url.Error
+	var uploadErr *storage.UploadError
+	switch {
+	// Checked first: upload errors wrap the network errors below.
+	case errors.As(err, &uploadErr):
+		return jobs.ErrorStorage
+	case errors.Is(err, errParserUnsupported):
+		return jobs.ErrorUnsupported
+	case errors.As(err, &rejected):
+		return rejected.Category
+	case errors.Is(err, parser.ErrNoMedia), errors.Is(err, errEmptyMedia):
+		return jobs.ErrorUnavailable
+	case errors.As(err, &se):
+		if se.Code == http.StatusTooManyRequests {
+			return jobs.ErrorRateLimited
+		}
+		if se.Code >= 500 {
+			return jobs.ErrorTransient
+		}
+	case errors.Is(err, errParserUnavailable), errors.Is(err, context.DeadlineExceeded), errors.As(err, &ue):
+		return jobs.ErrorTransient
+	}
+	return ""
+}
+
+type retryRule struct {
+	pattern   string
+	retryable bool
+}
+
+// parseRetryRules reads rules of the form "pattern=retry;pattern=terminal".
+// Patterns are matched case-insensitively as substrings of the error text.
+func parseRetryRules(raw string) ([]retryRule, error) {
+	var rules []retryRule
+	for _, part := range strings.Split(raw, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		idx := strings.LastIndex(part, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid rule %q: expected pattern=retry|terminal", part)
+		}
+		pattern := strings.ToLower(strings.TrimSpace(part[:idx]))
+		var retryable bool
+		switch strings.ToLower(strings.TrimSpace(part[idx+1:])) {
+		case "retry", "retryable":
+			retryable = true
+		case "terminal", "skip":
+			retryable = false
+		default:
+			return nil, fmt.Errorf("invalid rule %q: class must be retry or terminal", part)
+		}
+		if pattern == "" {
+			return nil, fmt.Errorf("invalid rule %q: empty pattern", part)
+		}
+		rules = append(rules, retryRule{pattern: pattern, retryable: retryable})
+	}
+	return rules, nil
+}
+
+func classifyError(err error) (retryable bool, matched bool) {
+	msg := strings.ToLower(err.Error())
+	for _, rule := range retryRules {
+		if strings.Contains(msg, rule.pattern) {
+			slog.Debug("retry classification", "pattern", rule.pattern, "retryable", rule.retryable, "err", truncate(err.Error(), 200))
+			return rule.retryable, true
+		}
+	}
+	return false, false
 }
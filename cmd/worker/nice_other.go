@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+// setNice cannot change process priority on this platform; ffmpeg runs at
+// normal priority.
+func setNice(int, int) error {
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+// setNice sets the scheduling priority of process pid; higher values run
+// at lower priority.
+func setNice(pid, nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeTitle(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		maxRunes int
+		want     string
+	}{
+		{"invalid utf-8", "bad \xff\xfe title \xc3", 0, "bad \uFFFD title \uFFFD"},
+		{"controls and format chars", "a\x00b\x1b[0m\u200bc\u202e", 0, "ab[0mc"},
+		{"whitespace", "  line\r\n\tbreak   here \u3000", 0, "line break here"},
+		{"truncated", "一二三 四五", 4, "一二三"},
+		{"truncated before space", "ab cd", 3, "ab"},
+		{"only invalid bytes", "\xff", 0, "\uFFFD"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeTitle(tt.raw, tt.maxRunes)
+			if got != tt.want {
+				t.Errorf("sanitizeTitle(%q, %d) = %q, want %q", tt.raw, tt.maxRunes, got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("result %q is not valid UTF-8", got)
+			}
+			// encoding/json would silently substitute invalid bytes; the
+			// sanitized title must survive a round trip unchanged.
+			b, err := json.Marshal(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var back string
+			if err := json.Unmarshal(b, &back); err != nil || back != got {
+				t.Errorf("JSON round trip = %q, %v; want %q", back, err, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"video2mp3/internal/config"
+	"video2mp3/internal/jobs"
+)
+
+// ffmpegConfig returns a config using the ffmpeg and ffprobe on PATH, and
+// skips the test when either is missing.
+func ffmpegConfig(t *testing.T) config.Config {
+	t.Helper()
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg not on PATH")
+	}
+	ffprobe, err := exec.LookPath("ffprobe")
+	if err != nil {
+		t.Skip("ffprobe not on PATH")
+	}
+	return config.Config{FFmpegPath: ffmpeg, FFprobePath: ffprobe, AudioSampleRate: 44100}
+}
+
+// toneInput writes a one-second stereo 48 kHz test tone.
+func toneInput(t *testing.T, cfg config.Config) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "input.wav")
+	out, err := exec.Command(cfg.FFmpegPath, "-hide_banner", "-loglevel", "error", "-f", "lavfi",
+		"-i", "sine=frequency=440:duration=1:sample_rate=48000", "-ac", "2", path).CombinedOutput()
+	if err != nil {
+		t.Fatalf("generate input: %v: %s", err, out)
+	}
+	return path
+}
+
+// ffprobeJSON runs ffprobe with args on path and decodes its JSON output.
+func ffprobeJSON(t *testing.T, cfg config.Config, path string, v any, args ...string) {
+	t.Helper()
+	args = append(append([]string{"-v", "error", "-of", "json"}, args...), path)
+	out, err := exec.Command(cfg.FFprobePath, args...).Output()
+	if err != nil {
+		t.Fatalf("ffprobe: %v", err)
+	}
+	if err := json.Unmarshal(out, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTranscodeSampleRateAndChannels(t *testing.T) {
+	base := ffmpegConfig(t)
+	input := toneInput(t, base)
+	tests := []struct {
+		name         string
+		rate, ch     int
+		opts         jobs.Options
+		wantRate     string
+		wantChannels int
+	}{
+		{"defaults keep source channels", 44100, 0, jobs.Options{}, "44100", 2},
+		{"voice archive config", 22050, 1, jobs.Options{}, "22050", 1},
+		{"job override", 44100, 2, jobs.Options{SampleRate: 16000, Channels: 1}, "16000", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			cfg.AudioSampleRate, cfg.AudioChannels = tt.rate, tt.ch
+			opts := tt.opts
+			if err := opts.Normalize(); err != nil {
+				t.Fatal(err)
+			}
+			output := filepath.Join(t.TempDir(), "out.mp3")
+			if _, err := transcodeWithFFmpeg(context.Background(), cfg, input, output, opts, trackMeta{}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			var probe struct {
+				Streams []struct {
+					SampleRate string `json:"sample_rate"`
+					Channels   int    `json:"channels"`
+				} `json:"streams"`
+			}
+			ffprobeJSON(t, cfg, output, &probe, "-select_streams", "a:0", "-show_entries", "stream=sample_rate,channels")
+			if len(probe.Streams) != 1 {
+				t.Fatalf("%d audio streams", len(probe.Streams))
+			}
+			if s := probe.Streams[0]; s.SampleRate != tt.wantRate || s.Channels != tt.wantChannels {
+				t.Errorf("output is %s Hz, %d channels; want %s Hz, %d", s.SampleRate, s.Channels, tt.wantRate, tt.wantChannels)
+			}
+		})
+	}
+}
+
+func TestTranscodeTags(t *testing.T) {
+	cfg := ffmpegConfig(t)
+	input := toneInput(t, cfg)
+	meta := trackMeta{Title: "测试 – a title", Artist: "douyin", Comment: "https://v.douyin.com/iRNBho6u/"}
+	tests := []struct {
+		format string
+		want   trackMeta
+	}{
+		{jobs.FormatMP3, meta},
+		// WAV carries no tags, so none are written.
+		{jobs.FormatWAV, trackMeta{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			opts := jobs.Options{Format: tt.format}
+			if err := opts.Normalize(); err != nil {
+				t.Fatal(err)
+			}
+			output := filepath.Join(t.TempDir(), "out."+opts.Output().Ext)
+			if _, err := transcodeWithFFmpeg(context.Background(), cfg, input, output, opts, meta, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			var probe struct {
+				Format struct {
+					Tags trackMeta `json:"tags"`
+				} `json:"format"`
+			}
+			ffprobeJSON(t, cfg, output, &probe, "-show_entries", "format_tags=title,artist,comment")
+			if got := probe.Format.Tags; got != tt.want {
+				t.Errorf("tags = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackMetaArgs(t *testing.T) {
+	got := trackMeta{Title: "t", Comment: "c"}.args()
+	want := []string{"-metadata", "title=t", "-metadata", "comment=c"}
+	if len(got) != len(want) {
+		t.Fatalf("args = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("args = %q, want %q", got, want)
+		}
+	}
+	if args := (trackMeta{}).args(); len(args) != 0 {
+		t.Errorf("empty meta args = %q", args)
+	}
+}
@@ -7,60 +7,316 @@ import (
 )
 
 type Config struct {
-	Env                  string
-	HTTPAddr             string
-	RedisAddr            string
-	RedisDB              int
-	DatabaseURL          string
-	S3Endpoint           string
-	S3PublicEndpoint     string
-	S3AccessKey          string
-	S3SecretKey          string
-	S3Bucket             string
-	S3Region             string
-	S3UsePathStyle       bool
-	TempDir              string
-	ParserAPIURL         string
-	MP3URLTTL            time.Duration
-	APIToken             string
-	JobRetentionDays     int
-	CleanupInterval      time.Duration
-	RateLimitPerMinute   int
-	CORSAllowOrigins     string
-	MaxJobDuration       time.Duration
-	MaxFileSizeBytes     int64
-	DownloadConcurrency  int
-	TranscodeConcurrency int
-	JobTimeout           time.Duration
+	Env                      string
+	HTTPAddr                 string
+	RedisAddr                string
+	RedisDB                  int
+	RedisURL                 string
+	RedisUsername            string
+	RedisPassword            string
+	RedisTLS                 bool
+	DatabaseURL              string
+	DBMaxOpenConns           int
+	DBMaxIdleConns           int
+	DBConnMaxLifetime        time.Duration
+	DBQueryTimeout           time.Duration
+	S3Endpoint               string
+	S3PublicEndpoint         string
+	S3AccessKey              string
+	S3SecretKey              string
+	S3Bucket                 string
+	S3Region                 string
+	S3UsePathStyle           bool
+	S3CreateBucket           bool
+	S3MultipartThreshold     int64
+	S3PartSize               int64
+	S3UploadConcurrency      int
+	S3SSE                    string
+	S3SSEKMSKeyID            string
+	S3KeyTemplate            string
+	TempDir                  string
+	OutputDir                string
+	TempSweepAge             time.Duration
+	DiskMinFreeMB            int
+	ParserAPIURL             string
+	ParserAuthMode           string
+	EnabledPlatforms         string
+	ParserAPIKey             string
+	ParserEndpointPath       string
+	ParserURLField           string
+	OutboundBlockCIDRs       string
+	OutboundAllowCIDRs       string
+	DownloadProxyURL         string
+	MP3URLTTL                time.Duration
+	MP3URLMaxTTL             time.Duration
+	UploadURLTTL             time.Duration
+	APIToken                 string
+	JobRetentionDays         int
+	CleanupInterval          time.Duration
+	JobsAnalyzeInterval      time.Duration
+	JobExpireAfter           time.Duration
+	ExpireInterval           time.Duration
+	VacuumAfterCleanup       bool
+	SoftDelete               bool
+	PurgeAfterDays           int
+	ObjectGCInterval         time.Duration
+	StallThreshold           time.Duration
+	StallCheckInterval       time.Duration
+	StallAction              string
+	OrphanCheckInterval      time.Duration
+	OrphanMinAge             time.Duration
+	ObjectGCMinAge           time.Duration
+	RateLimitPerMinute       int
+	DailyJobQuota            int
+	DailyJobQuotaOverrides   string
+	CORSAllowOrigins         string
+	CORSAllowMethods         string
+	CORSAllowHeaders         string
+	CORSMaxAge               time.Duration
+	CORSAllowCredentials     bool
+	GzipMinSize              int
+	RetainSource             bool
+	RecordDeadJobs           bool
+	MaxJobDuration           time.Duration
+	MaxFileSizeBytes         int64
+	MaxJSONBodyBytes         int64
+	DownloadConcurrency      int
+	DownloadChunks           int
+	TranscodeConcurrency     int
+	JobTimeout               time.Duration
+	DownloadStageTimeout     time.Duration
+	TranscodeStageTimeout    time.Duration
+	JobMaxRetry              int
+	RetryBaseDelay           time.Duration
+	RetryMaxDelay            time.Duration
+	JobUniqueTasks           bool
+	IdempotencyKeyTTL        time.Duration
+	ReadCacheTTL             time.Duration
+	ReadCacheSize            int
+	MetricsEnabled           bool
+	WorkerMetricsAddr        string
+	RetryRules               string
+	LogLevel                 string
+	LogFormat                string
+	FFmpegPath               string
+	FFmpegHWAccel            string
+	FFmpegThreads            int
+	FFmpegNice               int
+	FFprobePath              string
+	MediaProbeCheck          bool
+	CostMetricsEnabled       bool
+	AudioLoudnorm            bool
+	LoudnormTwoPass          bool
+	PlatformDownloadTimeouts string
+	PlatformDownloadHeaders  string
+	PlatformHeadersJSON      string
+	FetchCover               bool
+	FFmpegLenient            bool
+	RetryQueue               string
+	RetryQueueWeight         int
+	QueueWeights             string
+	ParserConcurrency        int
+	ParserMaxWait            time.Duration
+	ParserCacheTTL           time.Duration
+	ParserTimeout            time.Duration
+	ParserRetries            int
+	ParserBreakerThreshold   int
+	ParserBreakerCooldown    time.Duration
+	ValidateParserTimeout    time.Duration
+	AdminSigningSecrets      string
+	AdminSignatureMaxSkew    time.Duration
+	MP3KeysOnly              bool
+	ShutdownTimeout          time.Duration
+	SideArtifacts            string
+	SideArtifactConcurrency  int
+	SideArtifactTimeout      time.Duration
+	EnqueueFailureMode       string
+	TitleMaxRunes            int
+	CleanupConcurrency       int
+	RejectWithoutWorkers     bool
+	WorkerHeartbeatInterval  time.Duration
+	WorkerStaleAfter         time.Duration
+	DownloadMode             string
+	AccelRedirectPrefix      string
+	MediaPrefer              string
+	PresignConcurrency       int
+	JobsListDefaultLimit     int
+	JobsListMaxLimit         int
+	StreamTranscode          bool
+	StreamSkipPlatforms      string
+	StreamUpload             bool
+	RetentionReadyDays       int
+	RetentionFailedDays      int
+	RetentionExpiredDays     int
+	DownloadRetryAfterMax    time.Duration
+	SSEPollInterval          time.Duration
+	SSEKeepaliveInterval     time.Duration
+	MaxDownloadsPerHost      int
+	AudioSampleRate          int
+	AudioChannels            int
+	PreviousAPITokens        string
+	APITokenOwner            string
+	StorageBackend           string
+	LocalStorageDir          string
+	LocalStorageURL          string
+	LocalStorageSecret       string
 }
 
 func Load() Config {
 	return Config{
-		Env:                  getEnv("APP_ENV", "local"),
-		HTTPAddr:             getEnv("APP_HTTP_ADDR", ":8080"),
-		RedisAddr:            getEnv("REDIS_ADDR", "localhost:6380"),
-		RedisDB:              getEnvInt("REDIS_DB", 0),
-		DatabaseURL:          getEnv("DATABASE_URL", ""),
-		S3Endpoint:           getEnv("S3_ENDPOINT", "http://localhost:9000"),
-		S3PublicEndpoint:     getEnv("S3_PUBLIC_ENDPOINT", ""),
-		S3AccessKey:          getEnv("S3_ACCESS_KEY", "minio_access"),
-		S3SecretKey:          getEnv("S3_SECRET_KEY", "minio_secret"),
-		S3Bucket:             getEnv("S3_BUCKET", "v2m"),
-		S3Region:             getEnv("S3_REGION", "us-east-1"),
-		S3UsePathStyle:       getEnvBool("S3_USE_PATH_STYLE", true),
-		TempDir:              getEnv("TEMP_DIR", "./tmp"),
-		ParserAPIURL:         getEnv("PARSER_API_URL", "http://localhost:5001"),
-		MP3URLTTL:            getEnvDuration("MP3_URL_TTL", 15*time.Minute),
-		APIToken:             getEnv("API_TOKEN", ""),
-		JobRetentionDays:     getEnvInt("JOB_RETENTION_DAYS", 0),
-		CleanupInterval:      getEnvDuration("CLEANUP_INTERVAL", 0),
-		RateLimitPerMinute:   getEnvInt("RATE_LIMIT_PER_MIN", 0),
-		CORSAllowOrigins:     getEnv("CORS_ALLOW_ORIGINS", ""),
-		MaxJobDuration:       getEnvDuration("MAX_JOB_DURATION", 10*time.Minute),
-		MaxFileSizeBytes:     int64(getEnvInt("MAX_FILE_SIZE", 200000000)),
-		DownloadConcurrency:  getEnvInt("DOWNLOAD_CONCURRENCY", 1),
-		TranscodeConcurrency: getEnvInt("TRANSCODE_CONCURRENCY", 1),
-		JobTimeout:           getEnvDuration("JOB_TIMEOUT", 10*time.Minute),
+		Env:                      getEnv("APP_ENV", "local"),
+		HTTPAddr:                 getEnv("APP_HTTP_ADDR", ":8080"),
+		RedisAddr:                getEnv("REDIS_ADDR", "localhost:6380"),
+		RedisDB:                  getEnvInt("REDIS_DB", 0),
+		RedisURL:                 getEnv("REDIS_URL", ""),
+		RedisUsername:            getEnv("REDIS_USERNAME", ""),
+		RedisPassword:            getEnv("REDIS_PASSWORD", ""),
+		RedisTLS:                 getEnvBool("REDIS_TLS", false),
+		DatabaseURL:              getEnv("DATABASE_URL", ""),
+		DBMaxOpenConns:           getEnvInt("DB_MAX_OPEN_CONNS", 0),
+		DBMaxIdleConns:           getEnvInt("DB_MAX_IDLE_CONNS", 2),
+		DBConnMaxLifetime:        getEnvDuration("DB_CONN_MAX_LIFETIME", 0),
+		DBQueryTimeout:           getEnvDuration("DB_QUERY_TIMEOUT", 0),
+		S3Endpoint:               getEnv("S3_ENDPOINT", "http://localhost:9000"),
+		S3PublicEndpoint:         getEnv("S3_PUBLIC_ENDPOINT", ""),
+		S3AccessKey:              getEnv("S3_ACCESS_KEY", "minio_access"),
+		S3SecretKey:              getEnv("S3_SECRET_KEY", "minio_secret"),
+		S3Bucket:                 getEnv("S3_BUCKET", "v2m"),
+		S3Region:                 getEnv("S3_REGION", "us-east-1"),
+		S3UsePathStyle:           getEnvBool("S3_USE_PATH_STYLE", true),
+		S3CreateBucket:           getEnvBool("S3_CREATE_BUCKET", false),
+		S3MultipartThreshold:     int64(getEnvInt("S3_MULTIPART_THRESHOLD", 64<<20)),
+		S3PartSize:               int64(getEnvInt("S3_PART_SIZE", 64<<20)),
+		S3UploadConcurrency:      getEnvInt("S3_UPLOAD_CONCURRENCY", 4),
+		S3SSE:                    getEnv("S3_SSE", "none"),
+		S3SSEKMSKeyID:            getEnv("S3_SSE_KMS_KEY_ID", ""),
+		S3KeyTemplate:            getEnv("S3_KEY_TEMPLATE", "jobs/{id}.{ext}"),
+		TempDir:                  getEnv("TEMP_DIR", "./tmp"),
+		OutputDir:                getEnv("OUTPUT_DIR", ""),
+		TempSweepAge:             getEnvDuration("TEMP_SWEEP_AGE", 24*time.Hour),
+		DiskMinFreeMB:            getEnvInt("DISK_MIN_FREE_MB", 256),
+		ParserAPIURL:             getEnv("PARSER_API_URL", "http://localhost:5001"),
+		ParserAuthMode:           getEnv("PARSER_AUTH_MODE", "vigenere"),
+		EnabledPlatforms:         getEnv("ENABLED_PLATFORMS", ""),
+		ParserAPIKey:             getEnv("PARSER_API_KEY", ""),
+		ParserEndpointPath:       getEnv("PARSER_ENDPOINT_PATH", "api/parse"),
+		ParserURLField:           getEnv("PARSER_URL_FIELD", "text"),
+		OutboundBlockCIDRs:       getEnv("OUTBOUND_BLOCK_CIDRS", ""),
+		OutboundAllowCIDRs:       getEnv("OUTBOUND_ALLOW_CIDRS", ""),
+		DownloadProxyURL:         getEnv("DOWNLOAD_PROXY_URL", ""),
+		MP3URLTTL:                getEnvDuration("MP3_URL_TTL", 15*time.Minute),
+		MP3URLMaxTTL:             getEnvDuration("MP3_URL_MAX_TTL", 24*time.Hour),
+		UploadURLTTL:             getEnvDuration("UPLOAD_URL_TTL", 15*time.Minute),
+		APIToken:                 getEnv("API_TOKEN", ""),
+		JobRetentionDays:         getEnvInt("JOB_RETENTION_DAYS", 0),
+		CleanupInterval:          getEnvDuration("CLEANUP_INTERVAL", 0),
+		JobsAnalyzeInterval:      getEnvDuration("JOBS_ANALYZE_INTERVAL", 0),
+		JobExpireAfter:           getEnvDuration("JOB_EXPIRE_AFTER", 0),
+		ExpireInterval:           getEnvDuration("EXPIRE_INTERVAL", 10*time.Minute),
+		VacuumAfterCleanup:       getEnvBool("VACUUM_AFTER_CLEANUP", false),
+		SoftDelete:               getEnvBool("SOFT_DELETE", false),
+		PurgeAfterDays:           getEnvInt("PURGE_AFTER_DAYS", 30),
+		ObjectGCInterval:         getEnvDuration("OBJECT_GC_INTERVAL", 0),
+		StallThreshold:           getEnvDuration("STALL_THRESHOLD", 0),
+		StallCheckInterval:       getEnvDuration("STALL_CHECK_INTERVAL", time.Minute),
+		StallAction:              getEnv("STALL_ACTION", "fail"),
+		OrphanCheckInterval:      getEnvDuration("ORPHAN_CHECK_INTERVAL", 0),
+		OrphanMinAge:             getEnvDuration("ORPHAN_MIN_AGE", 5*time.Minute),
+		ObjectGCMinAge:           getEnvDuration("OBJECT_GC_MIN_AGE", 24*time.Hour),
+		RateLimitPerMinute:       getEnvInt("RATE_LIMIT_PER_MIN", 0),
+		DailyJobQuota:            getEnvInt("DAILY_JOB_QUOTA", 0),
+		DailyJobQuotaOverrides:   getEnv("DAILY_JOB_QUOTA_OVERRIDES", ""),
+		CORSAllowOrigins:         getEnv("CORS_ALLOW_ORIGINS", ""),
+		CORSAllowMethods:         getEnv("CORS_ALLOW_METHODS", "GET,POST,OPTIONS"),
+		CORSAllowHeaders:         getEnv("CORS_ALLOW_HEADERS", "Authorization,Content-Type,X-API-KEY,Idempotency-Key,If-None-Match"),
+		CORSMaxAge:               getEnvDuration("CORS_MAX_AGE", 0),
+		CORSAllowCredentials:     getEnvBool("CORS_ALLOW_CREDENTIALS", false),
+		GzipMinSize:              getEnvInt("GZIP_MIN_SIZE", 1024),
+		RetainSource:             getEnvBool("RETAIN_SOURCE", false),
+		RecordDeadJobs:           getEnvBool("RECORD_DEAD_JOBS", false),
+		MaxJobDuration:           getEnvDuration("MAX_JOB_DURATION", 10*time.Minute),
+		MaxFileSizeBytes:         int64(getEnvInt("MAX_FILE_SIZE", 200000000)),
+		MaxJSONBodyBytes:         int64(getEnvInt("MAX_JSON_BODY_BYTES", 1<<20)),
+		DownloadConcurrency:      getEnvInt("DOWNLOAD_CONCURRENCY", 1),
+		DownloadChunks:           getEnvInt("DOWNLOAD_CHUNKS", 1),
+		TranscodeConcurrency:     getEnvInt("TRANSCODE_CONCURRENCY", 1),
+		JobTimeout:               getEnvDuration("JOB_TIMEOUT", 10*time.Minute),
+		DownloadStageTimeout:     getEnvDuration("DOWNLOAD_TIMEOUT", 6*time.Minute),
+		TranscodeStageTimeout:    getEnvDuration("TRANSCODE_TIMEOUT", 4*time.Minute),
+		JobMaxRetry:              getEnvInt("JOB_MAX_RETRY", 3),
+		RetryBaseDelay:           getEnvDuration("RETRY_BASE_DELAY", 15*time.Second),
+		RetryMaxDelay:            getEnvDuration("RETRY_MAX_DELAY", 10*time.Minute),
+		JobUniqueTasks:           getEnvBool("JOB_UNIQUE_TASKS", true),
+		IdempotencyKeyTTL:        getEnvDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour),
+		ReadCacheTTL:             getEnvDuration("READ_CACHE_TTL", 0),
+		ReadCacheSize:            getEnvInt("READ_CACHE_SIZE", 1000),
+		MetricsEnabled:           getEnvBool("METRICS_ENABLED", true),
+		WorkerMetricsAddr:        getEnv("WORKER_METRICS_ADDR", ":9091"),
+		RetryRules:               getEnv("RETRY_RULES", ""),
+		LogLevel:                 getEnv("LOG_LEVEL", "info"),
+		LogFormat:                getEnv("LOG_FORMAT", "json"),
+		FFmpegPath:               getEnv("FFMPEG_PATH", "ffmpeg"),
+		FFmpegHWAccel:            getEnv("FFMPEG_HWACCEL", ""),
+		FFmpegThreads:            getEnvInt("FFMPEG_THREADS", 0),
+		FFmpegNice:               getEnvInt("FFMPEG_NICE", 0),
+		FFprobePath:              getEnv("FFPROBE_PATH", "ffprobe"),
+		MediaProbeCheck:          getEnvBool("MEDIA_PROBE_CHECK", false),
+		CostMetricsEnabled:       getEnvBool("COST_METRICS_ENABLED", false),
+		AudioLoudnorm:            getEnvBool("AUDIO_LOUDNORM", false),
+		LoudnormTwoPass:          getEnvBool("LOUDNORM_TWO_PASS", false),
+		PlatformDownloadTimeouts: getEnv("PLATFORM_DOWNLOAD_TIMEOUTS", ""),
+		PlatformDownloadHeaders:  getEnv("PLATFORM_DOWNLOAD_HEADERS", ""),
+		PlatformHeadersJSON:      getEnv("PLATFORM_HEADERS_JSON", ""),
+		FetchCover:               getEnvBool("FETCH_COVER", false),
+		FFmpegLenient:            getEnvBool("FFMPEG_LENIENT", false),
+		RetryQueue:               getEnv("RETRY_QUEUE", "default"),
+		RetryQueueWeight:         getEnvInt("RETRY_QUEUE_WEIGHT", 1),
+		QueueWeights:             getEnv("QUEUE_WEIGHTS", ""),
+		ParserConcurrency:        getEnvInt("PARSER_CONCURRENCY", 0),
+		ParserMaxWait:            getEnvDuration("PARSER_MAX_WAIT", 30*time.Second),
+		ParserCacheTTL:           getEnvDuration("PARSER_CACHE_TTL", 0),
+		ParserTimeout:            getEnvDuration("PARSER_TIMEOUT", 0),
+		ParserRetries:            getEnvInt("PARSER_RETRIES", 2),
+		ParserBreakerThreshold:   getEnvInt("PARSER_BREAKER_THRESHOLD", 5),
+		ParserBreakerCooldown:    getEnvDuration("PARSER_BREAKER_COOLDOWN", 30*time.Second),
+		ValidateParserTimeout:    getEnvDuration("VALIDATE_PARSER_TIMEOUT", 5*time.Second),
+		AdminSigningSecrets:      getEnv("ADMIN_SIGNING_SECRETS", ""),
+		AdminSignatureMaxSkew:    getEnvDuration("ADMIN_SIGNATURE_MAX_SKEW", 5*time.Minute),
+		MP3KeysOnly:              getEnvBool("MP3_KEYS_ONLY", false),
+		ShutdownTimeout:          getEnvDuration("SHUTDOWN_TIMEOUT", 15*time.Second),
+		SideArtifacts:            getEnv("SIDE_ARTIFACTS", ""),
+		SideArtifactConcurrency:  getEnvInt("SIDE_ARTIFACT_CONCURRENCY", 1),
+		SideArtifactTimeout:      getEnvDuration("SIDE_ARTIFACT_TIMEOUT", 30*time.Second),
+		EnqueueFailureMode:       getEnv("ENQUEUE_FAILURE_MODE", "fail"),
+		TitleMaxRunes:            getEnvInt("TITLE_MAX_RUNES", 200),
+		CleanupConcurrency:       getEnvInt("CLEANUP_CONCURRENCY", 4),
+		RejectWithoutWorkers:     getEnvBool("REJECT_WITHOUT_WORKERS", false),
+		WorkerHeartbeatInterval:  getEnvDuration("WORKER_HEARTBEAT_INTERVAL", 10*time.Second),
+		WorkerStaleAfter:         getEnvDuration("WORKER_STALE_AFTER", 30*time.Second),
+		DownloadMode:             getEnv("DOWNLOAD_MODE", "proxy"),
+		AccelRedirectPrefix:      getEnv("ACCEL_REDIRECT_PREFIX", "/_s3/"),
+		MediaPrefer:              getEnv("MEDIA_PREFER", "audio"),
+		PresignConcurrency:       getEnvInt("PRESIGN_CONCURRENCY", 8),
+		JobsListDefaultLimit:     getEnvInt("JOBS_LIST_DEFAULT_LIMIT", 20),
+		JobsListMaxLimit:         getEnvInt("JOBS_LIST_MAX_LIMIT", 100),
+		StreamTranscode:          getEnvBool("STREAM_TRANSCODE", false),
+		StreamSkipPlatforms:      getEnv("STREAM_TRANSCODE_SKIP_PLATFORMS", ""),
+		StreamUpload:             getEnvBool("STREAM_UPLOAD", false),
+		RetentionReadyDays:       getEnvInt("RETENTION_READY_DAYS", 0),
+		RetentionFailedDays:      getEnvInt("RETENTION_FAILED_DAYS", 0),
+		RetentionExpiredDays:     getEnvInt("RETENTION_EXPIRED_DAYS", 0),
+		DownloadRetryAfterMax:    getEnvDuration("DOWNLOAD_RETRY_AFTER_MAX", time.Minute),
+		SSEPollInterval:          getEnvDuration("SSE_POLL_INTERVAL", 3*time.Second),
+		SSEKeepaliveInterval:     getEnvDuration("SSE_KEEPALIVE_INTERVAL", 15*time.Second),
+		MaxDownloadsPerHost:      getEnvInt("MAX_DOWNLOADS_PER_HOST", 0),
+		AudioSampleRate:          getEnvInt("AUDIO_SAMPLE_RATE", 44100),
+		AudioChannels:            getEnvInt("AUDIO_CHANNELS", 0),
+		PreviousAPITokens:        getEnv("PREVIOUS_API_TOKENS", ""),
+		APITokenOwner:            getEnv("API_TOKEN_OWNER", ""),
+		StorageBackend:           getEnv("STORAGE_BACKEND", "s3"),
+		LocalStorageDir:          getEnv("LOCAL_STORAGE_DIR", "./data/objects"),
+		LocalStorageURL:          getEnv("LOCAL_STORAGE_URL", "http://localhost:8080"),
+		LocalStorageSecret:       getEnv("LOCAL_STORAGE_SECRET", ""),
 	}
 }
 
@@ -0,0 +1,47 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// JobUpdate is published by the worker whenever a job changes status or makes
+// download progress so SSE streams can push it without polling the database.
+type JobUpdate struct {
+	JobID  string  `json:"job_id"`
+	Status string  `json:"status"`
+	Error  *string `json:"error,omitempty"`
+	MP3Key *string `json:"mp3_key,omitempty"`
+	// ProgressBytes and ProgressTotalBytes are set on progress updates;
+	// the total only when the source reported its size.
+	ProgressBytes      *int64 `json:"progress_bytes,omitempty"`
+	ProgressTotalBytes *int64 `json:"progress_total_bytes,omitempty"`
+	// ErrorCategory classifies Error for failed and dead jobs.
+	ErrorCategory *string `json:"error_category,omitempty"`
+	// ETASeconds is the job's latest ETA; nil when it cannot be estimated
+	// or the job is not downloading or transcoding.
+	ETASeconds *int64 `json:"eta_seconds,omitempty"`
+	// UpdatedAt is the job's updated_at after the change.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func Channel(jobID string) string {
+	return "v2m:job:" + jobID
+}
+
+func Publish(ctx context.Context, rdb *redis.Client, u JobUpdate) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return rdb.Publish(ctx, Channel(u.JobID), b).Err()
+}
+
+func Decode(payload string) (JobUpdate, error) {
+	var u JobUpdate
+	err := json.Unmarshal([]byte(payload), &u)
+	return u, err
+}
@@ -0,0 +1,75 @@
+package heartbeat
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Key is the Redis hash holding one heartbeat per worker, keyed by Worker.ID.
+const Key = "v2m:workers"
+
+// forgetAfter is how long a worker that stopped reporting stays listed
+// (flagged stale) before List drops it.
+const forgetAfter = time.Hour
+
+// Worker is the state a worker reports on every heartbeat.
+type Worker struct {
+	ID          string     `json:"id"`
+	Hostname    string     `json:"hostname"`
+	PID         int        `json:"pid"`
+	StartedAt   time.Time  `json:"started_at"`
+	Concurrency int        `json:"concurrency"`
+	InFlight    int        `json:"in_flight"`
+	LastJobAt   *time.Time `json:"last_job_at,omitempty"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Version     string     `json:"version,omitempty"`
+	Commit      string     `json:"commit,omitempty"`
+}
+
+// Write records w, stamping its UpdatedAt.
+func Write(ctx context.Context, rdb *redis.Client, w Worker) error {
+	w.UpdatedAt = time.Now().UTC()
+	b, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return rdb.HSet(ctx, Key, w.ID, b).Err()
+}
+
+// Remove deletes the heartbeat of a worker that is shutting down cleanly.
+func Remove(ctx context.Context, rdb *redis.Client, id string) error {
+	return rdb.HDel(ctx, Key, id).Err()
+}
+
+// List returns the reported workers ordered by hostname and id. Entries not
+// updated for an hour, left by workers that died, are deleted instead.
+func List(ctx context.Context, rdb *redis.Client) ([]Worker, error) {
+	fields, err := rdb.HGetAll(ctx, Key).Result()
+	if err != nil {
+		return nil, err
+	}
+	workers := make([]Worker, 0, len(fields))
+	var gone []string
+	for id, raw := range fields {
+		var w Worker
+		if err := json.Unmarshal([]byte(raw), &w); err != nil || time.Since(w.UpdatedAt) > forgetAfter {
+			gone = append(gone, id)
+			continue
+		}
+		workers = append(workers, w)
+	}
+	if len(gone) > 0 {
+		_ = rdb.HDel(ctx, Key, gone...).Err()
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		if workers[i].Hostname != workers[j].Hostname {
+			return workers[i].Hostname < workers[j].Hostname
+		}
+		return workers[i].ID < workers[j].ID
+	})
+	return workers, nil
+}
@@ -0,0 +1,31 @@
+package jobs
+
+// Error categories tell users of a failed job whether retrying can help.
+const (
+	// ErrorUnsupported means the parser does not handle the platform or link.
+	ErrorUnsupported = "unsupported"
+	// ErrorUnavailable means the video is deleted, private or has no media.
+	ErrorUnavailable = "unavailable"
+	// ErrorGeoBlocked means the video is not available in the parser's region.
+	ErrorGeoBlocked = "geo_blocked"
+	// ErrorRateLimited means the parser or platform is throttling requests.
+	ErrorRateLimited = "rate_limited"
+	// ErrorTransient covers outages and timeouts that a retry may get past.
+	ErrorTransient = "transient"
+	// ErrorStorage means the output could not be stored. Whether a retry
+	// can help depends on the error (an outage or a denied request), so the
+	// category alone does not decide it.
+	ErrorStorage = "storage"
+)
+
+// IsRetryableCategory reports whether a job that failed with category may
+// succeed when retried. Unknown categories are not decided here.
+func IsRetryableCategory(category string) (retryable, known bool) {
+	switch category {
+	case ErrorUnsupported, ErrorUnavailable, ErrorGeoBlocked:
+		return false, true
+	case ErrorRateLimited, ErrorTransient:
+		return true, true
+	}
+	return false, false
+}
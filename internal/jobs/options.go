@@ -0,0 +1,320 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatMP3  = "mp3"
+	FormatWAV  = "wav"
+	FormatFLAC = "flac"
+)
+
+// Side artifacts are optional best-effort outputs produced next to the audio.
+const (
+	ArtifactCover = "cover"
+)
+
+var Artifacts = []string{ArtifactCover}
+
+func IsKnownArtifact(name string) bool {
+	for _, a := range Artifacts {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Media preferences choose which parser URL the worker downloads when both an
+// audio-only and a video URL are available.
+const (
+	// PreferAudio tries the audio URL first and falls back to video.
+	PreferAudio = "audio"
+	// PreferVideo tries the video URL first and falls back to audio.
+	PreferVideo = "video"
+	// PreferBest is PreferAudio: audio is the cheaper source to transcode.
+	PreferBest = "best"
+)
+
+func IsValidPrefer(p string) bool {
+	return p == PreferAudio || p == PreferVideo || p == PreferBest
+}
+
+// Priorities select the queue a job is enqueued to; the default priority is
+// stored as "".
+const (
+	PriorityHigh    = "high"
+	PriorityDefault = "default"
+	PriorityLow     = "low"
+)
+
+const (
+	SampleFormatInt   = "int"
+	SampleFormatFloat = "float"
+)
+
+// SampleRates are the output sample rates, in Hz, that every format can
+// encode.
+var SampleRates = []int{8000, 11025, 12000, 16000, 22050, 24000, 32000, 44100, 48000}
+
+func IsValidSampleRate(hz int) bool {
+	for _, r := range SampleRates {
+		if r == hz {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValidChannels reports whether n is a supported output channel count:
+// mono or stereo.
+func IsValidChannels(n int) bool {
+	return n == 1 || n == 2
+}
+
+type Options struct {
+	Format       string `json:"format,omitempty"`
+	BitDepth     int    `json:"bit_depth,omitempty"`
+	SampleFormat string `json:"sample_format,omitempty"`
+	// Loudnorm overrides the AUDIO_LOUDNORM default when set.
+	Loudnorm *bool `json:"loudnorm,omitempty"`
+	// Start and End trim the output; zero means "from the beginning" and
+	// "to the end" respectively.
+	Start Seconds `json:"start,omitempty"`
+	End   Seconds `json:"end,omitempty"`
+	// Artifacts selects side artifacts for this job; nil uses the worker's
+	// SIDE_ARTIFACTS default and an empty list disables them.
+	Artifacts *[]string `json:"artifacts,omitempty"`
+	// Prefer overrides the worker's MEDIA_PREFER default when set.
+	Prefer string `json:"prefer,omitempty"`
+	// Priority is high or low to use that queue instead of the default one.
+	Priority string `json:"priority,omitempty"`
+	// SampleRate and Channels override the worker's AUDIO_SAMPLE_RATE and
+	// AUDIO_CHANNELS defaults when set.
+	SampleRate int `json:"sample_rate,omitempty"`
+	Channels   int `json:"channels,omitempty"`
+	// FadeIn and FadeOut are the lengths, in seconds, of fades at the start
+	// and end of the output; zero adds none.
+	FadeIn  float64 `json:"fade_in,omitempty"`
+	FadeOut float64 `json:"fade_out,omitempty"`
+}
+
+// Seconds is a media timestamp that decodes from a JSON number of seconds or
+// a "hh:mm:ss[.fff]" / "mm:ss" string, and always encodes as seconds.
+type Seconds float64
+
+func (s *Seconds) UnmarshalJSON(b []byte) error {
+	var n float64
+	if err := json.Unmarshal(b, &n); err == nil {
+		*s = Seconds(n)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return fmt.Errorf("timestamp must be seconds or hh:mm:ss")
+	}
+	v, err := ParseTimestamp(str)
+	if err != nil {
+		return err
+	}
+	*s = Seconds(v)
+	return nil
+}
+
+func ParseTimestamp(raw string) (float64, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	parts := strings.Split(raw, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", raw)
+	}
+	var total float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		// ParseFloat accepts NaN and Inf, which compare false to any bound.
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) || v < 0 || (i > 0 && v >= 60) {
+			return 0, fmt.Errorf("invalid timestamp %q", raw)
+		}
+		total = total*60 + v
+	}
+	return total, nil
+}
+
+type OutputFormat struct {
+	Ext         string
+	ContentType string
+	Lossless    bool
+	// Tags reports whether the container carries title/artist metadata.
+	Tags bool
+	// Codecs maps "<sample_format>/<bit_depth>" to the ffmpeg audio arguments
+	// for lossless formats. Lossy formats leave it empty.
+	Codecs map[string][]string
+}
+
+var OutputFormats = map[string]OutputFormat{
+	FormatMP3: {Ext: "mp3", ContentType: "audio/mpeg", Tags: true},
+	FormatWAV: {
+		Ext:         "wav",
+		ContentType: "audio/wav",
+		Lossless:    true,
+		Codecs: map[string][]string{
+			"int/16":   {"-c:a", "pcm_s16le"},
+			"int/24":   {"-c:a", "pcm_s24le"},
+			"int/32":   {"-c:a", "pcm_s32le"},
+			"float/32": {"-c:a", "pcm_f32le"},
+		},
+	},
+	FormatFLAC: {
+		Ext:         "flac",
+		ContentType: "audio/flac",
+		Lossless:    true,
+		Tags:        true,
+		Codecs: map[string][]string{
+			"int/16": {"-c:a", "flac", "-sample_fmt", "s16"},
+			"int/24": {"-c:a", "flac", "-sample_fmt", "s32", "-bits_per_raw_sample", "24"},
+		},
+	},
+}
+
+// Normalize fills in defaults and rejects combinations the chosen format
+// cannot encode.
+func (o *Options) Normalize() error {
+	o.Format = strings.ToLower(strings.TrimSpace(o.Format))
+	o.SampleFormat = strings.ToLower(strings.TrimSpace(o.SampleFormat))
+	o.Prefer = strings.ToLower(strings.TrimSpace(o.Prefer))
+	o.Priority = strings.ToLower(strings.TrimSpace(o.Priority))
+	if o.Priority == PriorityDefault {
+		o.Priority = ""
+	}
+	if o.Priority != "" && o.Priority != PriorityHigh && o.Priority != PriorityLow {
+		return fmt.Errorf("priority must be high, default or low")
+	}
+	if o.Format == "" {
+		o.Format = FormatMP3
+	}
+	if o.Prefer != "" && !IsValidPrefer(o.Prefer) {
+		return fmt.Errorf("prefer must be audio, video or best")
+	}
+	if o.Artifacts != nil {
+		seen := make(map[string]bool, len(*o.Artifacts))
+		artifacts := make([]string, 0, len(*o.Artifacts))
+		for _, a := range *o.Artifacts {
+			a = strings.ToLower(strings.TrimSpace(a))
+			if !IsKnownArtifact(a) {
+				return fmt.Errorf("unknown artifact %q", a)
+			}
+			if !seen[a] {
+				seen[a] = true
+				artifacts = append(artifacts, a)
+			}
+		}
+		o.Artifacts = &artifacts
+	}
+	if o.SampleRate != 0 && !IsValidSampleRate(o.SampleRate) {
+		return fmt.Errorf("unsupported sample_rate %d", o.SampleRate)
+	}
+	if o.Channels != 0 && !IsValidChannels(o.Channels) {
+		return fmt.Errorf("channels must be 1 or 2")
+	}
+	if o.Start < 0 || o.End < 0 {
+		return fmt.Errorf("start and end must not be negative")
+	}
+	if o.End > 0 && o.End <= o.Start {
+		return fmt.Errorf("end must be greater than start")
+	}
+	if o.FadeIn < 0 || o.FadeOut < 0 {
+		return fmt.Errorf("fade_in and fade_out must not be negative")
+	}
+	if o.End > 0 && o.FadeIn+o.FadeOut > float64(o.End-o.Start) {
+		return fmt.Errorf("fade_in and fade_out exceed the clip length")
+	}
+	f, ok := OutputFormats[o.Format]
+	if !ok {
+		return fmt.Errorf("unsupported format %q", o.Format)
+	}
+	if !f.Lossless {
+		if o.BitDepth != 0 || o.SampleFormat != "" {
+			return fmt.Errorf("bit_depth and sample_format are only supported for lossless formats")
+		}
+		return nil
+	}
+	if o.BitDepth == 0 {
+		o.BitDepth = 16
+	}
+	if o.SampleFormat == "" {
+		o.SampleFormat = SampleFormatInt
+	}
+	if _, ok := f.Codecs[o.codecKey()]; !ok {
+		return fmt.Errorf("%s does not support %s samples at %d bits", o.Format, o.SampleFormat, o.BitDepth)
+	}
+	return nil
+}
+
+// WithDefaults fills fields o leaves unset from d, e.g. an owner's saved
+// defaults. Bit depth and sample format are only taken from d when o does
+// not pick a different format, since they depend on it.
+func (o Options) WithDefaults(d Options) Options {
+	sameFormat := o.Format == "" || strings.EqualFold(strings.TrimSpace(o.Format), d.Format)
+	if o.Format == "" {
+		o.Format = d.Format
+	}
+	if sameFormat {
+		if o.BitDepth == 0 {
+			o.BitDepth = d.BitDepth
+		}
+		if o.SampleFormat == "" {
+			o.SampleFormat = d.SampleFormat
+		}
+	}
+	if o.Loudnorm == nil {
+		o.Loudnorm = d.Loudnorm
+	}
+	if o.Artifacts == nil {
+		o.Artifacts = d.Artifacts
+	}
+	if o.Prefer == "" {
+		o.Prefer = d.Prefer
+	}
+	if o.SampleRate == 0 {
+		o.SampleRate = d.SampleRate
+	}
+	if o.Channels == 0 {
+		o.Channels = d.Channels
+	}
+	return o
+}
+
+// ValidateDefaults checks options meant to be saved as defaults: they must
+// normalize cleanly and cannot include a per-media trim or a priority.
+func (o Options) ValidateDefaults() error {
+	if o.Start != 0 || o.End != 0 {
+		return fmt.Errorf("start and end cannot be saved as defaults")
+	}
+	if strings.TrimSpace(o.Priority) != "" {
+		return fmt.Errorf("priority cannot be saved as a default")
+	}
+	return o.Normalize()
+}
+
+func (o Options) Output() OutputFormat {
+	if f, ok := OutputFormats[o.Format]; ok {
+		return f
+	}
+	return OutputFormats[FormatMP3]
+}
+
+// CodecArgs returns the ffmpeg encoder arguments for lossless formats.
+func (o Options) CodecArgs() []string {
+	return o.Output().Codecs[o.codecKey()]
+}
+
+func (o Options) codecKey() string {
+	return fmt.Sprintf("%s/%d", o.SampleFormat, o.BitDepth)
+}
@@ -0,0 +1,34 @@
+package jobs
+
+import "testing"
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    float64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"90", 90, false},
+		{" 1:30 ", 90, false},
+		{"01:02:03.5", 3723.5, false},
+		{"1:60", 0, true},
+		{"-1", 0, true},
+		{"1:2:3:4", 0, true},
+		{"abc", 0, true},
+		{"NaN", 0, true},
+		{"nan", 0, true},
+		{"Inf", 0, true},
+		{"+Inf", 0, true},
+		{"-Inf", 0, true},
+		{"infinity", 0, true},
+		{"1:NaN", 0, true},
+		{"Inf:00", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimestamp(tt.raw)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseTimestamp(%q) = %v, %v; want %v, error %v", tt.raw, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
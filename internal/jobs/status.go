@@ -7,4 +7,36 @@ const (
 	StatusReady       = "ready"
 	StatusFailed      = "failed"
 	StatusExpired     = "expired"
+	// StatusDead marks a job the worker gave up on: its last attempt failed
+	// or the error was not retryable. StatusFailed jobs may still be retried
+	// by asynq.
+	StatusDead = "dead"
 )
+
+var Statuses = []string{
+	StatusQueued,
+	StatusDownloading,
+	StatusTranscoding,
+	StatusReady,
+	StatusFailed,
+	StatusExpired,
+	StatusDead,
+}
+
+func IsValidStatus(status string) bool {
+	for _, s := range Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func IsTerminal(status string) bool {
+	return status == StatusReady || status == StatusFailed || status == StatusExpired || status == StatusDead
+}
+
+// IsRetryable reports whether a job in status may be queued again by hand.
+func IsRetryable(status string) bool {
+	return status == StatusFailed || status == StatusExpired || status == StatusDead
+}
@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	JobsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "v2m_jobs_created_total",
+		Help: "Jobs accepted by the API.",
+	}, []string{"platform"})
+	JobsSucceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "v2m_jobs_succeeded_total",
+		Help: "Jobs that finished with a ready MP3.",
+	}, []string{"platform"})
+	JobsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "v2m_jobs_failed_total",
+		Help: "Jobs whose last attempt failed; attempts that will be retried are not counted.",
+	}, []string{"platform"})
+	TranscodeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "v2m_transcode_duration_seconds",
+		Help:    "Time spent running ffmpeg.",
+		Buckets: []float64{1, 2, 5, 10, 20, 30, 60, 120, 300, 600},
+	})
+	DownloadBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "v2m_download_bytes_total",
+		Help: "Bytes of source media downloaded by workers.",
+	})
+	MediaDownloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "v2m_media_downloads_total",
+		Help: "Source media fetched by workers, by stream kind (audio or video).",
+	}, []string{"media"})
+	MediaDownloadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "v2m_media_download_bytes_total",
+		Help: "Bytes of source media fetched by workers, by stream kind (audio or video).",
+	}, []string{"media"})
+	ParserWaitDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "v2m_parser_wait_seconds",
+		Help:    "Time jobs waited for a parser slot.",
+		Buckets: []float64{0.01, 0.1, 0.5, 1, 2, 5, 10, 30, 60},
+	})
+	ParserWaitTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "v2m_parser_wait_timeouts_total",
+		Help: "Jobs that gave up waiting for a parser slot.",
+	})
+	DeprecatedTokenRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "v2m_deprecated_token_requests_total",
+		Help: "Requests authorized by a token from PREVIOUS_API_TOKENS.",
+	})
+)
+
+// Registry holds the collectors for one binary. Collectors above are always
+// safe to use; they are only exported when registered here.
+type Registry struct {
+	reg *prometheus.Registry
+}
+
+func NewRegistry(cs ...prometheus.Collector) *Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(cs...)
+	return &Registry{reg: reg}
+}
+
+func (r *Registry) Handler() http.Handler {
+	return promhttp.HandlerFor(r.reg, promhttp.HandlerOpts{})
+}
+
+// QueueCollector reports asynq queue sizes by task state on each scrape.
+type QueueCollector struct {
+	inspector *asynq.Inspector
+	queues    []string
+	depth     *prometheus.Desc
+}
+
+func NewQueueCollector(inspector *asynq.Inspector, queues ...string) *QueueCollector {
+	return &QueueCollector{
+		inspector: inspector,
+		queues:    queues,
+		depth: prometheus.NewDesc(
+			"v2m_queue_depth",
+			"Tasks in the asynq queue by state.",
+			[]string{"queue", "state"},
+			nil,
+		),
+	}
+}
+
+func (c *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.depth
+}
+
+func (c *QueueCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, q := range c.queues {
+		info, err := c.inspector.GetQueueInfo(q)
+		if err != nil {
+			continue
+		}
+		states := map[string]int{
+			"pending":   info.Pending,
+			"active":    info.Active,
+			"scheduled": info.Scheduled,
+			"retry":     info.Retry,
+			"archived":  info.Archived,
+		}
+		for state, n := range states {
+			ch <- prometheus.MustNewConstMetric(c.depth, prometheus.GaugeValue, float64(n), q, state)
+		}
+	}
+}
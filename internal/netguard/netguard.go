@@ -0,0 +1,223 @@
+package netguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// ErrBlocked is returned when an outbound connection would reach a blocked
+// address, e.g. a cloud metadata endpoint behind a crafted link.
+var ErrBlocked = errors.New("destination address is blocked")
+
+// DefaultBlocked covers loopback, private, link-local (including the
+// 169.254.169.254 metadata endpoint), CGNAT, multicast and reserved ranges.
+var DefaultBlocked = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// Guard resolves outbound hosts itself and refuses to connect to blocked
+// addresses. Checking at dial time also covers redirects and DNS names that
+// point at internal addresses.
+type Guard struct {
+	blocked []netip.Prefix
+	allowed []netip.Prefix
+	// trusted hosts (by name, as configured by the operator) skip the check.
+	trusted map[string]bool
+	dialer  *net.Dialer
+	proxy   func(*url.URL) (*url.URL, error)
+}
+
+// New builds a Guard. block is a comma-separated CIDR list replacing
+// DefaultBlocked when non-empty, or "none" to disable blocking; allow lists
+// CIDRs exempt from the blocklist; trustedHosts are host names never checked.
+func New(block, allow string, trustedHosts ...string) (*Guard, error) {
+	g := &Guard{
+		trusted: make(map[string]bool),
+		dialer:  &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+	var err error
+	switch strings.TrimSpace(block) {
+	case "":
+		g.blocked, err = parsePrefixes(DefaultBlocked)
+	case "none":
+	default:
+		g.blocked, err = parsePrefixes(strings.Split(block, ","))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if g.allowed, err = parsePrefixes(strings.Split(allow, ",")); err != nil {
+		return nil, err
+	}
+	for _, h := range trustedHosts {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			g.trusted[h] = true
+		}
+	}
+	return g, nil
+}
+
+func parsePrefixes(raw []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, s := range raw {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %w", s, err)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// Blocked reports whether connecting to ip is refused.
+func (g *Guard) Blocked(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range g.allowed {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	for _, p := range g.blocked {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// UseProxy routes requests through an egress proxy: override for both
+// schemes when set, otherwise HTTP_PROXY/HTTPS_PROXY. NO_PROXY applies either
+// way. Proxy hosts are trusted, and since the proxy connects on our behalf,
+// destinations are checked by resolving them before the request is handed
+// over.
+func (g *Guard) UseProxy(override string) error {
+	pc := httpproxy.FromEnvironment()
+	if override = strings.TrimSpace(override); override != "" {
+		u, err := url.Parse(override)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy url %q", override)
+		}
+		pc.HTTPProxy, pc.HTTPSProxy = override, override
+	}
+	for _, raw := range []string{pc.HTTPProxy, pc.HTTPSProxy} {
+		if raw == "" {
+			continue
+		}
+		if !strings.Contains(raw, "://") {
+			raw = "http://" + raw
+		}
+		if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+			g.trusted[strings.ToLower(u.Hostname())] = true
+		}
+	}
+	if pc.HTTPProxy != "" || pc.HTTPSProxy != "" {
+		g.proxy = pc.ProxyFunc()
+	}
+	return nil
+}
+
+// ProxyEnabled reports whether UseProxy configured a proxy.
+func (g *Guard) ProxyEnabled() bool {
+	return g.proxy != nil
+}
+
+// resolve looks host up and fails with ErrBlocked if any address is blocked.
+func (g *Guard) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if g.Blocked(ip) {
+			return nil, fmt.Errorf("%w: %s (%s)", ErrBlocked, host, ip.Unmap())
+		}
+	}
+	return ips, nil
+}
+
+// checkRequired reports whether connections to host must be checked.
+func (g *Guard) checkRequired(host string) bool {
+	return !g.trusted[strings.ToLower(host)] && len(g.blocked) > 0
+}
+
+// DialContext resolves addr, rejects it if any resolved address is blocked,
+// and dials the resolved addresses in turn.
+func (g *Guard) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !g.checkRequired(host) {
+		return g.dialer.DialContext(ctx, network, addr)
+	}
+	ips, err := g.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := g.dialer.DialContext(ctx, network, net.JoinHostPort(ip.Unmap().String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses for %s", host)
+	}
+	return nil, lastErr
+}
+
+// Transport returns an http.Transport that dials through the guard. Without
+// UseProxy it ignores HTTP(S)_PROXY, since an unchecked proxy would hide the
+// real destination.
+func (g *Guard) Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	if g.proxy != nil {
+		t.Proxy = g.proxyFor
+	}
+	t.DialContext = g.DialContext
+	return t
+}
+
+func (g *Guard) proxyFor(req *http.Request) (*url.URL, error) {
+	u, err := g.proxy(req.URL)
+	if err != nil || u == nil {
+		return u, err
+	}
+	if host := req.URL.Hostname(); g.checkRequired(host) {
+		if _, err := g.resolve(req.Context(), host); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
@@ -0,0 +1,219 @@
+package netguard
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestBlocked(t *testing.T) {
+	g, err := New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		// Private.
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"fd00::1", true},
+		// Loopback.
+		{"127.0.0.1", true},
+		{"127.8.9.10", true},
+		{"::1", true},
+		// Link-local, including the metadata endpoint.
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		// IPv4-mapped IPv6 is checked as the IPv4 address.
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"::ffff:10.0.0.1", true},
+		{"0.0.0.0", true},
+		{"100.64.0.1", true},
+		// Public.
+		{"8.8.8.8", false},
+		{"172.32.0.1", false},
+		{"::ffff:8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, tt := range tests {
+		if got := g.Blocked(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("Blocked(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestNewLists(t *testing.T) {
+	g, err := New("none", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Blocked(netip.MustParseAddr("127.0.0.1")) {
+		t.Error(`block "none" still blocks loopback`)
+	}
+
+	g, err = New("", "10.1.0.0/16, ::ffff:0:0/96")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Blocked(netip.MustParseAddr("10.1.2.3")) {
+		t.Error("allowed range blocked")
+	}
+	if !g.Blocked(netip.MustParseAddr("10.2.0.1")) {
+		t.Error("range outside the allow list not blocked")
+	}
+
+	g, err = New("203.0.113.0/24", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.Blocked(netip.MustParseAddr("203.0.113.7")) || g.Blocked(netip.MustParseAddr("127.0.0.1")) {
+		t.Error("custom block list does not replace the default")
+	}
+
+	for _, bad := range [][2]string{{"10.0.0.0/33", ""}, {"", "nope"}} {
+		if _, err := New(bad[0], bad[1]); err == nil {
+			t.Errorf("New(%q, %q) accepted an invalid cidr", bad[0], bad[1])
+		}
+	}
+}
+
+func TestDialBlocked(t *testing.T) {
+	g, err := New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"127.0.0.1:80", "[::1]:80", "169.254.169.254:80", "[::ffff:127.0.0.1]:80"} {
+		if _, err := g.DialContext(context.Background(), "tcp", addr); !errors.Is(err, ErrBlocked) {
+			t.Errorf("dial %s: err = %v, want ErrBlocked", addr, err)
+		}
+	}
+}
+
+func TestRedirectToBlockedHost(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.Write([]byte("ok"))
+		case "/metadata":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+		case "/mapped":
+			// The test server itself, spelled as an IPv4-mapped address.
+			_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+			http.Redirect(w, r, "http://[::ffff:127.0.0.1]:"+port+"/ok", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	// Only the test server's own name is trusted.
+	g, err := New("", "", u.Hostname())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: g.Transport()}
+
+	resp, err := client.Get(srv.URL + "/ok")
+	if err != nil {
+		t.Fatalf("trusted host: %v", err)
+	}
+	resp.Body.Close()
+	for _, path := range []string{"/metadata", "/mapped"} {
+		resp, err := client.Get(srv.URL + path)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !errors.Is(err, ErrBlocked) {
+			t.Errorf("redirect %s: err = %v, want ErrBlocked", path, err)
+		}
+	}
+}
+
+// clearProxyEnv unsets the proxy variables for the test.
+func clearProxyEnv(t *testing.T) {
+	for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestUseProxy(t *testing.T) {
+	clearProxyEnv(t)
+	t.Setenv("NO_PROXY", "storage.test")
+	var mu sync.Mutex
+	var seen []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.URL.String())
+		mu.Unlock()
+		w.Write([]byte("via proxy"))
+	}))
+	defer proxy.Close()
+
+	g, err := New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.UseProxy(proxy.URL); err != nil {
+		t.Fatal(err)
+	}
+	if !g.ProxyEnabled() {
+		t.Fatal("proxy not enabled")
+	}
+	client := &http.Client{Transport: g.Transport()}
+
+	// The proxy itself is on a blocked loopback address but trusted.
+	resp, err := client.Get("http://93.184.216.34/media.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "via proxy" {
+		t.Errorf("body = %q, want the proxy's answer", body)
+	}
+
+	// Destinations are still checked before the request is handed over.
+	if resp, err := client.Get("http://169.254.169.254/latest/meta-data/"); !errors.Is(err, ErrBlocked) {
+		if err == nil {
+			resp.Body.Close()
+		}
+		t.Errorf("metadata through proxy: err = %v, want ErrBlocked", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 1 || seen[0] != "http://93.184.216.34/media.mp4" {
+		t.Errorf("proxy saw %q, want only the allowed request", seen)
+	}
+
+	// NO_PROXY hosts, e.g. presigned storage URLs, go direct.
+	req := httptest.NewRequest(http.MethodGet, "https://bucket.storage.test/mp3/a.mp3", nil)
+	if u, err := g.proxyFor(req); u != nil || err != nil {
+		t.Errorf("proxyFor(NO_PROXY host) = %v, %v; want direct", u, err)
+	}
+}
+
+func TestUseProxyInvalid(t *testing.T) {
+	clearProxyEnv(t)
+	g, err := New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.UseProxy("://nope"); err == nil {
+		t.Error("invalid proxy url accepted")
+	}
+	if err := g.UseProxy(""); err != nil || g.ProxyEnabled() {
+		t.Errorf("no proxy configured: err %v, enabled %v", err, g.ProxyEnabled())
+	}
+}
@@ -0,0 +1,175 @@
+package parser
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Parser authentication modes (PARSER_AUTH_MODE).
+const (
+	authVigenere = "vigenere"
+	authBearer   = "bearer"
+	authHMAC     = "hmac"
+	authNone     = "none"
+)
+
+// Signer adds authentication headers to a parser request whose body is body.
+type Signer interface {
+	Sign(req *http.Request, body []byte) error
+}
+
+// NewSigner returns the signer for PARSER_AUTH_MODE. bearer and hmac need
+// PARSER_API_KEY.
+func NewSigner(mode, key string) (Signer, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "", authVigenere:
+		return vigenereSigner{}, nil
+	case authNone:
+		return noneSigner{}, nil
+	case authBearer, authHMAC:
+		if key == "" {
+			return nil, fmt.Errorf("PARSER_AUTH_MODE=%s requires PARSER_API_KEY", mode)
+		}
+		if mode == authBearer {
+			return bearerSigner{token: key}, nil
+		}
+		return hmacSigner{secret: []byte(key)}, nil
+	default:
+		return nil, fmt.Errorf("unknown PARSER_AUTH_MODE %q, want vigenere, bearer, hmac or none", mode)
+	}
+}
+
+// vigenereSigner is the bundled parser's scheme: 32 random letters in
+// X-GCLT-Text, and the same letters Vigenère-encrypted with a key derived
+// from X-Timestamp in X-EGCT-Text.
+type vigenereSigner struct{}
+
+func (vigenereSigner) Sign(req *http.Request, _ []byte) error {
+	ts := fmt.Sprintf("%d", time.Now().UnixMilli())
+	gclt, err := randomLetters(32)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Timestamp", ts)
+	req.Header.Set("X-GCLT-Text", gclt)
+	req.Header.Set("X-EGCT-Text", vigenereEncrypt(gclt, timestampToKey(ts)))
+	return nil
+}
+
+type bearerSigner struct {
+	token string
+}
+
+func (s bearerSigner) Sign(req *http.Request, _ []byte) error {
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	return nil
+}
+
+// hmacSigner sends X-Timestamp (unix milliseconds) and X-Signature, the hex
+// HMAC-SHA256 of "{timestamp}.{body}" keyed with the shared secret.
+type hmacSigner struct {
+	secret []byte
+}
+
+func (s hmacSigner) Sign(req *http.Request, body []byte) error {
+	ts := fmt.Sprintf("%d", time.Now().UnixMilli())
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	req.Header.Set("X-Timestamp", ts)
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+type noneSigner struct{}
+
+func (noneSigner) Sign(*http.Request, []byte) error {
+	return nil
+}
+
+// WithHeaders returns a signer that sets h on the request before signer
+// signs it. It returns signer itself when h is empty.
+func WithHeaders(signer Signer, h http.Header) Signer {
+	if len(h) == 0 {
+		return signer
+	}
+	return headerSigner{next: signer, headers: h}
+}
+
+type headerSigner struct {
+	next    Signer
+	headers http.Header
+}
+
+func (s headerSigner) Sign(req *http.Request, body []byte) error {
+	for name, values := range s.headers {
+		req.Header[name] = values
+	}
+	return s.next.Sign(req, body)
+}
+
+func timestampToKey(ts string) string {
+	const digitsToLetters = "abcdefghijklmnopqrstuvwxyz"
+	var b strings.Builder
+	for _, r := range ts {
+		if r < '0' || r > '9' {
+			b.WriteRune('?')
+			continue
+		}
+		b.WriteByte(digitsToLetters[int(r-'0')])
+	}
+	return b.String()
+}
+
+func vigenereEncrypt(text, key string) string {
+	if key == "" {
+		return text
+	}
+	var b strings.Builder
+	keyIndex := 0
+	keyRunes := []rune(strings.ToLower(key))
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			b.WriteRune(r)
+			continue
+		}
+		shiftBase := 'a'
+		if unicode.IsUpper(r) {
+			shiftBase = 'A'
+		}
+		keyChar := keyRunes[keyIndex%len(keyRunes)]
+		keyShift := keyChar - 'a'
+		enc := (r-shiftBase+keyShift)%26 + shiftBase
+		b.WriteRune(enc)
+		keyIndex++
+	}
+	return b.String()
+}
+
+func randomLetters(n int) (string, error) {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	if n <= 0 {
+		return "", nil
+	}
+	var b strings.Builder
+	b.Grow(n)
+	max := big.NewInt(int64(len(letters)))
+	for i := 0; i < n; i++ {
+		r, err := crand.Int(crand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(letters[r.Int64()])
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,124 @@
+package parser
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func signed(t *testing.T, s Signer, body string) http.Header {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/parse", nil)
+	if err := s.Sign(req, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	return req.Header
+}
+
+func TestVigenereSigner(t *testing.T) {
+	s, err := NewSigner("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := signed(t, s, `{"text":"x"}`)
+
+	ts, gclt := h.Get("X-Timestamp"), h.Get("X-GCLT-Text")
+	if !regexp.MustCompile(`^\d{13}$`).MatchString(ts) {
+		t.Errorf("X-Timestamp = %q, want unix milliseconds", ts)
+	}
+	if !regexp.MustCompile(`^[a-zA-Z]{32}$`).MatchString(gclt) {
+		t.Errorf("X-GCLT-Text = %q, want 32 letters", gclt)
+	}
+	if got, want := h.Get("X-EGCT-Text"), vigenereEncrypt(gclt, timestampToKey(ts)); got != want {
+		t.Errorf("X-EGCT-Text = %q, want %q", got, want)
+	}
+	if h.Get("Authorization") != "" {
+		t.Error("vigenere sent an Authorization header")
+	}
+}
+
+func TestVigenereEncrypt(t *testing.T) {
+	if got := timestampToKey("1700000000123"); got != "bhaaaaaaaabcd" {
+		t.Errorf("timestampToKey = %q", got)
+	}
+	// Letters shift by the key, case is kept and the key wraps around.
+	if got := vigenereEncrypt("abcXYZ", "bc"); got != "bddZZB" {
+		t.Errorf("vigenereEncrypt = %q, want bddZZB", got)
+	}
+}
+
+func TestBearerSigner(t *testing.T) {
+	s, err := NewSigner("Bearer", "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := signed(t, s, "{}")
+	if got := h.Get("Authorization"); got != "Bearer tok" {
+		t.Errorf("Authorization = %q, want Bearer tok", got)
+	}
+	if len(h) != 1 {
+		t.Errorf("extra headers: %v", h)
+	}
+}
+
+func TestHMACSigner(t *testing.T) {
+	s, err := NewSigner("hmac", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"text":"https://v.douyin.com/x/"}`
+	h := signed(t, s, body)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(h.Get("X-Timestamp") + "." + body))
+	if got, want := h.Get("X-Signature"), hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("X-Signature = %q, want %q", got, want)
+	}
+	if h.Get("X-Timestamp") == "" {
+		t.Error("X-Timestamp missing")
+	}
+}
+
+func TestNoneSigner(t *testing.T) {
+	s, err := NewSigner("none", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := signed(t, s, "{}"); len(h) != 0 {
+		t.Errorf("none sent headers: %v", h)
+	}
+}
+
+func TestNewSignerErrors(t *testing.T) {
+	for _, tt := range []struct{ mode, key string }{
+		{"bearer", ""},
+		{"hmac", ""},
+		{"basic", "key"},
+	} {
+		if _, err := NewSigner(tt.mode, tt.key); err == nil {
+			t.Errorf("NewSigner(%q, %q) succeeded", tt.mode, tt.key)
+		}
+	}
+}
+
+func TestWithHeaders(t *testing.T) {
+	s, err := NewSigner("bearer", "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if WithHeaders(s, nil) != s {
+		t.Error("WithHeaders wrapped a signer without headers")
+	}
+	h := signed(t, WithHeaders(s, http.Header{"X-Tenant": {"a"}, "Authorization": {"ignored"}}), "{}")
+	if h.Get("X-Tenant") != "a" {
+		t.Errorf("X-Tenant = %q, want a", h.Get("X-Tenant"))
+	}
+	// The signer runs last, so its headers win.
+	if got := h.Get("Authorization"); got != "Bearer tok" {
+		t.Errorf("Authorization = %q, want Bearer tok", got)
+	}
+}
@@ -0,0 +1,203 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"video2mp3/internal/jobs"
+)
+
+// ErrRejected marks a parser response that reported failure, as opposed to
+// the parser being unreachable. Rejections are returned as *RejectedError.
+var ErrRejected = errors.New("parser error")
+
+// ErrNoMedia is a successful parser response without any media URL.
+var ErrNoMedia = errors.New("parser returned no media url")
+
+// RejectedError is a parser response that reported failure, with the error
+// category its retcode and description map to ("" when unrecognized).
+type RejectedError struct {
+	Retcode  int
+	Retdesc  string
+	Category string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("%s: %d %s", ErrRejected, e.Retcode, e.Retdesc)
+}
+
+func (e *RejectedError) Is(target error) bool {
+	return target == ErrRejected
+}
+
+// StatusError is a non-200 HTTP response from the parser.
+type StatusError struct {
+	Code int
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("parser http status %d", e.Code)
+}
+
+// rejectionMarkers map words in a parser's retdesc to an error category,
+// checked in order. The parser answers in English or Chinese.
+var rejectionMarkers = []struct {
+	category string
+	words    []string
+}{
+	{jobs.ErrorRateLimited, []string{"rate limit", "too many", "too frequent", "频繁", "限流"}},
+	{jobs.ErrorGeoBlocked, []string{"region", "geo", "country", "地区", "区域"}},
+	{jobs.ErrorUnavailable, []string{"not found", "deleted", "removed", "private", "unavailable", "不存在", "已删除", "私密"}},
+	{jobs.ErrorUnsupported, []string{"unsupported", "not supported", "不支持"}},
+}
+
+// Categorize maps a parser rejection to a jobs error category, or "" when
+// neither the retcode nor the description is recognized.
+func Categorize(retcode int, retdesc string) string {
+	switch {
+	case retcode == http.StatusTooManyRequests:
+		return jobs.ErrorRateLimited
+	case retcode == http.StatusUnavailableForLegalReasons:
+		return jobs.ErrorGeoBlocked
+	case retcode == http.StatusNotFound || retcode == http.StatusGone:
+		return jobs.ErrorUnavailable
+	}
+	desc := strings.ToLower(retdesc)
+	for _, m := range rejectionMarkers {
+		for _, word := range m.words {
+			if strings.Contains(desc, word) {
+				return m.category
+			}
+		}
+	}
+	if retcode >= 500 {
+		return jobs.ErrorTransient
+	}
+	return ""
+}
+
+// Result is what the parser resolved a link to.
+type Result struct {
+	VideoURL string
+	AudioURL string
+	Platform string
+	Title    string
+	VideoID  string
+	CoverURL string
+}
+
+type response struct {
+	Retcode int    `json:"retcode"`
+	Retdesc string `json:"retdesc"`
+	Data    struct {
+		VideoID  string `json:"video_id"`
+		Platform string `json:"platform"`
+		Title    string `json:"title"`
+		VideoURL string `json:"video_url"`
+		CoverURL string `json:"cover_url"`
+		AudioURL string `json:"audio_url"`
+	} `json:"data"`
+	Succ bool `json:"succ"`
+}
+
+// Request body fields the link can be sent in (PARSER_URL_FIELD).
+const (
+	FieldText = "text"
+	FieldURL  = "url"
+)
+
+// Endpoint is where the parser is called and how the link is sent: a POST
+// to URL with a JSON body of {Field: link}.
+type Endpoint struct {
+	URL   string
+	Field string
+}
+
+// NewEndpoint joins PARSER_API_URL and PARSER_ENDPOINT_PATH and checks
+// PARSER_URL_FIELD. Empty path and field default to the bundled parser's
+// "api/parse" and "text". Without a base URL the endpoint is left unset and
+// Parse fails.
+func NewEndpoint(baseURL, path, field string) (Endpoint, error) {
+	field = strings.ToLower(strings.TrimSpace(field))
+	switch field {
+	case "":
+		field = FieldText
+	case FieldText, FieldURL:
+	default:
+		return Endpoint{}, fmt.Errorf("unknown PARSER_URL_FIELD %q, want text or url", field)
+	}
+	baseURL = strings.TrimSpace(baseURL)
+	if baseURL == "" {
+		return Endpoint{Field: field}, nil
+	}
+	path = strings.TrimSpace(path)
+	if path == "" {
+		path = "api/parse"
+	}
+	u, err := url.JoinPath(baseURL, path)
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("invalid PARSER_API_URL or PARSER_ENDPOINT_PATH: %w", err)
+	}
+	return Endpoint{URL: u, Field: field}, nil
+}
+
+// Parse makes one call to the parser at endpoint for sourceURL, signing it
+// with signer. client sets the timeout and transport.
+func Parse(ctx context.Context, client *http.Client, endpoint Endpoint, signer Signer, sourceURL string) (Result, error) {
+	if endpoint.URL == "" {
+		return Result{}, errors.New("PARSER_API_URL is required")
+	}
+	field := endpoint.Field
+	if field == "" {
+		field = FieldText
+	}
+	body, err := json.Marshal(map[string]string{field: sourceURL})
+	if err != nil {
+		return Result{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return Result{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := signer.Sign(req, body); err != nil {
+		return Result{}, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Result{}, StatusError{Code: resp.StatusCode}
+	}
+
+	var parsed response
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return Result{}, err
+	}
+	if !parsed.Succ || parsed.Retcode != 200 {
+		return Result{}, &RejectedError{Retcode: parsed.Retcode, Retdesc: parsed.Retdesc, Category: Categorize(parsed.Retcode, parsed.Retdesc)}
+	}
+	if strings.TrimSpace(parsed.Data.VideoURL) == "" && strings.TrimSpace(parsed.Data.AudioURL) == "" {
+		return Result{}, ErrNoMedia
+	}
+
+	return Result{
+		VideoURL: parsed.Data.VideoURL,
+		AudioURL: parsed.Data.AudioURL,
+		Platform: parsed.Data.Platform,
+		Title:    parsed.Data.Title,
+		VideoID:  parsed.Data.VideoID,
+		CoverURL: parsed.Data.CoverURL,
+	}, nil
+}
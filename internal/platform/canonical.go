@@ -0,0 +1,66 @@
+package platform
+
+import (
+	"net/url"
+	"strings"
+)
+
+// trackingParams lists query parameters that only record how a link was
+// shared, per platform. Parameters that select content (bilibili p and t,
+// youtube v, list and t) are never listed.
+var trackingParams = map[string][]string{
+	PlatformDouyin: {
+		"previous_page", "share_sign", "share_version", "share_token", "u_code", "did", "iid",
+		"with_sec_did", "sec_did", "timestamp", "ts", "from_ssr", "enter_from", "is_copy_url",
+		"is_from_webapp", "sender_device", "utm_campaign", "utm_medium", "utm_source",
+	},
+	PlatformBilibili: {
+		"spm_id_from", "vd_source", "share_source", "share_medium", "share_plat", "share_session_id",
+		"share_tag", "share_from", "unique_k", "bbid", "ts", "timestamp", "from_spmid", "plat_id",
+		"buvid", "up_id", "is_story_h5", "seid",
+	},
+	PlatformXHS: {
+		"xsec_source", "share_from_user_hidden", "author_share", "app_platform", "app_version",
+		"share_id", "apptime", "shareRedId",
+	},
+	PlatformKuaishou: {"fid", "cc", "shareMethod", "kpn", "subBiz", "shareId", "shareToken", "shareResourceType", "shareUrlOpened", "timestamp"},
+	PlatformYouTube:  {"si", "feature", "pp", "ab_channel"},
+	PlatformTikTok: {
+		"is_from_webapp", "sender_device", "sender_web_id", "_r", "_t", "u_code", "share_app_id",
+		"share_link_id", "social_sharing", "refer",
+	},
+	PlatformInstagram: {"igsh", "igshid"},
+}
+
+// Canonicalize rewrites a source link so equivalent links compare equal: the
+// scheme and host are lowercased, the fragment and utm_* parameters are
+// dropped, the platform's known tracking parameters are removed and the
+// remaining ones sorted. Links that do not parse are returned unchanged.
+func Canonicalize(platform, rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment, u.RawFragment = "", ""
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return u.String()
+	}
+	drop := make(map[string]bool, len(trackingParams[platform]))
+	for _, name := range trackingParams[platform] {
+		drop[name] = true
+	}
+	for name := range q {
+		if drop[name] || strings.HasPrefix(strings.ToLower(name), "utm_") {
+			q.Del(name)
+		}
+	}
+	u.RawQuery = q.Encode()
+	u.ForceQuery = false
+	return u.String()
+}
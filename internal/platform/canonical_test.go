@@ -0,0 +1,78 @@
+package platform
+
+import "testing"
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		platform, raw, want string
+	}{
+		{
+			PlatformBilibili,
+			"HTTPS://WWW.Bilibili.com/video/BV1xx411c7mD/?p=2&spm_id_from=333.1007.tianma.1-1-1.click&vd_source=0f1e2d3c#reply123",
+			"https://www.bilibili.com/video/BV1xx411c7mD/?p=2",
+		},
+		{
+			PlatformDouyin,
+			"https://www.douyin.com/video/7300000000000000000?previous_page=app_code_link&share_token=abc&u_code=x&utm_source=copy",
+			"https://www.douyin.com/video/7300000000000000000",
+		},
+		{
+			PlatformYouTube,
+			"https://youtu.be/dQw4w9WgXcQ?si=AbCdEf&t=42",
+			"https://youtu.be/dQw4w9WgXcQ?t=42",
+		},
+		{
+			PlatformYouTube,
+			"https://www.youtube.com/watch?v=dQw4w9WgXcQ&list=PL123&feature=share&UTM_Medium=x",
+			"https://www.youtube.com/watch?list=PL123&v=dQw4w9WgXcQ",
+		},
+		{
+			PlatformXHS,
+			"https://www.xiaohongshu.com/explore/64f0?xsec_token=tok&xsec_source=pc_share&shareRedId=r1",
+			"https://www.xiaohongshu.com/explore/64f0?xsec_token=tok",
+		},
+		{
+			PlatformInstagram,
+			"https://www.instagram.com/reel/Cx1/?igsh=MWQ1ZGUxMzBkMA==",
+			"https://www.instagram.com/reel/Cx1/",
+		},
+		// Another platform's tracking parameters are kept.
+		{PlatformDouyin, "https://v.douyin.com/iRNBho6u/?spm_id_from=1", "https://v.douyin.com/iRNBho6u/?spm_id_from=1"},
+		// The path keeps its case; short-link codes are case-sensitive.
+		{PlatformDouyin, "https://V.DOUYIN.COM/iRNBho6u/", "https://v.douyin.com/iRNBho6u/"},
+		{PlatformDouyin, "not a url", "not a url"},
+		{PlatformDouyin, "https://v.douyin.com/%zz", "https://v.douyin.com/%zz"},
+	}
+	for _, tt := range tests {
+		if got := Canonicalize(tt.platform, tt.raw); got != tt.want {
+			t.Errorf("Canonicalize(%s, %q)\n got %q\nwant %q", tt.platform, tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalizeEquivalentLinks(t *testing.T) {
+	pairs := []struct {
+		platform, a, b string
+	}{
+		{
+			PlatformBilibili,
+			"https://www.bilibili.com/video/BV1xx411c7mD?p=1&share_source=copy_web&vd_source=aaa",
+			"https://WWW.BILIBILI.COM/video/BV1xx411c7mD?spm_id_from=333.337&p=1#t=0",
+		},
+		{
+			PlatformDouyin,
+			"https://www.douyin.com/video/7300000000000000000?previous_page=web_code_link",
+			"https://www.douyin.com/video/7300000000000000000?is_from_webapp=1&sender_device=pc",
+		},
+		{
+			PlatformTikTok,
+			"https://www.tiktok.com/@user/video/7300000000000000000?is_from_webapp=1&sender_device=pc&_r=1",
+			"https://www.tiktok.com/@user/video/7300000000000000000?_t=8kL&utm_campaign=tt4d",
+		},
+	}
+	for _, p := range pairs {
+		if a, b := Canonicalize(p.platform, p.a), Canonicalize(p.platform, p.b); a != b {
+			t.Errorf("%s links differ:\n%q\n%q", p.platform, a, b)
+		}
+	}
+}
@@ -14,8 +14,94 @@ const (
 	PlatformWeishi   = "weishi"
 	PlatformPear     = "pearvideo"
 	PlatformPipigx   = "pipigaoxiao"
+	// Global platforms; the external parser may not support them.
+	PlatformYouTube   = "youtube"
+	PlatformTikTok    = "tiktok"
+	PlatformInstagram = "instagram"
+	// PlatformUpload marks jobs created from a direct file upload; Detect
+	// never returns it.
+	PlatformUpload = "upload"
 )
 
+var All = []string{
+	PlatformDouyin,
+	PlatformKuaishou,
+	PlatformBilibili,
+	PlatformXHS,
+	PlatformHaokan,
+	PlatformWeishi,
+	PlatformPear,
+	PlatformPipigx,
+	PlatformYouTube,
+	PlatformTikTok,
+	PlatformInstagram,
+	PlatformUpload,
+}
+
+// names are the display names of the platforms.
+var names = map[string]string{
+	PlatformDouyin:    "Douyin",
+	PlatformKuaishou:  "Kuaishou",
+	PlatformBilibili:  "Bilibili",
+	PlatformXHS:       "Xiaohongshu",
+	PlatformHaokan:    "Haokan",
+	PlatformWeishi:    "Weishi",
+	PlatformPear:      "Pear Video",
+	PlatformPipigx:    "Pipigaoxiao",
+	PlatformYouTube:   "YouTube",
+	PlatformTikTok:    "TikTok",
+	PlatformInstagram: "Instagram",
+	PlatformUpload:    "Upload",
+}
+
+// Info returns the display name of a platform and a slug for picking its
+// icon. The slug is the id for known platforms and "unknown" otherwise, so
+// clients only need icons for the ids in All; the name then falls back to id.
+func Info(id string) (displayName, slug string) {
+	if n, ok := names[id]; ok {
+		return n, id
+	}
+	return id, "unknown"
+}
+
+// Supported returns the platforms Detect can recognize in a link, in All
+// order.
+func Supported() []string {
+	out := make([]string, 0, len(All))
+	for _, p := range All {
+		if p != PlatformUpload {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Global lists the platforms the parser is not known to support; parser
+// rejections for them are reported as unsupported rather than as errors.
+var Global = []string{
+	PlatformYouTube,
+	PlatformTikTok,
+	PlatformInstagram,
+}
+
+func IsGlobal(id string) bool {
+	for _, p := range Global {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+func IsKnown(id string) bool {
+	for _, p := range All {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
 func Detect(raw string) (string, bool) {
 	u, err := url.Parse(raw)
 	if err != nil {
@@ -39,7 +125,23 @@ func Detect(raw string) (string, bool) {
 		return PlatformPear, true
 	case strings.Contains(host, "pipigx"):
 		return PlatformPipigx, true
+	case hostIs(host, "youtube.com") || hostIs(host, "youtu.be"):
+		return PlatformYouTube, true
+	case hostIs(host, "tiktok.com"):
+		return PlatformTikTok, true
+	case hostIs(host, "instagram.com") || hostIs(host, "instagr.am"):
+		return PlatformInstagram, true
 	default:
 		return "", false
 	}
 }
+
+// hostIs reports whether host is domain or one of its subdomains (e.g.
+// m.youtube.com, vt.tiktok.com).
+func hostIs(host, domain string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if h, _, ok := strings.Cut(host, ":"); ok {
+		host = h
+	}
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
@@ -0,0 +1,45 @@
+package platform
+
+import "testing"
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"https://v.douyin.com/iRNBho6u/", PlatformDouyin},
+		{"https://b23.tv/abc123", PlatformBilibili},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ", PlatformYouTube},
+		{"https://m.youtube.com/shorts/dQw4w9WgXcQ", PlatformYouTube},
+		{"https://youtu.be/dQw4w9WgXcQ", PlatformYouTube},
+		{"https://YOUTU.BE:443/dQw4w9WgXcQ", PlatformYouTube},
+		{"https://www.tiktok.com/@user/video/7300000000000000000", PlatformTikTok},
+		{"https://vt.tiktok.com/ZSabc123/", PlatformTikTok},
+		{"https://vm.tiktok.com/ZMabc123/", PlatformTikTok},
+		{"https://www.instagram.com/reel/Cx1/", PlatformInstagram},
+		{"https://instagr.am/p/Cx1/", PlatformInstagram},
+		// Look-alike hosts are not the platform.
+		{"https://notyoutube.com/watch?v=x", ""},
+		{"https://youtube.com.evil.example/watch?v=x", ""},
+		{"https://tiktok.co/x", ""},
+		{"https://example.com/?u=https://youtu.be/x", ""},
+		{"%zz", ""},
+	}
+	for _, tt := range tests {
+		got, ok := Detect(tt.raw)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("Detect(%q) = %q, %v; want %q", tt.raw, got, ok, tt.want)
+		}
+	}
+}
+
+func TestGlobalPlatforms(t *testing.T) {
+	for _, p := range []string{PlatformYouTube, PlatformTikTok, PlatformInstagram} {
+		if !IsGlobal(p) || !IsKnown(p) {
+			t.Errorf("%s: global %v, known %v", p, IsGlobal(p), IsKnown(p))
+		}
+	}
+	if IsGlobal(PlatformDouyin) {
+		t.Error("douyin reported as global")
+	}
+}
@@ -2,15 +2,151 @@ package queue
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"video2mp3/internal/jobs"
 
 	"github.com/hibiken/asynq"
 )
 
 const TaskProcessVideo = "video:process"
 
+const QueueDefault = "default"
+
+// Priority queues, selected by a job's priority option when QUEUE_WEIGHTS
+// configures them.
+const (
+	QueueHigh = "high"
+	QueueLow  = "low"
+)
+
+// defaultQueueWeight is the share of worker capacity given to fresh jobs when
+// retries use their own queue.
+const defaultQueueWeight = 4
+
+// ForPriority returns the queue a job with the given priority is enqueued to.
+func ForPriority(priority string) string {
+	if priority == "" {
+		return QueueDefault
+	}
+	return priority
+}
+
+// ParseWeights parses QUEUE_WEIGHTS, e.g. "high=6,default=3,low=1", into
+// asynq queue priorities. Only the high, default and low queues may be named
+// and default is required. An empty value returns nil: priorities are off.
+func ParseWeights(raw string) (map[string]int, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	weights := make(map[string]int)
+	for _, part := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || (name != QueueHigh && name != QueueDefault && name != QueueLow) {
+			return nil, fmt.Errorf("invalid queue weight %q, want high, default or low=<weight>", part)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("weight of queue %s must be a positive integer", name)
+		}
+		weights[name] = n
+	}
+	if _, ok := weights[QueueDefault]; !ok {
+		return nil, fmt.Errorf("queue weights must include %s", QueueDefault)
+	}
+	return weights, nil
+}
+
+// Names returns the queues in use, the default queue first. queueWeights is
+// QUEUE_WEIGHTS, validated at startup.
+func Names(retryQueue, queueWeights string) []string {
+	names := []string{QueueDefault}
+	weights, _ := ParseWeights(queueWeights)
+	extra := make([]string, 0, len(weights))
+	for name := range weights {
+		if name != QueueDefault {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	names = append(names, extra...)
+	if retryQueue != "" && retryQueue != QueueDefault && weights[retryQueue] == 0 {
+		names = append(names, retryQueue)
+	}
+	return names
+}
+
+// Weights returns the asynq queue priorities for the worker. A retry queue
+// not named in queueWeights gets retryWeight.
+func Weights(retryQueue string, retryWeight int, queueWeights string) map[string]int {
+	if retryWeight < 1 {
+		retryWeight = 1
+	}
+	weights, _ := ParseWeights(queueWeights)
+	if weights == nil {
+		if retryQueue == "" || retryQueue == QueueDefault {
+			return map[string]int{QueueDefault: 1}
+		}
+		return map[string]int{QueueDefault: defaultQueueWeight, retryQueue: retryWeight}
+	}
+	if retryQueue != "" && weights[retryQueue] == 0 {
+		weights[retryQueue] = retryWeight
+	}
+	return weights
+}
+
+// RetryDelay is the backoff before retry n+1 after n retries: base doubled
+// per retry, capped at max. It has no jitter so the worker can report the
+// exact next attempt time.
+func RetryDelay(n int, base, max time.Duration) time.Duration {
+	if base <= 0 {
+		base = time.Second
+	}
+	d := base
+	for i := 0; i < n; i++ {
+		d *= 2
+		if max > 0 && d >= max {
+			return max
+		}
+	}
+	if max > 0 && d > max {
+		return max
+	}
+	return d
+}
+
 type ProcessPayload struct {
-	JobID     string `json:"job_id"`
-	SourceURL string `json:"source_url"`
+	JobID     string       `json:"job_id"`
+	SourceURL string       `json:"source_url"`
+	Platform  string       `json:"platform,omitempty"`
+	Options   jobs.Options `json:"options,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+	// StagedKey is set for uploaded media already stored in S3; the worker
+	// fetches it instead of going through the parser.
+	StagedKey string `json:"staged_key,omitempty"`
+	// FreshParse skips the worker's parser result cache.
+	FreshParse bool `json:"fresh_parse,omitempty"`
+	// ReplacesKey is the output a re-transcode replaces; the worker deletes
+	// it once the new output is stored under a different key.
+	ReplacesKey string `json:"replaces_key,omitempty"`
+}
+
+// StagedUploadPrefix is the S3 prefix uploaded source files are staged under.
+// Sources kept for re-transcoding (RETAIN_SOURCE) are stored there too.
+const StagedUploadPrefix = "uploads/"
+
+// UploadScheme prefixes the source_url of jobs created from an uploaded file,
+// followed by the uploaded file name.
+const UploadScheme = "upload://"
+
+// StagedUploadKey is the S3 key an uploaded source file is staged under.
+func StagedUploadKey(jobID string) string {
+	return StagedUploadPrefix + jobID
 }
 
 func NewProcessTask(p ProcessPayload) (*asynq.Task, error) {
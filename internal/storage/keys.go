@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// KeyVars are the values available to an object key template.
+type KeyVars struct {
+	JobID    string
+	Platform string
+	Ext      string
+	Time     time.Time
+}
+
+// keyPlaceholders are the tokens an object key template may use.
+var keyPlaceholders = []string{"{id}", "{ext}", "{platform}", "{yyyy}", "{mm}", "{dd}"}
+
+// ValidateKeyTemplate requires {id} and {ext}, so keys never collide between
+// jobs or between a job's output and its cover, and rejects unknown tokens.
+func ValidateKeyTemplate(tmpl string) error {
+	if !strings.Contains(tmpl, "{id}") || !strings.Contains(tmpl, "{ext}") {
+		return fmt.Errorf("key template %q must contain {id} and {ext}", tmpl)
+	}
+	rest := tmpl
+	for _, p := range keyPlaceholders {
+		rest = strings.ReplaceAll(rest, p, "")
+	}
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("key template %q has unknown placeholders", tmpl)
+	}
+	if strings.HasPrefix(tmpl, "/") {
+		return fmt.Errorf("key template %q must not start with /", tmpl)
+	}
+	return nil
+}
+
+// KeyTemplatePrefix returns the fixed text before the first placeholder, the
+// narrowest prefix every expanded key shares. It may be empty.
+func KeyTemplatePrefix(tmpl string) string {
+	if i := strings.Index(tmpl, "{"); i >= 0 {
+		return tmpl[:i]
+	}
+	return tmpl
+}
+
+// ExpandKey fills a template such as "archive/{yyyy}/{mm}/{platform}/{id}.{ext}".
+// Dates are UTC; an empty platform becomes "unknown".
+func ExpandKey(tmpl string, v KeyVars) string {
+	t := v.Time.UTC()
+	plat := v.Platform
+	if plat == "" {
+		plat = "unknown"
+	}
+	return strings.NewReplacer(
+		"{id}", v.JobID,
+		"{ext}", v.Ext,
+		"{platform}", plat,
+		"{yyyy}", t.Format("2006"),
+		"{mm}", t.Format("01"),
+		"{dd}", t.Format("02"),
+	).Replace(tmpl)
+}
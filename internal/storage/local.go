@@ -0,0 +1,357 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalFilesPath is where the API serves LocalStorage's presigned URLs.
+const LocalFilesPath = "/files/"
+
+// localTmpDir holds uploads in progress, under the storage directory so they
+// can be renamed into place; it is skipped by ListObjects.
+const localTmpDir = ".tmp"
+
+// LocalStorage keeps objects as files under a directory, for development
+// instances without S3. Presigned URLs point at the API's LocalFilesPath
+// handler and are signed with an HMAC secret, which every API instance must
+// share. User metadata is not kept, and content types come from the key's
+// extension.
+type LocalStorage struct {
+	dir     string
+	baseURL string
+	secret  []byte
+}
+
+// NewLocal stores objects under dir and presigns URLs under baseURL, the
+// API's public address. An empty secret is replaced by a random one, which
+// only works with a single API instance.
+func NewLocal(dir, baseURL, secret string) (*LocalStorage, error) {
+	if strings.TrimSpace(dir) == "" {
+		return nil, errors.New("LOCAL_STORAGE_DIR is required")
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(strings.TrimSpace(baseURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid LOCAL_STORAGE_URL %q", baseURL)
+	}
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &LocalStorage{dir: abs, baseURL: strings.TrimRight(u.String(), "/"), secret: key}, nil
+}
+
+// SetUploadConfig is a no-op: multipart and encryption settings are S3's.
+func (s *LocalStorage) SetUploadConfig(UploadConfig) error {
+	return nil
+}
+
+// path maps objectKey to its file, rejecting keys that would leave the
+// directory.
+func (s *LocalStorage) path(objectKey string) (string, error) {
+	if strings.TrimSpace(objectKey) == "" {
+		return "", errors.New("object key is empty")
+	}
+	clean := path.Clean("/" + objectKey)[1:]
+	if clean == "" || clean != objectKey || clean == localTmpDir || strings.HasPrefix(clean, localTmpDir+"/") {
+		return "", fmt.Errorf("invalid object key %q", objectKey)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(clean)), nil
+}
+
+// write copies r to objectKey through a temporary file, so readers never see
+// a partial object.
+func (s *LocalStorage) write(objectKey string, r io.Reader) error {
+	dest, err := s.path(objectKey)
+	if err != nil {
+		return err
+	}
+	tmpDir := filepath.Join(s.dir, localTmpDir)
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return localUploadError(err)
+	}
+	f, err := os.CreateTemp(tmpDir, "upload-*")
+	if err != nil {
+		return localUploadError(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return localUploadError(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return localUploadError(err)
+	}
+	if err := os.Rename(f.Name(), dest); err != nil {
+		return localUploadError(err)
+	}
+	return nil
+}
+
+// localUploadError wraps a filesystem failure in *UploadError, permanent
+// when the directory is not writable.
+func localUploadError(err error) error {
+	return &UploadError{Err: err, Permanent: errors.Is(err, fs.ErrPermission)}
+}
+
+func (s *LocalStorage) UploadMP3(ctx context.Context, filePath, objectKey, contentType string, metadata map[string]string) (string, error) {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	if err := s.write(objectKey, src); err != nil {
+		return "", err
+	}
+	return objectKey, nil
+}
+
+func (s *LocalStorage) UploadMP3Stream(ctx context.Context, r io.Reader, objectKey, contentType string) (string, error) {
+	if err := s.write(objectKey, r); err != nil {
+		return "", err
+	}
+	return objectKey, nil
+}
+
+func (s *LocalStorage) PutObject(ctx context.Context, objectKey string, r io.Reader, size int64, contentType string) error {
+	return s.write(objectKey, r)
+}
+
+// presign signs method on objectKey until expiry, covering the response
+// overrides in extra.
+func (s *LocalStorage) presign(method, objectKey string, expiry time.Duration, extra url.Values) (string, error) {
+	if _, err := s.path(objectKey); err != nil {
+		return "", err
+	}
+	if expiry <= 0 {
+		expiry = 15 * time.Minute
+	}
+	q := url.Values{}
+	for k, v := range extra {
+		q[k] = v
+	}
+	q.Set("expires", strconv.FormatInt(time.Now().Add(expiry).Unix(), 10))
+	q.Set("sig", s.signature(method, objectKey, q))
+	return s.baseURL + LocalFilesPath + escapeKey(objectKey) + "?" + q.Encode(), nil
+}
+
+func (s *LocalStorage) signature(method, objectKey string, q url.Values) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, objectKey, q.Get("expires"), q.Get("filename"), q.Get("type"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func escapeKey(objectKey string) string {
+	parts := strings.Split(objectKey, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+func (s *LocalStorage) PresignMP3(ctx context.Context, objectKey string, expiry time.Duration) (string, error) {
+	return s.presign(http.MethodGet, objectKey, expiry, nil)
+}
+
+func (s *LocalStorage) PresignPut(ctx context.Context, objectKey string, expiry time.Duration) (string, error) {
+	return s.presign(http.MethodPut, objectKey, expiry, nil)
+}
+
+func (s *LocalStorage) PresignCover(ctx context.Context, objectKey string, expiry time.Duration) (string, error) {
+	return s.PresignMP3(ctx, objectKey, expiry)
+}
+
+func (s *LocalStorage) PresignMP3Download(ctx context.Context, objectKey string, expiry time.Duration, filename, contentType string) (string, error) {
+	if strings.TrimSpace(filename) == "" {
+		filename = "download.mp3"
+	}
+	if contentType == "" {
+		contentType = "audio/mpeg"
+	}
+	return s.presign(http.MethodGet, objectKey, expiry, url.Values{"filename": {filename}, "type": {contentType}})
+}
+
+func (s *LocalStorage) OpenObject(ctx context.Context, objectKey string) (io.ReadSeekCloser, *ObjectInfo, error) {
+	p, err := s.path(objectKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, ErrObjectNotFound
+		}
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	return f, localObjectInfo(objectKey, fi), nil
+}
+
+func (s *LocalStorage) StatObject(ctx context.Context, objectKey string) (*ObjectInfo, error) {
+	p, err := s.path(objectKey)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+	return localObjectInfo(objectKey, fi), nil
+}
+
+func localObjectInfo(objectKey string, fi fs.FileInfo) *ObjectInfo {
+	contentType := mime.TypeByExtension(path.Ext(objectKey))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return &ObjectInfo{Key: objectKey, Size: fi.Size(), ContentType: contentType, LastModified: fi.ModTime()}
+}
+
+func (s *LocalStorage) ListObjects(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	return filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if key == localTmpDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(*localObjectInfo(key, fi))
+	})
+}
+
+func (s *LocalStorage) BucketExists(ctx context.Context) error {
+	fi, err := os.Stat(s.dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.dir)
+	}
+	return nil
+}
+
+func (s *LocalStorage) EnsureBucket(ctx context.Context, create bool) error {
+	if err := s.BucketExists(ctx); err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if !create {
+		return fmt.Errorf("directory %s does not exist (set S3_CREATE_BUCKET=true to create it)", s.dir)
+	}
+	return os.MkdirAll(s.dir, 0o755)
+}
+
+func (s *LocalStorage) DeleteObject(ctx context.Context, objectKey string) error {
+	p, err := s.path(objectKey)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Handler serves the presigned URLs under LocalFilesPath: GET (and HEAD)
+// download an object, PUT stores one. Requests without a valid, unexpired
+// signature get 403.
+func (s *LocalStorage) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := r.Method
+		if method == http.MethodHead {
+			method = http.MethodGet
+		}
+		if method != http.MethodGet && method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		objectKey := strings.TrimPrefix(r.URL.Path, LocalFilesPath)
+		q := r.URL.Query()
+		expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+		if err != nil || time.Now().Unix() > expires ||
+			!hmac.Equal([]byte(q.Get("sig")), []byte(s.signature(method, objectKey, q))) {
+			http.Error(w, "invalid or expired signature", http.StatusForbidden)
+			return
+		}
+		if method == http.MethodPut {
+			if err := s.write(objectKey, r.Body); err != nil {
+				http.Error(w, "upload failed", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		f, info, err := s.OpenObject(r.Context(), objectKey)
+		if err != nil {
+			if errors.Is(err, ErrObjectNotFound) {
+				http.NotFound(w, r)
+				return
+			}
+			http.Error(w, "read failed", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		contentType := info.ContentType
+		if t := q.Get("type"); t != "" {
+			contentType = t
+		}
+		w.Header().Set("Content-Type", contentType)
+		if filename := q.Get("filename"); filename != "" {
+			w.Header().Set("Content-Disposition", ContentDisposition(filename))
+		}
+		http.ServeContent(w, r, "", info.LastModified, f)
+	})
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLocal returns a LocalStorage whose presigned URLs point at a test
+// server running its Handler.
+func newTestLocal(t *testing.T) *LocalStorage {
+	t.Helper()
+	var h http.Handler
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	s, err := NewLocal(t.TempDir(), srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = s.Handler()
+	return s
+}
+
+func doRequest(t *testing.T, method, rawURL, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, rawURL, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestLocalRejectsInvalidKeys(t *testing.T) {
+	s := newTestLocal(t)
+	ctx := context.Background()
+	keys := []string{"", " ", "../x", "mp3/../../x", "/etc/passwd", "a//b", "a/./b", ".tmp", ".tmp/upload-1"}
+	for _, key := range keys {
+		if _, err := s.path(key); err == nil {
+			t.Errorf("path(%q) accepted", key)
+		}
+		if err := s.PutObject(ctx, key, strings.NewReader("x"), 1, ""); err == nil {
+			t.Errorf("PutObject(%q) accepted", key)
+		}
+		if _, err := s.PresignPut(ctx, key, time.Minute); err == nil {
+			t.Errorf("PresignPut(%q) accepted", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(s.dir), "x")); !os.IsNotExist(err) {
+		t.Errorf("a file was written outside the storage directory: %v", err)
+	}
+	for _, key := range []string{"mp3/a.mp3", "uploads/job", ".tmpfile"} {
+		if _, err := s.path(key); err != nil {
+			t.Errorf("path(%q) = %v", key, err)
+		}
+	}
+}
+
+func TestLocalPresignedRoundTrip(t *testing.T) {
+	s := newTestLocal(t)
+	ctx := context.Background()
+	key := "mp3/2024/talk 1.mp3"
+
+	putURL, err := s.PresignPut(ctx, key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := doRequest(t, http.MethodPut, putURL, "frames"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT status = %d", resp.StatusCode)
+	}
+	// Writes go through .tmp and are renamed into place.
+	if tmp, err := os.ReadDir(filepath.Join(s.dir, localTmpDir)); err != nil || len(tmp) != 0 {
+		t.Errorf("%s holds %d files (err %v) after the upload", localTmpDir, len(tmp), err)
+	}
+
+	getURL, err := s.PresignMP3(ctx, key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := doRequest(t, http.MethodGet, getURL, "")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "frames" {
+		t.Fatalf("GET = %d %q, want 200 frames", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "audio/mpeg" {
+		t.Errorf("Content-Type = %q, want audio/mpeg from the extension", got)
+	}
+	if resp := doRequest(t, http.MethodHead, getURL, ""); resp.StatusCode != http.StatusOK || resp.ContentLength != 6 {
+		t.Errorf("HEAD = %d, length %d", resp.StatusCode, resp.ContentLength)
+	}
+
+	missing, err := s.PresignMP3(ctx, "mp3/missing.mp3", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := doRequest(t, http.MethodGet, missing, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of a missing object = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestLocalDownloadOverrides(t *testing.T) {
+	s := newTestLocal(t)
+	ctx := context.Background()
+	if err := s.PutObject(ctx, "mp3/a.mp3", strings.NewReader("frames"), 6, ""); err != nil {
+		t.Fatal(err)
+	}
+	signed, err := s.PresignMP3Download(ctx, "mp3/a.mp3", time.Minute, "Talk – 标题.flac", "audio/flac")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := doRequest(t, http.MethodGet, signed, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET status = %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "audio/flac" {
+		t.Errorf("Content-Type = %q, want the signed override", got)
+	}
+	if got, want := resp.Header.Get("Content-Disposition"), ContentDisposition("Talk – 标题.flac"); got != want {
+		t.Errorf("Content-Disposition = %q, want %q", got, want)
+	}
+
+	// The overrides are covered by the signature.
+	for param, value := range map[string]string{"filename": "evil.html", "type": "text/html"} {
+		u, _ := url.Parse(signed)
+		q := u.Query()
+		q.Set(param, value)
+		u.RawQuery = q.Encode()
+		if resp := doRequest(t, http.MethodGet, u.String(), ""); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("changed %s: status = %d, want 403", param, resp.StatusCode)
+		}
+	}
+}
+
+func TestLocalHandlerRejectsBadSignatures(t *testing.T) {
+	s := newTestLocal(t)
+	ctx := context.Background()
+	if err := s.PutObject(ctx, "mp3/a.mp3", strings.NewReader("frames"), 6, ""); err != nil {
+		t.Fatal(err)
+	}
+	getURL, err := s.PresignMP3(ctx, "mp3/a.mp3", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putURL, err := s.PresignPut(ctx, "mp3/a.mp3", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit := func(raw string, fn func(q url.Values)) string {
+		u, _ := url.Parse(raw)
+		q := u.Query()
+		fn(q)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	expired := edit(getURL, func(q url.Values) {
+		q.Set("expires", strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+		q.Set("sig", s.signature(http.MethodGet, "mp3/a.mp3", q))
+	})
+
+	tests := []struct {
+		name, method, url string
+	}{
+		{"expired", http.MethodGet, expired},
+		{"extended expiry", http.MethodGet, edit(getURL, func(q url.Values) { q.Set("expires", "99999999999") })},
+		{"tampered signature", http.MethodGet, edit(getURL, func(q url.Values) { q.Set("sig", strings.Repeat("0", 64)) })},
+		{"no signature", http.MethodGet, edit(getURL, func(q url.Values) { q.Del("sig") })},
+		{"other key", http.MethodGet, strings.Replace(getURL, "mp3/a.mp3", "mp3/b.mp3", 1)},
+		{"GET URL used to PUT", http.MethodPut, getURL},
+		{"PUT URL used to GET", http.MethodGet, putURL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := doRequest(t, tt.method, tt.url, "overwritten"); resp.StatusCode != http.StatusForbidden {
+				t.Errorf("status = %d, want 403", resp.StatusCode)
+			}
+		})
+	}
+	if data, _ := os.ReadFile(filepath.Join(s.dir, "mp3", "a.mp3")); string(data) != "frames" {
+		t.Errorf("object = %q after rejected requests", data)
+	}
+	if resp := doRequest(t, http.MethodDelete, getURL, ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE status = %d, want 405", resp.StatusCode)
+	}
+}
+
+func TestLocalListObjectsSkipsTmp(t *testing.T) {
+	s := newTestLocal(t)
+	ctx := context.Background()
+	for _, key := range []string{"mp3/a.mp3", "mp3/b.mp3", "uploads/job"} {
+		if err := s.PutObject(ctx, key, strings.NewReader(key), -1, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An upload in progress.
+	if err := os.WriteFile(filepath.Join(s.dir, localTmpDir, "upload-1"), []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(prefix string) []string {
+		var keys []string
+		if err := s.ListObjects(ctx, prefix, func(o ObjectInfo) error {
+			keys = append(keys, o.Key)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	if got, want := list(""), []string{"mp3/a.mp3", "mp3/b.mp3", "uploads/job"}; !slices.Equal(got, want) {
+		t.Errorf("ListObjects(\"\") = %q, want %q", got, want)
+	}
+	if got, want := list("mp3/"), []string{"mp3/a.mp3", "mp3/b.mp3"}; !slices.Equal(got, want) {
+		t.Errorf("ListObjects(\"mp3/\") = %q, want %q", got, want)
+	}
+}
@@ -5,17 +5,22 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 )
 
 var ErrObjectNotFound = errors.New("object not found")
 
 type ObjectInfo struct {
+	Key          string
 	Size         int64
 	ContentType  string
 	LastModified time.Time
@@ -25,9 +30,60 @@ type S3Client struct {
 	client         *minio.Client
 	presignClient  *minio.Client
 	bucket         string
+	region         string
 	usePathStyle   bool
 	publicEndpoint string
 	endpointURL    string
+	upload         UploadConfig
+}
+
+// UploadConfig tunes file uploads. Files of at least MultipartThreshold bytes
+// are sent as multipart uploads of PartSize-byte parts, Concurrency at a
+// time; smaller files use a single PUT. A zero threshold leaves the choice to
+// minio.
+type UploadConfig struct {
+	MultipartThreshold int64
+	PartSize           uint64
+	Concurrency        uint
+	// Encryption, when set, requests server-side encryption for every
+	// object written. Presigned GETs need nothing extra for SSE-S3/SSE-KMS.
+	Encryption encrypt.ServerSide
+	// MaxObjectSize, when known, is the largest object written with an
+	// unknown size. Parts of such uploads grow past PartSize only as far as
+	// needed for it to fit in maxParts parts.
+	MaxObjectSize int64
+}
+
+// ServerSideEncryption maps S3_SSE ("none", "s3" or "kms") to minio's
+// encryption setting; nil means no encryption.
+func ServerSideEncryption(mode, kmsKeyID string) (encrypt.ServerSide, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", "none":
+		return nil, nil
+	case "s3":
+		return encrypt.NewSSE(), nil
+	case "kms":
+		if strings.TrimSpace(kmsKeyID) == "" {
+			return nil, errors.New("S3_SSE_KMS_KEY_ID is required for kms encryption")
+		}
+		return encrypt.NewSSEKMS(strings.TrimSpace(kmsKeyID), nil)
+	default:
+		return nil, fmt.Errorf("unknown S3_SSE %q, want none, s3 or kms", mode)
+	}
+}
+
+// minPartSize is the smallest part S3 accepts (except for the last part).
+const minPartSize = 5 << 20
+
+func (s *S3Client) SetUploadConfig(c UploadConfig) error {
+	if c.MultipartThreshold > 0 && c.PartSize < minPartSize {
+		return fmt.Errorf("part size must be at least %d bytes", minPartSize)
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = 1
+	}
+	s.upload = c
+	return nil
 }
 
 func NewS3(endpoint, accessKey, secretKey, region, bucket string, usePathStyle bool, publicEndpoint string) (*S3Client, error) {
@@ -77,22 +133,133 @@ func NewS3(endpoint, accessKey, secretKey, region, bucket string, usePathStyle b
 		client:         client,
 		presignClient:  presignClient,
 		bucket:         bucket,
+		region:         region,
 		usePathStyle:   usePathStyle,
 		publicEndpoint: publicEndpoint,
 		endpointURL:    endpointURL,
 	}, nil
 }
 
-func (s *S3Client) UploadMP3(ctx context.Context, filePath, objectKey string) (string, error) {
-	_, err := s.client.FPutObject(ctx, s.bucket, objectKey, filePath, minio.PutObjectOptions{
-		ContentType: "audio/mpeg",
-	})
+// UploadMP3 uploads a file to objectKey with optional user metadata and
+// returns the key.
+func (s *S3Client) UploadMP3(ctx context.Context, filePath, objectKey, contentType string, metadata map[string]string) (string, error) {
+	if contentType == "" {
+		contentType = "audio/mpeg"
+	}
+	opts := minio.PutObjectOptions{
+		ContentType:          contentType,
+		UserMetadata:         metadata,
+		ServerSideEncryption: s.upload.Encryption,
+	}
+	if s.upload.MultipartThreshold > 0 {
+		fi, err := os.Stat(filePath)
+		if err != nil {
+			return "", err
+		}
+		if fi.Size() >= s.upload.MultipartThreshold {
+			opts.PartSize = s.upload.PartSize
+			opts.NumThreads = s.upload.Concurrency
+		} else {
+			opts.DisableMultipart = true
+		}
+	}
+	_, err := s.client.FPutObject(ctx, s.bucket, objectKey, filePath, opts)
 	if err != nil {
-		return "", err
+		return "", uploadError(err)
 	}
 	return objectKey, nil
 }
 
+// permanentUploadCodes are S3 error codes that retrying an upload cannot get
+// past, whatever their HTTP status.
+var permanentUploadCodes = map[string]bool{
+	"AccessDenied":          true,
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+	"NoSuchBucket":          true,
+	"InvalidBucketName":     true,
+}
+
+// uploadError wraps S3 error responses and network failures of an upload in
+// *UploadError. 4xx responses other than 408 and 429 are permanent; 5xx and
+// network errors are not. Other errors, e.g. from reading the body, are
+// returned as is.
+func uploadError(err error) error {
+	resp := minio.ToErrorResponse(err)
+	if resp.Code != "" || resp.StatusCode != 0 {
+		code := resp.StatusCode
+		permanent := permanentUploadCodes[resp.Code] ||
+			(code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests)
+		if resp.Code != "" {
+			err = fmt.Errorf("%s: %w", resp.Code, err)
+		}
+		return &UploadError{Err: err, Permanent: permanent}
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return &UploadError{Err: err}
+	}
+	return err
+}
+
+// streamPartSize is the part size of uploads of unknown size when no
+// S3_PART_SIZE is configured; minio buffers one part in memory.
+const streamPartSize = 16 << 20
+
+// maxParts is the most parts S3 accepts in one multipart upload.
+const maxParts = 10000
+
+// streamingPartSize is the part size of an upload of unknown size. Without
+// one, minio sizes parts for a 5 TiB object and buffers over 500 MiB.
+func (s *S3Client) streamingPartSize() uint64 {
+	size := uint64(streamPartSize)
+	if s.upload.PartSize > 0 {
+		size = s.upload.PartSize
+	}
+	if s.upload.MaxObjectSize > 0 {
+		// Round up to whole MiB.
+		need := (uint64(s.upload.MaxObjectSize) + maxParts - 1) / maxParts
+		need = (need + 1<<20 - 1) &^ (1<<20 - 1)
+		size = max(size, need)
+	}
+	return size
+}
+
+// UploadMP3Stream uploads r, of unknown size, to objectKey as it is read and
+// returns the key. The upload is aborted, leaving no object, if reading r
+// fails.
+func (s *S3Client) UploadMP3Stream(ctx context.Context, r io.Reader, objectKey, contentType string) (string, error) {
+	if contentType == "" {
+		contentType = "audio/mpeg"
+	}
+	opts := minio.PutObjectOptions{
+		ContentType:          contentType,
+		ServerSideEncryption: s.upload.Encryption,
+		PartSize:             s.streamingPartSize(),
+	}
+	if _, err := s.client.PutObject(ctx, s.bucket, objectKey, r, -1, opts); err != nil {
+		return "", uploadError(err)
+	}
+	return objectKey, nil
+}
+
+// PutObject streams r to objectKey; size may be -1 when unknown, in which
+// case it is sent in parts of streamingPartSize.
+func (s *S3Client) PutObject(ctx context.Context, objectKey string, r io.Reader, size int64, contentType string) error {
+	opts := minio.PutObjectOptions{
+		ContentType:          contentType,
+		ServerSideEncryption: s.upload.Encryption,
+	}
+	if size < 0 {
+		opts.PartSize = s.streamingPartSize()
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, objectKey, r, size, opts)
+	if err != nil {
+		return uploadError(err)
+	}
+	return nil
+}
+
 func (s *S3Client) objectURL(objectKey string) string {
 	base := strings.TrimRight(s.publicEndpoint, "/")
 	if base == "" {
@@ -133,7 +300,33 @@ func (s *S3Client) PresignMP3(ctx context.Context, objectKey string, expiry time
 	return u.String(), nil
 }
 
-func (s *S3Client) PresignMP3Download(ctx context.Context, objectKey string, expiry time.Duration, filename string) (string, error) {
+// PresignPut returns a URL a client can PUT an object to directly. Signing
+// cannot cap the body size, so callers must check the object afterwards.
+func (s *S3Client) PresignPut(ctx context.Context, objectKey string, expiry time.Duration) (string, error) {
+	if strings.TrimSpace(objectKey) == "" {
+		return "", errors.New("object key is empty")
+	}
+	if expiry <= 0 {
+		expiry = 15 * time.Minute
+	}
+	client := s.client
+	if s.presignClient != nil {
+		client = s.presignClient
+	}
+	u, err := client.PresignedPutObject(ctx, s.bucket, objectKey, expiry)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (s *S3Client) PresignCover(ctx context.Context, objectKey string, expiry time.Duration) (string, error) {
+	return s.PresignMP3(ctx, objectKey, expiry)
+}
+
+// PresignMP3Download signs a GET that makes the browser save the object as
+// filename; contentType defaults to audio/mpeg.
+func (s *S3Client) PresignMP3Download(ctx context.Context, objectKey string, expiry time.Duration, filename, contentType string) (string, error) {
 	if strings.TrimSpace(objectKey) == "" {
 		return "", errors.New("object key is empty")
 	}
@@ -144,8 +337,11 @@ func (s *S3Client) PresignMP3Download(ctx context.Context, objectKey string, exp
 		expiry = 15 * time.Minute
 	}
 	params := url.Values{}
-	params.Set("response-content-disposition", fmt.Sprintf("attachment; filename=%q", filename))
-	params.Set("response-content-type", "audio/mpeg")
+	params.Set("response-content-disposition", ContentDisposition(filename))
+	if contentType == "" {
+		contentType = "audio/mpeg"
+	}
+	params.Set("response-content-type", contentType)
 
 	client := s.client
 	if s.presignClient != nil {
@@ -158,7 +354,50 @@ func (s *S3Client) PresignMP3Download(ctx context.Context, objectKey string, exp
 	return u.String(), nil
 }
 
-func (s *S3Client) OpenObject(ctx context.Context, objectKey string) (io.ReadCloser, *ObjectInfo, error) {
+// ContentDisposition builds an attachment header for filename: a quoted ASCII
+// fallback plus an RFC 5987 filename* carrying the exact UTF-8 name.
+func ContentDisposition(filename string) string {
+	var ascii strings.Builder
+	ascii.Grow(len(filename))
+	plain := true
+	for _, r := range filename {
+		switch {
+		case r == '"' || r == '\\':
+			ascii.WriteByte('_')
+		case r < 0x20 || r >= 0x7f:
+			ascii.WriteByte('_')
+			plain = false
+		default:
+			ascii.WriteRune(r)
+		}
+	}
+	v := fmt.Sprintf("attachment; filename=\"%s\"", ascii.String())
+	if !plain {
+		v += "; filename*=UTF-8''" + rfc5987Escape(filename)
+	}
+	return v
+}
+
+// rfc5987Escape percent-encodes everything outside RFC 5987's attr-char set.
+func rfc5987Escape(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xf])
+	}
+	return b.String()
+}
+
+// OpenObject returns a seekable reader for the object, suitable for
+// http.ServeContent range requests.
+func (s *S3Client) OpenObject(ctx context.Context, objectKey string) (io.ReadSeekCloser, *ObjectInfo, error) {
 	if strings.TrimSpace(objectKey) == "" {
 		return nil, nil, errors.New("object key is empty")
 	}
@@ -174,12 +413,85 @@ func (s *S3Client) OpenObject(ctx context.Context, objectKey string) (io.ReadClo
 		}
 		return nil, nil, err
 	}
-	info := &ObjectInfo{
+	return obj, objectInfo(stat), nil
+}
+
+// StatObject returns the object's metadata without reading its content.
+func (s *S3Client) StatObject(ctx context.Context, objectKey string) (*ObjectInfo, error) {
+	if strings.TrimSpace(objectKey) == "" {
+		return nil, errors.New("object key is empty")
+	}
+	stat, err := s.client.StatObject(ctx, s.bucket, objectKey, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	return objectInfo(stat), nil
+}
+
+func objectInfo(stat minio.ObjectInfo) *ObjectInfo {
+	return &ObjectInfo{
+		Key:          stat.Key,
 		Size:         stat.Size,
 		ContentType:  stat.ContentType,
 		LastModified: stat.LastModified,
 	}
-	return obj, info, nil
+}
+
+// ListObjects calls fn for every object under prefix, stopping at the first
+// error fn returns.
+func (s *S3Client) ListObjects(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if err := fn(*objectInfo(obj)); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (s *S3Client) BucketExists(ctx context.Context) error {
+	ok, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("bucket %q does not exist", s.bucket)
+	}
+	return nil
+}
+
+// EnsureBucket checks that the bucket exists and, when create is set, creates
+// it in the configured region if it does not. Credentials that may not check
+// for the bucket are let through, as they may still be able to use it.
+func (s *S3Client) EnsureBucket(ctx context.Context, create bool) error {
+	ok, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "AccessDenied" {
+			return nil
+		}
+		return fmt.Errorf("check bucket %q: %w", s.bucket, err)
+	}
+	if ok {
+		return nil
+	}
+	if !create {
+		return fmt.Errorf("bucket %q does not exist (set S3_CREATE_BUCKET=true to create it)", s.bucket)
+	}
+	if err := s.client.MakeBucket(ctx, s.bucket, minio.MakeBucketOptions{Region: s.region}); err != nil {
+		if code := minio.ToErrorResponse(err).Code; code == "BucketAlreadyOwnedByYou" || code == "BucketAlreadyExists" {
+			// Another instance created it first.
+			return nil
+		}
+		return fmt.Errorf("create bucket %q: %w", s.bucket, err)
+	}
+	return nil
 }
 
 func (s *S3Client) DeleteObject(ctx context.Context, objectKey string) error {
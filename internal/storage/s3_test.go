@@ -0,0 +1,426 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory S3 endpoint with path-style buckets. It handles
+// single PUTs, multipart uploads, GET, HEAD and DELETE, and records the
+// requests it served. Signatures are not checked.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	requests []fakeS3Request
+}
+
+type fakeS3Request struct {
+	method string
+	key    string
+	query  string
+	header http.Header
+}
+
+const testBucket = "test-bucket"
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3Client) {
+	t.Helper()
+	f := &fakeS3{objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	s3, err := NewS3(srv.URL, "key", "secret", "us-east-1", testBucket, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, s3
+}
+
+// served returns the recorded requests for which match reports true.
+func (f *fakeS3) served(match func(fakeS3Request) bool) []fakeS3Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []fakeS3Request
+	for _, r := range f.requests {
+		if match(r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+testBucket+"/")
+	if !ok {
+		http.Error(w, "unknown bucket", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	f.mu.Lock()
+	f.requests = append(f.requests, fakeS3Request{method: r.Method, key: key, query: r.URL.RawQuery, header: r.Header.Clone()})
+	f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		id := strconv.FormatInt(rand.Int63(), 36)
+		f.mu.Lock()
+		f.uploads[id] = map[int][]byte{}
+		f.mu.Unlock()
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: testBucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		body, err := readPayload(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		f.mu.Lock()
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if ok {
+			parts[n] = body
+		}
+		f.mu.Unlock()
+		if !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		var req struct {
+			Parts []struct {
+				PartNumber int
+			} `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		parts := f.uploads[q.Get("uploadId")]
+		var data []byte
+		for _, p := range req.Parts {
+			data = append(data, parts[p.PartNumber]...)
+		}
+		f.objects[key] = data
+		delete(f.uploads, q.Get("uploadId"))
+		f.mu.Unlock()
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: testBucket, Key: key, ETag: etag(data)})
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		f.mu.Lock()
+		delete(f.uploads, q.Get("uploadId"))
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		body, err := readPayload(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.objects[key] = body
+		f.mu.Unlock()
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		f.mu.Lock()
+		data, ok := f.objects[key]
+		f.mu.Unlock()
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+			}
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Content-Type", "audio/mpeg")
+		http.ServeContent(w, r, key, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), bytes.NewReader(data))
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		delete(f.objects, key)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusNotImplemented)
+	}
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// readPayload reads a request body, decoding the aws-chunked encoding minio
+// uses for streaming signatures over plain HTTP. Trailers are ignored.
+func readPayload(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	br := bufio.NewReader(r.Body)
+	var out []byte
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad chunk header %q", line)
+		}
+		if n == 0 {
+			return out, nil
+		}
+		chunk := make([]byte, n+2)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		out = append(out, chunk[:n]...)
+	}
+}
+
+func writeTestFile(t *testing.T, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	path := filepath.Join(t.TempDir(), "out.mp3")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestUploadMP3Multipart(t *testing.T) {
+	f, s3 := newFakeS3(t)
+	if err := s3.SetUploadConfig(UploadConfig{MultipartThreshold: 5 << 20, PartSize: 5 << 20, Concurrency: 3}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		size      int
+		wantParts int
+	}{
+		{"above threshold", 11<<20 + 123, 3},
+		{"below threshold", 4 << 10, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, data := writeTestFile(t, tt.size)
+			key := "mp3/" + strings.ReplaceAll(tt.name, " ", "-") + ".mp3"
+
+			if _, err := s3.UploadMP3(ctx, path, key, "", map[string]string{"sha256": "x"}); err != nil {
+				t.Fatal(err)
+			}
+
+			parts := f.served(func(r fakeS3Request) bool {
+				return r.key == key && r.method == http.MethodPut && strings.Contains(r.query, "uploadId")
+			})
+			if len(parts) != tt.wantParts {
+				t.Errorf("uploaded %d parts, want %d", len(parts), tt.wantParts)
+			}
+			obj, info, err := s3.OpenObject(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer obj.Close()
+			got, err := io.ReadAll(obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size != int64(len(data)) || !bytes.Equal(got, data) {
+				t.Errorf("round trip returned %d bytes (stat %d), want the %d uploaded", len(got), info.Size, len(data))
+			}
+		})
+	}
+}
+
+func TestSetUploadConfigPartSize(t *testing.T) {
+	var s3 S3Client
+	if err := s3.SetUploadConfig(UploadConfig{MultipartThreshold: 1 << 20, PartSize: 1 << 20}); err == nil {
+		t.Error("part size under 5 MiB accepted")
+	}
+	if err := s3.SetUploadConfig(UploadConfig{MultipartThreshold: 1 << 20, PartSize: 5 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	if s3.upload.Concurrency != 1 {
+		t.Errorf("concurrency = %d, want the default 1", s3.upload.Concurrency)
+	}
+}
+
+func TestPutObjectUnknownSize(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		cfg       UploadConfig
+		size      int
+		wantParts int
+	}{
+		// Left to minio, parts would be sized for 5 TiB and this would be
+		// a single PUT.
+		{"default part size", UploadConfig{}, 20 << 20, 2},
+		{"configured part size", UploadConfig{PartSize: 5 << 20}, 12<<20 + 1, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, s3 := newFakeS3(t)
+			if err := s3.SetUploadConfig(tt.cfg); err != nil {
+				t.Fatal(err)
+			}
+			data := make([]byte, tt.size)
+			rand.New(rand.NewSource(1)).Read(data)
+
+			if err := s3.PutObject(ctx, "uploads/staged", bytes.NewReader(data), -1, "video/mp4"); err != nil {
+				t.Fatal(err)
+			}
+
+			parts := f.served(func(r fakeS3Request) bool {
+				return r.method == http.MethodPut && strings.Contains(r.query, "uploadId")
+			})
+			if len(parts) != tt.wantParts {
+				t.Errorf("uploaded %d parts, want %d", len(parts), tt.wantParts)
+			}
+			f.mu.Lock()
+			got := f.objects["uploads/staged"]
+			f.mu.Unlock()
+			if !bytes.Equal(got, data) {
+				t.Errorf("stored %d bytes, want the %d sent", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestStreamingPartSize(t *testing.T) {
+	tests := []struct {
+		cfg  UploadConfig
+		want uint64
+	}{
+		{UploadConfig{}, streamPartSize},
+		{UploadConfig{PartSize: 8 << 20}, 8 << 20},
+		{UploadConfig{MaxObjectSize: 2 << 30}, streamPartSize},
+		// 200 GiB needs parts of 20.48 MiB to fit in 10,000.
+		{UploadConfig{MaxObjectSize: 200 << 30}, 21 << 20},
+		{UploadConfig{PartSize: 64 << 20, MaxObjectSize: 200 << 30}, 64 << 20},
+	}
+	for _, tt := range tests {
+		s3 := S3Client{upload: tt.cfg}
+		if got := s3.streamingPartSize(); got != tt.want {
+			t.Errorf("streamingPartSize(%+v) = %d, want %d", tt.cfg, got, tt.want)
+		}
+	}
+}
+
+func TestUploadServerSideEncryption(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		mode, kmsKey string
+		want         http.Header
+	}{
+		{"none", "", http.Header{"X-Amz-Server-Side-Encryption": nil}},
+		{"s3", "", http.Header{"X-Amz-Server-Side-Encryption": {"AES256"}}},
+		{"kms", "key-1", http.Header{
+			"X-Amz-Server-Side-Encryption":                {"aws:kms"},
+			"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": {"key-1"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			sse, err := ServerSideEncryption(tt.mode, tt.kmsKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, s3 := newFakeS3(t)
+			if err := s3.SetUploadConfig(UploadConfig{MultipartThreshold: 5 << 20, PartSize: 5 << 20, Concurrency: 2, Encryption: sse}); err != nil {
+				t.Fatal(err)
+			}
+			small, data := writeTestFile(t, 1<<10)
+			large, _ := writeTestFile(t, 6<<20)
+			if _, err := s3.UploadMP3(ctx, small, "mp3/small.mp3", "", nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s3.UploadMP3(ctx, large, "mp3/large.mp3", "", nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := s3.PutObject(ctx, "uploads/staged", bytes.NewReader(data), int64(len(data)), "video/mp4"); err != nil {
+				t.Fatal(err)
+			}
+
+			// The object is created by the single PUT or by initiating the
+			// multipart upload; those requests carry the encryption headers.
+			creates := f.served(func(r fakeS3Request) bool {
+				return (r.method == http.MethodPut && !strings.Contains(r.query, "uploadId")) ||
+					(r.method == http.MethodPost && strings.Contains(r.query, "uploads"))
+			})
+			if len(creates) != 3 {
+				t.Fatalf("%d object creations, want 3", len(creates))
+			}
+			for _, r := range creates {
+				for name, want := range tt.want {
+					if got := r.header.Values(name); strings.Join(got, ",") != strings.Join(want, ",") {
+						t.Errorf("%s %s: %s = %q, want %q", r.method, r.key, name, got, want)
+					}
+				}
+			}
+
+			// Presigned GETs need no encryption parameters.
+			u, err := s3.PresignMP3(ctx, "mp3/small.mp3", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(strings.ToLower(u), "server-side-encryption") {
+				t.Errorf("presigned url carries encryption parameters: %s", u)
+			}
+			resp, err := http.Get(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			got, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(got, data) {
+				t.Errorf("presigned GET: status %d, %d bytes", resp.StatusCode, len(got))
+			}
+		})
+	}
+}
+
+func TestServerSideEncryptionConfig(t *testing.T) {
+	for _, tt := range []struct{ mode, key string }{{"kms", ""}, {"kms", "  "}, {"sse-c", ""}} {
+		if _, err := ServerSideEncryption(tt.mode, tt.key); err == nil {
+			t.Errorf("ServerSideEncryption(%q, %q) succeeded", tt.mode, tt.key)
+		}
+	}
+	if sse, err := ServerSideEncryption(" NONE ", ""); sse != nil || err != nil {
+		t.Errorf("none = %v, %v; want no encryption", sse, err)
+	}
+}
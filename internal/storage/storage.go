@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// STORAGE_BACKEND values.
+const (
+	BackendS3    = "s3"
+	BackendLocal = "local"
+)
+
+// Storage is where jobs' outputs, covers and staged uploads are kept.
+// S3Client is the production backend; LocalStorage keeps objects in a
+// directory for development and tests.
+type Storage interface {
+	// UploadMP3 uploads a file to objectKey with optional user metadata and
+	// returns the key.
+	UploadMP3(ctx context.Context, filePath, objectKey, contentType string, metadata map[string]string) (string, error)
+	// UploadMP3Stream uploads r, of unknown size, to objectKey as it is read
+	// and returns the key. No object is left behind if reading r fails.
+	UploadMP3Stream(ctx context.Context, r io.Reader, objectKey, contentType string) (string, error)
+	// PutObject streams r to objectKey; size may be -1 when unknown.
+	PutObject(ctx context.Context, objectKey string, r io.Reader, size int64, contentType string) error
+	PresignMP3(ctx context.Context, objectKey string, expiry time.Duration) (string, error)
+	// PresignPut returns a URL a client can PUT an object to directly.
+	// Signing cannot cap the body size, so callers must check the object
+	// afterwards.
+	PresignPut(ctx context.Context, objectKey string, expiry time.Duration) (string, error)
+	PresignCover(ctx context.Context, objectKey string, expiry time.Duration) (string, error)
+	// PresignMP3Download signs a GET that makes the browser save the object
+	// as filename; contentType defaults to audio/mpeg.
+	PresignMP3Download(ctx context.Context, objectKey string, expiry time.Duration, filename, contentType string) (string, error)
+	// OpenObject returns a seekable reader for the object, suitable for
+	// http.ServeContent range requests, or ErrObjectNotFound.
+	OpenObject(ctx context.Context, objectKey string) (io.ReadSeekCloser, *ObjectInfo, error)
+	// StatObject returns the object's metadata without reading its
+	// content, or ErrObjectNotFound.
+	StatObject(ctx context.Context, objectKey string) (*ObjectInfo, error)
+	// ListObjects calls fn for every object under prefix, stopping at the
+	// first error fn returns.
+	ListObjects(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+	// BucketExists reports an error when the storage is not usable.
+	BucketExists(ctx context.Context) error
+	// EnsureBucket checks that the storage exists and, when create is set,
+	// creates it if it does not.
+	EnsureBucket(ctx context.Context, create bool) error
+	// DeleteObject removes the object; a missing object is not an error.
+	DeleteObject(ctx context.Context, objectKey string) error
+	SetUploadConfig(c UploadConfig) error
+}
+
+// UploadError is a write the backend refused or could not complete, as
+// opposed to a failure reading what was being uploaded. Permanent is set
+// when retrying cannot help, e.g. when S3 denies access or the bucket does
+// not exist.
+type UploadError struct {
+	Err       error
+	Permanent bool
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("storage upload failed: %v", e.Err)
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	_ Storage = (*S3Client)(nil)
+	_ Storage = (*LocalStorage)(nil)
+)
@@ -0,0 +1,38 @@
+-- Schema as created by Init before versioned migrations. Every statement is
+-- idempotent so existing databases adopt it as already applied.
+CREATE TABLE IF NOT EXISTS jobs (
+	id UUID PRIMARY KEY,
+	source_url TEXT NOT NULL,
+	platform TEXT NOT NULL,
+	status TEXT NOT NULL,
+	error TEXT,
+	mp3_url TEXT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS client_job_id TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS jobs_client_job_id_key ON jobs (client_job_id);
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS options JSONB;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS owner TEXT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS download_bytes BIGINT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS output_bytes BIGINT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS transcode_cpu_ms BIGINT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS title TEXT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS video_id TEXT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS cover_key TEXT;
+CREATE INDEX IF NOT EXISTS jobs_active_created_at_idx ON jobs (created_at)
+	WHERE status IN ('queued', 'downloading', 'transcoding');
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS completed_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS jobs_updated_at_idx ON jobs (updated_at);
+CREATE INDEX IF NOT EXISTS jobs_completed_at_idx ON jobs (completed_at);
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS request_id TEXT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS duration_seconds DOUBLE PRECISION;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS next_retry_at TIMESTAMPTZ;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS progress_bytes BIGINT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS progress_total_bytes BIGINT;
+CREATE TABLE IF NOT EXISTS owner_settings (
+	owner TEXT PRIMARY KEY,
+	options JSONB NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,5 @@
+-- ListJobs orders by created_at (optionally filtered by status) and cleanup
+-- scans created_at ranges; source_url lookups find recent jobs for a link.
+CREATE INDEX IF NOT EXISTS jobs_created_at_idx ON jobs (created_at);
+CREATE INDEX IF NOT EXISTS jobs_status_created_at_idx ON jobs (status, created_at);
+CREATE INDEX IF NOT EXISTS jobs_source_url_created_at_idx ON jobs (source_url, created_at);
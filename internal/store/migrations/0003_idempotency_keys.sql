@@ -0,0 +1,10 @@
+-- Idempotency-Key values seen on POST /jobs, per owner. Rows go away with
+-- their job.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	owner TEXT NOT NULL,
+	key TEXT NOT NULL,
+	job_id UUID NOT NULL REFERENCES jobs (id) ON DELETE CASCADE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (owner, key)
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_job_id_idx ON idempotency_keys (job_id);
@@ -0,0 +1,2 @@
+-- SHA-256 of the output file, hex encoded, recorded by the worker.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS output_sha256 TEXT;
@@ -0,0 +1,10 @@
+-- Jobs the worker gave up on, with the untruncated error and the task
+-- payload, written when RECORD_DEAD_JOBS is set. A job that dies again after
+-- a manual retry overwrites its row.
+CREATE TABLE IF NOT EXISTS dead_jobs (
+	job_id UUID PRIMARY KEY REFERENCES jobs (id) ON DELETE CASCADE,
+	error TEXT NOT NULL,
+	payload JSONB NOT NULL,
+	attempts INTEGER NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,4 @@
+-- Set instead of deleting the row when SOFT_DELETE is on; rows are purged
+-- once deleted_at is older than PURGE_AFTER_DAYS.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS jobs_deleted_at_idx ON jobs (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,3 @@
+-- Latest estimate of the seconds left in the current download or transcode,
+-- cleared on every status change.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS eta_seconds BIGINT;
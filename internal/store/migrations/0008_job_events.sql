@@ -0,0 +1,11 @@
+-- Every status change made through UpdateJobStatus, written in the same
+-- transaction, so a job's timeline survives retries.
+CREATE TABLE IF NOT EXISTS job_events (
+	id BIGSERIAL PRIMARY KEY,
+	job_id UUID NOT NULL REFERENCES jobs (id) ON DELETE CASCADE,
+	from_status TEXT,
+	to_status TEXT NOT NULL,
+	message TEXT,
+	at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS job_events_job_id_idx ON job_events (job_id, at, id);
@@ -0,0 +1,3 @@
+-- Classifies a failed job's error so clients can tell whether a retry can
+-- help; NULL when the error is not classified.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS error_category TEXT;
@@ -0,0 +1,3 @@
+-- The platform detected from the submitted link, kept when the parser
+-- reports a different one and platform is updated to it.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS detected_platform TEXT;
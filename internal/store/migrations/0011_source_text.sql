@@ -0,0 +1,2 @@
+-- The share message a link was pasted from, kept as a title fallback.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS source_text TEXT;
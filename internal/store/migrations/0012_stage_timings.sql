@@ -0,0 +1,4 @@
+-- How long the last successful run spent in each stage, in milliseconds.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS download_ms BIGINT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS transcode_ms BIGINT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS upload_ms BIGINT;
@@ -0,0 +1,3 @@
+-- ListJobs sorts completed_at DESC NULLS LAST so unfinished jobs come last,
+-- which a backward scan of the ascending index cannot provide.
+CREATE INDEX IF NOT EXISTS jobs_completed_at_desc_idx ON jobs (completed_at DESC NULLS LAST);
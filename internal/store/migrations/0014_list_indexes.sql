@@ -0,0 +1,6 @@
+-- Status-filtered listings sorted by updated_at or completed_at, and the
+-- retention cleanup of ready jobs, which sorts by when they finished.
+CREATE INDEX IF NOT EXISTS jobs_status_updated_at_idx ON jobs (status, updated_at);
+CREATE INDEX IF NOT EXISTS jobs_status_completed_at_desc_idx ON jobs (status, completed_at DESC NULLS LAST);
+CREATE INDEX IF NOT EXISTS jobs_ready_finished_at_idx ON jobs ((COALESCE(completed_at, updated_at)))
+	WHERE status = 'ready';
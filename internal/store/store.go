@@ -4,24 +4,83 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
+var ErrConflict = errors.New("conflict")
+
+const jobColumns = `id, source_url, platform, status, error, mp3_url, client_job_id, options, owner, download_bytes, output_bytes, transcode_cpu_ms, title, video_id, cover_key, completed_at, request_id, duration_seconds, attempts, next_retry_at, progress_bytes, progress_total_bytes, output_sha256, eta_seconds, error_category, detected_platform, source_text, download_ms, transcode_ms, upload_ms, created_at, updated_at`
+
 type Store struct {
-	db *sql.DB
+	db           *sql.DB
+	queryTimeout time.Duration
+}
+
+// PoolConfig bounds the connection pool and individual queries. Zero values
+// mean no limit, as with database/sql's defaults.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// QueryTimeout caps each query so a slow database cannot pile up
+	// connections; the caller's deadline still applies when it is shorter.
+	QueryTimeout time.Duration
 }
 
 type Job struct {
-	ID        string
-	SourceURL string
-	Platform  string
-	Status    string
-	Error     sql.NullString
-	MP3URL    sql.NullString
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	ID          string
+	SourceURL   string
+	Platform    string
+	Status      string
+	Error       sql.NullString
+	MP3URL      sql.NullString
+	ClientJobID sql.NullString
+	Options     []byte
+	Owner       sql.NullString
+	// Resource usage, recorded only when cost metrics are enabled.
+	DownloadBytes  sql.NullInt64
+	OutputBytes    sql.NullInt64
+	TranscodeCPUMs sql.NullInt64
+	Title          sql.NullString
+	VideoID        sql.NullString
+	CoverKey       sql.NullString
+	CompletedAt    sql.NullTime
+	RequestID      sql.NullString
+	// DurationSeconds is the probed length of the output audio.
+	DurationSeconds sql.NullFloat64
+	// Attempts is the worker attempt number of the job's current task.
+	Attempts int
+	// NextRetryAt is set while a failed job waits for an automatic retry.
+	NextRetryAt sql.NullTime
+	// Download progress of the source; the total is unknown when the
+	// source did not report its size.
+	ProgressBytes      sql.NullInt64
+	ProgressTotalBytes sql.NullInt64
+	// OutputSHA256 is the hex SHA-256 of the output file.
+	OutputSHA256 sql.NullString
+	// ETASeconds estimates the time left in the current download or
+	// transcode; unset when it cannot be estimated.
+	ETASeconds sql.NullInt64
+	// ErrorCategory classifies Error (see the jobs.Error* constants).
+	ErrorCategory sql.NullString
+	// DetectedPlatform is the platform detected from the link when the
+	// parser reported a different one; Platform holds the parser's.
+	DetectedPlatform sql.NullString
+	// SourceText is the share message the link was pasted from, when the
+	// submission had more than the link.
+	SourceText sql.NullString
+	// DownloadMs, TranscodeMs and UploadMs time the stages of the last
+	// successful run; a stage merged into another (streaming) is unset.
+	DownloadMs  sql.NullInt64
+	TranscodeMs sql.NullInt64
+	UploadMs    sql.NullInt64
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
 }
 
 func New(ctx context.Context, dsn string) (*Store, error) {
@@ -38,6 +97,65 @@ func New(ctx context.Context, dsn string) (*Store, error) {
 	return &Store{db: db}, nil
 }
 
+func (s *Store) SetPoolConfig(c PoolConfig) {
+	s.db.SetMaxOpenConns(c.MaxOpenConns)
+	s.db.SetMaxIdleConns(c.MaxIdleConns)
+	s.db.SetConnMaxLifetime(c.ConnMaxLifetime)
+	s.queryTimeout = c.QueryTimeout
+}
+
+// withTimeout derives the context a single query runs under.
+func (s *Store) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.queryTimeout)
+}
+
+// exec runs a statement under the query timeout and returns the number of
+// rows it affected.
+func (s *Store) exec(ctx context.Context, q string, args ...any) (int64, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	res, err := s.db.ExecContext(ctx, q, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// queryRow runs a single-row query under the query timeout and scans it into
+// dest. It returns sql.ErrNoRows when there is no row.
+func (s *Store) queryRow(ctx context.Context, q string, args []any, dest ...any) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.db.QueryRowContext(ctx, q, args...).Scan(dest...)
+}
+
+// query runs q under the query timeout and calls scan for every row.
+func (s *Store) query(ctx context.Context, q string, args []any, scan func(rowScanner) error) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// getJob runs a query for a single job under the query timeout.
+func (s *Store) getJob(ctx context.Context, q string, args ...any) (Job, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return scanJob(s.db.QueryRowContext(ctx, q, args...))
+}
+
 func (s *Store) Close() error {
 	if s == nil || s.db == nil {
 		return nil
@@ -45,156 +163,925 @@ func (s *Store) Close() error {
 	return s.db.Close()
 }
 
+func (s *Store) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Init brings the schema up to date by applying pending migrations.
 func (s *Store) Init(ctx context.Context) error {
-	const schema = `
-CREATE TABLE IF NOT EXISTS jobs (
-	id UUID PRIMARY KEY,
-	source_url TEXT NOT NULL,
-	platform TEXT NOT NULL,
-	status TEXT NOT NULL,
-	error TEXT,
-	mp3_url TEXT,
-	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
-	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
-);
-`
-	_, err := s.db.ExecContext(ctx, schema)
-	return err
+	return s.migrate(ctx)
 }
 
 func (s *Store) CreateJob(ctx context.Context, j Job) error {
 	const q = `
-INSERT INTO jobs (id, source_url, platform, status, error, mp3_url, created_at, updated_at)
-VALUES ($1, $2, $3, $4, $5, $6, NOW(), NOW())
+INSERT INTO jobs (id, source_url, platform, status, error, mp3_url, client_job_id, options, owner, request_id, source_text, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NOW(), NOW())
 `
-	_, err := s.db.ExecContext(ctx, q, j.ID, j.SourceURL, j.Platform, j.Status, nullString(j.Error), nullString(j.MP3URL))
+	_, err := s.exec(ctx, q, j.ID, j.SourceURL, j.Platform, j.Status, nullString(j.Error), nullString(j.MP3URL), nullString(j.ClientJobID), nullBytes(j.Options), nullString(j.Owner), nullString(j.RequestID), nullString(j.SourceText))
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
 	return err
 }
 
 func (s *Store) GetJob(ctx context.Context, id string) (Job, error) {
 	const q = `
-SELECT id, source_url, platform, status, error, mp3_url, created_at, updated_at
+SELECT ` + jobColumns + `
 FROM jobs
-WHERE id = $1
+WHERE id = $1 AND deleted_at IS NULL
 `
-	var j Job
-	err := s.db.QueryRowContext(ctx, q, id).Scan(
-		&j.ID,
-		&j.SourceURL,
-		&j.Platform,
-		&j.Status,
-		&j.Error,
-		&j.MP3URL,
-		&j.CreatedAt,
-		&j.UpdatedAt,
-	)
-	return j, err
+	return s.getJob(ctx, q, id)
 }
 
-func (s *Store) ListJobs(ctx context.Context, limit int) ([]Job, error) {
-	if limit <= 0 {
-		limit = 20
+// GetIdempotentJobID returns the job an owner's Idempotency-Key created at or
+// after since, or sql.ErrNoRows.
+func (s *Store) GetIdempotentJobID(ctx context.Context, owner, key string, since time.Time) (string, error) {
+	const q = `
+SELECT job_id
+FROM idempotency_keys
+WHERE owner = $1 AND key = $2 AND created_at >= $3
+`
+	var jobID string
+	err := s.queryRow(ctx, q, []any{owner, key, since}, &jobID)
+	return jobID, err
+}
+
+// ClaimIdempotencyKey binds key to jobID unless the owner used it at or after
+// since, and returns the job the key belongs to afterwards.
+func (s *Store) ClaimIdempotencyKey(ctx context.Context, owner, key, jobID string, since time.Time) (string, error) {
+	const q = `
+INSERT INTO idempotency_keys (owner, key, job_id)
+VALUES ($1, $2, $3)
+ON CONFLICT (owner, key) DO UPDATE
+SET job_id = EXCLUDED.job_id, created_at = NOW()
+WHERE idempotency_keys.created_at < $4
+RETURNING job_id
+`
+	var claimed string
+	err := s.queryRow(ctx, q, []any{owner, key, jobID, since}, &claimed)
+	if errors.Is(err, sql.ErrNoRows) {
+		const existing = `
+SELECT job_id
+FROM idempotency_keys
+WHERE owner = $1 AND key = $2
+`
+		err = s.queryRow(ctx, existing, []any{owner, key}, &claimed)
 	}
+	return claimed, err
+}
+
+// ReleaseIdempotencyKey unbinds the owner's key from jobID, e.g. when the job
+// could not be enqueued, so a retried request creates a new job.
+func (s *Store) ReleaseIdempotencyKey(ctx context.Context, owner, key, jobID string) error {
 	const q = `
-SELECT id, source_url, platform, status, error, mp3_url, created_at, updated_at
+DELETE FROM idempotency_keys
+WHERE owner = $1 AND key = $2 AND job_id = $3
+`
+	_, err := s.exec(ctx, q, owner, key, jobID)
+	return err
+}
+
+func (s *Store) GetJobByClientID(ctx context.Context, clientJobID string) (Job, error) {
+	const q = `
+SELECT ` + jobColumns + `
 FROM jobs
-ORDER BY created_at DESC
-LIMIT $1
+WHERE client_job_id = $1 AND deleted_at IS NULL
 `
-	rows, err := s.db.QueryContext(ctx, q, limit)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	return s.getJob(ctx, q, clientJobID)
+}
 
-	var jobs []Job
-	for rows.Next() {
-		var j Job
-		if err := rows.Scan(
-			&j.ID,
-			&j.SourceURL,
-			&j.Platform,
-			&j.Status,
-			&j.Error,
-			&j.MP3URL,
-			&j.CreatedAt,
-			&j.UpdatedAt,
-		); err != nil {
-			return nil, err
+// Sortable columns for ListFilter.OrderBy. Each has an index.
+var SortColumns = []string{"created_at", "updated_at", "completed_at"}
+
+type ListFilter struct {
+	Status   string
+	Platform string
+	// OrderBy is one of SortColumns (default created_at).
+	OrderBy string
+	Asc     bool
+}
+
+func (s *Store) ListJobs(ctx context.Context, f ListFilter, limit int) ([]Job, error) {
+	q, args := listJobsQuery(f, limit)
+	return s.queryJobs(ctx, q, args...)
+}
+
+// listJobsQuery builds ListJobs' query. Only completed_at can be NULL, so
+// only it sorts with NULLS LAST; the other columns keep the plain order
+// their indexes provide.
+func listJobsQuery(f ListFilter, limit int) (string, []any) {
+	if limit <= 0 {
+		limit = 20
+	}
+	where := []string{"deleted_at IS NULL"}
+	var args []any
+	if f.Status != "" {
+		args = append(args, f.Status)
+		where = append(where, fmt.Sprintf("status = $%d", len(args)))
+	}
+	if f.Platform != "" {
+		args = append(args, f.Platform)
+		where = append(where, fmt.Sprintf("platform = $%d", len(args)))
+	}
+	q := "\nSELECT " + jobColumns + "\nFROM jobs\nWHERE " + strings.Join(where, " AND ") + "\n"
+	orderBy := "created_at"
+	for _, c := range SortColumns {
+		if f.OrderBy == c {
+			orderBy = c
 		}
-		jobs = append(jobs, j)
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	dir := "DESC"
+	if f.Asc {
+		dir = "ASC"
 	}
-	return jobs, nil
+	if orderBy == "completed_at" {
+		dir += " NULLS LAST"
+	}
+	args = append(args, limit)
+	q += fmt.Sprintf("ORDER BY %s %s\nLIMIT $%d\n", orderBy, dir, len(args))
+	return q, args
 }
 
+// ListActiveJobs returns jobs that have not reached a terminal status, oldest
+// first.
+func (s *Store) ListActiveJobs(ctx context.Context, limit int) ([]Job, error) {
+	if limit <= 0 {
+		limit = 20
+	}
+	const q = `
+SELECT ` + jobColumns + `
+FROM jobs
+WHERE status IN ('queued', 'downloading', 'transcoding') AND deleted_at IS NULL
+ORDER BY created_at ASC
+LIMIT $1
+`
+	return s.queryJobs(ctx, q, limit)
+}
+
+const listJobsBeforeQuery = `
+SELECT ` + jobColumns + `
+FROM jobs
+WHERE created_at < $1 AND deleted_at IS NULL
+ORDER BY created_at ASC
+LIMIT $2
+`
+
 func (s *Store) ListJobsBefore(ctx context.Context, before time.Time, limit int) ([]Job, error) {
+	if limit <= 0 {
+		limit = 200
+	}
+	return s.queryJobs(ctx, listJobsBeforeQuery, before, limit)
+}
+
+// ListJobsBeforeWithStatus is ListJobsBefore restricted to jobs in status.
+func (s *Store) ListJobsBeforeWithStatus(ctx context.Context, status string, before time.Time, limit int) ([]Job, error) {
 	if limit <= 0 {
 		limit = 200
 	}
 	const q = `
-SELECT id, source_url, platform, status, error, mp3_url, created_at, updated_at
+SELECT ` + jobColumns + `
 FROM jobs
-WHERE created_at < $1
+WHERE status = $1 AND created_at < $2 AND deleted_at IS NULL
 ORDER BY created_at ASC
+LIMIT $3
+`
+	return s.queryJobs(ctx, q, status, before, limit)
+}
+
+const listReadyJobsBeforeQuery = `
+SELECT ` + jobColumns + `
+FROM jobs
+WHERE status = 'ready' AND COALESCE(completed_at, updated_at) < $1 AND deleted_at IS NULL
+ORDER BY COALESCE(completed_at, updated_at) ASC
+LIMIT $2
+`
+
+// ListReadyJobsBefore returns ready jobs that completed before the given time
+// (by updated_at for jobs finished before completed_at was recorded).
+func (s *Store) ListReadyJobsBefore(ctx context.Context, before time.Time, limit int) ([]Job, error) {
+	if limit <= 0 {
+		limit = 200
+	}
+	return s.queryJobs(ctx, listReadyJobsBeforeQuery, before, limit)
+}
+
+// ListStalledJobs returns downloading or transcoding jobs not updated since
+// before, oldest first.
+func (s *Store) ListStalledJobs(ctx context.Context, before time.Time, limit int) ([]Job, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	const q = `
+SELECT ` + jobColumns + `
+FROM jobs
+WHERE status IN ('downloading', 'transcoding') AND updated_at < $1
+ORDER BY updated_at ASC
 LIMIT $2
 `
-	rows, err := s.db.QueryContext(ctx, q, before, limit)
+	return s.queryJobs(ctx, q, before, limit)
+}
+
+// ListQueuedJobsBefore returns queued jobs not updated since before, oldest
+// first, in keyset order after (afterUpdated, afterID). Pass nil cursors for
+// the first page.
+func (s *Store) ListQueuedJobsBefore(ctx context.Context, before time.Time, afterUpdated, afterID any, limit int) ([]Job, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	const q = `
+SELECT ` + jobColumns + `
+FROM jobs
+WHERE status = 'queued' AND updated_at < $1 AND deleted_at IS NULL
+	AND ($2::timestamptz IS NULL OR (updated_at, id) > ($2::timestamptz, $3::uuid))
+ORDER BY updated_at ASC, id ASC
+LIMIT $4
+`
+	return s.queryJobs(ctx, q, before, afterUpdated, afterID, limit)
+}
+
+// ClaimQueuedJob bumps updated_at of a job still queued and not updated since
+// before, so only one API instance re-enqueues it. It reports whether the row
+// changed.
+func (s *Store) ClaimQueuedJob(ctx context.Context, id string, before time.Time) (bool, error) {
+	const q = `
+UPDATE jobs
+SET updated_at = NOW()
+WHERE id = $1 AND status = 'queued' AND updated_at < $2
+`
+	n, err := s.exec(ctx, q, id, before)
+	return n > 0, err
+}
+
+// ResetStalledJob moves a job to status only if it is still stalled (in
+// progress and not updated since before), so a worker that resumed in the
+// meantime wins. It reports whether the row changed.
+func (s *Store) ResetStalledJob(ctx context.Context, id, status string, errMsg *string, before time.Time) (bool, error) {
+	const q = `
+WITH prev AS (
+	SELECT id, status FROM jobs
+	WHERE id = $1 AND status IN ('downloading', 'transcoding') AND updated_at < $4
+	FOR UPDATE
+)
+UPDATE jobs
+SET status = $2, error = $3, error_category = NULL, updated_at = NOW(), next_retry_at = NULL,
+	completed_at = CASE WHEN $2 IN ('ready', 'failed', 'expired', 'dead') THEN NOW() END
+FROM prev
+WHERE jobs.id = prev.id
+RETURNING jobs.id, prev.status, jobs.status, jobs.updated_at
+`
+	changed, err := s.changeStatus(ctx, q, errMsg, id, status, errMsg, before)
+	return len(changed) > 0, err
+}
+
+// RequeueReadyJob queues a ready job again with new options, clearing its
+// output. It reports false if the job was not ready, so concurrent requests
+// cannot both claim it.
+func (s *Store) RequeueReadyJob(ctx context.Context, id string, options []byte) (bool, error) {
+	const q = `
+WITH prev AS (
+	SELECT id, status FROM jobs WHERE id = $1 AND status = 'ready' FOR UPDATE
+)
+UPDATE jobs
+SET status = 'queued', options = $2, error = NULL, error_category = NULL, mp3_url = NULL, completed_at = NULL,
+	progress_bytes = NULL, progress_total_bytes = NULL, updated_at = NOW()
+FROM prev
+WHERE jobs.id = prev.id
+RETURNING jobs.id, prev.status, jobs.status, jobs.updated_at
+`
+	changed, err := s.changeStatus(ctx, q, nil, id, options)
+	return len(changed) > 0, err
+}
+
+// RetryableFilter narrows ListRetryableJobs. Empty Platform and Status match
+// any.
+type RetryableFilter struct {
+	Since    time.Time
+	Platform string
+	Status   string
+}
+
+// ListRetryableJobs returns failed, expired or dead jobs matching f, in keyset
+// order after (afterCreated, afterID). Pass nil cursors for the first page.
+func (s *Store) ListRetryableJobs(ctx context.Context, f RetryableFilter, afterCreated, afterID any, limit int) ([]Job, error) {
+	if limit <= 0 {
+		limit = 200
+	}
+	const q = `
+SELECT ` + jobColumns + `
+FROM jobs
+WHERE status IN ('failed', 'expired', 'dead') AND created_at >= $1 AND deleted_at IS NULL
+	AND ($2 = '' OR platform = $2) AND ($3 = '' OR status = $3)
+	AND ($4::timestamptz IS NULL OR (created_at, id) > ($4::timestamptz, $5::uuid))
+ORDER BY created_at ASC, id ASC
+LIMIT $6
+`
+	return s.queryJobs(ctx, q, f.Since, f.Platform, f.Status, afterCreated, afterID, limit)
+}
+
+// RequeueFailedJob moves a failed, expired or dead job back to queued. It reports
+// false if the job was in any other status, so a job already picked up again
+// is never queued twice.
+func (s *Store) RequeueFailedJob(ctx context.Context, id string) (bool, error) {
+	const q = `
+WITH prev AS (
+	SELECT id, status FROM jobs WHERE id = $1 AND status IN ('failed', 'expired', 'dead') FOR UPDATE
+)
+UPDATE jobs
+SET status = 'queued', error = NULL, error_category = NULL, next_retry_at = NULL, completed_at = NULL, updated_at = NOW()
+FROM prev
+WHERE jobs.id = prev.id
+RETURNING jobs.id, prev.status, jobs.status, jobs.updated_at
+`
+	changed, err := s.changeStatus(ctx, q, nil, id)
+	return len(changed) > 0, err
+}
+
+// ExpireJobs marks ready jobs expired and forgets their objects, keeping the
+// rows and their completed_at.
+func (s *Store) ExpireJobs(ctx context.Context, ids []string) (int64, error) {
+	const q = `
+WITH prev AS (
+	SELECT id, status FROM jobs WHERE id = ANY($1) AND status = 'ready' FOR UPDATE
+)
+UPDATE jobs
+SET status = 'expired', mp3_url = NULL, cover_key = NULL, updated_at = NOW()
+FROM prev
+WHERE jobs.id = prev.id
+RETURNING jobs.id, prev.status, jobs.status, jobs.updated_at
+`
+	changed, err := s.changeStatus(ctx, q, nil, ids)
+	return int64(len(changed)), err
+}
+
+// GetJobsByID returns the jobs among ids that exist and are not deleted.
+func (s *Store) GetJobsByID(ctx context.Context, ids []string) ([]Job, error) {
+	const q = `
+SELECT ` + jobColumns + `
+FROM jobs
+WHERE id = ANY($1) AND deleted_at IS NULL
+`
+	return s.queryJobs(ctx, q, ids)
+}
+
+func (s *Store) DeleteJob(ctx context.Context, id string) error {
+	const q = `
+DELETE FROM jobs
+WHERE id = $1
+`
+	_, err := s.exec(ctx, q, id)
+	return err
+}
+
+func (s *Store) DeleteJobsByID(ctx context.Context, ids []string) (int64, error) {
+	const q = `
+DELETE FROM jobs
+WHERE id = ANY($1)
+`
+	return s.exec(ctx, q, ids)
+}
+
+// SoftDeleteJobsByID marks jobs deleted, hiding them from every read, and
+// forgets their objects. The client_job_id is released for reuse, as a hard
+// delete would.
+func (s *Store) SoftDeleteJobsByID(ctx context.Context, ids []string) (int64, error) {
+	const q = `
+UPDATE jobs
+SET deleted_at = NOW(), client_job_id = NULL, mp3_url = NULL, cover_key = NULL, updated_at = NOW()
+WHERE id = ANY($1) AND deleted_at IS NULL
+`
+	return s.exec(ctx, q, ids)
+}
+
+// RestoreJob undoes a soft delete. A job that was ready comes back expired,
+// since its objects are gone. It reports false if the job is not deleted.
+func (s *Store) RestoreJob(ctx context.Context, id string) (bool, error) {
+	const q = `
+WITH prev AS (
+	SELECT id, status FROM jobs WHERE id = $1 AND deleted_at IS NOT NULL FOR UPDATE
+)
+UPDATE jobs
+SET deleted_at = NULL, status = CASE WHEN prev.status = 'ready' THEN 'expired' ELSE prev.status END, updated_at = NOW()
+FROM prev
+WHERE jobs.id = prev.id
+RETURNING jobs.id, prev.status, jobs.status, jobs.updated_at
+`
+	changed, err := s.changeStatus(ctx, q, nil, id)
+	return len(changed) > 0, err
+}
+
+// PurgeDeletedJobs removes the rows of jobs soft-deleted before the given time.
+func (s *Store) PurgeDeletedJobs(ctx context.Context, before time.Time) (int64, error) {
+	const q = `
+DELETE FROM jobs
+WHERE deleted_at < $1
+`
+	return s.exec(ctx, q, before)
+}
+
+func (s *Store) UpdateJobStatus(ctx context.Context, id, status string, errMsg, mp3URL *string) error {
+	_, err := s.UpdateJobStatusAt(ctx, id, status, errMsg, mp3URL)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+// UpdateJobStatusAt is UpdateJobStatus that also returns the stored
+// updated_at, so callers can publish it alongside the change. A change of
+// status is recorded in job_events in the same transaction. It returns
+// sql.ErrNoRows if the job no longer exists.
+func (s *Store) UpdateJobStatusAt(ctx context.Context, id, status string, errMsg, mp3URL *string) (time.Time, error) {
+	return s.updateJobStatus(ctx, id, status, errMsg, mp3URL, nil)
+}
+
+// UpdateJobFailure is UpdateJobStatusAt for a failed or dead job, storing
+// the error's category alongside it.
+func (s *Store) UpdateJobFailure(ctx context.Context, id, status string, errMsg, category *string) (time.Time, error) {
+	return s.updateJobStatus(ctx, id, status, errMsg, nil, category)
+}
+
+func (s *Store) updateJobStatus(ctx context.Context, id, status string, errMsg, mp3URL, category *string) (time.Time, error) {
+	const q = `
+WITH prev AS (
+	SELECT id, status FROM jobs WHERE id = $1 FOR UPDATE
+)
+UPDATE jobs
+SET status = $2, error = $3, mp3_url = $4, error_category = $5, updated_at = NOW(), next_retry_at = NULL, eta_seconds = NULL,
+	completed_at = CASE WHEN $2 IN ('ready', 'failed', 'expired', 'dead') THEN NOW() END
+FROM prev
+WHERE jobs.id = prev.id
+RETURNING jobs.id, prev.status, jobs.status, jobs.updated_at
+`
+	changed, err := s.changeStatus(ctx, q, errMsg, id, status, errMsg, mp3URL, category)
 	if err != nil {
-		return nil, err
+		return time.Time{}, err
 	}
-	defer rows.Close()
+	if len(changed) == 0 {
+		return time.Time{}, sql.ErrNoRows
+	}
+	return changed[0].At, nil
+}
 
-	var jobs []Job
+// statusChange is a row updated by changeStatus.
+type statusChange struct {
+	ID       string
+	From, To string
+	At       time.Time
+}
+
+// changeStatus runs q, an UPDATE of jobs returning each row's id, previous
+// status, new status and updated_at, and records every change of status in
+// job_events with message in the same transaction. Every status transition
+// goes through here so the history stays complete.
+func (s *Store) changeStatus(ctx context.Context, q string, message *string, args ...any) ([]statusChange, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	var changed []statusChange
 	for rows.Next() {
-		var j Job
-		if err := rows.Scan(
-			&j.ID,
-			&j.SourceURL,
-			&j.Platform,
-			&j.Status,
-			&j.Error,
-			&j.MP3URL,
-			&j.CreatedAt,
-			&j.UpdatedAt,
-		); err != nil {
+		var c statusChange
+		if err := rows.Scan(&c.ID, &c.From, &c.To, &c.At); err != nil {
+			rows.Close()
 			return nil, err
 		}
-		jobs = append(jobs, j)
+		changed = append(changed, c)
 	}
+	rows.Close()
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-	return jobs, nil
+	const insert = `INSERT INTO job_events (job_id, from_status, to_status, message, at) VALUES ($1, $2, $3, $4, $5)`
+	for _, c := range changed {
+		if c.From == c.To {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, insert, c.ID, c.From, c.To, message, c.At); err != nil {
+			return nil, err
+		}
+	}
+	return changed, tx.Commit()
 }
 
-func (s *Store) DeleteJobsBefore(ctx context.Context, before time.Time) (int64, error) {
+// JobEvent is one status change of a job.
+type JobEvent struct {
+	FromStatus sql.NullString
+	ToStatus   string
+	Message    sql.NullString
+	At         time.Time
+}
+
+// ListJobEvents returns the recorded status changes of a job, oldest first.
+func (s *Store) ListJobEvents(ctx context.Context, jobID string) ([]JobEvent, error) {
 	const q = `
-DELETE FROM jobs
-WHERE created_at < $1
+SELECT from_status, to_status, message, at
+FROM job_events
+WHERE job_id = $1
+ORDER BY at ASC, id ASC
 `
-	res, err := s.db.ExecContext(ctx, q, before)
-	if err != nil {
-		return 0, err
-	}
-	return res.RowsAffected()
+	var events []JobEvent
+	err := s.query(ctx, q, []any{jobID}, func(row rowScanner) error {
+		var e JobEvent
+		if err := row.Scan(&e.FromStatus, &e.ToStatus, &e.Message, &e.At); err != nil {
+			return err
+		}
+		events = append(events, e)
+		return nil
+	})
+	return events, err
 }
 
-func (s *Store) UpdateJobStatus(ctx context.Context, id, status string, errMsg, mp3URL *string) error {
+// ListJobsWithMP3URLs returns jobs whose mp3_url still holds a full URL
+// rather than an object key.
+func (s *Store) ListJobsWithMP3URLs(ctx context.Context) ([]Job, error) {
+	const q = `
+SELECT ` + jobColumns + `
+FROM jobs
+WHERE mp3_url LIKE 'http://%' OR mp3_url LIKE 'https://%'
+`
+	return s.queryJobs(ctx, q)
+}
+
+func (s *Store) UpdateJobMP3Key(ctx context.Context, id, key string) error {
+	const q = `
+UPDATE jobs
+SET mp3_url = $2, updated_at = NOW()
+WHERE id = $1
+`
+	_, err := s.exec(ctx, q, id, key)
+	return err
+}
+
+// UpdateJobSourceInfo stores what the parser reported about the source video.
+// Empty values are stored as NULL.
+func (s *Store) UpdateJobSourceInfo(ctx context.Context, id, title, videoID string) error {
+	const q = `
+UPDATE jobs
+SET title = NULLIF($2, ''), video_id = NULLIF($3, ''), updated_at = NOW()
+WHERE id = $1
+`
+	_, err := s.exec(ctx, q, id, title, videoID)
+	return err
+}
+
+// UpdateJobPlatform replaces the job's platform with the one the parser
+// reported, keeping the first detected one in detected_platform.
+func (s *Store) UpdateJobPlatform(ctx context.Context, id, plat string) error {
+	const q = `
+UPDATE jobs
+SET detected_platform = COALESCE(detected_platform, NULLIF(platform, '')), platform = $2, updated_at = NOW()
+WHERE id = $1 AND platform <> $2
+`
+	_, err := s.exec(ctx, q, id, plat)
+	return err
+}
+
+func (s *Store) UpdateJobCover(ctx context.Context, id, coverKey string) error {
+	const q = `
+UPDATE jobs
+SET cover_key = $2, updated_at = NOW()
+WHERE id = $1
+`
+	_, err := s.exec(ctx, q, id, coverKey)
+	return err
+}
+
+// UpdateJobProgress records download progress and its ETA while the job is
+// downloading and returns the new updated_at. It returns sql.ErrNoRows once
+// the job has moved on.
+func (s *Store) UpdateJobProgress(ctx context.Context, id string, done int64, total, eta *int64) (time.Time, error) {
+	const q = `
+UPDATE jobs
+SET progress_bytes = $2, progress_total_bytes = $3, eta_seconds = $4, updated_at = NOW()
+WHERE id = $1 AND status = 'downloading'
+RETURNING updated_at
+`
+	var updatedAt time.Time
+	err := s.queryRow(ctx, q, []any{id, done, total, eta}, &updatedAt)
+	return updatedAt, err
+}
+
+// UpdateJobTranscodeETA records the transcode ETA while the job is
+// transcoding and returns the new updated_at. It returns sql.ErrNoRows once
+// the job has moved on.
+func (s *Store) UpdateJobTranscodeETA(ctx context.Context, id string, eta *int64) (time.Time, error) {
+	const q = `
+UPDATE jobs
+SET eta_seconds = $2, updated_at = NOW()
+WHERE id = $1 AND status = 'transcoding'
+RETURNING updated_at
+`
+	var updatedAt time.Time
+	err := s.queryRow(ctx, q, []any{id, eta}, &updatedAt)
+	return updatedAt, err
+}
+
+// UpdateJobNextRetry records when the queue will retry a failed job. Any
+// later status change clears it.
+func (s *Store) UpdateJobNextRetry(ctx context.Context, id string, at time.Time) error {
+	const q = `
+UPDATE jobs
+SET next_retry_at = $2, updated_at = NOW()
+WHERE id = $1
+`
+	_, err := s.exec(ctx, q, id, at)
+	return err
+}
+
+// AnalyzeJobs refreshes the planner statistics of the jobs table. Like
+// VacuumJobs it runs without the query timeout, bounded only by ctx.
+func (s *Store) AnalyzeJobs(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `ANALYZE jobs`)
+	return err
+}
+
+// VacuumJobs reclaims space left by deleted job rows and refreshes statistics.
+// VACUUM cannot run inside a transaction, so it must not be wrapped in one,
+// and on a bloated table it takes far longer than any per-query timeout.
+func (s *Store) VacuumJobs(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `VACUUM (ANALYZE) jobs`)
+	return err
+}
+
+// UpdateJobAttempts records which worker attempt is processing the job.
+func (s *Store) UpdateJobAttempts(ctx context.Context, id string, attempts int) error {
+	const q = `
+UPDATE jobs
+SET attempts = $2, updated_at = NOW()
+WHERE id = $1
+`
+	_, err := s.exec(ctx, q, id, attempts)
+	return err
+}
+
+// GetOwnerSettings returns the owner's saved default job options as JSON, or
+// sql.ErrNoRows if none are saved.
+func (s *Store) GetOwnerSettings(ctx context.Context, owner string) ([]byte, error) {
+	const q = `
+SELECT options
+FROM owner_settings
+WHERE owner = $1
+`
+	var options []byte
+	err := s.queryRow(ctx, q, []any{owner}, &options)
+	return options, err
+}
+
+func (s *Store) PutOwnerSettings(ctx context.Context, owner string, options []byte) error {
+	const q = `
+INSERT INTO owner_settings (owner, options, updated_at)
+VALUES ($1, $2, NOW())
+ON CONFLICT (owner) DO UPDATE SET options = EXCLUDED.options, updated_at = NOW()
+`
+	_, err := s.exec(ctx, q, owner, options)
+	return err
+}
+
+// UpdateJobOutputInfo stores the output file size, its SHA-256 and, when it
+// could be probed, its duration. An empty checksum is stored as NULL.
+func (s *Store) UpdateJobOutputInfo(ctx context.Context, id string, sizeBytes int64, durationSeconds *float64, checksum string) error {
 	const q = `
 UPDATE jobs
-SET status = $2, error = $3, mp3_url = $4, updated_at = NOW()
+SET output_bytes = $2, duration_seconds = $3, output_sha256 = NULLIF($4, ''), updated_at = NOW()
 WHERE id = $1
 `
-	_, err := s.db.ExecContext(ctx, q, id, status, errMsg, mp3URL)
+	_, err := s.exec(ctx, q, id, sizeBytes, durationSeconds, checksum)
+	return err
+}
+
+// DeadJob is the record of a job the worker gave up on.
+type DeadJob struct {
+	JobID    string
+	Error    string
+	Payload  []byte
+	Attempts int
+}
+
+// RecordDeadJob stores d, replacing the record of an earlier death of the
+// same job.
+func (s *Store) RecordDeadJob(ctx context.Context, d DeadJob) error {
+	const q = `
+INSERT INTO dead_jobs (job_id, error, payload, attempts, created_at)
+VALUES ($1, $2, $3, $4, NOW())
+ON CONFLICT (job_id) DO UPDATE SET error = EXCLUDED.error, payload = EXCLUDED.payload,
+	attempts = EXCLUDED.attempts, created_at = NOW()
+`
+	_, err := s.exec(ctx, q, d.JobID, d.Error, d.Payload, d.Attempts)
 	return err
 }
 
+type JobUsage struct {
+	DownloadBytes  int64
+	OutputBytes    int64
+	TranscodeCPUMs int64
+}
+
+func (s *Store) UpdateJobUsage(ctx context.Context, id string, u JobUsage) error {
+	const q = `
+UPDATE jobs
+SET download_bytes = $2, output_bytes = $3, transcode_cpu_ms = $4, updated_at = NOW()
+WHERE id = $1
+`
+	_, err := s.exec(ctx, q, id, u.DownloadBytes, u.OutputBytes, u.TranscodeCPUMs)
+	return err
+}
+
+// JobTimings are a run's stage durations in milliseconds; 0 is stored as
+// NULL, for stages that were not timed on their own.
+type JobTimings struct {
+	DownloadMs  int64
+	TranscodeMs int64
+	UploadMs    int64
+}
+
+func (s *Store) UpdateJobTimings(ctx context.Context, id string, t JobTimings) error {
+	const q = `
+UPDATE jobs
+SET download_ms = NULLIF($2, 0), transcode_ms = NULLIF($3, 0), upload_ms = NULLIF($4, 0), updated_at = NOW()
+WHERE id = $1
+`
+	_, err := s.exec(ctx, q, id, t.DownloadMs, t.TranscodeMs, t.UploadMs)
+	return err
+}
+
+type UsageSummary struct {
+	Owner          string
+	Platform       string
+	Jobs           int64
+	DownloadBytes  int64
+	OutputBytes    int64
+	TranscodeCPUMs int64
+}
+
+func (s *Store) SummarizeUsage(ctx context.Context, since time.Time) ([]UsageSummary, error) {
+	const q = `
+SELECT COALESCE(owner, ''), platform, COUNT(*),
+	COALESCE(SUM(download_bytes), 0), COALESCE(SUM(output_bytes), 0), COALESCE(SUM(transcode_cpu_ms), 0)
+FROM jobs
+WHERE created_at >= $1 AND download_bytes IS NOT NULL
+GROUP BY 1, 2
+ORDER BY 1, 2
+`
+	var out []UsageSummary
+	err := s.query(ctx, q, []any{since}, func(row rowScanner) error {
+		var u UsageSummary
+		if err := row.Scan(&u.Owner, &u.Platform, &u.Jobs, &u.DownloadBytes, &u.OutputBytes, &u.TranscodeCPUMs); err != nil {
+			return err
+		}
+		out = append(out, u)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CountJobsByStatus returns the number of jobs in each status that has any.
+func (s *Store) CountJobsByStatus(ctx context.Context) (map[string]int64, error) {
+	const q = `SELECT status, COUNT(*) FROM jobs WHERE deleted_at IS NULL GROUP BY status`
+	out := make(map[string]int64)
+	err := s.query(ctx, q, nil, func(row rowScanner) error {
+		var status string
+		var n int64
+		if err := row.Scan(&status, &n); err != nil {
+			return err
+		}
+		out[status] = n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CountJobsCompletedSince returns how many jobs became ready at or after since.
+func (s *Store) CountJobsCompletedSince(ctx context.Context, since time.Time) (int64, error) {
+	const q = `SELECT COUNT(*) FROM jobs WHERE status = 'ready' AND completed_at >= $1`
+	var n int64
+	err := s.queryRow(ctx, q, []any{since}, &n)
+	return n, err
+}
+
+// EachJob calls fn for every job in creation order. Jobs are read batchSize
+// at a time by keyset pagination, so the whole table can be streamed without
+// holding it in memory or one connection for the duration.
+func (s *Store) EachJob(ctx context.Context, batchSize int, fn func(Job) error) error {
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	var afterCreated, afterID any
+	for {
+		items, err := s.listJobsAfter(ctx, afterCreated, afterID, batchSize)
+		if err != nil {
+			return err
+		}
+		for _, j := range items {
+			if err := fn(j); err != nil {
+				return err
+			}
+		}
+		if len(items) < batchSize {
+			return nil
+		}
+		last := items[len(items)-1]
+		afterCreated, afterID = last.CreatedAt, last.ID
+	}
+}
+
+func (s *Store) listJobsAfter(ctx context.Context, afterCreated, afterID any, limit int) ([]Job, error) {
+	const q = `
+SELECT ` + jobColumns + `
+FROM jobs
+WHERE deleted_at IS NULL AND ($1::timestamptz IS NULL OR (created_at, id) > ($1::timestamptz, $2::uuid))
+ORDER BY created_at ASC, id ASC
+LIMIT $3
+`
+	return s.queryJobs(ctx, q, afterCreated, afterID, limit)
+}
+
+func (s *Store) queryJobs(ctx context.Context, q string, args ...any) ([]Job, error) {
+	var jobs []Job
+	err := s.query(ctx, q, args, func(row rowScanner) error {
+		j, err := scanJob(row)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, j)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanJob(row rowScanner) (Job, error) {
+	var j Job
+	err := row.Scan(
+		&j.ID,
+		&j.SourceURL,
+		&j.Platform,
+		&j.Status,
+		&j.Error,
+		&j.MP3URL,
+		&j.ClientJobID,
+		&j.Options,
+		&j.Owner,
+		&j.DownloadBytes,
+		&j.OutputBytes,
+		&j.TranscodeCPUMs,
+		&j.Title,
+		&j.VideoID,
+		&j.CoverKey,
+		&j.CompletedAt,
+		&j.RequestID,
+		&j.DurationSeconds,
+		&j.Attempts,
+		&j.NextRetryAt,
+		&j.ProgressBytes,
+		&j.ProgressTotalBytes,
+		&j.OutputSHA256,
+		&j.ETASeconds,
+		&j.ErrorCategory,
+		&j.DetectedPlatform,
+		&j.SourceText,
+		&j.DownloadMs,
+		&j.TranscodeMs,
+		&j.UploadMs,
+		&j.CreatedAt,
+		&j.UpdatedAt,
+	)
+	return j, err
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
 func nullString(ns sql.NullString) *string {
 	if ns.Valid {
 		return &ns.String
 	}
 	return nil
 }
+
+func nullBytes(b []byte) any {
+	if len(b) == 0 {
+		return nil
+	}
+	return string(b)
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// testStore connects to TEST_DATABASE_URL and applies the migrations. Tests
+// that need Postgres are skipped when it is unset.
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	s, err := New(ctx, dsn)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.Init(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return s
+}
+
+// explain returns the plan of q with sequential scans disabled, so an empty
+// test table still shows whether an index can serve the query.
+func explain(t *testing.T, s *Store, q string, args ...any) string {
+	t.Helper()
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `SET LOCAL enable_seqscan = off`); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := tx.QueryContext(ctx, "EXPLAIN "+q, args...)
+	if err != nil {
+		t.Fatalf("explain: %v", err)
+	}
+	defer rows.Close()
+	var plan []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			t.Fatal(err)
+		}
+		plan = append(plan, line)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(plan, "\n")
+}
+
+func TestListQueriesUseIndexes(t *testing.T) {
+	s := testStore(t)
+	now := time.Now()
+
+	listCases := map[string]ListFilter{
+		"default":                 {},
+		"asc":                     {Asc: true},
+		"status":                  {Status: "ready"},
+		"platform":                {Platform: "douyin"},
+		"updated_at":              {OrderBy: "updated_at"},
+		"status updated_at":       {Status: "failed", OrderBy: "updated_at"},
+		"completed_at":            {OrderBy: "completed_at"},
+		"completed_at asc":        {OrderBy: "completed_at", Asc: true},
+		"status completed_at":     {Status: "ready", OrderBy: "completed_at"},
+		"status completed_at asc": {Status: "ready", OrderBy: "completed_at", Asc: true},
+	}
+	for name, f := range listCases {
+		t.Run("ListJobs "+name, func(t *testing.T) {
+			q, args := listJobsQuery(f, 20)
+			assertIndexOrdered(t, explain(t, s, q, args...))
+		})
+	}
+	t.Run("ListJobsBefore", func(t *testing.T) {
+		assertIndexOrdered(t, explain(t, s, listJobsBeforeQuery, now, 200))
+	})
+	t.Run("ListReadyJobsBefore", func(t *testing.T) {
+		assertIndexOrdered(t, explain(t, s, listReadyJobsBeforeQuery, now, 200))
+	})
+}
+
+// assertIndexOrdered fails unless the plan reads rows through an index in
+// the requested order, without sorting them.
+func assertIndexOrdered(t *testing.T, plan string) {
+	t.Helper()
+	if !strings.Contains(plan, "Index") {
+		t.Errorf("plan does not use an index:\n%s", plan)
+	}
+	if strings.Contains(plan, "Sort") {
+		t.Errorf("plan sorts instead of reading an index in order:\n%s", plan)
+	}
+}
+
+func createTestJob(t *testing.T, s *Store) string {
+	t.Helper()
+	id := uuid.NewString()
+	if err := s.CreateJob(context.Background(), Job{ID: id, SourceURL: "https://example.com/" + id, Platform: "douyin", Status: "queued"}); err != nil {
+		t.Fatalf("create job: %v", err)
+	}
+	t.Cleanup(func() { s.DeleteJob(context.Background(), id) })
+	return id
+}
+
+func TestStatusTransitionsRecordEvents(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	id := createTestJob(t, s)
+
+	msg := "boom"
+	if err := s.UpdateJobStatus(ctx, id, "failed", &msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.RequeueFailedJob(ctx, id); err != nil || !ok {
+		t.Fatalf("RequeueFailedJob = %v, %v", ok, err)
+	}
+	if err := s.UpdateJobStatus(ctx, id, "ready", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.RequeueReadyJob(ctx, id, []byte(`{"format":"mp3"}`)); err != nil || !ok {
+		t.Fatalf("RequeueReadyJob = %v, %v", ok, err)
+	}
+	if err := s.UpdateJobStatus(ctx, id, "downloading", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	stalled := "stalled"
+	if ok, err := s.ResetStalledJob(ctx, id, "failed", &stalled, time.Now().Add(time.Hour)); err != nil || !ok {
+		t.Fatalf("ResetStalledJob = %v, %v", ok, err)
+	}
+	if _, err := s.RequeueFailedJob(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateJobStatus(ctx, id, "ready", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.ExpireJobs(ctx, []string{id}); err != nil || n != 1 {
+		t.Fatalf("ExpireJobs = %d, %v", n, err)
+	}
+
+	events, err := s.ListJobEvents(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"queued>failed", "failed>queued", "queued>ready", "ready>queued", "queued>downloading",
+		"downloading>failed", "failed>queued", "queued>ready", "ready>expired",
+	}
+	var got []string
+	for _, e := range events {
+		got = append(got, e.FromStatus.String+">"+e.ToStatus)
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	if events[5].Message.String != "stalled" {
+		t.Errorf("stall event message = %q, want stalled", events[5].Message.String)
+	}
+}
+
+func TestServedFieldUpdatesBumpUpdatedAt(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	id := createTestJob(t, s)
+	duration := 12.5
+	updates := map[string]func() error{
+		"UpdateJobNextRetry":  func() error { return s.UpdateJobNextRetry(ctx, id, time.Now().Add(time.Minute)) },
+		"UpdateJobOutputInfo": func() error { return s.UpdateJobOutputInfo(ctx, id, 1024, &duration, "abc") },
+		"UpdateJobAttempts":   func() error { return s.UpdateJobAttempts(ctx, id, 2) },
+		"UpdateJobMP3Key":     func() error { return s.UpdateJobMP3Key(ctx, id, "jobs/"+id+".mp3") },
+	}
+	for name, update := range updates {
+		before, err := s.GetJob(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := update(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		after, err := s.GetJob(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !after.UpdatedAt.After(before.UpdatedAt) {
+			t.Errorf("%s left updated_at at %v", name, before.UpdatedAt)
+		}
+	}
+}
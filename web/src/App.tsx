@@ -259,12 +259,16 @@ function App() {
         }
       }
 
-      source.addEventListener("job", (event) => {
-        const payload = (event as MessageEvent).data
-        if (typeof payload === "string") {
-          handleEvent(payload)
-        }
-      })
+      // The final state arrives as a named "done" or "error" event; the
+      // browser's own connection errors carry no data and are left to onerror.
+      for (const name of ["job", "done", "error"]) {
+        source.addEventListener(name, (event) => {
+          const payload = (event as MessageEvent).data
+          if (typeof payload === "string") {
+            handleEvent(payload)
+          }
+        })
+      }
 
       source.onmessage = (event) => {
         if (typeof event.data === "string") {